@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Entries of a backup archive. The manifests come first so a restore knows
+// every file before reading its content.
+const (
+	// Files documents of the bucket, one extended JSON document per line
+	backupManifest = "manifest.jsonl"
+	// Documents of created folders, one extended JSON document per line
+	backupFolders = "folders.jsonl"
+	// Directory holding the content of every file, named by file id
+	backupContent = "content/"
+)
+
+// Encode documents as JSON lines in relaxed extended JSON, keeping ids and
+// dates restorable
+// @param docs []bson.M documents
+// @return []byte JSON lines
+// @return error error
+func jsonLines(docs []bson.M) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		line, err := bson.MarshalExtJSON(doc, false, false)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Write file of a backup archive
+// @param archive *tar.Writer
+// @param name string entry name
+// @param size int64 size in bytes
+// @param modTime time.Time
+// @param content io.Reader
+// @return error error
+func writeBackupEntry(archive *tar.Writer, name string, size int64, modTime time.Time, content io.Reader) error {
+	err := archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(archive, content)
+	if err == nil && written != size {
+		err = fmt.Errorf("%s: got %d bytes, expected %d", name, written, size)
+	}
+	return err
+}
+
+// Stream the whole bucket, all revisions and expired files not cleaned up
+// yet included, into a tar.gz archive. Only the files documents are held in
+// memory, content is copied from GridFS into the archive chunk by chunk.
+// @param ctx context.Context
+// @param w io.Writer
+// @return int number of files
+// @return int64 content size in bytes
+// @return error error
+func (c *directClient) Backup(ctx context.Context, w io.Writer) (int, int64, error) {
+	cursor, err := c.files().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, 0, err
+	}
+	var fileDocs []bson.M
+	if err := cursor.All(ctx, &fileDocs); err != nil {
+		return 0, 0, err
+	}
+	manifest, err := jsonLines(fileDocs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cursor, err = c.db.Collection(c.bucketName+".folders").Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, 0, err
+	}
+	var folderDocs []bson.M
+	if err := cursor.All(ctx, &folderDocs); err != nil {
+		return 0, 0, err
+	}
+	folders, err := jsonLines(folderDocs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	now := time.Now()
+	if err := writeBackupEntry(archive, backupManifest, int64(len(manifest)), now, bytes.NewReader(manifest)); err != nil {
+		return 0, 0, err
+	}
+	if err := writeBackupEntry(archive, backupFolders, int64(len(folders)), now, bytes.NewReader(folders)); err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, fileDoc := range fileDocs {
+		image := fileDocImage(fileDoc)
+		id, ok := fileDoc["_id"].(primitive.ObjectID)
+		if !ok {
+			return 0, 0, fmt.Errorf("%s: file id %v is no ObjectId", image.Name, fileDoc["_id"])
+		}
+		stream, err := c.bucket.OpenDownloadStream(id)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", image.Name, err)
+		}
+		// Content not matching the length fails the backup
+		err = writeBackupEntry(archive, backupContent+id.Hex(), image.Size, image.UploadDate, stream)
+		stream.Close()
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", image.Name, err)
+		}
+		total += image.Size
+	}
+
+	if err := archive.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := compressed.Close(); err != nil {
+		return 0, 0, err
+	}
+	return len(fileDocs), total, nil
+}
+
+// Back up the whole bucket into a tar.gz archive, needs --direct
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @return error error
+func backupCommand(ctx context.Context, c client, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "-", "archive file, - for standard output")
+	flags.Parse(args)
+
+	dc, ok := c.(*directClient)
+	if !ok {
+		return fmt.Errorf("backup needs --direct")
+	}
+
+	w := io.Writer(os.Stdout)
+	var file *os.File
+	if *output != "-" {
+		var err error
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	files, size, err := dc.Backup(ctx, w)
+	if err != nil {
+		if file != nil {
+			os.Remove(*output)
+		}
+		return err
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "backed up %d files (%d bytes) to %s\n", files, size, *output)
+	return nil
+}
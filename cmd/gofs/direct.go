@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Uploads and deletes run through the server only, where they are validated,
+// audited, announced and checked by hooks like all others
+var errNeedsServer = errors.New("uploads and deletes need the HTTP API, --direct only reads, lists, backs up, restores backups and migrates")
+
+// Client working on the GridFS bucket directly, for maintenance without a
+// running server: reading, listing, backups, restoring backups and
+// migrations, which copy files as they are stored.
+type directClient struct {
+	client     *mongo.Client
+	db         *mongo.Database
+	bucket     *gridfs.Bucket
+	bucketName string
+}
+
+// Connect to MongoDB
+// @param ctx context.Context
+// @param uri string connection string
+// @param databaseName string database of the server
+// @param bucketName string GridFS bucket of the server
+// @return *directClient client
+// @return error error
+func newDirectClient(ctx context.Context, uri, databaseName, bucketName string) (*directClient, error) {
+	if uri == "" {
+		return nil, errors.New("--direct needs --mongo-uri or MONGODB_SRV_RECORD")
+	}
+	clientOptions := options.Client().ApplyURI(uri).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1))
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	db := client.Database(databaseName)
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(bucketName))
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return &directClient{client: client, db: db, bucket: bucket, bucketName: bucketName}, nil
+}
+
+// Disconnect from MongoDB
+func (c *directClient) Close() {
+	c.client.Disconnect(context.Background())
+}
+
+// Get files collection of the bucket
+// @return *mongo.Collection collection
+func (c *directClient) files() *mongo.Collection {
+	return c.db.Collection(c.bucketName + ".files")
+}
+
+// Restrict filter to files which have not expired yet
+// @param filter bson.M
+// @return bson.M filter
+func activeFilter(filter bson.M) bson.M {
+	filter["metadata.expiresAt"] = bson.M{"$not": bson.M{"$lte": time.Now()}}
+	return filter
+}
+
+// Convert files document to listed image
+// @param fileDoc bson.M files document
+// @return remoteFile image
+func fileDocImage(fileDoc bson.M) remoteFile {
+	image := remoteFile{Name: fileDoc["filename"].(string)}
+	if id, ok := fileDoc["_id"].(primitive.ObjectID); ok {
+		image.ID = id.Hex()
+	}
+	switch length := fileDoc["length"].(type) {
+	case int32:
+		image.Size = int64(length)
+	case int64:
+		image.Size = length
+	}
+	if uploadDate, ok := fileDoc["uploadDate"].(primitive.DateTime); ok {
+		image.UploadDate = uploadDate.Time()
+	}
+	image.Metadata, _ = fileDoc["metadata"].(bson.M)
+	return image
+}
+
+// Find current version of image
+// @param ctx context.Context
+// @param name string
+// @return bson.M files document
+// @return error error
+func (c *directClient) current(ctx context.Context, name string) (bson.M, error) {
+	var fileDoc bson.M
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "metadata.current", Value: -1}, {Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}})
+	err := c.files().FindOne(ctx, activeFilter(bson.M{"filename": name}), findOptions).Decode(&fileDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errNotFound
+	}
+	return fileDoc, err
+}
+
+// Uploads go through the server, see errNeedsServer
+// @param ctx context.Context
+// @param localPath string
+// @param folder string remote folder
+// @param collision string collision policy
+// @return remoteFile uploaded image
+// @return error errNeedsServer
+func (c *directClient) Put(ctx context.Context, localPath, folder, collision string) (remoteFile, error) {
+	return remoteFile{}, errNeedsServer
+}
+
+// Download current version of image
+// @param ctx context.Context
+// @param name string
+// @param w io.Writer
+// @return error error
+func (c *directClient) Get(ctx context.Context, name string, w io.Writer) error {
+	fileDoc, err := c.current(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = c.bucket.DownloadToStream(fileDoc["_id"], w)
+	return err
+}
+
+// List folder
+// @param ctx context.Context
+// @param folder string
+// @return remoteFolder listing
+// @return error error
+func (c *directClient) List(ctx context.Context, folder string) (remoteFolder, error) {
+	var listing remoteFolder
+	prefix := ""
+	if folder = strings.Trim(folder, "/"); folder != "" {
+		prefix = folder + "/"
+	}
+	regex := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}
+
+	names, err := c.files().Distinct(ctx, "filename", activeFilter(bson.M{"filename": regex}))
+	if err != nil {
+		return listing, err
+	}
+	created, err := c.db.Collection(c.bucketName+".folders").Distinct(ctx, "_id", bson.M{"_id": regex})
+	if err != nil {
+		return listing, err
+	}
+
+	folders := map[string]bool{}
+	var fileNames []string
+	for _, name := range names {
+		rest := strings.TrimPrefix(name.(string), prefix)
+		if subfolder, _, found := strings.Cut(rest, "/"); found {
+			folders[subfolder] = true
+			continue
+		}
+		fileNames = append(fileNames, name.(string))
+	}
+	for _, created := range created {
+		subfolder, _, _ := strings.Cut(strings.TrimPrefix(created.(string), prefix), "/")
+		folders[subfolder] = true
+	}
+	for subfolder := range folders {
+		listing.Folders = append(listing.Folders, subfolder)
+	}
+	sort.Strings(listing.Folders)
+
+	for _, name := range fileNames {
+		fileDoc, err := c.current(ctx, name)
+		if err != nil {
+			return listing, err
+		}
+		listing.Images = append(listing.Images, fileDocImage(fileDoc))
+	}
+	return listing, nil
+}
+
+// Deletes go through the server, see errNeedsServer
+// @param ctx context.Context
+// @param name string
+// @return error errNeedsServer
+func (c *directClient) Remove(ctx context.Context, name string) error {
+	return errNeedsServer
+}
+
+// Get metadata of current version of image
+// @param ctx context.Context
+// @param name string
+// @return map[string]interface{} image info
+// @return error error
+func (c *directClient) Stat(ctx context.Context, name string) (map[string]interface{}, error) {
+	fileDoc, err := c.current(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	image := fileDocImage(fileDoc)
+	return map[string]interface{}{
+		"id":         image.ID,
+		"name":       image.Name,
+		"size":       image.Size,
+		"uploadDate": image.UploadDate,
+		"metadata":   image.Metadata,
+		"chunkSize":  fileDoc["chunkSize"],
+	}, nil
+}
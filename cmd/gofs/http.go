@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Client of the HTTP API. Responses are requested in the bare format so the
+// payload doesn't depend on the server's response envelope setting.
+type httpClient struct {
+	server string
+	http   *http.Client
+}
+
+// Error of an unknown image
+var errNotFound = errors.New("image not found")
+
+// Create HTTP API client
+// @param server string server URL
+// @return *httpClient client
+func newHTTPClient(server string) *httpClient {
+	return &httpClient{server: strings.TrimRight(server, "/"), http: &http.Client{}}
+}
+
+// Escape image name or folder for use in a URL path, keeping the slashes
+// @param name string
+// @return string escaped name
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Send request and decode the JSON response into result
+// @param req *http.Request request
+// @param result interface{} nil to discard the response
+// @return error error
+func (c *httpClient) do(req *http.Request, result interface{}) error {
+	req.Header.Set("Accept", "application/json; profile=bare")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Build error of a failed request from the response body
+// @param resp *http.Response response
+// @return error error
+func responseError(resp *http.Response) error {
+	// Problem details carry the message in detail, the legacy format in msg
+	var body struct {
+		Msg    string `json:"msg"`
+		Detail string `json:"detail"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if body.Msg == "" {
+		body.Msg = body.Detail
+	}
+	if body.Msg == "" {
+		body.Msg = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("%s (%d)", body.Msg, resp.StatusCode)
+}
+
+// Upload local file as multipart form, streaming it from disk
+// @param ctx context.Context
+// @param localPath string
+// @param folder string remote folder
+// @param collision string collision policy, empty for the server default
+// @return remoteFile uploaded image
+// @return error error
+func (c *httpClient) Put(ctx context.Context, localPath, folder, collision string) (remoteFile, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	defer file.Close()
+
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		err := func() error {
+			if folder != "" {
+				if err := form.WriteField("folder", folder); err != nil {
+					return err
+				}
+			}
+			if collision != "" {
+				if err := form.WriteField("collision", collision); err != nil {
+					return err
+				}
+			}
+			part, err := form.CreateFormFile("image", filepath.Base(localPath))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(part, file); err != nil {
+				return err
+			}
+			return form.Close()
+		}()
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server+"/api/image", reader)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	var image remoteFile
+	err = c.do(req, &image)
+	return image, err
+}
+
+// Download current version of image
+// @param ctx context.Context
+// @param name string
+// @param w io.Writer
+// @return error error
+func (c *httpClient) Get(ctx context.Context, name string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+"/api/image/name/"+escapePath(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// List folder
+// @param ctx context.Context
+// @param folder string
+// @return remoteFolder listing
+// @return error error
+func (c *httpClient) List(ctx context.Context, folder string) (remoteFolder, error) {
+	var listing remoteFolder
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+"/api/folders/"+escapePath(folder), nil)
+	if err != nil {
+		return listing, err
+	}
+	err = c.do(req, &listing)
+	return listing, err
+}
+
+// Find current version of image in the listing of its folder
+// @param ctx context.Context
+// @param name string
+// @return remoteFile image
+// @return error error
+func (c *httpClient) find(ctx context.Context, name string) (remoteFile, error) {
+	folder := path.Dir(name)
+	if folder == "." {
+		folder = ""
+	}
+	listing, err := c.List(ctx, folder)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	for _, image := range listing.Images {
+		if image.Name == name {
+			return image, nil
+		}
+	}
+	return remoteFile{}, errNotFound
+}
+
+// Delete image with all its versions
+// @param ctx context.Context
+// @param name string
+// @return error error
+func (c *httpClient) Remove(ctx context.Context, name string) error {
+	image, err := c.find(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var versions []struct {
+		ID string `json:"id"`
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+"/api/image/id/"+image.ID+"/versions", nil)
+	if err != nil {
+		return err
+	}
+	if err := c.do(req, &versions); err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.server+"/api/image/id/"+version.ID, nil)
+		if err != nil {
+			return err
+		}
+		if err := c.do(req, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get metadata of current version of image
+// @param ctx context.Context
+// @param name string
+// @return map[string]interface{} image info
+// @return error error
+func (c *httpClient) Stat(ctx context.Context, name string) (map[string]interface{}, error) {
+	image, err := c.find(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var info map[string]interface{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+"/api/image/id/"+image.ID+"/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	err = c.do(req, &info)
+	return info, err
+}
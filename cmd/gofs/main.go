@@ -0,0 +1,409 @@
+// Command gofs uploads, downloads, lists and deletes images of a go-mongo-fs
+// server through its HTTP API. With --direct it reads, lists, backs up,
+// restores and migrates them directly on MongoDB.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload" // Load .env file automatically
+)
+
+const usage = `Usage: gofs [flags] <command> [args]
+
+Commands:
+  put [-folder F] [-collision P] <file|glob>...  upload local files
+  get [-o DIR] <name|glob>...                     download images
+  ls [folder]                                     list folder
+  rm <name|glob>...                               delete images with all versions
+  stat <name|glob>...                             show image metadata
+  backup [-o FILE]                                write bucket as tar.gz, needs --direct
+  restore <archive|dir>                           restore backup, needs --direct, or upload image tree
+  migrate [-to-uri U] [-to-database D] [-to-bucket B] [-hash]
+                                                  copy bucket to another bucket or cluster
+                                                  and verify it, needs --direct
+
+Uploads and deletes (put, rm, restore of an image tree) run through the HTTP
+API only. Remote globs match the last path segment, e.g. "avatars/*.png".
+
+Flags:
+`
+
+// Image as listed by the server
+type remoteFile struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Size       int64                  `json:"size"`
+	UploadDate time.Time              `json:"uploadDate"`
+	Metadata   map[string]interface{} `json:"metadata"`
+}
+
+// Folder listing
+type remoteFolder struct {
+	Folders []string     `json:"folders"`
+	Images  []remoteFile `json:"images"`
+}
+
+// Operations on the image store, implemented over HTTP and directly on MongoDB
+type client interface {
+	Put(ctx context.Context, localPath, folder, collision string) (remoteFile, error)
+	Get(ctx context.Context, name string, w io.Writer) error
+	List(ctx context.Context, folder string) (remoteFolder, error)
+	Remove(ctx context.Context, name string) error
+	Stat(ctx context.Context, name string) (map[string]interface{}, error)
+}
+
+func main() {
+	flags := flag.NewFlagSet("gofs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", envOr("GOFS_SERVER", "http://localhost:3000"), "server URL")
+	direct := flags.Bool("direct", false, "access MongoDB directly instead of the HTTP API")
+	mongoURI := flags.String("mongo-uri", os.Getenv("MONGODB_SRV_RECORD"), "MongoDB connection string used with --direct")
+	database := flags.String("database", envOr("DATABASE_NAME", "go-fs"), "database of the server, used with --direct")
+	bucket := flags.String("bucket", envOr("BUCKET_NAME", "images"), "GridFS bucket of the server, used with --direct")
+	parallel := flags.Int("parallel", 4, "number of concurrent transfers")
+	timeout := flags.Duration("timeout", 0, "time limit of the whole command, 0 for none")
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 || *parallel < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	if *direct && (command == "put" || command == "rm") {
+		fatal(errNeedsServer)
+	}
+
+	var c client
+	if *direct {
+		dc, err := newDirectClient(ctx, *mongoURI, *database, *bucket)
+		if err != nil {
+			fatal(err)
+		}
+		defer dc.Close()
+		c = dc
+	} else {
+		c = newHTTPClient(*server)
+	}
+
+	var err error
+	switch command {
+	case "put":
+		err = putCommand(ctx, c, args, *parallel)
+	case "get":
+		err = getCommand(ctx, c, args, *parallel)
+	case "ls":
+		err = lsCommand(ctx, c, args)
+	case "rm":
+		err = rmCommand(ctx, c, args, *parallel)
+	case "stat":
+		err = statCommand(ctx, c, args)
+	case "backup":
+		err = backupCommand(ctx, c, args)
+	case "restore":
+		err = restoreCommand(ctx, c, args)
+	case "migrate":
+		err = migrateCommand(ctx, c, args, *parallel, *mongoURI)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// Read environment variable with fallback value
+// @param key string
+// @param fallback string
+// @return string value
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Print error and exit
+// @param err error
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "gofs:", err)
+	os.Exit(1)
+}
+
+// Run fn for every item with at most parallel calls at once. Failures are
+// reported as they happen.
+// @param items []string
+// @param parallel int
+// @param fn func(string) error
+// @return error error if any call failed
+func runParallel(items []string, parallel int, fn func(string) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	queue := make(chan string)
+	for i := 0; i < parallel && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				if err := fn(item); err != nil {
+					mu.Lock()
+					failed++
+					fmt.Fprintf(os.Stderr, "gofs: %s: %v\n", item, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d failed", failed, len(items))
+	}
+	return nil
+}
+
+// Check if pattern contains glob meta characters
+// @param pattern string
+// @return bool glob
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Expand local file globs, patterns without matches are an error
+// @param patterns []string
+// @return []string paths
+// @return error error
+func expandLocal(patterns []string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		if !isGlob(pattern) {
+			paths = append(paths, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// Expand remote image name globs against the listing of their folder
+// @param ctx context.Context
+// @param c client
+// @param patterns []string
+// @return []string names
+// @return error error
+func expandRemote(ctx context.Context, c client, patterns []string) ([]string, error) {
+	var names []string
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if !isGlob(pattern) {
+			names = append(names, pattern)
+			continue
+		}
+
+		folder := path.Dir(pattern)
+		if folder == "." {
+			folder = ""
+		}
+		if isGlob(folder) {
+			return nil, fmt.Errorf("glob %q: only the last path segment may contain wildcards", pattern)
+		}
+		listing, err := c.List(ctx, folder)
+		if err != nil {
+			return nil, err
+		}
+		matched := 0
+		for _, image := range listing.Images {
+			ok, err := path.Match(pattern, image.Name)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				names = append(names, image.Name)
+				matched++
+			}
+		}
+		if matched == 0 {
+			return nil, fmt.Errorf("no images match %q", pattern)
+		}
+	}
+	return names, nil
+}
+
+// Upload local files
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @param parallel int
+// @return error error
+func putCommand(ctx context.Context, c client, args []string, parallel int) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	folder := flags.String("folder", "", "remote folder the files are placed in")
+	collision := flags.String("collision", "", "filename collision policy: reject, overwrite, auto-suffix or version")
+	flags.Parse(args)
+
+	paths, err := expandLocal(flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("put: no files given")
+	}
+	return runParallel(paths, parallel, func(localPath string) error {
+		image, err := c.Put(ctx, localPath, *folder, *collision)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s -> %s (%d bytes, id %s)\n", localPath, image.Name, image.Size, image.ID)
+		return nil
+	})
+}
+
+// Download images into a local directory
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @param parallel int
+// @return error error
+func getCommand(ctx context.Context, c client, args []string, parallel int) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	output := flags.String("o", ".", "local directory the images are saved in")
+	flags.Parse(args)
+
+	names, err := expandRemote(ctx, c, flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("get: no images given")
+	}
+	return runParallel(names, parallel, func(name string) error {
+		localPath := filepath.Join(*output, path.Base(name))
+		file, err := os.Create(localPath)
+		if err != nil {
+			return err
+		}
+		if err := c.Get(ctx, name, file); err != nil {
+			file.Close()
+			os.Remove(localPath)
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("%s -> %s\n", name, localPath)
+		return nil
+	})
+}
+
+// List subfolders and images of a folder
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @return error error
+func lsCommand(ctx context.Context, c client, args []string) error {
+	folder := ""
+	if len(args) > 0 {
+		folder = strings.Trim(args[0], "/")
+	}
+	listing, err := c.List(ctx, folder)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, subfolder := range listing.Folders {
+		fmt.Fprintf(w, "-\t-\t%s/\t\n", subfolder)
+	}
+	sort.Slice(listing.Images, func(i, j int) bool { return listing.Images[i].Name < listing.Images[j].Name })
+	for _, image := range listing.Images {
+		fmt.Fprintf(w, "%d\t%s\t%s\t\n", image.Size, image.UploadDate.Local().Format(time.DateTime), path.Base(image.Name))
+	}
+	return w.Flush()
+}
+
+// Delete images with all their versions
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @param parallel int
+// @return error error
+func rmCommand(ctx context.Context, c client, args []string, parallel int) error {
+	names, err := expandRemote(ctx, c, args)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("rm: no images given")
+	}
+	return runParallel(names, parallel, func(name string) error {
+		if err := c.Remove(ctx, name); err != nil {
+			return err
+		}
+		fmt.Println("removed", name)
+		return nil
+	})
+}
+
+// Print metadata of images as JSON
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @return error error
+func statCommand(ctx context.Context, c client, args []string) error {
+	names, err := expandRemote(ctx, c, args)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("stat: no images given")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	for _, name := range names {
+		info, err := c.Stat(ctx, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := encoder.Encode(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Interval of migration progress reports
+const migrateProgressInterval = 5 * time.Second
+
+// Progress of a migration, updated by parallel copies
+type migrateProgress struct {
+	total   int
+	copied  atomic.Int64
+	skipped atomic.Int64
+	bytes   atomic.Int64
+}
+
+// Print progress of a migration
+// @param step string e.g. copied
+func (p *migrateProgress) report(step string) {
+	done := p.copied.Load() + p.skipped.Load()
+	fmt.Fprintf(os.Stderr, "%s %d/%d files (%d bytes, %d already present)\n", step, done, p.total, p.bytes.Load(), p.skipped.Load())
+}
+
+// Print progress periodically until stop is closed
+// @param step string e.g. copied
+// @param stop chan struct{}
+func (p *migrateProgress) reportEvery(step string, stop chan struct{}) {
+	ticker := time.NewTicker(migrateProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.report(step)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Hash content of a file
+// @param c *directClient client
+// @param id interface{} file id
+// @return []byte md5 checksum
+// @return error error
+func contentHash(c *directClient, id interface{}) ([]byte, error) {
+	stream, err := c.bucket.OpenDownloadStream(id)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, stream); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// Verify a migrated file exists in the target with the same length, and
+// with hash the same content
+// @param ctx context.Context
+// @param target *directClient target client
+// @param fileDoc bson.M files document in the source
+// @param hash bool compare content checksums
+// @return error error
+func (c *directClient) verifyMigrated(ctx context.Context, target *directClient, fileDoc bson.M, hash bool) error {
+	var targetDoc bson.M
+	err := target.files().FindOne(ctx, bson.M{"_id": fileDoc["_id"]}).Decode(&targetDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errors.New("missing in target")
+	}
+	if err != nil {
+		return err
+	}
+	if size, targetSize := fileDocImage(fileDoc).Size, fileDocImage(targetDoc).Size; size != targetSize {
+		return fmt.Errorf("length %d in target, %d in source", targetSize, size)
+	}
+	if !hash {
+		return nil
+	}
+
+	sourceHash, err := contentHash(c, fileDoc["_id"])
+	if err != nil {
+		return err
+	}
+	targetHash, err := contentHash(target, fileDoc["_id"])
+	if err != nil {
+		return err
+	}
+	if string(sourceHash) != string(targetHash) {
+		return errors.New("content differs from source")
+	}
+	return nil
+}
+
+// Copy all files of the bucket, revisions and their ids included, and the
+// created folders into the bucket of target, then verify the copies. Files
+// already in the target are skipped, so an interrupted migration resumes
+// where it stopped when run again.
+// @param ctx context.Context
+// @param target *directClient target client
+// @param parallel int number of concurrent copies
+// @param hash bool verify content checksums, not just lengths
+// @return error error
+func (c *directClient) Migrate(ctx context.Context, target *directClient, parallel int, hash bool) error {
+	cursor, err := c.files().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var fileDocs []bson.M
+	if err := cursor.All(ctx, &fileDocs); err != nil {
+		return err
+	}
+	index, err := manifestIndex(fileDocs)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(fileDocs))
+	for _, fileDoc := range fileDocs {
+		ids = append(ids, fileDoc["_id"].(primitive.ObjectID).Hex())
+	}
+
+	cursor, err = c.db.Collection(c.bucketName+".folders").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var folderDocs []bson.M
+	if err := cursor.All(ctx, &folderDocs); err != nil {
+		return err
+	}
+	if err := target.restoreFolders(ctx, folderDocs); err != nil {
+		return err
+	}
+
+	progress := &migrateProgress{total: len(ids)}
+	stop := make(chan struct{})
+	go progress.reportEvery("copied", stop)
+	err = runParallel(ids, parallel, func(id string) error {
+		fileDoc := index[id]
+		stream, err := c.bucket.OpenDownloadStream(fileDoc["_id"])
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		restored, err := target.restoreFile(ctx, fileDoc, stream)
+		if err != nil {
+			return err
+		}
+		if restored {
+			progress.copied.Add(1)
+			progress.bytes.Add(fileDocImage(fileDoc).Size)
+		} else {
+			progress.skipped.Add(1)
+		}
+		return nil
+	})
+	close(stop)
+	progress.report("copied")
+	if err != nil {
+		return fmt.Errorf("copy: %w, run migrate again to resume", err)
+	}
+
+	var verified atomic.Int64
+	err = runParallel(ids, parallel, func(id string) error {
+		if err := c.verifyMigrated(ctx, target, index[id], hash); err != nil {
+			return err
+		}
+		verified.Add(1)
+		return nil
+	})
+	fmt.Fprintf(os.Stderr, "verified %d/%d files\n", verified.Load(), len(ids))
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	return nil
+}
+
+// Copy the bucket into another bucket or cluster, needs --direct
+// @param ctx context.Context
+// @param c client source client
+// @param args []string
+// @param parallel int number of concurrent copies
+// @param sourceURI string connection string of the source
+// @return error error
+func migrateCommand(ctx context.Context, c client, args []string, parallel int, sourceURI string) error {
+	dc, ok := c.(*directClient)
+	if !ok {
+		return fmt.Errorf("migrate needs --direct")
+	}
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	toURI := flags.String("to-uri", envOr("GOFS_TARGET_URI", sourceURI), "MongoDB connection string of the target")
+	toDatabase := flags.String("to-database", dc.db.Name(), "target database")
+	toBucket := flags.String("to-bucket", dc.bucketName, "target GridFS bucket")
+	hash := flags.Bool("hash", false, "verify content checksums, not just lengths")
+	flags.Parse(args)
+
+	if *toURI == sourceURI && *toDatabase == dc.db.Name() && *toBucket == dc.bucketName {
+		return fmt.Errorf("migrate: target is the source, set -to-uri, -to-database or -to-bucket")
+	}
+	target, err := newDirectClient(ctx, *toURI, *toDatabase, *toBucket)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	defer target.Close()
+	return dc.Migrate(ctx, target, parallel, *hash)
+}
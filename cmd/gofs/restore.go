@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields of a files document written by the upload itself, all others are
+// restored from the manifest
+var uploadFields = map[string]bool{
+	"_id":       true,
+	"filename":  true,
+	"length":    true,
+	"chunkSize": true,
+	"metadata":  true,
+}
+
+// Files restored from a backup
+type restoreStats struct {
+	Restored int
+	Skipped  int
+	Missing  int
+}
+
+// Decode JSON lines of extended JSON documents, see jsonLines
+// @param r io.Reader
+// @return []bson.M documents
+// @return error error
+func readJSONLines(r io.Reader) ([]bson.M, error) {
+	var docs []bson.M
+	scanner := bufio.NewScanner(r)
+	// Lines hold whole files documents, metadata included
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var doc bson.M
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, scanner.Err()
+}
+
+// Index files documents of a manifest by the name of their content entry
+// @param fileDocs []bson.M files documents
+// @return map[string]bson.M files documents by file id
+// @return error error
+func manifestIndex(fileDocs []bson.M) (map[string]bson.M, error) {
+	index := make(map[string]bson.M, len(fileDocs))
+	for _, fileDoc := range fileDocs {
+		id, ok := fileDoc["_id"].(primitive.ObjectID)
+		if !ok {
+			return nil, fmt.Errorf("%s: file id %v is no ObjectId", backupManifest, fileDoc["_id"])
+		}
+		index[id.Hex()] = fileDoc
+	}
+	return index, nil
+}
+
+// Recreate created folders, existing ones are kept
+// @param ctx context.Context
+// @param folderDocs []bson.M folder documents
+// @return error error
+func (c *directClient) restoreFolders(ctx context.Context, folderDocs []bson.M) error {
+	folders := c.db.Collection(c.bucketName + ".folders")
+	for _, folderDoc := range folderDocs {
+		id := folderDoc["_id"]
+		delete(folderDoc, "_id")
+		update := bson.M{"$setOnInsert": folderDoc}
+		if len(folderDoc) == 0 {
+			update = bson.M{"$setOnInsert": bson.M{"_id": id}}
+		}
+		if _, err := folders.UpdateOne(ctx, bson.M{"_id": id}, update, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload content of a backed up file under its id, then restore its upload
+// date and the other fields of its files document. Files whose id already
+// exists are skipped.
+// @param ctx context.Context
+// @param fileDoc bson.M files document from the manifest
+// @param content io.Reader
+// @return bool restored, false if skipped
+// @return error error
+func (c *directClient) restoreFile(ctx context.Context, fileDoc bson.M, content io.Reader) (bool, error) {
+	image := fileDocImage(fileDoc)
+	existing, err := c.files().CountDocuments(ctx, bson.M{"_id": fileDoc["_id"]})
+	if err != nil {
+		return false, err
+	}
+	if existing > 0 {
+		return false, nil
+	}
+
+	uploadOptions := options.GridFSUpload()
+	if metadata, ok := fileDoc["metadata"]; ok {
+		uploadOptions.SetMetadata(metadata)
+	}
+	switch chunkSize := fileDoc["chunkSize"].(type) {
+	case int32:
+		uploadOptions.SetChunkSizeBytes(chunkSize)
+	case int64:
+		uploadOptions.SetChunkSizeBytes(int32(chunkSize))
+	}
+	// Chunks left behind by an interrupted restore of the file are replaced
+	if _, err := c.db.Collection(c.bucketName+".chunks").DeleteMany(ctx, bson.M{"files_id": fileDoc["_id"]}); err != nil {
+		return false, err
+	}
+	// Upload streams have their own buffer, so files can be restored in
+	// parallel
+	upload, err := c.bucket.OpenUploadStreamWithID(fileDoc["_id"], image.Name, uploadOptions)
+	if err != nil {
+		return false, err
+	}
+	written, err := io.Copy(upload, content)
+	if err == nil && written != image.Size {
+		err = fmt.Errorf("got %d bytes, expected %d", written, image.Size)
+	}
+	if err != nil {
+		upload.Abort()
+		return false, err
+	}
+	if err := upload.Close(); err != nil {
+		return false, err
+	}
+
+	fields := bson.M{}
+	for key, value := range fileDoc {
+		if !uploadFields[key] {
+			fields[key] = value
+		}
+	}
+	if len(fields) > 0 {
+		if _, err := c.files().UpdateOne(ctx, bson.M{"_id": fileDoc["_id"]}, bson.M{"$set": fields}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Restore a file and print the outcome
+// @param ctx context.Context
+// @param fileDoc bson.M files document from the manifest
+// @param content io.Reader
+// @param stats *restoreStats
+// @return error error
+func (c *directClient) restoreEntry(ctx context.Context, fileDoc bson.M, content io.Reader, stats *restoreStats) error {
+	image := fileDocImage(fileDoc)
+	restored, err := c.restoreFile(ctx, fileDoc, content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", image.Name, err)
+	}
+	if restored {
+		stats.Restored++
+		fmt.Printf("restored %s (id %s)\n", image.Name, image.ID)
+	} else {
+		stats.Skipped++
+		fmt.Printf("skipped %s (id %s), id exists\n", image.Name, image.ID)
+	}
+	return nil
+}
+
+// Report backed up files without content in the backup
+// @param index map[string]bson.M files documents not restored yet
+// @param stats *restoreStats
+func reportMissing(index map[string]bson.M, stats *restoreStats) {
+	for id, fileDoc := range index {
+		stats.Missing++
+		fmt.Fprintf(os.Stderr, "gofs: %s (id %s): content missing from backup\n", fileDocImage(fileDoc).Name, id)
+	}
+}
+
+// Restore a backup archive written by the backup command, gzip compressed
+// or not. The manifest must precede the content.
+// @param ctx context.Context
+// @param r io.Reader archive
+// @return restoreStats stats
+// @return error error
+func (c *directClient) restoreArchive(ctx context.Context, r io.Reader) (restoreStats, error) {
+	var stats restoreStats
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return stats, err
+		}
+		defer decompressed.Close()
+		r = decompressed
+	} else {
+		r = buffered
+	}
+
+	archive := tar.NewReader(r)
+	var index map[string]bson.M
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		switch name := path.Clean(header.Name); {
+		case name == backupManifest:
+			fileDocs, err := readJSONLines(archive)
+			if err != nil {
+				return stats, fmt.Errorf("%s: %w", backupManifest, err)
+			}
+			if index, err = manifestIndex(fileDocs); err != nil {
+				return stats, err
+			}
+		case name == backupFolders:
+			folderDocs, err := readJSONLines(archive)
+			if err != nil {
+				return stats, fmt.Errorf("%s: %w", backupFolders, err)
+			}
+			if err := c.restoreFolders(ctx, folderDocs); err != nil {
+				return stats, err
+			}
+		case strings.HasPrefix(name, backupContent):
+			if index == nil {
+				return stats, fmt.Errorf("%s: no %s before the content", name, backupManifest)
+			}
+			fileDoc, ok := index[strings.TrimPrefix(name, backupContent)]
+			if !ok {
+				return stats, fmt.Errorf("%s: not in %s", name, backupManifest)
+			}
+			delete(index, strings.TrimPrefix(name, backupContent))
+			if err := c.restoreEntry(ctx, fileDoc, archive, &stats); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if index == nil {
+		return stats, fmt.Errorf("no %s in archive", backupManifest)
+	}
+	reportMissing(index, &stats)
+	return stats, nil
+}
+
+// Restore an extracted backup archive
+// @param ctx context.Context
+// @param dir string directory holding the manifest
+// @return restoreStats stats
+// @return error error
+func (c *directClient) restoreBackupDir(ctx context.Context, dir string) (restoreStats, error) {
+	var stats restoreStats
+	readDocs := func(name string) ([]bson.M, error) {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readJSONLines(file)
+	}
+
+	fileDocs, err := readDocs(backupManifest)
+	if err != nil {
+		return stats, err
+	}
+	index, err := manifestIndex(fileDocs)
+	if err != nil {
+		return stats, err
+	}
+	folderDocs, err := readDocs(backupFolders)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return stats, err
+	}
+	if err := c.restoreFolders(ctx, folderDocs); err != nil {
+		return stats, err
+	}
+
+	for _, fileDoc := range fileDocs {
+		id := fileDoc["_id"].(primitive.ObjectID).Hex()
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(backupContent), id))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		delete(index, id)
+		err = c.restoreEntry(ctx, fileDoc, file, &stats)
+		file.Close()
+		if err != nil {
+			return stats, err
+		}
+	}
+	reportMissing(index, &stats)
+	return stats, nil
+}
+
+// Upload the images of a local directory tree through the server, named by
+// their path below dir. Without a manifest ids and upload dates are new,
+// existing images get a new version.
+// @param ctx context.Context
+// @param c client
+// @param dir string
+// @return restoreStats stats
+// @return error error
+func restoreTree(ctx context.Context, c client, dir string) (restoreStats, error) {
+	var stats restoreStats
+	err := filepath.WalkDir(dir, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(localPath)) {
+		case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".heif", ".pdf", ".mp4", ".webm", ".mp3", ".ogg", ".flac", ".docx", ".xlsx", ".pptx", ".txt", ".log", ".csv", ".md", ".json":
+		default:
+			return nil
+		}
+		relative, err := filepath.Rel(dir, filepath.Dir(localPath))
+		if err != nil {
+			return err
+		}
+		folder := filepath.ToSlash(relative)
+		if folder == "." {
+			folder = ""
+		}
+
+		image, err := c.Put(ctx, localPath, folder, "version")
+		if err != nil {
+			return fmt.Errorf("%s: %w", localPath, err)
+		}
+		stats.Restored++
+		fmt.Printf("restored %s (id %s)\n", image.Name, image.ID)
+		return nil
+	})
+	return stats, err
+}
+
+// Restore a backup archive or an extracted backup
+// @param ctx context.Context
+// @param source string archive or directory, - for an archive on standard input
+// @return restoreStats stats
+// @return error error
+func (c *directClient) Restore(ctx context.Context, source string) (restoreStats, error) {
+	if source == "-" {
+		return c.restoreArchive(ctx, os.Stdin)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return restoreStats{}, err
+	}
+	if !info.IsDir() {
+		file, err := os.Open(source)
+		if err != nil {
+			return restoreStats{}, err
+		}
+		defer file.Close()
+		return c.restoreArchive(ctx, file)
+	}
+	return c.restoreBackupDir(ctx, source)
+}
+
+// Check if source is a directory tree of images rather than a backup
+// @param source string archive or directory
+// @return bool tree
+func isImageTree(source string) bool {
+	if info, err := os.Stat(source); err != nil || !info.IsDir() {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(source, backupManifest))
+	return err != nil
+}
+
+// Restore a backup archive or an extracted backup, needs --direct, or
+// upload a directory tree of images, through the HTTP API
+// @param ctx context.Context
+// @param c client
+// @param args []string
+// @return error error
+func restoreCommand(ctx context.Context, c client, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("restore: expected one archive or directory, - for standard input")
+	}
+	source := flags.Arg(0)
+	dc, direct := c.(*directClient)
+
+	var stats restoreStats
+	var err error
+	switch {
+	case isImageTree(source):
+		if direct {
+			return fmt.Errorf("restore of a directory tree uploads its images, run it without --direct")
+		}
+		stats, err = restoreTree(ctx, c, source)
+	case !direct:
+		return fmt.Errorf("restore of a backup needs --direct")
+	default:
+		stats, err = dc.Restore(ctx, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "restored %d files, skipped %d existing", stats.Restored, stats.Skipped)
+	if stats.Missing > 0 {
+		fmt.Fprintf(os.Stderr, ", %d without content", stats.Missing)
+	}
+	fmt.Fprintln(os.Stderr)
+	if stats.Missing > 0 {
+		return fmt.Errorf("%d files missing content", stats.Missing)
+	}
+	return nil
+}
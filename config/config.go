@@ -0,0 +1,204 @@
+// Package config resolves settings from layered sources. Settings are named
+// like their environment variables, e.g. BUCKET_NAME, and later layers take
+// precedence over earlier ones:
+//
+//  1. built-in defaults
+//  2. YAML config file given with -config or CONFIG_FILE
+//  3. environment variables, including those of a .env file
+//  4. command-line flags
+//
+// In the config file settings are written in lower case, and nested keys are
+// joined with "_", so both of these set S3_LISTEN_ADDR:
+//
+//	s3_listen_addr: ":9000"
+//
+//	s3:
+//	  listen_addr: ":9000"
+//
+// Lists can be YAML sequences. On the command line settings are given as
+// -bucket-name=avatars or -bucket-name avatars.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings resolved from the config file, environment and flags
+type Settings struct {
+	file  map[string]string
+	flags map[string]string
+	env   func(key string) (string, bool)
+
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+// Error returned for -h and -help, after printing the usage
+var ErrHelp = errors.New("help requested")
+
+const usage = `Usage: %s [-config FILE] [-SETTING=VALUE]...
+
+Settings are read from the config file, then the environment, then flags,
+later sources overriding earlier ones. Flags are the lower case setting names
+with "-" instead of "_", e.g. -bucket-name=avatars sets BUCKET_NAME. See
+.env.example for all settings.
+`
+
+// Load settings from command-line arguments, the config file they or the
+// CONFIG_FILE environment variable name and the environment
+// @param args []string arguments without the program name
+// @return *Settings settings
+// @return error error
+func Load(args []string) (*Settings, error) {
+	s := &Settings{
+		file:  map[string]string{},
+		flags: map[string]string{},
+		env:   os.LookupEnv,
+		used:  map[string]bool{},
+	}
+
+	path := os.Getenv("CONFIG_FILE")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == "h" || name == "help" {
+			fmt.Fprintf(os.Stderr, usage, os.Args[0])
+			return nil, ErrHelp
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		if name == "config" {
+			path = value
+			continue
+		}
+		s.flags[settingKey(name, "-")] = value
+	}
+
+	if path != "" {
+		if err := s.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Read YAML config file
+// @param path string
+// @return error error
+func (s *Settings) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := flatten(s.file, "", document); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Add values of YAML mapping to settings, joining nested keys with "_"
+// @param settings map[string]string
+// @param prefix string key of the enclosing mapping
+// @param document map[string]interface{}
+// @return error error
+func flatten(settings map[string]string, prefix string, document map[string]interface{}) error {
+	for name, value := range document {
+		key := settingKey(name, "_")
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flatten(settings, key, value); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				if _, ok := item.(map[string]interface{}); ok {
+					return fmt.Errorf("%s: list items must be plain values", name)
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			settings[key] = strings.Join(items, ",")
+		case nil:
+			settings[key] = ""
+		default:
+			settings[key] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
+
+// Convert flag or config file name to setting key, e.g. bucket-name becomes
+// BUCKET_NAME
+// @param name string
+// @param separator string word separator used in name
+// @return string key
+func settingKey(name, separator string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, separator, "_"))
+}
+
+// Look up setting, flags overriding the environment and the environment
+// overriding the config file
+// @param key string setting key, e.g. BUCKET_NAME
+// @return string value
+// @return bool whether the setting is set
+func (s *Settings) Lookup(key string) (string, bool) {
+	s.mu.Lock()
+	s.used[key] = true
+	s.mu.Unlock()
+
+	if value, ok := s.flags[key]; ok {
+		return value, true
+	}
+	if value, ok := s.env(key); ok && strings.TrimSpace(value) != "" {
+		return value, true
+	}
+	value, ok := s.file[key]
+	return value, ok
+}
+
+// Get settings of the config file and flags which were never looked up,
+// most likely typos
+// @return []string setting keys
+func (s *Settings) Unused() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unused := map[string]bool{}
+	for _, layer := range []map[string]string{s.file, s.flags} {
+		for key := range layer {
+			if !s.used[key] {
+				unused[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(unused))
+	for key := range unused {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
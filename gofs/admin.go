@@ -0,0 +1,151 @@
+package gofs
+
+import (
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// Time the service was started, reported by the runtime stats
+var startTime = time.Now()
+
+// Profiles served under /admin/debug/pprof, as listed on the pprof index
+var pprofHandlers = map[string]fasthttp.RequestHandler{
+	"cmdline":      fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Cmdline),
+	"profile":      fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Profile),
+	"symbol":       fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Symbol),
+	"trace":        fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Trace),
+	"allocs":       fasthttpadaptor.NewFastHTTPHandler(pprof.Handler("allocs")),
+	"block":        fasthttpadaptor.NewFastHTTPHandler(pprof.Handler("block")),
+	"goroutine":    fasthttpadaptor.NewFastHTTPHandler(pprof.Handler("goroutine")),
+	"heap":         fasthttpadaptor.NewFastHTTPHandler(pprof.Handler("heap")),
+	"mutex":        fasthttpadaptor.NewFastHTTPHandler(pprof.Handler("mutex")),
+	"threadcreate": fasthttpadaptor.NewFastHTTPHandler(pprof.Handler("threadcreate")),
+}
+
+// Middleware admitting requests authenticated as admin not bound to a
+// tenant, e.g. with the admin token, a JWT or an API key, after
+// authenticateRequest. Anonymous requests are never admitted, whatever
+// ANONYMOUS_ROLE is.
+// @param c *fiber.Ctx context
+// @return error error
+func requireAdmin(c *fiber.Ctx) error {
+	p := principalFromContext(c.Context())
+	if p == nil || !p.Authenticated {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="admin"`)
+		return fiber.NewError(fiber.StatusUnauthorized, "Admin credentials required")
+	}
+	if !p.globalAdmin() {
+		return fiber.NewError(fiber.StatusForbidden, "Role "+roleAdmin+" required")
+	}
+	return c.Next()
+}
+
+// Collect runtime statistics of the process
+// @return fiber.Map stats
+func runtimeStats() fiber.Map {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	var lastGC *time.Time
+	if memStats.NumGC > 0 {
+		last := time.Unix(0, int64(memStats.LastGC)).UTC()
+		lastGC = &last
+	}
+
+	return fiber.Map{
+		"goVersion":       runtime.Version(),
+		"uptime":          time.Since(startTime).Round(time.Second).String(),
+		"cpus":            runtime.NumCPU(),
+		"goroutines":      runtime.NumGoroutine(),
+		"activeTransfers": activeTransfers.Load(),
+		"memoryCache":     memoryCacheStats(),
+		"transformCache":  transformCache().Stats(),
+		"memory": fiber.Map{
+			"alloc":        memStats.Alloc,
+			"totalAlloc":   memStats.TotalAlloc,
+			"sys":          memStats.Sys,
+			"heapAlloc":    memStats.HeapAlloc,
+			"heapInuse":    memStats.HeapInuse,
+			"heapIdle":     memStats.HeapIdle,
+			"heapReleased": memStats.HeapReleased,
+			"heapObjects":  memStats.HeapObjects,
+			"stackInuse":   memStats.StackInuse,
+		},
+		"gc": fiber.Map{
+			"count":        memStats.NumGC,
+			"pauseTotalNs": memStats.PauseTotalNs,
+			"lastGC":       lastGC,
+			"cpuFraction":  memStats.GCCPUFraction,
+		},
+	}
+}
+
+// Register profiling, runtime stats, audit trail, maintenance and report
+// routes, available to admins only, see requireAdmin
+// @param app *fiber.App app
+func registerAdminRoutes(app *fiber.App) {
+	admin := app.Group("/admin", requireAdmin)
+
+	// Get pprof index, its links are relative and need the trailing slash
+	// @return HTML index of profiles
+	admin.Get("/debug/pprof", func(c *fiber.Ctx) error {
+		if path, _, _ := strings.Cut(c.OriginalURL(), "?"); !strings.HasSuffix(path, "/") {
+			return c.Redirect(path+"/", fiber.StatusMovedPermanently)
+		}
+		fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Index)(c.Context())
+		return nil
+	})
+
+	// Get profile, e.g. heap, goroutine or a CPU profile with ?seconds=30
+	// @param profile string
+	// @return profile in pprof format, or text with ?debug=1
+	admin.Get("/debug/pprof/:profile", func(c *fiber.Ctx) error {
+		handler, ok := pprofHandlers[c.Params("profile")]
+		if !ok {
+			return fiber.NewError(fiber.StatusNotFound, "Unknown profile "+c.Params("profile"))
+		}
+		handler(c.Context())
+		return nil
+	})
+
+	// Get memory, garbage collector and goroutine statistics
+	// @return runtime stats
+	admin.Get("/debug/runtime", func(c *fiber.Ctx) error {
+		return respond(c, fiber.StatusOK, "Runtime stats fetched successfully", "runtime", runtimeStats())
+	})
+
+	// Register audit trail route
+	registerAuditRoutes(admin)
+
+	// Register orphan cleanup route
+	registerOrphanRoutes(admin)
+
+	// Register consistency check route
+	registerFsckRoutes(admin)
+
+	// Register duplicate files report route
+	registerDuplicatesRoutes(admin)
+
+	// Register replication status route
+	registerReplicationRoutes(admin)
+
+	// Register background job routes
+	registerJobRoutes(admin)
+
+	// Register webhook dead letter routes
+	registerWebhookRoutes(admin)
+
+	// Register maintenance schedule route
+	registerMaintenanceRoutes(admin)
+
+	// Register tenant registry routes
+	registerTenantRoutes(admin)
+
+	// Register tenant API key routes
+	registerTenantKeyRoutes(admin)
+}
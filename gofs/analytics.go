@@ -0,0 +1,450 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Time limit for updating the download counters of a file
+const downloadCountTimeout = 5 * time.Second
+
+// Maximum number of time buckets of a per-file download series
+const maxStatsBuckets = 1000
+
+// Time buckets of per-file download series. Counters are stored per hour,
+// longer buckets sum them up.
+var statsIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// Download counter of a file, kept until the file is deleted
+type downloadStats struct {
+	Id             primitive.ObjectID `bson:"_id" json:"id"`
+	Bucket         string             `bson:"bucket" json:"-"`
+	Filename       string             `bson:"filename" json:"name"`
+	Downloads      int64              `bson:"downloads" json:"downloads"`
+	LastAccessedAt time.Time          `bson:"lastAccessedAt" json:"lastAccessedAt"`
+}
+
+// Open collection of the download counters of all files
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func downloadStatsCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(config.StatsCollection)
+}
+
+// Open collection of the hourly download counters, removed after the
+// retention period
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func hourlyDownloadsCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(config.StatsCollection + ".hourly")
+}
+
+// Open collection of the daily download counters, rolled up from the hourly
+// ones by the statsRollup maintenance task and kept until the file is deleted
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func dailyDownloadsCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(config.StatsCollection + ".daily")
+}
+
+// Record download of the file described by files document in the audit trail
+// and count it if it succeeded
+// @param ctx context.Context context of the download
+// @param fileDoc bson.M files document
+// @param err error error opening the content, nil if the download started
+func trackDownload(ctx context.Context, fileDoc bson.M, err error) {
+	id := fileDoc["_id"].(primitive.ObjectID)
+	filename := fileDoc["filename"].(string)
+	recordAudit(ctx, auditDownload, id, filename, err)
+	if err == nil {
+		countDownload(ctx, id, filename)
+	}
+}
+
+// Increment total and hourly download counters of a file and set its last
+// access time. Failing to count is logged, it does not fail the download.
+// @param ctx context.Context context of the download
+// @param id primitive.ObjectID file id
+// @param filename string
+func countDownload(ctx context.Context, id primitive.ObjectID, filename string) {
+	now := time.Now().UTC()
+	bucket := BucketFromContext(ctx)
+	db := requestDatabase(ctx)
+
+	// Count the download even if its request was canceled meanwhile
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), downloadCountTimeout)
+	defer cancel()
+
+	upsert := options.Update().SetUpsert(true)
+	_, err := downloadStatsCollection(db).UpdateOne(writeCtx, bson.M{"_id": id}, bson.M{
+		"$inc": bson.M{"downloads": 1},
+		"$set": bson.M{"bucket": bucket, "filename": filename, "lastAccessedAt": now},
+	}, upsert)
+	if err == nil {
+		_, err = hourlyDownloadsCollection(db).UpdateOne(writeCtx, bson.M{"fileId": id, "start": now.Truncate(time.Hour)}, bson.M{
+			"$inc":         bson.M{"downloads": 1},
+			"$setOnInsert": bson.M{"bucket": bucket},
+		}, upsert)
+	}
+	if err != nil {
+		logger.Error("count download", "file_id", id, "error", err)
+	}
+}
+
+// Remove download counters of a deleted file
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param id primitive.ObjectID file id
+func forgetDownloads(ctx context.Context, db *mongo.Database, id primitive.ObjectID) {
+	if _, err := downloadStatsCollection(db).DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		logger.Error("delete download counters", "file_id", id, "error", err)
+		return
+	}
+	for _, collection := range []*mongo.Collection{hourlyDownloadsCollection(db), dailyDownloadsCollection(db)} {
+		if _, err := collection.DeleteMany(ctx, bson.M{"fileId": id}); err != nil {
+			logger.Error("delete download counters", "file_id", id, "error", err)
+			return
+		}
+	}
+}
+
+// Sum up hourly download counters of the days since the last rollup into
+// daily counters, which outlive DOWNLOAD_STATS_RETENTION. Only days which
+// are over are rolled up, their counters don't change anymore.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @return int number of days rolled up
+// @return error error
+func rollupDownloads(ctx context.Context, db *mongo.Database) (int, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	var latest struct {
+		Start time.Time `bson:"start"`
+	}
+	var from time.Time
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "start", Value: -1}}).SetProjection(bson.M{"start": 1})
+	err := dailyDownloadsCollection(db).FindOne(ctx, bson.M{}, findOptions).Decode(&latest)
+	if err == nil {
+		from = latest.Start.UTC().Add(24 * time.Hour)
+	} else if errors.Is(err, mongo.ErrNoDocuments) {
+		// The first rollup starts at the oldest hourly counter
+		err = hourlyDownloadsCollection(db).FindOne(ctx, bson.M{}, findOptions.SetSort(bson.D{{Key: "start", Value: 1}})).Decode(&latest)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		from = latest.Start.UTC().Truncate(24 * time.Hour)
+	} else {
+		return 0, err
+	}
+	if !from.Before(today) {
+		return 0, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"start": bson.M{"$gte": from, "$lt": today}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"fileId": "$fileId",
+				"start":  bson.M{"$subtract": bson.A{"$start", bson.M{"$mod": bson.A{bson.M{"$toLong": "$start"}, int64(24 * time.Hour / time.Millisecond)}}}},
+			},
+			"bucket":    bson.M{"$first": "$bucket"},
+			"downloads": bson.M{"$sum": "$downloads"},
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "fileId": "$_id.fileId", "start": "$_id.start", "bucket": 1, "downloads": 1}}},
+		{{Key: "$merge", Value: bson.M{
+			"into":           dailyDownloadsCollection(db).Name(),
+			"on":             bson.A{"fileId", "start"},
+			"whenMatched":    "replace",
+			"whenNotMatched": "insert",
+		}}},
+	}
+	cursor, err := hourlyDownloadsCollection(db).Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	if err := cursor.Close(ctx); err != nil {
+		return 0, err
+	}
+	return int(today.Sub(from) / (24 * time.Hour)), nil
+}
+
+// Read RFC 3339 timestamp query parameter
+// @param c *fiber.Ctx context
+// @param param string
+// @param fallback time.Time value if the parameter is missing
+// @return time.Time timestamp
+// @return error error
+func queryTime(c *fiber.Ctx, param string, fallback time.Time) (time.Time, error) {
+	value := c.Query(param)
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "Invalid "+param+", expected RFC 3339 timestamp")
+	}
+	return t.UTC(), nil
+}
+
+// Get most downloaded files of the bucket of ctx, counting all downloads or
+// those since the given time
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param since *time.Time start of the counted period, nil for all downloads
+// @param skip int64
+// @param limit int64
+// @return []downloadStats files, most downloaded first
+// @return error error
+func topDownloads(ctx context.Context, db *mongo.Database, since *time.Time, skip, limit int64) ([]downloadStats, error) {
+	stats := []downloadStats{}
+
+	if since == nil {
+		findOptions := options.Find().
+			SetSort(bson.D{{Key: "downloads", Value: -1}, {Key: "_id", Value: 1}}).
+			SetSkip(skip).
+			SetLimit(limit)
+		cursor, err := downloadStatsCollection(db).Find(ctx, bson.M{"bucket": BucketFromContext(ctx)}, findOptions)
+		if err != nil {
+			return nil, err
+		}
+		return stats, cursor.All(ctx, &stats)
+	}
+
+	// Sum the hourly counters of the period, taking name and last access from
+	// the total counters
+	cursor, err := hourlyDownloadsCollection(db).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"bucket": BucketFromContext(ctx), "start": bson.M{"$gte": since.Truncate(time.Hour)}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$fileId", "downloads": bson.M{"$sum": "$downloads"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "downloads", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$lookup", Value: bson.M{"from": config.StatsCollection, "localField": "_id", "foreignField": "_id", "as": "total"}}},
+		{{Key: "$unwind", Value: "$total"}},
+		{{Key: "$addFields", Value: bson.M{"filename": "$total.filename", "lastAccessedAt": "$total.lastAccessedAt"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, cursor.All(ctx, &stats)
+}
+
+// Get files of the bucket of ctx accessed least recently, files which were
+// never downloaded first
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param skip int64
+// @param limit int64
+// @return []fiber.Map files with download counts
+// @return error error
+func coldFiles(ctx context.Context, db *mongo.Database, skip, limit int64) ([]fiber.Map, error) {
+	cursor, err := requestFilesCollection(ctx, db).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: activeFilter(bson.M{})}},
+		{{Key: "$lookup", Value: bson.M{"from": config.StatsCollection, "localField": "_id", "foreignField": "_id", "as": "stats"}}},
+		{{Key: "$addFields", Value: bson.M{
+			"downloads":      bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$stats.downloads", 0}}, 0}},
+			"lastAccessedAt": bson.M{"$arrayElemAt": bson.A{"$stats.lastAccessedAt", 0}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "lastAccessedAt", Value: 1}, {Key: "uploadDate", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var fileDocs []bson.M
+	if err := cursor.All(ctx, &fileDocs); err != nil {
+		return nil, err
+	}
+
+	files := make([]fiber.Map, 0, len(fileDocs))
+	for _, fileDoc := range fileDocs {
+		file := fileInfo(fileDoc)
+		file["downloads"] = fileDoc["downloads"]
+		file["lastAccessedAt"] = fileDoc["lastAccessedAt"]
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Get downloads of a file per time bucket. Every bucket of the period is
+// included, buckets without downloads count 0.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param id primitive.ObjectID file id
+// @param interval time.Duration bucket length
+// @param since time.Time start of the period
+// @param until time.Time end of the period
+// @return []fiber.Map buckets with start time and downloads
+// @return error error
+func downloadSeries(ctx context.Context, db *mongo.Database, id primitive.ObjectID, interval time.Duration, since, until time.Time) ([]fiber.Map, error) {
+	start := since.Truncate(interval)
+	if !until.After(start) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid period, until must be after since")
+	}
+	if until.Sub(start)/interval >= maxStatsBuckets {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Period too long for the interval")
+	}
+
+	cursor, err := hourlyDownloadsCollection(db).Find(ctx, bson.M{
+		"fileId": id,
+		"start":  bson.M{"$gte": start, "$lt": until},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var hours []struct {
+		Start     time.Time `bson:"start"`
+		Downloads int64     `bson:"downloads"`
+	}
+	if err := cursor.All(ctx, &hours); err != nil {
+		return nil, err
+	}
+
+	// Days rolled up into daily counters count those, the hourly counters
+	// of older days may have expired
+	counts := map[time.Time]int64{}
+	rolledUp := map[time.Time]bool{}
+	if interval >= 24*time.Hour {
+		cursor, err := dailyDownloadsCollection(db).Find(ctx, bson.M{
+			"fileId": id,
+			"start":  bson.M{"$gte": start, "$lt": until},
+		})
+		if err != nil {
+			return nil, err
+		}
+		var days []struct {
+			Start     time.Time `bson:"start"`
+			Downloads int64     `bson:"downloads"`
+		}
+		if err := cursor.All(ctx, &days); err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			rolledUp[day.Start.UTC()] = true
+			counts[day.Start.UTC().Truncate(interval)] += day.Downloads
+		}
+	}
+	for _, hour := range hours {
+		if !rolledUp[hour.Start.UTC().Truncate(24*time.Hour)] {
+			counts[hour.Start.UTC().Truncate(interval)] += hour.Downloads
+		}
+	}
+	series := []fiber.Map{}
+	for bucket := start; bucket.Before(until); bucket = bucket.Add(interval) {
+		series = append(series, fiber.Map{"start": bucket, "downloads": counts[bucket]})
+	}
+	return series, nil
+}
+
+// Register download analytics routes
+// @param app *fiber.App app
+func registerAnalyticsRoutes(app *fiber.App) {
+	// Get most downloaded images, of all time or since a given time
+	// @param since string RFC 3339 timestamp
+	// @param skip int
+	// @param limit int
+	// @return files with download counts
+	app.Get("/api/images/top", requireRole(roleAdmin), func(c *fiber.Ctx) error {
+		skip, limit, err := listPage(c)
+		if err != nil {
+			return err
+		}
+		var since *time.Time
+		if c.Query("since") != "" {
+			t, err := queryTime(c, "since", time.Time{})
+			if err != nil {
+				return err
+			}
+			since = &t
+		}
+
+		stats, err := topDownloads(c.Context(), requestDatabase(c.Context()), since, skip, limit)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Top downloads fetched successfully", "images", stats)
+	})
+
+	// Get images accessed least recently, never downloaded images first
+	// @param skip int
+	// @param limit int
+	// @return files with download counts
+	app.Get("/api/images/cold", requireRole(roleAdmin), func(c *fiber.Ctx) error {
+		skip, limit, err := listPage(c)
+		if err != nil {
+			return err
+		}
+
+		files, err := coldFiles(c.Context(), requestDatabase(c.Context()), skip, limit)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Cold images fetched successfully", "images", files)
+	})
+
+	// Get download count, last access and downloads per hour, day or week of
+	// an image, by default for the last 7 days
+	// @param id string
+	// @param interval string hour|day|week
+	// @param since string RFC 3339 timestamp
+	// @param until string RFC 3339 timestamp
+	// @return download stats
+	app.Get("/api/image/id/:id/stats", func(c *fiber.Ctx) error {
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+		intervalName := c.Query("interval", "day")
+		interval, ok := statsIntervals[intervalName]
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid interval, expected hour, day or week")
+		}
+		until, err := queryTime(c, "until", time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		since, err := queryTime(c, "since", until.Add(-7*24*time.Hour))
+		if err != nil {
+			return err
+		}
+
+		db := requestDatabase(c.Context())
+		id := fileDoc["_id"].(primitive.ObjectID)
+		series, err := downloadSeries(c.Context(), db, id, interval, since, until)
+		if err != nil {
+			return err
+		}
+
+		stats := fiber.Map{
+			"id":             id,
+			"name":           fileDoc["filename"],
+			"downloads":      0,
+			"lastAccessedAt": nil,
+			"interval":       intervalName,
+			"series":         series,
+		}
+		var total downloadStats
+		err = downloadStatsCollection(db).FindOne(c.Context(), bson.M{"_id": id}).Decode(&total)
+		switch {
+		case err == nil:
+			stats["downloads"] = total.Downloads
+			stats["lastAccessedAt"] = total.LastAccessedAt
+		case !errors.Is(err, mongo.ErrNoDocuments):
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Download stats fetched successfully", "stats", stats)
+	})
+}
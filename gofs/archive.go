@@ -0,0 +1,143 @@
+package gofs
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// Maximum number of files in one archive
+const maxArchiveFiles = 100
+
+// Request body of the archive endpoint
+type archiveRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// Make archive entry name unique by adding a counter before the extension
+// @param name string
+// @param used map[string]bool names already in the archive
+// @return string entry name
+func uniqueEntryName(name string, used map[string]bool) string {
+	entryName := name
+	ext := path.Ext(name)
+	for i := 1; used[entryName]; i++ {
+		entryName = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[entryName] = true
+	return entryName
+}
+
+// Stream files from GridFS bucket into zip archive
+// @param ctx context.Context context carrying the audit source
+// @param w io.Writer
+// @param bucket *gridfs.Bucket bucket
+// @param fileDocs []bson.M files documents
+// @return error error
+func writeArchive(ctx context.Context, w io.Writer, bucket *gridfs.Bucket, fileDocs []bson.M) error {
+	archive := zip.NewWriter(w)
+	used := map[string]bool{}
+
+	for _, fileDoc := range fileDocs {
+		// Images are already compressed, store them as is
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     uniqueEntryName(fileDoc["filename"].(string), used),
+			Method:   zip.Store,
+			Modified: fileDoc["uploadDate"].(primitive.DateTime).Time(),
+		})
+		if err != nil {
+			return err
+		}
+
+		downloadStream, err := bucket.OpenDownloadStream(fileDoc["_id"])
+		trackDownload(ctx, fileDoc, err)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, downloadStream)
+		downloadStream.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// Register archive download route
+// @param app *fiber.App app
+func registerArchiveRoutes(app *fiber.App) {
+	// Download several images as one zip archive. Entries are streamed from
+	// GridFS into the archive so it is never buffered in memory.
+	// @param ids []string
+	// @return zip archive
+	app.Post("/api/images/archive", func(c *fiber.Ctx) error {
+		var body archiveRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if len(body.Ids) == 0 || len(body.Ids) > maxArchiveFiles {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Expected between 1 and %d ids", maxArchiveFiles))
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(body.Ids))
+		for _, hex := range body.Ids {
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				return newError(fiber.StatusBadRequest, CodeInvalidId, "Invalid id "+hex)
+			}
+			ids = append(ids, id)
+		}
+
+		// Look up all files before streaming so missing ones can still be reported
+		db := requestDatabase(c.Context())
+		cursor, err := filesCollection(db).Find(c.Context(), activeFilter(bson.M{"_id": bson.M{"$in": ids}}))
+		if err != nil {
+			return err
+		}
+		var found []bson.M
+		if err := cursor.All(c.Context(), &found); err != nil {
+			return err
+		}
+		byId := map[primitive.ObjectID]bson.M{}
+		for _, fileDoc := range found {
+			byId[fileDoc["_id"].(primitive.ObjectID)] = fileDoc
+		}
+
+		// Keep request order in the archive
+		fileDocs := make([]bson.M, 0, len(ids))
+		for i, id := range ids {
+			fileDoc, ok := byId[id]
+			if !ok {
+				return newError(fiber.StatusNotFound, CodeFileNotFound, "Image not found: "+body.Ids[i])
+			}
+			fileDocs = append(fileDocs, fileDoc)
+		}
+
+		bucket, err := imageBucket(db)
+		if err != nil {
+			return err
+		}
+
+		c.Set(fiber.HeaderContentType, "application/zip")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="images.zip"`)
+		// The archive is written after the handler returned, c is gone by then
+		requestLog := requestLogger(c)
+		ctx := withAuditSource(context.Background(), auditSourceFrom(c.Context()))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			if err := writeArchive(ctx, w, bucket, fileDocs); err != nil {
+				requestLog.Error("write archive", "error", err)
+			}
+		})
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+package gofs
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Months counted by the upload date facet, older uploads are counted
+// together
+const uploadFacetMonths = 12
+
+// Build Atlas Search operator matching query in filenames, tags and
+// descriptions with up to one typo per word. Filename matches weigh more,
+// expired files are left out like by activeFilter.
+// @param query string
+// @return bson.M compound operator
+func atlasSearchOperator(query string) bson.M {
+	fuzzy := bson.M{"maxEdits": 1}
+	return bson.M{
+		"should": bson.A{
+			bson.M{"text": bson.M{"query": query, "path": "filename", "fuzzy": fuzzy, "score": bson.M{"boost": bson.M{"value": 10}}}},
+			bson.M{"text": bson.M{"query": query, "path": bson.A{"metadata.tags", "metadata.description"}, "fuzzy": fuzzy}},
+		},
+		"minimumShouldMatch": 1,
+		"mustNot": bson.A{
+			bson.M{"range": bson.M{"path": "metadata.expiresAt", "lte": time.Now()}},
+		},
+	}
+}
+
+// Get first days of the months counted by the upload date facet, oldest
+// first, followed by the first day of next month
+// @param now time.Time
+// @return []time.Time boundaries
+func uploadFacetBoundaries(now time.Time) []time.Time {
+	now = now.UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	boundaries := make([]time.Time, 0, uploadFacetMonths+1)
+	for i := uploadFacetMonths - 1; i >= -1; i-- {
+		boundaries = append(boundaries, month.AddDate(0, -i, 0))
+	}
+	return boundaries
+}
+
+// Result of the $searchMeta facet collector
+type atlasFacetResult struct {
+	Count struct {
+		LowerBound int64 `bson:"lowerBound"`
+	} `bson:"count"`
+	Facet struct {
+		ContentType struct {
+			Buckets []struct {
+				Id    string `bson:"_id"`
+				Count int64  `bson:"count"`
+			} `bson:"buckets"`
+		} `bson:"contentType"`
+		UploadDate struct {
+			Buckets []struct {
+				Id    interface{} `bson:"_id"`
+				Count int64       `bson:"count"`
+			} `bson:"buckets"`
+		} `bson:"uploadDate"`
+	} `bson:"facet"`
+}
+
+// Count files matching query by content type and upload month with Atlas
+// Search. The counts don't take the listing filters into account.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param query string
+// @return fiber.Map total, content type and upload month counts
+// @return error error
+func atlasFacets(ctx context.Context, db *mongo.Database, query string) (fiber.Map, error) {
+	boundaries := uploadFacetBoundaries(time.Now())
+	pipeline := mongo.Pipeline{
+		{{Key: "$searchMeta", Value: bson.M{
+			"index": config.AtlasSearchIndex,
+			"facet": bson.M{
+				"operator": bson.M{"compound": atlasSearchOperator(query)},
+				"facets": bson.M{
+					"contentType": bson.M{"type": "string", "path": "metadata.ext", "numBuckets": len(contentTypes)},
+					"uploadDate":  bson.M{"type": "date", "path": "uploadDate", "boundaries": boundaries, "default": "older"},
+				},
+			},
+		}}},
+	}
+	var results []atlasFacetResult
+	err := withRetry(ctx, func() error {
+		cursor, err := requestFilesCollection(ctx, db).Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &results)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result atlasFacetResult
+	if len(results) > 0 {
+		result = results[0]
+	}
+
+	// Extensions of the same content type, e.g. .jpg and .jpeg, are counted
+	// together
+	byContentType := map[string]int64{}
+	for _, bucket := range result.Facet.ContentType.Buckets {
+		if contentType, ok := contentTypes[bucket.Id]; ok {
+			byContentType[contentType] += bucket.Count
+		}
+	}
+	contentTypeCounts := make([]fiber.Map, 0, len(byContentType))
+	for contentType, count := range byContentType {
+		contentTypeCounts = append(contentTypeCounts, fiber.Map{"contentType": contentType, "count": count})
+	}
+	sort.Slice(contentTypeCounts, func(i, j int) bool {
+		a, b := contentTypeCounts[i], contentTypeCounts[j]
+		if a["count"] != b["count"] {
+			return a["count"].(int64) > b["count"].(int64)
+		}
+		return a["contentType"].(string) < b["contentType"].(string)
+	})
+
+	// Months without uploads are listed with count 0, uploads before the
+	// first month under "from": null
+	byMonth := map[time.Time]int64{}
+	var older int64
+	for _, bucket := range result.Facet.UploadDate.Buckets {
+		switch id := bucket.Id.(type) {
+		case primitive.DateTime:
+			byMonth[id.Time().UTC()] = bucket.Count
+		case string:
+			older = bucket.Count
+		}
+	}
+	monthCounts := []fiber.Map{{"from": nil, "until": boundaries[0], "count": older}}
+	for i, from := range boundaries[:len(boundaries)-1] {
+		monthCounts = append(monthCounts, fiber.Map{"from": from, "until": boundaries[i+1], "count": byMonth[from]})
+	}
+
+	return fiber.Map{
+		"count":        result.Count.LowerBound,
+		"contentTypes": contentTypeCounts,
+		"uploadMonths": monthCounts,
+	}, nil
+}
@@ -0,0 +1,572 @@
+package gofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Longest tag value kept in the metadata
+const maxAudioTag = 256
+
+// How far after the ID3 tag the first MP3 frame is looked for
+const maxMP3FrameSearch = 64 * 1024
+
+// Tags of ID3v2.3 and v2.4 frames and their ID3v2.2 counterparts by the
+// metadata field they are stored in
+var id3Frames = map[string]string{
+	"TIT2": "title",
+	"TT2":  "title",
+	"TPE1": "artist",
+	"TP1":  "artist",
+	"TALB": "album",
+	"TAL":  "album",
+	"TYER": "year",
+	"TYE":  "year",
+	"TDRC": "year",
+	"TRCK": "track",
+	"TRK":  "track",
+	"TCON": "genre",
+	"TCO":  "genre",
+}
+
+// Vorbis comment fields of FLAC and Ogg files by the metadata field they are
+// stored in
+var vorbisCommentFields = map[string]string{
+	"TITLE":       "title",
+	"ARTIST":      "artist",
+	"ALBUM":       "album",
+	"DATE":        "year",
+	"TRACKNUMBER": "track",
+	"GENRE":       "genre",
+}
+
+// MP3 bitrates in kbit/s by MPEG version (1 or 2 and 2.5), layer and index
+var mp3Bitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// MPEG 1 sample rates, halved for MPEG 2 and quartered for MPEG 2.5
+var mp3SampleRates = [3]int{44100, 48000, 32000}
+
+// Audio metadata stored with uploads
+type audioInfo struct {
+	// Duration in seconds
+	Duration float64
+	// Average bitrate in bit/s
+	Bitrate    int
+	SampleRate int
+	Channels   int
+	// Title, artist, album, year, track and genre, if tagged
+	Tags map[string]string
+}
+
+// Get audio metadata as stored in the audio metadata field
+// @return bson.M metadata
+func (a audioInfo) metadata() bson.M {
+	metadata := bson.M{
+		"duration":   math.Round(a.Duration*1000) / 1000,
+		"bitrate":    a.Bitrate,
+		"sampleRate": a.SampleRate,
+		"channels":   a.Channels,
+	}
+	for key, value := range a.Tags {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// Set tag unless it is set already or empty, cutting long values
+// @param key string metadata field
+// @param value string
+func (a *audioInfo) tag(key, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if _, ok := a.Tags[key]; ok || value == "" {
+		return
+	}
+	if runes := []rune(value); len(runes) > maxAudioTag {
+		value = string(runes[:maxAudioTag])
+	}
+	if a.Tags == nil {
+		a.Tags = map[string]string{}
+	}
+	a.Tags[key] = value
+}
+
+// Inspect uploaded MP3, Ogg or FLAC audio and extract its duration, bitrate
+// and tags. Uploads larger than AUDIO_MAX_BYTES are rejected. Unless
+// IMAGE_VERIFICATION is none the content has to be audio of the format of
+// the file extension. With decode the first MP3 frame also has to be
+// followed by another one, and Ogg streams have to be complete.
+// @param content io.Reader upload content
+// @param ext string file extension
+// @return io.Reader content
+// @return bson.M audio metadata
+// @return error error
+func inspectAudio(content io.Reader, ext string) (io.Reader, bson.M, error) {
+	if config.MaxAudioBytes > 0 {
+		content = &limitReader{reader: content, remaining: config.MaxAudioBytes}
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var info audioInfo
+	switch ext {
+	case ".flac":
+		info, err = flacInfo(data)
+	case ".ogg":
+		info, err = oggInfo(data)
+	default:
+		info, err = mp3Info(data)
+	}
+	if err != nil {
+		if config.ImageVerification != verifyNone {
+			return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not valid "+strings.ToUpper(ext[1:])+" audio: "+err.Error())
+		}
+		return bytes.NewReader(data), nil, nil
+	}
+	return bytes.NewReader(data), bson.M{"audio": info.metadata()}, nil
+}
+
+// Decode ID3v2 size, 7 bits per byte
+// @param b []byte 4 bytes
+// @return int size
+func synchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// Decode ID3v2 text frame: an encoding byte followed by Latin-1, UTF-16 with
+// byte order mark, UTF-16BE or UTF-8 text. Of several values the first is
+// returned.
+// @param payload []byte frame payload
+// @return string text
+func id3Text(payload []byte) string {
+	if len(payload) == 0 {
+		return ""
+	}
+	encoding, text := payload[0], payload[1:]
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(text) >= 2 && text[0] == 0xff && text[1] == 0xfe {
+			bigEndian, text = false, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+			bigEndian, text = true, text[2:]
+		}
+		var units []uint16
+		for i := 0; i+1 < len(text); i += 2 {
+			unit := binary.LittleEndian.Uint16(text[i:])
+			if bigEndian {
+				unit = binary.BigEndian.Uint16(text[i:])
+			}
+			if unit == 0 {
+				break
+			}
+			units = append(units, unit)
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		value, _, _ := strings.Cut(string(text), "\x00")
+		return strings.ToValidUTF8(value, "")
+	}
+	value, _, _ := bytes.Cut(text, []byte{0})
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Read the text frames of an ID3v2 tag into the tags of info
+// @param tag []byte tag without its header
+// @param version byte major version, 2 to 4
+// @param info *audioInfo
+func readID3Frames(tag []byte, version byte, info *audioInfo) {
+	idLength, headerLength := 4, 10
+	if version == 2 {
+		idLength, headerLength = 3, 6
+	}
+	for len(tag) >= headerLength && tag[0] != 0 {
+		id := string(tag[:idLength])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			size = synchsafe(tag[4:8])
+		}
+		if size > len(tag)-headerLength {
+			return
+		}
+		if key, ok := id3Frames[id]; ok {
+			info.tag(key, id3Text(tag[headerLength:headerLength+size]))
+		}
+		tag = tag[headerLength+size:]
+	}
+}
+
+// Read ID3v1 tag at the end of an MP3 file into the tags of info, for tags
+// the ID3v2 tag didn't have
+// @param data []byte MP3 file
+// @param info *audioInfo
+// @return bool whether the file ends with an ID3v1 tag
+func readID3v1(data []byte, info *audioInfo) bool {
+	if len(data) < 128 || string(data[len(data)-128:len(data)-125]) != "TAG" {
+		return false
+	}
+	tag := data[len(data)-128:]
+	for key, field := range map[string][]byte{"title": tag[3:33], "artist": tag[33:63], "album": tag[63:93], "year": tag[93:97]} {
+		info.tag(key, id3Text(append([]byte{0}, field...)))
+	}
+	// ID3v1.1 keeps the track number in the last byte of the comment
+	if tag[125] == 0 && tag[126] != 0 {
+		info.tag("track", strconv.Itoa(int(tag[126])))
+	}
+	return true
+}
+
+// MP3 frame header
+type mp3Frame struct {
+	// MPEG version: 1, 2 or 25 for 2.5
+	version    int
+	layer      int
+	bitrate    int
+	sampleRate int
+	channels   int
+	// Frame length in bytes
+	length int
+	// Samples per frame
+	samples int
+}
+
+// Parse MP3 frame header
+// @param b []byte at least 4 bytes
+// @return mp3Frame frame
+// @return bool whether b starts with a valid frame header
+func parseMP3Frame(b []byte) (mp3Frame, bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return mp3Frame{}, false
+	}
+	versionBits, layerBits := b[1]>>3&3, b[1]>>1&3
+	bitrateIndex, rateIndex := b[2]>>4, b[2]>>2&3
+	if versionBits == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	frame := mp3Frame{layer: int(4 - layerBits), channels: 2}
+	table := 1
+	switch versionBits {
+	case 3:
+		frame.version, table = 1, 0
+		frame.sampleRate = mp3SampleRates[rateIndex]
+	case 2:
+		frame.version = 2
+		frame.sampleRate = mp3SampleRates[rateIndex] / 2
+	default:
+		frame.version = 25
+		frame.sampleRate = mp3SampleRates[rateIndex] / 4
+	}
+	frame.bitrate = mp3Bitrates[table][frame.layer-1][bitrateIndex] * 1000
+	if b[3]>>6 == 3 {
+		frame.channels = 1
+	}
+
+	padding := int(b[2] >> 1 & 1)
+	switch {
+	case frame.layer == 1:
+		frame.samples = 384
+		frame.length = (12*frame.bitrate/frame.sampleRate + padding) * 4
+	case frame.layer == 3 && frame.version != 1:
+		frame.samples = 576
+		frame.length = 72*frame.bitrate/frame.sampleRate + padding
+	default:
+		frame.samples = 1152
+		frame.length = 144*frame.bitrate/frame.sampleRate + padding
+	}
+	return frame, true
+}
+
+// Get duration, bitrate and tags of an MP3 file. VBR files are timed by the
+// frame count of their Xing or VBRI header, CBR files by their size.
+// @param data []byte MP3 file
+// @return audioInfo info
+// @return error error if the content has no MPEG audio frame
+func mp3Info(data []byte) (audioInfo, error) {
+	var info audioInfo
+	start, end := 0, len(data)
+	if len(data) >= 10 && string(data[0:3]) == "ID3" {
+		version, flags := data[3], data[5]
+		size := synchsafe(data[6:10])
+		if size > len(data)-10 {
+			return info, errors.New("truncated ID3 tag")
+		}
+		tag := data[10 : 10+size]
+		// Extended headers are skipped, unsynchronised v2.3 tags not read
+		if flags&0x40 != 0 && len(tag) >= 4 {
+			extended := int(binary.BigEndian.Uint32(tag[0:4])) + 4
+			if version == 4 {
+				extended = synchsafe(tag[0:4])
+			}
+			tag = tag[min(extended, len(tag)):]
+		}
+		if version >= 2 && version <= 4 && (flags&0x80 == 0 || version == 4) {
+			readID3Frames(tag, version, &info)
+		}
+		start = 10 + size
+		if flags&0x10 != 0 {
+			start += 10
+		}
+	}
+	if readID3v1(data, &info) {
+		end -= 128
+	}
+
+	// Padding may follow the tag
+	var frame mp3Frame
+	found := false
+	for limit := min(start+maxMP3FrameSearch, end-4); start < limit; start++ {
+		if frame, found = parseMP3Frame(data[start:end]); found {
+			break
+		}
+	}
+	if !found {
+		return info, errors.New("no MPEG audio frame")
+	}
+	info.SampleRate, info.Channels = frame.sampleRate, frame.channels
+	// The first frame has to be followed by another one or the end of the file
+	if next := start + frame.length; config.ImageVerification == verifyDecode && next < end {
+		if _, ok := parseMP3Frame(data[next:end]); !ok {
+			return info, errors.New("invalid MPEG audio frame")
+		}
+	}
+
+	// The first frame of VBR files holds a Xing or VBRI header instead of audio
+	sideInfo := 32
+	switch {
+	case frame.version == 1 && frame.channels == 1:
+		sideInfo = 17
+	case frame.version != 1 && frame.channels == 2:
+		sideInfo = 17
+	case frame.version != 1:
+		sideInfo = 9
+	}
+	frames := 0
+	if xing := data[min(start+4+sideInfo, end):end]; len(xing) >= 12 && (string(xing[0:4]) == "Xing" || string(xing[0:4]) == "Info") && xing[7]&1 != 0 {
+		frames = int(binary.BigEndian.Uint32(xing[8:12]))
+	} else if vbri := data[min(start+36, end):end]; len(vbri) >= 18 && string(vbri[0:4]) == "VBRI" {
+		frames = int(binary.BigEndian.Uint32(vbri[14:18]))
+	}
+
+	audioBytes := end - start
+	if frames > 0 {
+		info.Duration = float64(frames*frame.samples) / float64(frame.sampleRate)
+		info.Bitrate = int(float64(audioBytes*8) / info.Duration)
+	} else {
+		info.Bitrate = frame.bitrate
+		info.Duration = float64(audioBytes*8) / float64(frame.bitrate)
+	}
+	return info, nil
+}
+
+// Read Vorbis comments into the tags of info
+// @param data []byte comment header without its packet type
+// @param info *audioInfo
+func readVorbisComments(data []byte, info *audioInfo) {
+	if len(data) < 4 {
+		return
+	}
+	vendor := int(binary.LittleEndian.Uint32(data))
+	if vendor > len(data)-8 {
+		return
+	}
+	data = data[4+vendor:]
+	count := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	for i := 0; i < count && len(data) >= 4; i++ {
+		length := int(binary.LittleEndian.Uint32(data))
+		if length > len(data)-4 {
+			return
+		}
+		key, value, _ := strings.Cut(string(data[4:4+length]), "=")
+		if field, ok := vorbisCommentFields[strings.ToUpper(key)]; ok {
+			info.tag(field, strings.ToValidUTF8(value, ""))
+		}
+		data = data[4+length:]
+	}
+}
+
+// Get duration, bitrate, stream information and tags of a FLAC file from
+// its STREAMINFO and VORBIS_COMMENT metadata blocks
+// @param data []byte FLAC file
+// @return audioInfo info
+// @return error error if the content is no FLAC file
+func flacInfo(data []byte) (audioInfo, error) {
+	var info audioInfo
+	if len(data) < 4 || string(data[0:4]) != "fLaC" {
+		return info, errors.New("missing fLaC marker")
+	}
+
+	var samples uint64
+	offset, streamInfo := 4, false
+	for last := false; !last; {
+		if len(data)-offset < 4 {
+			return info, errors.New("truncated metadata block")
+		}
+		last = data[offset]&0x80 != 0
+		typ := data[offset] & 0x7f
+		length := int(data[offset+1])<<16 | int(data[offset+2])<<8 | int(data[offset+3])
+		offset += 4
+		if length > len(data)-offset {
+			return info, errors.New("truncated metadata block")
+		}
+		block := data[offset : offset+length]
+		offset += length
+
+		switch {
+		case typ == 0 && length >= 18:
+			streamInfo = true
+			info.SampleRate = int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+			info.Channels = int(block[12]>>1&7) + 1
+			samples = uint64(block[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(block[14:18]))
+		case typ == 4:
+			readVorbisComments(block, &info)
+		}
+	}
+	if !streamInfo || info.SampleRate == 0 {
+		return info, errors.New("missing STREAMINFO block")
+	}
+	if samples > 0 {
+		info.Duration = float64(samples) / float64(info.SampleRate)
+		info.Bitrate = int(float64((len(data)-offset)*8) / info.Duration)
+	}
+	return info, nil
+}
+
+// Get the first packets of the first logical stream of an Ogg file
+// @param data []byte Ogg file
+// @param count int number of packets
+// @return [][]byte packets
+// @return error error if the pages are invalid or end before the packets
+func oggPackets(data []byte, count int) ([][]byte, error) {
+	var packets [][]byte
+	var packet []byte
+	var serial []byte
+	for len(packets) < count {
+		if len(data) < 27 || string(data[0:4]) != "OggS" {
+			return nil, errors.New("invalid or truncated page")
+		}
+		segments := int(data[26])
+		if len(data) < 27+segments {
+			return nil, errors.New("truncated page")
+		}
+		lacing := data[27 : 27+segments]
+		body := data[27+segments:]
+		pageSerial := data[14:18]
+		size := 0
+		for _, length := range lacing {
+			size += int(length)
+		}
+		if size > len(body) {
+			return nil, errors.New("truncated page")
+		}
+
+		if serial == nil {
+			serial = pageSerial
+		}
+		if bytes.Equal(serial, pageSerial) {
+			for _, length := range lacing {
+				packet = append(packet, body[:length]...)
+				body = body[length:]
+				// Packets continue on the next segment after full ones
+				if length < 255 {
+					packets = append(packets, packet)
+					packet = nil
+				}
+			}
+		}
+		data = data[27+segments+size:]
+	}
+	return packets[:count], nil
+}
+
+// Get duration, bitrate, stream information and tags of an Ogg Vorbis or
+// Opus file from its identification and comment headers and the granule
+// position of its last page
+// @param data []byte Ogg file
+// @return audioInfo info
+// @return error error if the content is no Ogg Vorbis or Opus file
+func oggInfo(data []byte) (audioInfo, error) {
+	var info audioInfo
+	if len(data) < 4 || string(data[0:4]) != "OggS" {
+		return info, errors.New("missing OggS page")
+	}
+	packets, err := oggPackets(data, 2)
+	if err != nil {
+		return info, err
+	}
+	identification, comments := packets[0], packets[1]
+
+	// Opus granule positions count 48 kHz samples, after pre-skip ones
+	granuleRate, preSkip := 0, 0
+	switch {
+	case len(identification) >= 28 && string(identification[0:7]) == "\x01vorbis":
+		info.Channels = int(identification[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(identification[12:16]))
+		info.Bitrate = int(int32(binary.LittleEndian.Uint32(identification[20:24])))
+		granuleRate = info.SampleRate
+		if len(comments) >= 7 && string(comments[0:7]) == "\x03vorbis" {
+			readVorbisComments(comments[7:], &info)
+		}
+	case len(identification) >= 19 && string(identification[0:8]) == "OpusHead":
+		info.Channels = int(identification[9])
+		preSkip = int(binary.LittleEndian.Uint16(identification[10:12]))
+		info.SampleRate = int(binary.LittleEndian.Uint32(identification[12:16]))
+		granuleRate = 48000
+		if len(comments) >= 8 && string(comments[0:8]) == "OpusTags" {
+			readVorbisComments(comments[8:], &info)
+		}
+	default:
+		return info, errors.New("no Vorbis or Opus stream")
+	}
+	if granuleRate == 0 {
+		return info, errors.New("invalid sample rate")
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || len(data)-last < 27 {
+		return info, errors.New("truncated page")
+	}
+	// The last page of a complete stream has the end of stream flag
+	if config.ImageVerification == verifyDecode && data[last+5]&0x04 == 0 {
+		return info, errors.New("missing end of stream")
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule > int64(preSkip) {
+		info.Duration = float64(granule-int64(preSkip)) / float64(granuleRate)
+	}
+	if info.Bitrate <= 0 && info.Duration > 0 {
+		info.Bitrate = int(float64(len(data)*8) / info.Duration)
+	}
+	return info, nil
+}
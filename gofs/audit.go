@@ -0,0 +1,274 @@
+package gofs
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/peer"
+)
+
+// Audited file operations
+const (
+	auditUpload   = "upload"
+	auditDownload = "download"
+	auditDelete   = "delete"
+	auditRename   = "rename"
+	auditMetadata = "metadata"
+	auditCopy     = "copy"
+)
+
+// Results of audited operations
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// Time limit for writing an audit entry
+const auditWriteTimeout = 5 * time.Second
+
+// Entry of the audit trail. Entries are only ever inserted, never updated or
+// deleted by the service.
+type auditEntry struct {
+	Id        primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Timestamp time.Time           `bson:"timestamp" json:"timestamp"`
+	Action    string              `bson:"action" json:"action"`
+	Result    string              `bson:"result" json:"result"`
+	Error     string              `bson:"error,omitempty" json:"error,omitempty"`
+	Actor     string              `bson:"actor" json:"actor"`
+	IP        string              `bson:"ip,omitempty" json:"ip,omitempty"`
+	Protocol  string              `bson:"protocol" json:"protocol"`
+	Tenant    string              `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	RequestId string              `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	Bucket    string              `bson:"bucket" json:"bucket"`
+	FileId    *primitive.ObjectID `bson:"fileId,omitempty" json:"fileId,omitempty"`
+	Filename  string              `bson:"filename,omitempty" json:"filename,omitempty"`
+}
+
+// Context key of the audit source of a request. Like the bucket it is kept
+// in the locals of REST and S3 requests, see bucketContextKey.
+type auditSourceKey struct{}
+
+// Who performed an audited operation, and from where
+type auditSource struct {
+	Actor     string
+	IP        string
+	Protocol  string
+	RequestId string
+}
+
+// Get context carrying the audit source of its operations
+// @param ctx context.Context
+// @param source auditSource
+// @return context.Context context
+func withAuditSource(ctx context.Context, source auditSource) context.Context {
+	return context.WithValue(ctx, auditSourceKey{}, source)
+}
+
+// Get audit source of ctx. gRPC calls are recognized by their peer, other
+// operations without a source are attributed to an unknown actor.
+// @param ctx context.Context
+// @return auditSource source
+func auditSourceFrom(ctx context.Context) auditSource {
+	if source, ok := ctx.Value(auditSourceKey{}).(auditSource); ok {
+		return source
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return auditSource{Actor: "anonymous", IP: p.Addr.String(), Protocol: "grpc"}
+	}
+	return auditSource{Actor: "unknown"}
+}
+
+// Check if request carries the admin token as bearer token
+// @param c *fiber.Ctx context
+// @return bool admin
+func isAdmin(c *fiber.Ctx) bool {
+	return isAdminToken(c.Get(fiber.HeaderAuthorization))
+}
+
+// Check if Authorization header value carries the admin token as bearer token
+// @param authorization string header value
+// @return bool admin
+func isAdminToken(authorization string) bool {
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	return found && config.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// Middleware attributing the operations of a request to its actor: the user
+// named by the AUDIT_ACTOR_HEADER of an authenticating proxy, "admin" for
+// requests with the admin token or "anonymous"
+// @param protocol string protocol recorded with the operations, e.g. http
+// @return fiber.Handler middleware
+func auditRequests(protocol string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		actor := "anonymous"
+		if config.AuditActorHeader != "" && c.Get(config.AuditActorHeader) != "" {
+			actor = c.Get(config.AuditActorHeader)
+		} else if isAdmin(c) {
+			actor = "admin"
+		}
+		requestId, _ := c.Locals(requestIDKey).(string)
+		c.Locals(auditSourceKey{}, auditSource{
+			Actor:     actor,
+			IP:        c.IP(),
+			Protocol:  protocol,
+			RequestId: requestId,
+		})
+		return c.Next()
+	}
+}
+
+// Register middleware attributing file operations to their actor, after the
+// request ID middleware
+// @param app *fiber.App app
+func registerAuditMiddleware(app *fiber.App) {
+	app.Use(auditRequests("http"))
+}
+
+// Open audit trail collection
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func auditCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(config.AuditCollection)
+}
+
+// Append operation on a file to the audit trail. Failing to write the entry
+// is logged, it does not fail the operation.
+// @param ctx context.Context context of the operation, carrying its source
+// @param action string audited operation, e.g. auditUpload
+// @param fileId primitive.ObjectID file id, zero if the file is unknown
+// @param filename string filename, may be empty
+// @param opErr error error of the operation, nil if it succeeded
+func recordAudit(ctx context.Context, action string, fileId primitive.ObjectID, filename string, opErr error) {
+	source := auditSourceFrom(ctx)
+	entry := auditEntry{
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+		Result:    auditSuccess,
+		Actor:     source.Actor,
+		IP:        source.IP,
+		Protocol:  source.Protocol,
+		RequestId: source.RequestId,
+		Bucket:    BucketFromContext(ctx),
+		Filename:  filename,
+	}
+	if t := tenantFromContext(ctx); t != nil {
+		entry.Tenant = t.Id
+	}
+	if !fileId.IsZero() {
+		entry.FileId = &fileId
+	}
+	if opErr != nil {
+		entry.Result = auditFailure
+		entry.Error = opErr.Error()
+	}
+
+	// Record the operation even if its request was canceled meanwhile
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if _, err := auditCollection(database()).InsertOne(writeCtx, entry); err != nil {
+		logger.Error("write audit entry", "action", action, "file_id", entry.FileId, "request_id", source.RequestId, "error", err)
+	}
+}
+
+// Build audit trail filter from query parameters
+// @param c *fiber.Ctx context
+// @return bson.M filter
+// @return error error
+func auditFilter(c *fiber.Ctx) (bson.M, error) {
+	filter := bson.M{}
+	if value := c.Query("fileId"); value != "" {
+		fileId, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid fileId")
+		}
+		filter["fileId"] = fileId
+	}
+	for _, param := range []string{"actor", "action", "result", "tenant"} {
+		if value := c.Query(param); value != "" {
+			filter[param] = value
+		}
+	}
+
+	timestamp := bson.M{}
+	for _, bound := range []struct{ param, operator string }{
+		{"since", "$gte"},
+		{"until", "$lt"},
+	} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+bound.param+", expected RFC 3339 timestamp")
+		}
+		timestamp[bound.operator] = t
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter, nil
+}
+
+// Register audit trail route on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerAuditRoutes(admin fiber.Router) {
+	// Query the audit trail, newest entries first
+	// @param fileId string
+	// @param actor string
+	// @param action string upload|download|delete|rename|metadata
+	// @param result string success|failure
+	// @param since string RFC 3339 timestamp
+	// @param until string RFC 3339 timestamp
+	// @param cursor string nextCursor of the previous page
+	// @param skip int
+	// @param limit int
+	// @return audit entries and cursor of the next page
+	admin.Get("/audit", func(c *fiber.Ctx) error {
+		filter, err := auditFilter(c)
+		if err != nil {
+			return err
+		}
+		v := &validation.Validator{}
+		skip, limit := pageParams(c, v)
+		var after auditEntry
+		if decodeCursor(v, c.Query("cursor"), &after.Timestamp, &after.Id) {
+			v.Check(skip == 0, validation.Query, "skip", "skip can't be combined with cursor")
+			filter["$and"] = bson.A{keysetFilter([]string{"timestamp", "_id"}, []interface{}{after.Timestamp, after.Id}, -1)}
+		}
+		if err := v.Err(); err != nil {
+			return err
+		}
+
+		// One more than the page tells if there is a next one
+		findOptions := options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(skip).
+			SetLimit(limit + 1)
+		cursor, err := auditCollection(database()).Find(c.Context(), filter, findOptions)
+		if err != nil {
+			return err
+		}
+		entries := []auditEntry{}
+		if err := cursor.All(c.Context(), &entries); err != nil {
+			return err
+		}
+		nextCursor := ""
+		if int64(len(entries)) > limit {
+			entries = entries[:limit]
+			last := entries[limit-1]
+			nextCursor = encodeCursor(last.Timestamp, last.Id)
+		}
+
+		return respondPage(c, "Audit entries fetched successfully", "entries", entries, nextCursor)
+	})
+}
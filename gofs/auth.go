@@ -0,0 +1,243 @@
+package gofs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Roles of the file service, each one includes the rights of the previous
+const (
+	roleReader   = "reader"
+	roleUploader = "uploader"
+	roleAdmin    = "admin"
+)
+
+// Rank of the roles, higher ranks include the rights of lower ones
+var roleRanks = map[string]int{
+	roleReader:   1,
+	roleUploader: 2,
+	roleAdmin:    3,
+}
+
+// Check if role is known
+// @param role string
+// @return bool valid
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Context key of the principal of a request. Like the bucket it is kept in
+// the locals of REST requests, see bucketContextKey.
+type principalKey struct{}
+
+// Who a request is authenticated as, and what it may do
+type principal struct {
+	// Actor recorded in the audit trail
+	Actor string
+	Role  string
+	// Tenant the credentials are bound to, empty if they are not
+	Tenant string
+	// False for anonymous requests
+	Authenticated bool
+}
+
+// Check if principal may use the routes of the service admin, which span
+// all tenants
+// @return bool admin
+func (p *principal) globalAdmin() bool {
+	return p.Authenticated && p.Role == roleAdmin && p.Tenant == ""
+}
+
+// Get principal of a request
+// @param ctx context.Context
+// @return *principal principal, nil before authentication
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// Check if the principal of a request has at least role
+// @param ctx context.Context
+// @param role string
+// @return error forbidden error if it has not
+func authorize(ctx context.Context, role string) error {
+	p := principalFromContext(ctx)
+	if p == nil || !hasRole(p.Role, role) {
+		return fiber.NewError(fiber.StatusForbidden, "Role "+role+" required")
+	}
+	return nil
+}
+
+// Check if role includes the rights of required
+// @param role string
+// @param required string
+// @return bool included
+func hasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// Route middleware admitting requests whose principal has at least role
+// @param role string
+// @return fiber.Handler middleware
+func requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := authorize(c.Context(), role); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// Get principal of a request from its credentials: those of a registered
+// Authenticator, the admin token, a tenant API key, a JWT or the ID token of
+// an OIDC login session. Requests without credentials get ANONYMOUS_ROLE.
+// @param c *fiber.Ctx context
+// @return *principal principal
+// @return error unauthorized error if the credentials are invalid
+func requestPrincipal(c *fiber.Ctx) (*principal, error) {
+	if p, err := pluggedPrincipal(c); p != nil || err != nil {
+		return p, err
+	}
+
+	authorization := c.Get(fiber.HeaderAuthorization)
+	// Responses depend on the credentials, shared caches must keep them apart
+	if c.Get(apiKeyHeader) != "" {
+		c.Vary(fiber.HeaderAuthorization, apiKeyHeader)
+	} else if strings.HasPrefix(authorization, "Bearer ") {
+		c.Vary(fiber.HeaderAuthorization)
+	}
+	p, err := credentialPrincipal(c.Context(), authorization, c.Get(apiKeyHeader))
+	if p == nil && err == nil {
+		// Expired sessions count as anonymous, the browser logs in again
+		if token := sessionToken(c); token != "" {
+			c.Vary(fiber.HeaderCookie)
+			if claims, err := verifyJWT(c.Context(), token); err == nil {
+				return tokenPrincipal(claims)
+			}
+		}
+		p, err = anonymousPrincipal()
+	}
+	return p, unauthorized(c, err)
+}
+
+// Get principal of the credentials of a REST request or gRPC call: the
+// admin token, a tenant API key or a JWT
+// @param ctx context.Context
+// @param authorization string Authorization value
+// @param apiKey string X-API-Key value
+// @return *principal principal, nil without credentials
+// @return error unauthorized error if the credentials are invalid
+func credentialPrincipal(ctx context.Context, authorization string, apiKey string) (*principal, error) {
+	if isAdminToken(authorization) {
+		return &principal{Actor: "admin", Role: roleAdmin, Authenticated: true}, nil
+	}
+
+	if key := credentialAPIKey(authorization, apiKey); key != "" {
+		if config.TenantMode == "" {
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid API key")
+		}
+		keyTenant, stored, err := findTenantByKey(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if keyTenant == nil {
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid API key")
+		}
+		return &principal{Actor: "apikey:" + stored.Id, Role: stored.role(), Tenant: keyTenant.Id, Authenticated: true}, nil
+	}
+
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found {
+		if config.JWTSecret == "" && config.OIDCIssuer == "" {
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+		}
+		claims, err := verifyJWT(ctx, token)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+		}
+		return tokenPrincipal(claims)
+	}
+	return nil, nil
+}
+
+// Get principal of requests without credentials, with ANONYMOUS_ROLE
+// @return *principal principal
+// @return error unauthorized error if ANONYMOUS_ROLE is none
+func anonymousPrincipal() (*principal, error) {
+	if config.AnonymousRole == "none" {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "Credentials required")
+	}
+	return &principal{Actor: "anonymous", Role: config.AnonymousRole}, nil
+}
+
+// Get principal of a verified token, mapping its claims to owner, role and
+// tenant
+// @param claims jwtClaims
+// @return *principal principal
+// @return error forbidden error if the token carries no known role
+func tokenPrincipal(claims jwtClaims) (*principal, error) {
+	p := &principal{Actor: claims.owner(), Role: claims.role(), Tenant: claims.tenant(), Authenticated: true}
+	if p.Role == "" {
+		return nil, fiber.NewError(fiber.StatusForbidden, "Token carries no known role")
+	}
+	return p, nil
+}
+
+// Ask for bearer credentials if err rejects a request as unauthorized
+// @param c *fiber.Ctx context
+// @param err error error rejecting the request, or nil
+// @return error err
+func unauthorized(c *fiber.Ctx, err error) error {
+	if errorStatus(err) == fiber.StatusUnauthorized {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="gofs"`)
+	}
+	return err
+}
+
+// Middleware authenticating requests, attributing their operations to the
+// principal unless a proxy named the user
+// @param c *fiber.Ctx context
+// @return error error
+func authenticateRequest(c *fiber.Ctx) error {
+	p, err := requestPrincipal(c)
+	if err != nil {
+		return err
+	}
+	c.Locals(principalKey{}, p)
+	if source, ok := c.Locals(auditSourceKey{}).(auditSource); ok && p.Authenticated && source.Actor == "anonymous" {
+		source.Actor = p.Actor
+		c.Locals(auditSourceKey{}, source)
+	}
+	return c.Next()
+}
+
+// Middleware enforcing the policy of file routes by method: readers may
+// only GET, uploaders may also change files, only admins may delete them.
+// Routes listing all files of a bucket require admins with requireRole.
+// @param c *fiber.Ctx context
+// @return error error
+func authorizeMethod(c *fiber.Ctx) error {
+	role := roleUploader
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		role = roleReader
+	case fiber.MethodDelete:
+		role = roleAdmin
+	}
+	if err := authorize(c.Context(), role); err != nil {
+		return err
+	}
+	return c.Next()
+}
+
+// Register middleware authenticating file service and admin requests and
+// enforcing the role policy of file routes. GraphQL operations are
+// authorized by their resolvers.
+// @param app *fiber.App app
+func registerAuthMiddleware(app *fiber.App) {
+	app.Use("/api", authenticateRequest, authorizeMethod)
+	app.Use("/graphql", authenticateRequest, requireRole(roleReader))
+	app.Use("/admin", authenticateRequest)
+}
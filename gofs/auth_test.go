@@ -0,0 +1,276 @@
+package gofs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	gofsv1 "github.com/roshanpaturkar/go-mongo-fs/api/gofs/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Admin token and JWT secret of the role tests
+const (
+	testAdminToken = "admin-token"
+	testJWTSecret  = "jwt-secret"
+)
+
+// Configure authentication for a test, restoring the configuration after it
+// @param t *testing.T
+// @param anonymousRole string ANONYMOUS_ROLE
+func setTestAuthConfig(t *testing.T, anonymousRole string) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = Config{
+		AdminToken:     testAdminToken,
+		JWTSecret:      testJWTSecret,
+		JWTRoleClaim:   "role",
+		JWTOwnerClaim:  "sub",
+		JWTTenantClaim: "tenant",
+		AnonymousRole:  anonymousRole,
+	}
+}
+
+// Sign JWT for a role, optionally bound to a tenant
+// @param t *testing.T
+// @param role string
+// @param tenant string empty for tokens not bound to a tenant
+// @return string Authorization value
+func testRoleToken(t *testing.T, role, tenant string) string {
+	t.Helper()
+	claims := map[string]interface{}{"sub": "alice", "role": role, "exp": time.Now().Add(time.Hour).Unix()}
+	if tenant != "" {
+		claims["tenant"] = tenant
+	}
+	return "Bearer " + signTestJWT(t, "HS256", testJWTSecret, claims)
+}
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role, required string
+		want           bool
+	}{
+		{roleReader, roleReader, true},
+		{roleReader, roleUploader, false},
+		{roleReader, roleAdmin, false},
+		{roleUploader, roleReader, true},
+		{roleUploader, roleUploader, true},
+		{roleUploader, roleAdmin, false},
+		{roleAdmin, roleReader, true},
+		{roleAdmin, roleUploader, true},
+		{roleAdmin, roleAdmin, true},
+		{"", roleReader, false},
+		{"none", roleReader, false},
+		{"superuser", roleReader, false},
+	}
+	for _, test := range tests {
+		if got := hasRole(test.role, test.required); got != test.want {
+			t.Errorf("hasRole(%q, %q) = %v, want %v", test.role, test.required, got, test.want)
+		}
+	}
+}
+
+func TestAnonymousRoleDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"no credentials", nil, roleReader},
+		{"admin token", map[string]string{"ADMIN_TOKEN": "secret"}, "none"},
+		{"JWT secret", map[string]string{"JWT_SECRET": "secret"}, "none"},
+		{"OIDC issuer", map[string]string{"OIDC_ISSUER": "https://issuer.example"}, "none"},
+		{"tenant mode", map[string]string{"TENANT_MODE": "header"}, "none"},
+		{"explicit", map[string]string{"ADMIN_TOKEN": "secret", "ANONYMOUS_ROLE": roleAdmin}, roleAdmin},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"MONGODB_SRV_RECORD": "mongodb://localhost:27017"}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			cfg, err := LoadConfigFrom(func(key string) (string, bool) {
+				value, ok := env[key]
+				return value, ok
+			})
+			if err != nil {
+				t.Fatalf("LoadConfigFrom() error = %v", err)
+			}
+			if cfg.AnonymousRole != test.want {
+				t.Errorf("AnonymousRole = %q, want %q", cfg.AnonymousRole, test.want)
+			}
+		})
+	}
+
+	_, err := LoadConfigFrom(func(key string) (string, bool) {
+		value, ok := map[string]string{"MONGODB_SRV_RECORD": "mongodb://localhost:27017", "ANONYMOUS_ROLE": "root"}[key]
+		return value, ok
+	})
+	if err == nil {
+		t.Error("LoadConfigFrom() accepted ANONYMOUS_ROLE root")
+	}
+}
+
+func TestRouteRoles(t *testing.T) {
+	tests := []struct {
+		name          string
+		anonymousRole string
+		authorization string
+		method        string
+		path          string
+		want          int
+	}{
+		// Files routes by method
+		{"anonymous reader reads", roleReader, "", fiber.MethodGet, "/api/image/a", fiber.StatusOK},
+		{"anonymous reader uploads", roleReader, "", fiber.MethodPost, "/api/image", fiber.StatusForbidden},
+		{"anonymous none reads", "none", "", fiber.MethodGet, "/api/image/a", fiber.StatusUnauthorized},
+		{"reader uploads", "none", "reader", fiber.MethodPost, "/api/image", fiber.StatusForbidden},
+		{"uploader uploads", "none", "uploader", fiber.MethodPost, "/api/image", fiber.StatusOK},
+		{"uploader renames", "none", "uploader", fiber.MethodPatch, "/api/image/a", fiber.StatusOK},
+		{"uploader deletes", "none", "uploader", fiber.MethodDelete, "/api/image/a", fiber.StatusForbidden},
+		{"admin deletes", "none", "admin", fiber.MethodDelete, "/api/image/a", fiber.StatusOK},
+		{"admin token deletes", "none", "token", fiber.MethodDelete, "/api/image/a", fiber.StatusOK},
+		{"invalid token", roleAdmin, "Bearer invalid", fiber.MethodGet, "/api/image/a", fiber.StatusUnauthorized},
+		{"wrong admin token", roleAdmin, "Bearer " + testAdminToken + "x", fiber.MethodGet, "/api/image/a", fiber.StatusUnauthorized},
+		// Routes requiring a role
+		{"reader moves", "none", "reader", fiber.MethodPost, "/api/image/a/move", fiber.StatusForbidden},
+		{"uploader moves", "none", "uploader", fiber.MethodPost, "/api/image/a/move", fiber.StatusForbidden},
+		{"admin moves", "none", "admin", fiber.MethodPost, "/api/image/a/move", fiber.StatusOK},
+		// Admin routes
+		{"admin JWT on admin route", "none", "admin", fiber.MethodGet, "/admin/debug/runtime", fiber.StatusOK},
+		{"admin token on admin route", "none", "token", fiber.MethodGet, "/admin/debug/runtime", fiber.StatusOK},
+		{"tenant admin on admin route", "none", "tenant-admin", fiber.MethodGet, "/admin/debug/runtime", fiber.StatusForbidden},
+		{"uploader on admin route", "none", "uploader", fiber.MethodGet, "/admin/debug/runtime", fiber.StatusForbidden},
+		{"anonymous admin on admin route", roleAdmin, "", fiber.MethodGet, "/admin/debug/runtime", fiber.StatusUnauthorized},
+		{"admin JWT on stats", "none", "admin", fiber.MethodGet, "/api/admin/stats", fiber.StatusOK},
+		{"anonymous admin on stats", roleAdmin, "", fiber.MethodGet, "/api/admin/stats", fiber.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestAuthConfig(t, test.anonymousRole)
+			app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+			registerAuthMiddleware(app)
+			ok := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+			app.Post("/api/image/:id/move", requireRole(roleAdmin), ok)
+			app.Get("/api/admin/stats", requireAdmin, ok)
+			app.Group("/admin", requireAdmin).Get("/debug/runtime", ok)
+			app.All("/api/image/*", ok)
+			app.Post("/api/image", ok)
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+			switch test.authorization {
+			case "":
+			case "token":
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer "+testAdminToken)
+			case "tenant-admin":
+				req.Header.Set(fiber.HeaderAuthorization, testRoleToken(t, roleAdmin, "acme"))
+			case roleReader, roleUploader, roleAdmin:
+				req.Header.Set(fiber.HeaderAuthorization, testRoleToken(t, test.authorization, ""))
+			default:
+				req.Header.Set(fiber.HeaderAuthorization, test.authorization)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.want)
+			}
+			if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get(fiber.HeaderWWWAuthenticate) == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestGRPCAuthorize(t *testing.T) {
+	tests := []struct {
+		name          string
+		anonymousRole string
+		authorization string
+		method        string
+		want          codes.Code
+	}{
+		{"anonymous reader downloads", roleReader, "", gofsv1.FileService_Download_FullMethodName, codes.OK},
+		{"anonymous reader uploads", roleReader, "", gofsv1.FileService_Upload_FullMethodName, codes.PermissionDenied},
+		{"anonymous none downloads", "none", "", gofsv1.FileService_Download_FullMethodName, codes.Unauthenticated},
+		{"uploader uploads", "none", "uploader", gofsv1.FileService_Upload_FullMethodName, codes.OK},
+		{"uploader lists", "none", "uploader", gofsv1.FileService_List_FullMethodName, codes.PermissionDenied},
+		{"uploader deletes", "none", "uploader", gofsv1.FileService_Delete_FullMethodName, codes.PermissionDenied},
+		{"admin deletes", "none", "admin", gofsv1.FileService_Delete_FullMethodName, codes.OK},
+		{"admin token lists", "none", "token", gofsv1.FileService_List_FullMethodName, codes.OK},
+		{"unknown method", "none", "uploader", "/gofs.v1.FileService/Purge", codes.PermissionDenied},
+		{"invalid token", roleAdmin, "Bearer invalid", gofsv1.FileService_Download_FullMethodName, codes.Unauthenticated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestAuthConfig(t, test.anonymousRole)
+			authorization := test.authorization
+			switch authorization {
+			case "token":
+				authorization = "Bearer " + testAdminToken
+			case roleReader, roleUploader, roleAdmin:
+				authorization = testRoleToken(t, authorization, "")
+			}
+			ctx := context.Background()
+			if authorization != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", authorization))
+			}
+			_, err := grpcAuthorize(ctx, test.method)
+			if got := status.Code(err); got != test.want {
+				t.Errorf("grpcAuthorize() code = %v, want %v (%v)", got, test.want, err)
+			}
+		})
+	}
+}
+
+func TestGatewayRoles(t *testing.T) {
+	webdavTests := []struct {
+		method, depth string
+		want          string
+	}{
+		{http.MethodGet, "", roleReader},
+		{"PROPFIND", "0", roleReader},
+		{"PROPFIND", "1", roleAdmin},
+		{"PROPFIND", "infinity", roleAdmin},
+		{http.MethodPut, "", roleUploader},
+		{"MOVE", "", roleUploader},
+		{"MKCOL", "", roleUploader},
+		{http.MethodDelete, "", roleAdmin},
+	}
+	for _, test := range webdavTests {
+		req := httptest.NewRequest(test.method, "/a.png", nil)
+		if test.depth != "" {
+			req.Header.Set("Depth", test.depth)
+		}
+		if got := webdavRole(req); got != test.want {
+			t.Errorf("webdavRole(%s, Depth %q) = %q, want %q", test.method, test.depth, got, test.want)
+		}
+	}
+
+	sftpTests := []struct {
+		sessionRole, required string
+		want                  error
+	}{
+		{roleReader, roleReader, nil},
+		{roleReader, roleUploader, os.ErrPermission},
+		{roleUploader, roleUploader, nil},
+		{roleUploader, roleAdmin, os.ErrPermission},
+		{roleAdmin, roleAdmin, nil},
+	}
+	saved := config
+	t.Cleanup(func() { config = saved })
+	for _, test := range sftpTests {
+		config = Config{SFTPRole: test.sessionRole}
+		if got := sftpAuthorize(test.required); got != test.want {
+			t.Errorf("sftpAuthorize(%q) with SFTP_ROLE %q = %v, want %v", test.required, test.sessionRole, got, test.want)
+		}
+	}
+}
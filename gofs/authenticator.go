@@ -0,0 +1,71 @@
+package gofs
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Authentication plugged in by embedders, e.g. session cookies, custom
+// headers or an internal SSO, asked before the built-in admin token, API
+// keys and JWTs of REST, GraphQL and admin requests
+type Authenticator interface {
+	// Authenticate request. Requests without credentials of the
+	// authenticator get nil and no error, so the next authenticator and then
+	// the built-in ones are asked. Errors reject the request, with the status
+	// of a *fiber.Error, e.g. fiber.NewError(fiber.StatusUnauthorized, "..."),
+	// or 500 for other errors. Authenticators reading credentials from
+	// headers other than Authorization have to add them to Vary.
+	Authenticate(c *fiber.Ctx) (*Identity, error)
+}
+
+// Function used as Authenticator
+type AuthenticatorFunc func(c *fiber.Ctx) (*Identity, error)
+
+// Authenticate request by calling f
+// @param c *fiber.Ctx context
+// @return *Identity identity, nil without credentials
+// @return error error rejecting the request
+func (f AuthenticatorFunc) Authenticate(c *fiber.Ctx) (*Identity, error) {
+	return f(c)
+}
+
+// Who an Authenticator authenticated a request as
+type Identity struct {
+	// Actor recorded in the audit trail, e.g. a user name
+	Actor string
+	// Role: reader, uploader or admin
+	Role string
+	// Tenant the identity is bound to, empty for admins of all tenants
+	Tenant string
+}
+
+// Authenticators in registration order
+var authenticators []Authenticator
+
+// Register authenticator asked for the principal of REST, GraphQL and admin
+// requests, after the ones registered before. Must be called before the
+// routes are registered.
+// @param authenticator Authenticator
+func RegisterAuthenticator(authenticator Authenticator) {
+	authenticators = append(authenticators, authenticator)
+}
+
+// Get principal of a request from the registered authenticators
+// @param c *fiber.Ctx context
+// @return *principal principal, nil if no authenticator knows the request
+// @return error error rejecting the request
+func pluggedPrincipal(c *fiber.Ctx) (*principal, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(c)
+		if err != nil {
+			return nil, err
+		}
+		if identity == nil {
+			continue
+		}
+		if !validRole(identity.Role) {
+			return nil, fiber.NewError(fiber.StatusForbidden, "Identity carries no known role")
+		}
+		return &principal{Actor: identity.Actor, Role: identity.Role, Tenant: identity.Tenant, Authenticated: true}, nil
+	}
+	return nil, nil
+}
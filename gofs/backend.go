@@ -0,0 +1,189 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Error returned by storage backends for unknown or expired files
+var ErrFileNotFound = errors.New("file not found")
+
+// Backend storing file content together with its description. Files are
+// described by documents with the fields of GridFS files documents (_id,
+// filename, length, uploadDate and metadata), so handlers work the same on
+// every backend. Requests to named buckets carry the bucket in ctx, see
+// BucketFromContext. Versions, folders and the protocol gateways query the
+// GridFS files collection directly and need the gridfs backend.
+type Storage interface {
+	// Store content under filename, returning the new file id and size
+	Put(ctx context.Context, filename string, content io.Reader, metadata bson.M) (primitive.ObjectID, int64, error)
+	// Open content of a file
+	Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error)
+	// Get document describing a file
+	Stat(ctx context.Context, id primitive.ObjectID) (bson.M, error)
+	// Delete file and its content
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// List documents of files matching filter in its sort order, newest
+	// first by default, after filter.After
+	List(ctx context.Context, filter FileFilter, skip, limit int64) ([]bson.M, error)
+}
+
+// Storage backends by name, selected with STORAGE_BACKEND
+var storageBackends = map[string]Storage{
+	"gridfs": gridfsStorage{},
+}
+
+// Register storage backend under name so it can be selected in the
+// configuration. Must be called before the configuration is loaded.
+// @param name string
+// @param storage Storage backend
+func RegisterStorageBackend(name string, storage Storage) {
+	storageBackends[name] = storage
+}
+
+// Get names of registered storage backends
+// @return []string names
+func storageBackendNames() []string {
+	names := make([]string, 0, len(storageBackends))
+	for name := range storageBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get configured storage backend
+// @return Storage backend
+func fileStorage() Storage {
+	return storageBackends[config.StorageBackend]
+}
+
+// Default backend storing files in the GridFS bucket of the request
+type gridfsStorage struct{}
+
+// Stream content into the bucket
+// @param ctx context.Context
+// @param filename string
+// @param content io.Reader
+// @param metadata bson.M
+// @return primitive.ObjectID file id
+// @return int64 file size
+// @return error error
+func (gridfsStorage) Put(ctx context.Context, filename string, content io.Reader, metadata bson.M) (primitive.ObjectID, int64, error) {
+	bucket, err := requestBucket(ctx, requestDatabase(ctx))
+	if err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+	return storeReader(bucket, filename, content, metadata)
+}
+
+// Open download stream of a file. Files of at least
+// DOWNLOAD_PARALLEL_MIN_BYTES are fetched with concurrent chunk queries if
+// DOWNLOAD_PARALLELISM is above 1.
+// @param ctx context.Context
+// @param id primitive.ObjectID file id
+// @return io.ReadCloser content
+// @return error error
+func (gridfsStorage) Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	bucket, err := requestBucket(ctx, readDatabase(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if config.DownloadParallelism > 1 {
+		var fileDoc bson.M
+		err = withRetry(ctx, func() error {
+			findOptions := options.FindOne().SetProjection(bson.M{"length": 1, "chunkSize": 1})
+			return bucket.GetFilesCollection().FindOne(ctx, bson.M{"_id": id}, findOptions).Decode(&fileDoc)
+		})
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrFileNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fileLength(fileDoc) >= config.ParallelDownloadMinBytes {
+			return newChunkPrefetcher(ctx, bucket.GetChunksCollection(), fileDoc, config.DownloadParallelism), nil
+		}
+	}
+	var stream *gridfs.DownloadStream
+	err = withRetry(ctx, func() error {
+		var openErr error
+		stream, openErr = bucket.OpenDownloadStream(id)
+		return openErr
+	})
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrFileNotFound
+	}
+	return stream, err
+}
+
+// Get files document of a file which has not expired
+// @param ctx context.Context
+// @param id primitive.ObjectID file id
+// @return bson.M files document
+// @return error error
+func (gridfsStorage) Stat(ctx context.Context, id primitive.ObjectID) (bson.M, error) {
+	var fileDoc bson.M
+	err := withRetry(ctx, func() error {
+		return requestFilesCollection(ctx, readDatabase(ctx)).FindOne(ctx, activeFilter(bson.M{"_id": id})).Decode(&fileDoc)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrFileNotFound
+	}
+	return fileDoc, err
+}
+
+// Delete file and its chunks
+// @param ctx context.Context
+// @param id primitive.ObjectID file id
+// @return error error
+func (gridfsStorage) Delete(ctx context.Context, id primitive.ObjectID) error {
+	bucket, err := requestBucket(ctx, requestDatabase(ctx))
+	if err != nil {
+		return err
+	}
+	err = bucket.DeleteContext(ctx, id)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return ErrFileNotFound
+	}
+	return err
+}
+
+// List files documents matching filter in its sort order
+// @param ctx context.Context
+// @param filter FileFilter
+// @param skip int64
+// @param limit int64
+// @return []bson.M files documents
+// @return error error
+func (gridfsStorage) List(ctx context.Context, filter FileFilter, skip, limit int64) ([]bson.M, error) {
+	query, err := filter.bson()
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.Find().
+		SetSort(filter.sort()).
+		SetSkip(skip).
+		SetLimit(limit)
+	if filter.Projection != nil {
+		findOptions.SetProjection(filter.Projection)
+	}
+	var fileDocs []bson.M
+	err = withRetry(ctx, func() error {
+		cursor, err := requestFilesCollection(ctx, readDatabase(ctx)).Find(ctx, query, findOptions)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &fileDocs)
+	})
+	return fileDocs, err
+}
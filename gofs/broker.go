@@ -0,0 +1,328 @@
+package gofs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection storing change stream resume tokens
+const eventOffsetsCollection = "event_offsets"
+
+// Delay before watching the change stream again after an error
+const changeStreamRetryDelay = 5 * time.Second
+
+// Message broker receiving file events
+type eventBroker interface {
+	// Publish event payload
+	Publish(ctx context.Context, eventType string, payload []byte) error
+}
+
+// Create broker selected in configuration
+// @return eventBroker broker, nil if publishing is disabled
+func newEventBroker() eventBroker {
+	switch config.EventBroker {
+	case "nats":
+		return &natsBroker{address: config.NatsURL, subject: config.NatsSubject}
+	case "kafka":
+		return &kafkaRestBroker{url: config.KafkaRestURL, topic: config.KafkaTopic}
+	}
+	return nil
+}
+
+// Publisher speaking the NATS client protocol
+type natsBroker struct {
+	address string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Connect to NATS server, called with b.mu held. A reader goroutine answers
+// server PINGs and drops the connection on errors so the next publish
+// reconnects.
+// @return net.Conn connection
+// @return error error
+func (b *natsBroker) connect() (net.Conn, error) {
+	server, err := url.Parse(b.address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", server.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected nats greeting: %q %v", line, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "go-mongo-fs"}
+	if user := server.User; user != nil {
+		connect["user"] = user.Username()
+		connect["pass"], _ = user.Password()
+	}
+	options, _ := json.Marshal(connect)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				b.drop(conn)
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				b.mu.Lock()
+				conn.Write([]byte("PONG\r\n"))
+				b.mu.Unlock()
+			case strings.HasPrefix(line, "-ERR"):
+				logger.Error("nats error", "error", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+// Close connection if it is still the current one
+// @param conn net.Conn
+func (b *natsBroker) drop(conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn.Close()
+	if b.conn == conn {
+		b.conn = nil
+	}
+}
+
+// Publish event to subject <subject>.<event type>
+// @param ctx context.Context
+// @param eventType string
+// @param payload []byte
+// @return error error
+func (b *natsBroker) Publish(ctx context.Context, eventType string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn, err := b.connect()
+		if err != nil {
+			return err
+		}
+		b.conn = conn
+	}
+
+	message := fmt.Sprintf("PUB %s.%s %d\r\n%s\r\n", b.subject, eventType, len(payload), payload)
+	if _, err := b.conn.Write([]byte(message)); err != nil {
+		b.conn.Close()
+		b.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Publisher producing records through the Kafka REST Proxy API
+type kafkaRestBroker struct {
+	url   string
+	topic string
+}
+
+// Produce event as JSON record keyed by event type
+// @param ctx context.Context
+// @param eventType string
+// @param payload []byte
+// @return error error
+func (b *kafkaRestBroker) Publish(ctx context.Context, eventType string, payload []byte) error {
+	body, err := json.Marshal(fiber.Map{
+		"records": []fiber.Map{{"key": eventType, "value": json.RawMessage(payload)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(b.url, "/")+"/topics/"+url.PathEscape(b.topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, "application/vnd.kafka.json.v2+json")
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("kafka rest proxy responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Change of a files collection as delivered by the change stream
+type fileChange struct {
+	OperationType string `bson:"operationType"`
+	Namespace     struct {
+		Database   string `bson:"db"`
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey  bson.M `bson:"documentKey"`
+	FullDocument bson.M `bson:"fullDocument"`
+}
+
+// Find tenant owning a database, for events of the deployment wide stream
+// @param ctx context.Context
+// @param name string database name
+// @return *tenant tenant, nil for the default database
+// @return bool false if the database belongs to no enabled tenant
+// @return error error
+func tenantOfDatabase(ctx context.Context, name string) (*tenant, bool, error) {
+	if name == config.DatabaseName {
+		return nil, true, nil
+	}
+	if config.TenantMode == "" {
+		return nil, false, nil
+	}
+	var found tenant
+	err := tenantCollection(database()).FindOne(ctx, bson.M{"database": name, "disabled": bson.M{"$ne": true}}).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &found, true, nil
+}
+
+// Watch the files collections of all buckets once, publishing create and
+// delete events until the stream fails. Without tenants the default database
+// is watched, with tenants the whole deployment since every tenant has its
+// own database. The resume token is stored after every published event so a
+// restart continues where it stopped.
+// @param ctx context.Context
+// @param db *mongo.Database default database
+// @param broker eventBroker
+// @return error error
+func watchFileChanges(ctx context.Context, db *mongo.Database, broker eventBroker) error {
+	offsets := db.Collection(eventOffsetsCollection)
+	streamName := "database.files"
+	if config.TenantMode != "" {
+		streamName = "deployment.files"
+	}
+
+	streamOptions := options.ChangeStream()
+	var offset struct {
+		Token bson.Raw `bson:"token"`
+	}
+	if err := offsets.FindOne(ctx, bson.M{"_id": streamName}).Decode(&offset); err == nil {
+		streamOptions.SetResumeAfter(offset.Token)
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "delete"}},
+		"ns.coll":       primitive.Regex{Pattern: `\.files$`},
+	}}}}
+	var stream *mongo.ChangeStream
+	var err error
+	if config.TenantMode != "" {
+		stream, err = db.Client().Watch(ctx, pipeline, streamOptions)
+	} else {
+		stream, err = db.Watch(ctx, pipeline, streamOptions)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(ctx)
+
+	// Tenants by database, looked up once per stream
+	tenants := map[string]*tenant{}
+	for stream.Next(ctx) {
+		var change fileChange
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+
+		t, owned := tenants[change.Namespace.Database]
+		if !owned {
+			if t, owned, err = tenantOfDatabase(ctx, change.Namespace.Database); err != nil {
+				return err
+			}
+			if owned {
+				tenants[change.Namespace.Database] = t
+			}
+		}
+		if owned {
+			var tenantId interface{}
+			if t != nil {
+				tenantId = t.Id
+			}
+			bucket := strings.TrimSuffix(change.Namespace.Collection, ".files")
+
+			eventType, data := eventFileDeleted, fiber.Map{"id": change.DocumentKey["_id"]}
+			if change.OperationType == "insert" {
+				eventType, data = eventFileUploaded, fileInfo(change.FullDocument)
+			}
+			data["bucket"], data["tenant"] = bucket, tenantId
+			payload, err := json.Marshal(fileEvent{Id: newEventId(), Type: eventType, Timestamp: time.Now().UTC(), Data: data})
+			if err != nil {
+				return err
+			}
+			if err := broker.Publish(ctx, eventType, payload); err != nil {
+				return err
+			}
+		}
+
+		if _, err := offsets.UpdateOne(ctx, bson.M{"_id": streamName}, bson.M{"$set": bson.M{"token": stream.ResumeToken()}}, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
+
+// Publish file changes to the configured message broker in the background
+func startChangeStreamPublisher() {
+	broker := newEventBroker()
+	if broker == nil {
+		return
+	}
+	db := database()
+	ctx, cancel := context.WithCancel(context.Background())
+	onShutdown(func(context.Context) {
+		cancel()
+	})
+
+	go func() {
+		for {
+			if err := watchFileChanges(ctx, db, broker); err != nil && ctx.Err() == nil {
+				logger.Error("file change stream failed", "error", err)
+			}
+			select {
+			case <-time.After(changeStreamRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package gofs
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Context key of the GridFS bucket a request works on. Fiber keeps locals as
+// values of the request context, so handlers pass the bucket on to storage
+// helpers with c.Context().
+type bucketContextKey struct{}
+
+// Get GridFS bucket a request works on, the default bucket unless the request
+// came through /api/:bucket/file. Storage backends use it to keep the files of
+// named buckets apart.
+// @param ctx context.Context
+// @return string bucket name
+func BucketFromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(bucketContextKey{}).(string); ok {
+		return name
+	}
+	return config.BucketName
+}
+
+// Get context working on the given GridFS bucket
+// @param ctx context.Context
+// @param name string bucket name
+// @return context.Context context
+func withBucket(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, bucketContextKey{}, name)
+}
+
+// Get buckets maintained in the background: the default bucket and all
+// configured ones
+// @return []string bucket names
+func managedBuckets() []string {
+	buckets := []string{config.BucketName}
+	for _, bucket := range config.Buckets {
+		if bucket != config.BucketName {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// Check if bucket is maintained in the background, see managedBuckets
+// @param name string bucket name
+// @return bool managed
+func managedBucket(name string) bool {
+	for _, bucket := range managedBuckets() {
+		if bucket == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Select bucket given in the request params for the following handlers,
+// rejecting buckets which are not configured
+// @param c *fiber.Ctx context
+// @return error error
+func selectBucket(c *fiber.Ctx) error {
+	name := c.Params("bucket")
+	if !allowedBucket(name) {
+		return newError(fiber.StatusNotFound, CodeBucketNotFound, "Unknown bucket "+name)
+	}
+	c.Locals(bucketContextKey{}, name)
+	return c.Next()
+}
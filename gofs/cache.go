@@ -0,0 +1,222 @@
+package gofs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long files documents are kept in the in-memory cache. Changes made
+// through this instance invalidate them at once, the expiry bounds how long
+// changes made elsewhere, e.g. by the CLI, go unnoticed.
+const fileDocCacheTTL = 30 * time.Second
+
+var (
+	// Redis cache of small file contents, nil if caching is disabled
+	redisCache     *redisClient
+	redisCacheOnce sync.Once
+
+	// In-memory cache of file contents and files documents, nil if disabled
+	memoryCache     *lruCache
+	memoryCacheOnce sync.Once
+
+	// Generation of the cached files documents of each bucket, bumped when
+	// files of the bucket change so the cached documents are no longer found
+	fileDocGenerations sync.Map
+)
+
+// Get Redis cache of file contents, created on first use
+// @return *redisClient cache, nil if CACHE_REDIS_URL is not set or invalid
+func contentCache() *redisClient {
+	redisCacheOnce.Do(func() {
+		if config.CacheRedisURL == "" {
+			return
+		}
+		// Validated when the configuration is loaded
+		client, err := newRedisClient(config.CacheRedisURL)
+		if err != nil {
+			logger.Error("content cache disabled", "key", "CACHE_REDIS_URL", "error", err)
+			return
+		}
+		redisCache = client
+	})
+	return redisCache
+}
+
+// Get in-memory cache, created on first use
+// @return *lruCache cache, nil if MEMORY_CACHE_BYTES is not set
+func localCache() *lruCache {
+	memoryCacheOnce.Do(func() {
+		if config.MemoryCacheBytes > 0 {
+			memoryCache = newLRUCache(config.MemoryCacheBytes, config.MemoryCacheMaxItem)
+		}
+	})
+	return memoryCache
+}
+
+// Get cache key of file content. Content never changes under a file id,
+// replacing a file uploads a new one.
+// @param ctx context.Context context carrying the tenant
+// @param bucket string bucket name
+// @param id primitive.ObjectID file id
+// @return string key
+func contentCacheKey(ctx context.Context, bucket string, id primitive.ObjectID) string {
+	return "gofs:content:" + databaseName(ctx) + ":" + bucket + ":" + id.Hex()
+}
+
+// Check if the content of a file is small enough for the in-memory cache or
+// Redis
+// @param fileDoc bson.M files document
+// @return bool cacheable
+func contentCacheable(fileDoc bson.M) bool {
+	size := fileLength(fileDoc)
+	if local := localCache(); local != nil && local.fits(size) {
+		return true
+	}
+	return contentCache() != nil && size <= config.CacheMaxBytes
+}
+
+// Read content of a file, from the in-memory cache or Redis if it is small
+// enough to be cached. Content read from Redis or the storage backend is
+// cached on the way. The cache failing only costs the read from the storage
+// backend.
+// @param ctx context.Context context carrying the bucket
+// @param fileDoc bson.M files document
+// @return []byte content
+// @return bool content came from the cache
+// @return error error
+func readFileContent(ctx context.Context, fileDoc bson.M) ([]byte, bool, error) {
+	id := fileDoc["_id"].(primitive.ObjectID)
+	cache := contentCache()
+	cacheable := cache != nil && fileLength(fileDoc) <= config.CacheMaxBytes
+	key := contentCacheKey(ctx, BucketFromContext(ctx), id)
+
+	local := localCache()
+	if local != nil {
+		if content, ok := local.Get(key); ok {
+			return content.([]byte), true, nil
+		}
+	}
+
+	if cacheable {
+		content, err := cache.Get(ctx, key)
+		if err != nil {
+			logger.Warn("read content cache", "file_id", id, "error", err)
+		} else if content != nil {
+			if local != nil {
+				local.Set(key, content, int64(len(content)), 0)
+			}
+			return content, true, nil
+		}
+	}
+
+	stream, err := fileStorage().Get(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	defer stream.Close()
+	reader, done := startTransfer(stream)
+	defer done()
+	var buffer bytes.Buffer
+	if _, err := io.Copy(&buffer, reader); err != nil {
+		return nil, false, err
+	}
+
+	if local != nil {
+		local.Set(key, buffer.Bytes(), int64(buffer.Len()), 0)
+	}
+	if cacheable {
+		if err := cache.Set(ctx, key, buffer.Bytes(), config.CacheTTL); err != nil {
+			logger.Warn("write content cache", "file_id", id, "error", err)
+		}
+	}
+	return buffer.Bytes(), false, nil
+}
+
+// Remove content of deleted files from the caches and invalidate the cached
+// files documents of the bucket. Cached content of deleted files is never
+// served, as files are looked up before their content, it is only removed
+// to free the memory early.
+// @param ctx context.Context
+// @param bucket string bucket name
+// @param ids ...primitive.ObjectID file ids
+func uncacheFiles(ctx context.Context, bucket string, ids ...primitive.ObjectID) {
+	if len(ids) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, contentCacheKey(ctx, bucket, id))
+	}
+	if local := localCache(); local != nil {
+		local.Delete(keys...)
+	}
+	forgetFileDocs(bucket)
+
+	cache := contentCache()
+	if cache == nil {
+		return
+	}
+	if err := cache.Del(context.WithoutCancel(ctx), keys...); err != nil {
+		logger.Warn("invalidate content cache", "bucket", bucket, "files", len(ids), "error", err)
+	}
+}
+
+// Invalidate the cached files documents of a bucket, called when files of
+// the bucket are uploaded, changed or deleted. Lookups by name depend on the
+// other revisions too, so the whole bucket is invalidated.
+// @param bucket string bucket name
+func forgetFileDocs(bucket string) {
+	if localCache() == nil {
+		return
+	}
+	generation, _ := fileDocGenerations.LoadOrStore(bucket, new(atomic.Int64))
+	generation.(*atomic.Int64).Add(1)
+}
+
+// Look up files document through the in-memory cache. Only found documents
+// are cached, the cached document is shared and must not be modified.
+// @param ctx context.Context context carrying the tenant and bucket
+// @param lookup string key of the lookup, e.g. id:<hex> or name:<filename>
+// @param find func() (bson.M, error) lookup on a cache miss
+// @return bson.M files document
+// @return error error
+func cachedFileDoc(ctx context.Context, lookup string, find func() (bson.M, error)) (bson.M, error) {
+	local := localCache()
+	if local == nil {
+		return find()
+	}
+	bucket := BucketFromContext(ctx)
+	generation, _ := fileDocGenerations.LoadOrStore(bucket, new(atomic.Int64))
+	key := "files:" + databaseName(ctx) + ":" + bucket + ":" + strconv.FormatInt(generation.(*atomic.Int64).Load(), 10) + ":" + lookup
+	if fileDoc, ok := local.Get(key); ok {
+		return fileDoc.(bson.M), nil
+	}
+
+	fileDoc, err := find()
+	if err != nil {
+		return nil, err
+	}
+	if raw, err := bson.Marshal(fileDoc); err == nil {
+		local.Set(key, fileDoc, int64(len(raw)), fileDocCacheTTL)
+	}
+	return fileDoc, nil
+}
+
+// Get statistics of the in-memory cache
+// @return fiber.Map stats, nil if the cache is disabled
+func memoryCacheStats() fiber.Map {
+	local := localCache()
+	if local == nil {
+		return nil
+	}
+	return local.Stats()
+}
@@ -0,0 +1,182 @@
+package gofs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Visibility of files, set by clients in the metadata field visibility
+const (
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+)
+
+// Base URLs of the CDN purge APIs
+const (
+	fastlyAPI     = "https://api.fastly.com"
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+)
+
+// Number of attempts of a CDN purge, and delay before the first retry,
+// doubled on every further attempt
+const (
+	cdnPurgeAttempts   = 3
+	cdnPurgeRetryDelay = time.Second
+)
+
+// HTTP client used for CDN purge calls
+var cdnClient = &http.Client{Timeout: 10 * time.Second}
+
+// Get visibility stored in files document metadata
+// @param fileDoc bson.M files document
+// @return string visibility, public by default
+func fileVisibility(fileDoc bson.M) string {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	if visibility, _ := metadata["visibility"].(string); visibility == visibilityPrivate {
+		return visibilityPrivate
+	}
+	return visibilityPublic
+}
+
+// Get Cache-Control header of a file download. Private files get
+// CACHE_CONTROL_PRIVATE, public ones the header configured for their bucket.
+// @param bucket string bucket name
+// @param fileDoc bson.M files document
+// @return string header value
+func cacheControl(bucket string, fileDoc bson.M) string {
+	if fileVisibility(fileDoc) == visibilityPrivate {
+		return config.PrivateCaching
+	}
+	if value, ok := config.BucketCacheControl[bucket]; ok {
+		return value
+	}
+	return config.CacheControl
+}
+
+// Get surrogate key of all files of a bucket
+// @param bucket string bucket name
+// @return string key
+func bucketSurrogateKey(bucket string) string {
+	return "gofs-" + bucket
+}
+
+// Get surrogate key of a file's content, served under its id
+// @param bucket string bucket name
+// @param id primitive.ObjectID file id
+// @return string key
+func fileSurrogateKey(bucket string, id primitive.ObjectID) string {
+	return bucketSurrogateKey(bucket) + "-" + id.Hex()
+}
+
+// Get surrogate key of a filename, served with the current revision. Names
+// may contain spaces and commas, which separate keys, so they are hashed.
+// @param bucket string bucket name
+// @param filename string
+// @return string key
+func nameSurrogateKey(bucket string, filename string) string {
+	sum := sha256.Sum256([]byte(filename))
+	return bucketSurrogateKey(bucket) + "-name-" + hex.EncodeToString(sum[:8])
+}
+
+// Set surrogate keys of a file download, for Fastly in Surrogate-Key and
+// for Cloudflare in Cache-Tag
+// @param c *fiber.Ctx context
+// @param bucket string bucket name
+// @param fileDoc bson.M files document
+func setSurrogateKeys(c *fiber.Ctx, bucket string, fileDoc bson.M) {
+	keys := []string{
+		bucketSurrogateKey(bucket),
+		fileSurrogateKey(bucket, fileDoc["_id"].(primitive.ObjectID)),
+	}
+	if filename, ok := fileDoc["filename"].(string); ok {
+		keys = append(keys, nameSurrogateKey(bucket, filename))
+	}
+	c.Set("Surrogate-Key", strings.Join(keys, " "))
+	c.Set("Cache-Tag", strings.Join(keys, ","))
+}
+
+// Purge a replaced or deleted file from the CDN, both under its id and its
+// name
+// @param bucket string bucket name
+// @param id primitive.ObjectID file id
+// @param filenames ...string names the file was served under
+func purgeFile(bucket string, id primitive.ObjectID, filenames ...string) {
+	keys := []string{fileSurrogateKey(bucket, id)}
+	for _, filename := range filenames {
+		keys = append(keys, nameSurrogateKey(bucket, filename))
+	}
+	purgeCDN(keys...)
+}
+
+// Purge surrogate keys from the CDN in the background, if one is configured
+// @param keys ...string surrogate keys
+func purgeCDN(keys ...string) {
+	if config.CDNProvider == "" || len(keys) == 0 {
+		return
+	}
+	go func() {
+		delay := cdnPurgeRetryDelay
+		for attempt := 1; ; attempt++ {
+			err := sendCDNPurge(keys)
+			if err == nil {
+				return
+			}
+			if attempt == cdnPurgeAttempts {
+				logger.Error("CDN purge failed", "provider", config.CDNProvider, "keys", keys, "attempts", attempt, "error", err)
+				return
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+// Send purge request for surrogate keys to the configured CDN once
+// @param keys []string surrogate keys
+// @return error error
+func sendCDNPurge(keys []string) error {
+	var req *http.Request
+	var err error
+	switch config.CDNProvider {
+	case "fastly":
+		req, err = http.NewRequest(http.MethodPost, fastlyAPI+"/service/"+config.CDNServiceId+"/purge", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Fastly-Key", config.CDNToken)
+		req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+	case "cloudflare":
+		payload, err := json.Marshal(fiber.Map{"tags": keys})
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequest(http.MethodPost, cloudflareAPI+"/zones/"+config.CDNServiceId+"/purge_cache", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+config.CDNToken)
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	default:
+		return fmt.Errorf("unknown CDN provider %q", config.CDNProvider)
+	}
+
+	res, err := cdnClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("CDN responded with status %d", res.StatusCode)
+	}
+	return nil
+}
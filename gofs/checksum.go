@@ -0,0 +1,124 @@
+package gofs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+)
+
+// Headers carrying the digests of an upload: the base64 encoded MD5 digest
+// and the hex or base64 encoded SHA-256 digest
+const (
+	contentMD5Header     = "Content-MD5"
+	checksumSHA256Header = "X-Checksum-SHA256"
+)
+
+// Digests the content of an upload must have, as sent by the client
+type uploadChecksum struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// Decode digest of size bytes, hex or base64 encoded
+// @param value string
+// @param size int digest size in bytes
+// @return []byte digest, nil if it is invalid
+func decodeDigest(value string, size int) []byte {
+	if digest, err := hex.DecodeString(value); err == nil && len(digest) == size {
+		return digest
+	}
+	if digest, err := base64.StdEncoding.DecodeString(value); err == nil && len(digest) == size {
+		return digest
+	}
+	return nil
+}
+
+// Read expected digests of an upload from the Content-MD5 and
+// X-Checksum-SHA256 headers, recording invalid ones in v
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @return *uploadChecksum digests, nil if none were sent
+func requestChecksum(c *fiber.Ctx, v *validation.Validator) *uploadChecksum {
+	checksum := &uploadChecksum{}
+	if value := c.Get(contentMD5Header); value != "" {
+		checksum.md5, _ = base64.StdEncoding.DecodeString(value)
+		v.Check(len(checksum.md5) == md5.Size, validation.Header, contentMD5Header, "Content-MD5 must be a base64 encoded MD5 digest")
+	}
+	if value := c.Get(checksumSHA256Header); value != "" {
+		checksum.sha256 = decodeDigest(value, sha256.Size)
+		v.Check(checksum.sha256 != nil, validation.Header, checksumSHA256Header, checksumSHA256Header+" must be a hex or base64 encoded SHA-256 digest")
+	}
+	if checksum.md5 == nil && checksum.sha256 == nil {
+		return nil
+	}
+	return checksum
+}
+
+// Check if a request carries upload digests
+// @param c *fiber.Ctx context
+// @return bool Content-MD5 or X-Checksum-SHA256 is set
+func hasChecksumHeaders(c *fiber.Ctx) bool {
+	return c.Get(contentMD5Header) != "" || c.Get(checksumSHA256Header) != ""
+}
+
+// Hash content of an upload as it is read. The returned function wraps the
+// reader finally stored, e.g. after inspectImage replaced the content with a
+// sanitized one, and fails it at its end if the digests of the upload don't
+// match, before the storage backend keeps the file.
+// @param content io.Reader upload as received
+// @return io.Reader content
+// @return func(io.Reader) io.Reader wrapper of the stored content
+func (checksum *uploadChecksum) hash(content io.Reader) (io.Reader, func(io.Reader) io.Reader) {
+	if checksum == nil {
+		return content, func(stored io.Reader) io.Reader { return stored }
+	}
+	r := &checksumReader{checksum: checksum, md5: md5.New(), sha256: sha256.New()}
+	return io.TeeReader(content, io.MultiWriter(r.md5, r.sha256)), func(stored io.Reader) io.Reader {
+		r.reader = stored
+		return r
+	}
+}
+
+// Compare digests of an upload to the expected ones
+// @param md5Sum []byte
+// @param sha256Sum []byte
+// @return error error, 400 if they don't match
+func (checksum *uploadChecksum) compare(md5Sum, sha256Sum []byte) error {
+	if checksum.md5 != nil && !bytes.Equal(checksum.md5, md5Sum) {
+		return newError(fiber.StatusBadRequest, CodeChecksumMismatch, "Content-MD5 doesn't match the uploaded content")
+	}
+	if checksum.sha256 != nil && !bytes.Equal(checksum.sha256, sha256Sum) {
+		return newError(fiber.StatusBadRequest, CodeChecksumMismatch, checksumSHA256Header+" doesn't match the uploaded content")
+	}
+	return nil
+}
+
+// Reader of stored upload content, failing at its end if the upload doesn't
+// match its digests, see uploadChecksum.hash
+type checksumReader struct {
+	reader   io.Reader
+	checksum *uploadChecksum
+	md5      hash.Hash
+	sha256   hash.Hash
+}
+
+// Read stored content
+// @param p []byte
+// @return int bytes read
+// @return error error, the checksum mismatch instead of io.EOF
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		if mismatch := r.checksum.compare(r.md5.Sum(nil), r.sha256.Sum(nil)); mismatch != nil {
+			return n, mismatch
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package gofs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Policies applied when an upload uses the filename of an existing image
+const (
+	collisionReject     = "reject"
+	collisionOverwrite  = "overwrite"
+	collisionAutoSuffix = "auto-suffix"
+	collisionVersion    = "version"
+)
+
+// Maximum number of suffixes tried to find a free filename
+const maxFilenameSuffix = 1000
+
+// Check if collision policy name is known
+// @param policy string
+// @return bool valid
+func validCollisionPolicy(policy string) bool {
+	switch policy {
+	case collisionReject, collisionOverwrite, collisionAutoSuffix, collisionVersion:
+		return true
+	}
+	return false
+}
+
+// Validate collision policy requested by the client, falling back to the
+// configured default when empty
+// @param policy string
+// @return string policy
+// @return error error
+func collisionPolicy(policy string) (string, error) {
+	if policy == "" {
+		return config.CollisionPolicy, nil
+	}
+	if !validCollisionPolicy(policy) {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Invalid collision policy "+policy)
+	}
+	return policy, nil
+}
+
+// Check if an image is stored under filename
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @return bool exists
+// @return error error
+func filenameExists(ctx context.Context, db *mongo.Database, filename string) (bool, error) {
+	count, err := requestFilesCollection(ctx, db).CountDocuments(ctx, activeFilter(bson.M{"filename": filename}))
+	return count > 0, err
+}
+
+// Find a free filename by adding a counter before the extension,
+// e.g. photo.jpg becomes photo (1).jpg
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @return string filename
+// @return error error
+func suffixedFilename(ctx context.Context, db *mongo.Database, filename string) (string, error) {
+	ext := path.Ext(filename)
+	for i := 1; i <= maxFilenameSuffix; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), i, ext)
+		exists, err := filenameExists(ctx, db, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+	return "", newError(fiber.StatusConflict, CodeFilenameTaken, "No free filename for "+filename)
+}
+
+// Resolve filename collision of a new upload according to policy
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param policy string
+// @param filename string
+// @return string filename to store the upload under
+// @return int version of the upload
+// @return error error
+func resolveCollision(ctx context.Context, db *mongo.Database, policy string, filename string) (string, int, error) {
+	exists, err := filenameExists(ctx, db, filename)
+	if err != nil || !exists {
+		return filename, 1, err
+	}
+
+	switch policy {
+	case collisionReject:
+		return "", 0, newError(fiber.StatusConflict, CodeFilenameTaken, "Filename already in use")
+	case collisionAutoSuffix:
+		filename, err = suffixedFilename(ctx, db, filename)
+		return filename, 1, err
+	case collisionVersion:
+		version, err := nextVersion(ctx, db, filename)
+		return filename, version, err
+	}
+
+	// Overwrite stores the upload as a fresh file, older revisions are
+	// removed once it was written
+	return filename, 1, nil
+}
+
+// Delete all revisions of filename except the given one, like deletes on
+// request, so hooks may veto them
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @param keep interface{} id of the revision to keep
+// @return error error
+func deleteOtherRevisions(ctx context.Context, db *mongo.Database, filename string, keep interface{}) error {
+	cursor, err := requestFilesCollection(ctx, db).Find(ctx, bson.M{"filename": filename, "_id": bson.M{"$ne": keep}})
+	if err != nil {
+		return err
+	}
+	var fileDocs []bson.M
+	if err := cursor.All(ctx, &fileDocs); err != nil {
+		return err
+	}
+	for _, fileDoc := range fileDocs {
+		// Revisions deleted meanwhile are gone already
+		if err := deleteFile(ctx, fileDoc["_id"].(primitive.ObjectID)); err != nil && errorStatus(err) != fiber.StatusNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gofs
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Brotli and gzip/deflate levels of the COMPRESSION_LEVEL settings, "off"
+// disables compression
+var compressionLevels = map[string][2]int{
+	"speed":   {fasthttp.CompressBrotliBestSpeed, fasthttp.CompressBestSpeed},
+	"default": {fasthttp.CompressBrotliDefaultCompression, fasthttp.CompressDefaultCompression},
+	"best":    {fasthttp.CompressBrotliBestCompression, fasthttp.CompressBestCompression},
+}
+
+// Check if compression level setting is valid
+// @param level string
+// @return bool valid
+func validCompressionLevel(level string) bool {
+	_, ok := compressionLevels[level]
+	return ok || level == "off"
+}
+
+// Content types worth compressing besides text/*. Images, archives, audio
+// and video are already compressed and sent as is.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/graphql":    true,
+	"image/svg+xml":          true,
+}
+
+// Check if responses of a content type are worth compressing
+// @param contentType string Content-Type header, parameters included
+// @return bool compressible
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// Middleware compressing responses of compressible content types with
+// brotli, gzip or deflate, whichever the client accepts first in that order.
+// Small, partial and already encoded responses are sent as is.
+// @return fiber.Handler middleware
+func compressResponses() fiber.Handler {
+	levels, ok := compressionLevels[config.CompressionLevel]
+	if !ok {
+		return func(c *fiber.Ctx) error {
+			return c.Next()
+		}
+	}
+	compressor := fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {}, levels[0], levels[1])
+
+	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		res := c.Response()
+		if !compressibleType(string(res.Header.ContentType())) || res.StatusCode() == fiber.StatusPartialContent {
+			return nil
+		}
+		res.Header.Add(fiber.HeaderVary, fiber.HeaderAcceptEncoding)
+		if len(res.Header.Peek(fiber.HeaderContentEncoding)) > 0 || (!res.IsBodyStream() && len(res.Body()) < config.CompressMinBytes) {
+			return nil
+		}
+
+		compressor(c.Context())
+		// The encoded body differs byte for byte, only a weak validator holds
+		if etag := string(res.Header.Peek(fiber.HeaderETag)); len(res.Header.Peek(fiber.HeaderContentEncoding)) > 0 && strings.HasPrefix(etag, `"`) {
+			res.Header.Set(fiber.HeaderETag, "W/"+etag)
+		}
+		return nil
+	}
+}
+
+// Register response compression middleware
+// @param app *fiber.App app
+func registerCompressionMiddleware(app *fiber.App) {
+	app.Use(compressResponses())
+}
@@ -0,0 +1,298 @@
+package gofs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Request body of the copy endpoint
+type copyRequest struct {
+	Filename string `json:"filename"`
+	Bucket   string `json:"bucket"`
+}
+
+// Check if bucket is configured as a copy/move target
+// @param name string
+// @return bool allowed
+func allowedBucket(name string) bool {
+	for _, bucket := range config.Buckets {
+		if bucket == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy file to target bucket by streaming its chunks server-side. The copy
+// keeps the metadata and starts a new version history. Like uploads it goes
+// through the BeforeStore hooks, which may change its custom metadata and
+// expiry but not its filename. Callers announce the copy once they keep it,
+// see announceCopy.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param fileDoc bson.M source files document
+// @param target string target bucket name
+// @param filename string target filename
+// @param extra bson.M additional metadata of the copy
+// @return FileInfo copy
+// @return error error
+func copyFile(ctx context.Context, db *mongo.Database, fileDoc bson.M, target string, filename string, extra bson.M) (FileInfo, error) {
+	source, err := imageBucket(db)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	destination, err := namedBucket(db, target)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	// Hooks and the audit trail see the copy as new file of the target bucket
+	ctx = withBucket(ctx, target)
+
+	metadata, custom := bson.M{}, map[string]interface{}{}
+	if existing, ok := fileDoc["metadata"].(bson.M); ok {
+		for key, value := range existing {
+			if reservedMetadataKeys[key] {
+				metadata[key] = value
+			} else {
+				custom[key] = value
+			}
+		}
+	}
+	for key, value := range extra {
+		metadata[key] = value
+	}
+
+	upload := &Upload{Filename: filename, Metadata: custom}
+	if expiresAt, ok := metadata["expiresAt"].(primitive.DateTime); ok {
+		expires := expiresAt.Time()
+		upload.ExpiresAt = &expires
+	}
+	upload.Owner, _ = metadata["owner"].(string)
+	if err := beforeStore(ctx, upload); err != nil {
+		recordAudit(ctx, auditCopy, primitive.NilObjectID, filename, err)
+		return FileInfo{}, err
+	}
+	for key, value := range upload.Metadata {
+		metadata[key] = value
+	}
+	delete(metadata, "expiresAt")
+	if upload.ExpiresAt != nil {
+		metadata["expiresAt"] = upload.ExpiresAt
+	}
+	metadata["version"] = 1
+	metadata["current"] = true
+
+	downloadStream, err := source.OpenDownloadStream(fileDoc["_id"])
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer downloadStream.Close()
+
+	copyId, size, err := storeReader(destination, filename, downloadStream, metadata)
+	recordAudit(ctx, auditCopy, copyId, filename, err)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Id: copyId, Bucket: target, Filename: filename, Size: size, Metadata: metadata}, nil
+}
+
+// Run the AfterStore hooks on a copy which is kept and publish it as uploaded
+// file, see copyFile
+// @param ctx context.Context
+// @param file FileInfo copy
+func announceCopy(ctx context.Context, file FileInfo) {
+	afterStore(withBucket(ctx, file.Bucket), file)
+
+	custom := bson.M{}
+	for key, value := range file.Metadata {
+		if !reservedMetadataKeys[key] {
+			custom[key] = value
+		}
+	}
+	publishEvent(eventFileUploaded, fiber.Map{
+		"id":        file.Id,
+		"name":      file.Filename,
+		"size":      file.Size,
+		"bucket":    file.Bucket,
+		"version":   file.Metadata["version"],
+		"expiresAt": file.Metadata["expiresAt"],
+		"metadata":  custom,
+	})
+}
+
+// Request body of the move endpoint
+type moveRequest struct {
+	Bucket string `json:"bucket"`
+}
+
+// Check that a copied file matches its source in length and chunk count
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param fileDoc bson.M source files document
+// @param target string target bucket name
+// @param copyId primitive.ObjectID
+// @return bool verified
+// @return error error
+func verifyCopy(ctx context.Context, db *mongo.Database, fileDoc bson.M, target string, copyId primitive.ObjectID) (bool, error) {
+	var copyDoc bson.M
+	if err := namedFilesCollection(db, target).FindOne(ctx, bson.M{"_id": copyId}).Decode(&copyDoc); err != nil {
+		return false, err
+	}
+	if fileLength(copyDoc) != fileLength(fileDoc) {
+		return false, nil
+	}
+
+	sourceChunks, err := db.Collection(config.BucketName+".chunks").CountDocuments(ctx, bson.M{"files_id": fileDoc["_id"]})
+	if err != nil {
+		return false, err
+	}
+	copyChunks, err := db.Collection(target+".chunks").CountDocuments(ctx, bson.M{"files_id": copyId})
+	if err != nil {
+		return false, err
+	}
+	return sourceChunks == copyChunks, nil
+}
+
+// Register copy and move routes
+// @param app *fiber.App app
+func registerCopyRoutes(app *fiber.App) {
+	// Move an image to another configured bucket. The file is copied, the copy
+	// verified against the source and only then the source is deleted. The
+	// original bucket and id are kept in metadata.movedFrom. Moves delete the
+	// source, so they need the admin role like deletes.
+	// @param id string
+	// @param bucket string
+	// @return image metadata
+	app.Post("/api/image/id/:id/move", requireRole(roleAdmin), func(c *fiber.Ctx) error {
+		db := requestDatabase(c.Context())
+
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+
+		var body moveRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		target := strings.TrimSpace(body.Bucket)
+		if target == config.BucketName {
+			return fiber.NewError(fiber.StatusBadRequest, "Image is already in bucket "+target)
+		}
+		if !allowedBucket(target) {
+			return fiber.NewError(fiber.StatusBadRequest, "Unknown bucket "+target)
+		}
+
+		filename := fileDoc["filename"].(string)
+		copied, err := copyFile(c.Context(), db, fileDoc, target, filename, bson.M{
+			"movedFrom": bson.M{"bucket": config.BucketName, "id": fileDoc["_id"]},
+		})
+		if err != nil {
+			return err
+		}
+		fileId, fileSize := copied.Id, copied.Size
+
+		// Remove the copy again if it doesn't match, keeping the source intact
+		destination, err := namedBucket(db, target)
+		if err != nil {
+			return err
+		}
+		verified, err := verifyCopy(c.Context(), db, fileDoc, target, fileId)
+		if err != nil || !verified {
+			destination.Delete(fileId)
+			if err == nil {
+				err = fiber.NewError(fiber.StatusInternalServerError, "Copy verification failed, image was not moved")
+			}
+			return err
+		}
+
+		// Delete the source like deletes on request, hooks vetoing it keep the
+		// image where it was
+		if err := deleteFile(c.Context(), fileDoc["_id"].(primitive.ObjectID)); err != nil {
+			destination.Delete(fileId)
+			return err
+		}
+		announceCopy(c.Context(), copied)
+		forgetFileDocs(target)
+		replicateFile(c.Context(), target, fileId)
+
+		return respond(c, fiber.StatusOK, "Image moved successfully", "image", fiber.Map{
+			"id":        fileId,
+			"name":      filename,
+			"size":      fileSize,
+			"bucket":    target,
+			"movedFrom": fiber.Map{"bucket": config.BucketName, "id": fileDoc["_id"]},
+		})
+	})
+
+	// Duplicate an image server-side, optionally with a new filename or into
+	// another configured bucket
+	// @param id string
+	// @param filename string
+	// @param bucket string
+	// @return image metadata
+	app.Post("/api/image/id/:id/copy", func(c *fiber.Ctx) error {
+		db := requestDatabase(c.Context())
+
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+
+		// Body is optional, by default the copy keeps the filename
+		var body copyRequest
+		if c.Request().Header.ContentLength() != 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+		target := strings.TrimSpace(body.Bucket)
+		if target == "" {
+			target = config.BucketName
+		}
+		if !allowedBucket(target) {
+			return fiber.NewError(fiber.StatusBadRequest, "Unknown bucket "+target)
+		}
+		filename := strings.TrimSpace(body.Filename)
+		if filename == "" {
+			filename = fileDoc["filename"].(string)
+		}
+		if err := validateFilename(filename); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		// A copy is a new file, it must not become a version of another one
+		count, err := namedFilesCollection(db, target).CountDocuments(c.Context(), activeFilter(bson.M{"filename": filename}))
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return newError(fiber.StatusConflict, CodeFilenameTaken, "Filename already in use")
+		}
+
+		// The copy belongs to whoever made it
+		copied, err := copyFile(c.Context(), db, fileDoc, target, filename, bson.M{
+			"copiedFrom": fileDoc["_id"],
+			"owner":      auditSourceFrom(c.Context()).Actor,
+		})
+		if err != nil {
+			return err
+		}
+		fileId, fileSize := copied.Id, copied.Size
+		announceCopy(c.Context(), copied)
+		forgetFileDocs(target)
+		replicateFile(c.Context(), target, fileId)
+
+		return respond(c, fiber.StatusCreated, "Image copied successfully", "image", fiber.Map{
+			"id":     fileId,
+			"name":   filename,
+			"size":   fileSize,
+			"bucket": target,
+		})
+	})
+}
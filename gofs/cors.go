@@ -0,0 +1,70 @@
+package gofs
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// Request headers browsers may send cross-origin by default: credentials,
+// upload content types and digests, range and conditional downloads,
+// conditional metadata updates, upload progress and the tenant header
+// @return []string headers
+func defaultCORSHeaders() []string {
+	return []string{
+		fiber.HeaderAuthorization,
+		fiber.HeaderContentType,
+		contentMD5Header,
+		checksumSHA256Header,
+		fiber.HeaderRange,
+		fiber.HeaderIfNoneMatch,
+		fiber.HeaderIfModifiedSince,
+		fiber.HeaderIfMatch,
+		fiber.HeaderXRequestID,
+		apiKeyHeader,
+		uploadIdHeader,
+		config.TenantHeader,
+	}
+}
+
+// Response headers scripts may read cross-origin by default, those of
+// downloads, partial content and paged lists besides the CORS-safelisted
+// ones
+var defaultCORSExposeHeaders = []string{
+	fiber.HeaderContentDisposition,
+	fiber.HeaderContentLength,
+	fiber.HeaderContentRange,
+	fiber.HeaderAcceptRanges,
+	fiber.HeaderETag,
+	fiber.HeaderXRequestID,
+	fiber.HeaderLocation,
+	"X-Cache",
+	nextCursorHeader,
+}
+
+// Register CORS middleware if CORS_ALLOW_ORIGINS is set, before the
+// authentication middleware, as preflight requests carry no credentials
+// @param app *fiber.App app
+func registerCORSMiddleware(app *fiber.App) {
+	if len(config.CORSOrigins) == 0 {
+		return
+	}
+	headers := config.CORSHeaders
+	if headers == nil {
+		headers = defaultCORSHeaders()
+	}
+	exposed := config.CORSExposeHeaders
+	if exposed == nil {
+		exposed = defaultCORSExposeHeaders
+	}
+
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     strings.Join(config.CORSOrigins, ","),
+		AllowMethods:     strings.Join(config.CORSMethods, ","),
+		AllowHeaders:     strings.Join(headers, ","),
+		AllowCredentials: config.CORSCredentials,
+		ExposeHeaders:    strings.Join(exposed, ","),
+		MaxAge:           int(config.CORSMaxAge.Seconds()),
+	}))
+}
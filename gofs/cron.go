@@ -0,0 +1,196 @@
+package gofs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedules standing for cron expressions
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Fields of cron expressions: minute, hour, day of month, month and day of
+// week, with the names accepted for months and days of week
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// Times a task runs at, in UTC, parsed from a cron expression
+type cronSchedule struct {
+	// Allowed values of the fields by bit, days of week with Sunday as 0
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// Day fields restricted by the expression. Restricting both matches days
+	// matching either, like cron does.
+	dayOfMonthSet, dayOfWeekSet bool
+	// Interval of "@every <duration>" schedules, which don't follow the clock
+	every time.Duration
+}
+
+// Parse cron expression: five fields (minute, hour, day of month, month,
+// day of week) of "*", values, ranges and steps, e.g. "*/15 2-5 * * mon-fri",
+// one of @yearly, @monthly, @weekly, @daily and @hourly, or "@every
+// <duration>", e.g. "@every 30m"
+// @param spec string
+// @return *cronSchedule schedule
+// @return error error
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if every, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("invalid interval %q", every)
+		}
+		return &cronSchedule{every: interval}, nil
+	}
+	if expression, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = expression
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, errors.New("expected 5 fields: minute, hour, day of month, month and day of week")
+	}
+	var values [5]uint64
+	for i, field := range fields {
+		bits, err := parseCronField(field, i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", cronFields[i].name, field, err)
+		}
+		values[i] = bits
+	}
+	// Sunday is 0 or 7
+	if values[4]&(1<<7) != 0 {
+		values[4] |= 1
+	}
+	return &cronSchedule{
+		minute:        values[0],
+		hour:          values[1],
+		dayOfMonth:    values[2],
+		month:         values[3],
+		dayOfWeek:     values[4],
+		dayOfMonthSet: fields[2] != "*",
+		dayOfWeekSet:  fields[4] != "*",
+	}, nil
+}
+
+// Parse comma separated parts of a cron field
+// @param field string
+// @param index int index of the field in the expression
+// @return uint64 allowed values by bit
+// @return error error
+func parseCronField(field string, index int) (uint64, error) {
+	spec := cronFields[index]
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, errors.New("invalid step")
+			}
+		}
+
+		low, high := spec.min, spec.max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = cronValue(first, index); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = cronValue(last, index); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// A start with a step runs to the end, e.g. 5/15
+				high = spec.max
+			}
+			if high < low {
+				return 0, errors.New("range ends before it starts")
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// Parse value of a cron field, a number or a month or day name
+// @param value string
+// @param index int index of the field in the expression
+// @return int value
+// @return error error
+func cronValue(value string, index int) (int, error) {
+	spec := cronFields[index]
+	for i, name := range spec.names {
+		if strings.EqualFold(value, name) {
+			return i + spec.min, nil
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < spec.min || n > spec.max {
+		return 0, fmt.Errorf("expected %d to %d", spec.min, spec.max)
+	}
+	return n, nil
+}
+
+// Check if the day of t is one the schedule runs on
+// @param t time.Time
+// @return bool
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.dayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := s.dayOfWeek&(1<<t.Weekday()) != 0
+	if s.dayOfMonthSet && s.dayOfWeekSet {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// Get the first time the schedule runs after a time
+// @param after time.Time
+// @return time.Time next run in UTC, zero if there is none in the next 5 years
+func (s *cronSchedule) next(after time.Time) time.Time {
+	after = after.UTC()
+	if s.every > 0 {
+		return after.Add(s.every).Truncate(time.Second)
+	}
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,74 @@
+package gofs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// Wednesday
+	from := time.Date(2024, 1, 10, 12, 34, 56, 0, time.UTC)
+	tests := []struct {
+		spec string
+		// First run after from
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 10, 12, 35, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 12, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 10, 12, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 1, 11, 3, 0, 0, 0, time.UTC)},
+		{"30 4,18 * * *", time.Date(2024, 1, 10, 18, 30, 0, 0, time.UTC)},
+		{"0 2-5 * * *", time.Date(2024, 1, 11, 2, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2024, 1, 11, 9, 0, 0, 0, time.UTC)},
+		// Restricting both days matches either
+		{"0 0 20 * sat", time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 10, 13, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, 1, 10, 12, 36, 26, 0, time.UTC)},
+		{"0 0 30 feb *", time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			schedule, err := parseCron(test.spec)
+			if err != nil {
+				t.Fatalf("parseCron() error = %v", err)
+			}
+			if next := schedule.next(from); !next.Equal(test.next) {
+				t.Errorf("next() = %v, want %v", next, test.next)
+			}
+		})
+	}
+}
+
+func TestParseCronRejects(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"@every 500ms",
+		"@every soon",
+		"@sometimes",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := parseCron(spec); err == nil {
+				t.Fatal("parseCron() accepted the expression")
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package gofs
+
+import (
+	"encoding/base64"
+
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Encode sort keys of the last item of a page, e.g. its upload date and
+// id, as opaque cursor of the next page
+// @param keys ...interface{} sort key values, in sort order
+// @return string cursor
+func encodeCursor(keys ...interface{}) string {
+	// Sort keys are dates, numbers and ObjectIDs, which always marshal
+	data, _ := bson.Marshal(bson.M{"k": bson.A(keys)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Read cursor query parameter into the sort keys it was encoded from,
+// recording it in v if it isn't one made by encodeCursor with as many keys
+// of these types
+// @param v *validation.Validator
+// @param value string cursor, empty for the first page
+// @param keys ...interface{} pointers the sort keys are read into
+// @return bool a valid cursor was read
+func decodeCursor(v *validation.Validator, value string, keys ...interface{}) bool {
+	if value == "" {
+		return false
+	}
+	var cursor struct {
+		Keys []bson.RawValue `bson:"k"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = bson.Unmarshal(data, &cursor)
+	}
+	valid := err == nil && len(cursor.Keys) == len(keys)
+	for i := 0; valid && i < len(keys); i++ {
+		valid = cursor.Keys[i].Unmarshal(keys[i]) == nil
+	}
+	return v.Check(valid, validation.Query, "cursor", "cursor must be a nextCursor of a previous page")
+}
+
+// Build filter of the items after the cursor in a list sorted by fields, all
+// in the same direction. Later fields break ties of earlier ones, the last
+// one has to be unique, e.g. _id.
+// @param fields []string sort fields
+// @param keys []interface{} sort keys of the last item of the previous page
+// @param order int 1 for ascending, -1 for descending
+// @return bson.M filter
+func keysetFilter(fields []string, keys []interface{}, order int) bson.M {
+	operator := "$lt"
+	if order > 0 {
+		operator = "$gt"
+	}
+	or := bson.A{}
+	for i := range fields {
+		clause := bson.M{fields[i]: bson.M{operator: keys[i]}}
+		for j := 0; j < i; j++ {
+			clause[fields[j]] = keys[j]
+		}
+		or = append(or, clause)
+	}
+	return bson.M{"$or": or}
+}
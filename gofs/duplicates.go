@@ -0,0 +1,161 @@
+package gofs
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// File of a duplicate set
+type duplicateFile struct {
+	Id         primitive.ObjectID `bson:"id" json:"id"`
+	Filename   string             `bson:"filename" json:"filename"`
+	UploadDate time.Time          `bson:"uploadDate" json:"uploadDate"`
+	// Oldest file of the set, which a cleanup keeps
+	Keep bool `bson:"-" json:"keep"`
+}
+
+// Files storing the same content
+type duplicateSet struct {
+	Sha256 string `bson:"sha256" json:"sha256"`
+	Size   int64  `bson:"size" json:"size"`
+	// Bytes freed by deleting all files but one
+	ReclaimableBytes int64           `bson:"reclaimableBytes" json:"reclaimableBytes"`
+	Files            []duplicateFile `bson:"files" json:"files"`
+}
+
+// Report of the duplicate files of a bucket
+type duplicatesReport struct {
+	Bucket string `json:"bucket"`
+	// Number of duplicate sets and files in them
+	Sets  int64 `json:"sets"`
+	Files int64 `json:"files"`
+	// Bytes freed by deleting all duplicates but one per set
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+	// Files stored before content hashes were recorded, which can't be
+	// compared
+	UnhashedFiles int64          `json:"unhashedFiles"`
+	Duplicates    []duplicateSet `json:"duplicates"`
+}
+
+// Result of the duplicates pipeline
+type duplicateFacets struct {
+	Totals []struct {
+		Sets             int64 `bson:"sets"`
+		Files            int64 `bson:"files"`
+		ReclaimableBytes int64 `bson:"reclaimableBytes"`
+	} `bson:"totals"`
+	Sets []duplicateSet `bson:"sets"`
+}
+
+// Group the files of a GridFS bucket by the SHA-256 hash of their content
+// and report the sets of files storing the same content, those with the
+// most reclaimable bytes first. All revisions count, as they all take up
+// storage. Files of a set are listed oldest first, the oldest is marked to
+// be kept.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param minSize int64 smallest file size in bytes considered
+// @param skip int64 sets skipped
+// @param limit int64 sets listed
+// @return duplicatesReport report
+// @return error error
+func findDuplicates(ctx context.Context, db *mongo.Database, bucket string, minSize, skip, limit int64) (duplicatesReport, error) {
+	report := duplicatesReport{Bucket: bucket, Duplicates: []duplicateSet{}}
+	files := namedFilesCollection(db, bucket)
+
+	cursor, err := files.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"metadata.sha256": bson.M{"$exists": true}, "length": bson.M{"$gte": minSize}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "uploadDate", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"sha256": "$metadata.sha256", "size": "$length"},
+			"count": bson.M{"$sum": 1},
+			"files": bson.M{"$push": bson.M{"id": "$_id", "filename": "$filename", "uploadDate": "$uploadDate"}},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":              0,
+			"sha256":           "$_id.sha256",
+			"size":             "$_id.size",
+			"count":            1,
+			"files":            1,
+			"reclaimableBytes": bson.M{"$multiply": bson.A{"$_id.size", bson.M{"$subtract": bson.A{"$count", 1}}}},
+		}}},
+		{{Key: "$facet", Value: bson.M{
+			"totals": bson.A{bson.M{"$group": bson.M{
+				"_id":              nil,
+				"sets":             bson.M{"$sum": 1},
+				"files":            bson.M{"$sum": "$count"},
+				"reclaimableBytes": bson.M{"$sum": "$reclaimableBytes"},
+			}}},
+			"sets": bson.A{
+				bson.M{"$sort": bson.D{{Key: "reclaimableBytes", Value: -1}, {Key: "sha256", Value: 1}}},
+				bson.M{"$skip": skip},
+				bson.M{"$limit": limit},
+			},
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return report, err
+	}
+	var facets []duplicateFacets
+	if err := cursor.All(ctx, &facets); err != nil {
+		return report, err
+	}
+	result := facets[0]
+	if len(result.Totals) > 0 {
+		report.Sets = result.Totals[0].Sets
+		report.Files = result.Totals[0].Files
+		report.ReclaimableBytes = result.Totals[0].ReclaimableBytes
+	}
+	for _, set := range result.Sets {
+		set.Files[0].Keep = true
+		report.Duplicates = append(report.Duplicates, set)
+	}
+
+	report.UnhashedFiles, err = files.CountDocuments(ctx, bson.M{"metadata.sha256": bson.M{"$exists": false}})
+	return report, err
+}
+
+// Register duplicates report route on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerDuplicatesRoutes(admin fiber.Router) {
+	// Report files of a bucket storing the same content, with the bytes a
+	// cleanup keeping one file per set would free
+	// @param bucket string default bucket if empty
+	// @param minSize int smallest file size in bytes considered
+	// @param skip int
+	// @param limit int
+	// @return duplicates report
+	admin.Get("/duplicates", func(c *fiber.Ctx) error {
+		if config.StorageBackend != "gridfs" {
+			return fiber.NewError(fiber.StatusConflict, "Storage backend "+config.StorageBackend+" stores no content hashes")
+		}
+		bucket := c.Query("bucket", config.BucketName)
+		if !managedBucket(bucket) {
+			return newError(fiber.StatusNotFound, CodeBucketNotFound, "Unknown bucket "+bucket)
+		}
+		v := &validation.Validator{}
+		minSize := v.Size(validation.Query, "minSize", c.Query("minSize"))
+		skip, limit := pageParams(c, v)
+		if err := v.Err(); err != nil {
+			return err
+		}
+		if minSize == nil {
+			minSize = new(int64)
+		}
+
+		report, err := findDuplicates(c.Context(), requestDatabase(c.Context()), bucket, *minSize, skip, limit)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Duplicates report fetched successfully", "report", report)
+	})
+}
@@ -0,0 +1,149 @@
+package gofs
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+)
+
+// Machine-readable code of error responses. Codes are stable, unlike error
+// messages, so clients can branch on them.
+type ErrorCode string
+
+// Error codes of the file service
+const (
+	CodeBadRequest           ErrorCode = "BAD_REQUEST"
+	CodeValidation           ErrorCode = "VALIDATION_FAILED"
+	CodeInvalidId            ErrorCode = "INVALID_ID"
+	CodeInvalidFileType      ErrorCode = "INVALID_FILE_TYPE"
+	CodeInvalidMetadata      ErrorCode = "INVALID_METADATA"
+	CodeInvalidImage         ErrorCode = "INVALID_IMAGE"
+	CodeChecksumMismatch     ErrorCode = "CHECKSUM_MISMATCH"
+	CodeImageTooLarge        ErrorCode = "IMAGE_TOO_LARGE"
+	CodeUnauthorized         ErrorCode = "UNAUTHORIZED"
+	CodeForbidden            ErrorCode = "FORBIDDEN"
+	CodeNotFound             ErrorCode = "NOT_FOUND"
+	CodeFileNotFound         ErrorCode = "FILE_NOT_FOUND"
+	CodeVersionNotFound      ErrorCode = "VERSION_NOT_FOUND"
+	CodeFolderNotFound       ErrorCode = "FOLDER_NOT_FOUND"
+	CodeBucketNotFound       ErrorCode = "BUCKET_NOT_FOUND"
+	CodeTenantNotFound       ErrorCode = "TENANT_NOT_FOUND"
+	CodeMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeNotAcceptable        ErrorCode = "NOT_ACCEPTABLE"
+	CodeConflict             ErrorCode = "CONFLICT"
+	CodeFilenameTaken        ErrorCode = "FILENAME_TAKEN"
+	CodeUploadTooLarge       ErrorCode = "UPLOAD_TOO_LARGE"
+	CodeMetadataTooLarge     ErrorCode = "METADATA_TOO_LARGE"
+	CodeRangeNotSatisfiable  ErrorCode = "RANGE_NOT_SATISFIABLE"
+	CodePreconditionFailed   ErrorCode = "PRECONDITION_FAILED"
+	CodePreconditionRequired ErrorCode = "PRECONDITION_REQUIRED"
+	CodeUpstreamFailed       ErrorCode = "UPSTREAM_FAILED"
+	CodeUnavailable          ErrorCode = "SERVICE_UNAVAILABLE"
+	CodeInternal             ErrorCode = "INTERNAL_ERROR"
+)
+
+// All error codes, listed in the API documentation
+var errorCodes = []ErrorCode{
+	CodeBadRequest, CodeValidation, CodeInvalidId, CodeInvalidFileType, CodeInvalidMetadata,
+	CodeInvalidImage, CodeImageTooLarge, CodeChecksumMismatch,
+	CodeUnauthorized, CodeForbidden,
+	CodeNotFound, CodeFileNotFound, CodeVersionNotFound, CodeFolderNotFound, CodeBucketNotFound, CodeTenantNotFound,
+	CodeMethodNotAllowed, CodeNotAcceptable, CodeConflict, CodeFilenameTaken,
+	CodeUploadTooLarge, CodeMetadataTooLarge, CodeRangeNotSatisfiable,
+	CodePreconditionFailed, CodePreconditionRequired,
+	CodeUpstreamFailed, CodeUnavailable, CodeInternal,
+}
+
+// Codes of errors created without one, by HTTP status
+var statusCodes = map[int]ErrorCode{
+	fiber.StatusBadRequest:                   CodeBadRequest,
+	fiber.StatusUnauthorized:                 CodeUnauthorized,
+	fiber.StatusForbidden:                    CodeForbidden,
+	fiber.StatusNotFound:                     CodeNotFound,
+	fiber.StatusMethodNotAllowed:             CodeMethodNotAllowed,
+	fiber.StatusNotAcceptable:                CodeNotAcceptable,
+	fiber.StatusConflict:                     CodeConflict,
+	fiber.StatusRequestEntityTooLarge:        CodeUploadTooLarge,
+	fiber.StatusRequestedRangeNotSatisfiable: CodeRangeNotSatisfiable,
+	fiber.StatusPreconditionFailed:           CodePreconditionFailed,
+	fiber.StatusPreconditionRequired:         CodePreconditionRequired,
+	fiber.StatusBadGateway:                   CodeUpstreamFailed,
+	fiber.StatusServiceUnavailable:           CodeUnavailable,
+}
+
+// Error with HTTP status and error code. It unwraps to a fiber error, so it
+// keeps its status wherever fiber errors do.
+type codedError struct {
+	code ErrorCode
+	err  *fiber.Error
+}
+
+// Get error message
+// @return string message
+func (e *codedError) Error() string {
+	return e.err.Message
+}
+
+// Get fiber error carrying the status
+// @return error error
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// Create error with HTTP status and error code
+// @param status int
+// @param code ErrorCode
+// @param msg string
+// @return error error
+func newError(status int, code ErrorCode, msg string) error {
+	return &codedError{code: code, err: fiber.NewError(status, msg)}
+}
+
+// Get error code of error, derived from its status if it was created without
+// one. Violations of request fields share the code of their rule if there is
+// just one, see validation.Errors.
+// @param err error
+// @return ErrorCode code
+func errorCode(err error) ErrorCode {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	var violations validation.Errors
+	if errors.As(err, &violations) {
+		code := violations[0].Code
+		for _, violation := range violations[1:] {
+			if violation.Code != code {
+				return CodeValidation
+			}
+		}
+		if code == "" {
+			return CodeValidation
+		}
+		return ErrorCode(code)
+	}
+	return statusCode(errorStatus(err))
+}
+
+// Get violations of request fields reported by err
+// @param err error
+// @return validation.Errors violations, nil if err is no validation error
+func errorViolations(err error) validation.Errors {
+	var violations validation.Errors
+	errors.As(err, &violations)
+	return violations
+}
+
+// Get error code of HTTP status
+// @param status int
+// @return ErrorCode code
+func statusCode(status int) ErrorCode {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status < fiber.StatusInternalServerError {
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
@@ -0,0 +1,116 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Restrict files documents filter to files which have not expired yet.
+// Files without metadata.expiresAt never expire.
+// @param filter bson.M
+// @return bson.M filter
+func activeFilter(filter bson.M) bson.M {
+	filter["metadata.expiresAt"] = bson.M{"$not": bson.M{"$lte": time.Now()}}
+	return filter
+}
+
+// Parse RFC 3339 expiry time, falling back to the configured default TTL
+// when empty
+// @param value string
+// @return *time.Time expiry, nil if the file never expires
+// @return error error
+func parseExpiry(value string) (*time.Time, error) {
+	if value != "" {
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid expiresAt, expected RFC 3339 timestamp")
+		}
+		if !expiresAt.After(time.Now()) {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "expiresAt must be in the future")
+		}
+		return &expiresAt, nil
+	}
+
+	if config.DefaultTTL > 0 {
+		expiresAt := time.Now().Add(config.DefaultTTL)
+		return &expiresAt, nil
+	}
+
+	return nil, nil
+}
+
+// Delete expired files and their chunks from the GridFS bucket of ctx
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @return int number of deleted files
+// @return error error
+func deleteExpiredFiles(ctx context.Context, db *mongo.Database) (int, error) {
+	bucket, err := requestBucket(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	findOptions := options.Find().SetProjection(bson.M{"_id": 1, "filename": 1})
+	cursor, err := requestFilesCollection(ctx, db).Find(ctx, bson.M{"metadata.expiresAt": bson.M{"$lte": time.Now()}}, findOptions)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	deleted := 0
+	for cursor.Next(ctx) {
+		var fileDoc bson.M
+		if err := cursor.Decode(&fileDoc); err != nil {
+			return deleted, err
+		}
+		// Delete removes the files document and all of its chunks
+		if err := bucket.DeleteContext(ctx, fileDoc["_id"]); err != nil && err != gridfs.ErrFileNotFound {
+			return deleted, err
+		}
+		forgetDownloads(ctx, db, fileDoc["_id"].(primitive.ObjectID))
+		uncacheFiles(ctx, BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID))
+		purgeFile(BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID), fileDoc["filename"].(string))
+		replicateFile(ctx, BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID))
+		publishEvent(eventFileDeleted, fiber.Map{"id": fileDoc["_id"], "reason": "expired"})
+		deleted++
+	}
+	return deleted, cursor.Err()
+}
+
+// Delete expired files of all buckets, of every tenant
+// @param ctx context.Context
+// @return int number of deleted files
+// @return error error of the buckets which failed
+func deleteAllExpiredFiles(ctx context.Context) (int, error) {
+	tenants, err := managedTenants(ctx)
+	if err != nil {
+		logger.Error("list tenants", "error", err)
+	}
+	total := 0
+	var errs []error
+	for _, t := range tenants {
+		tenantCtx := withTenant(ctx, t)
+		db := requestDatabase(tenantCtx)
+		for _, bucket := range managedBuckets() {
+			deleted, err := deleteExpiredFiles(withBucket(tenantCtx, bucket), db)
+			total += deleted
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", db.Name(), bucket, err))
+				continue
+			}
+			if deleted > 0 {
+				logger.Info("deleted expired files", "database", db.Name(), "bucket", bucket, "count", deleted)
+			}
+		}
+	}
+	return total, errors.Join(errs...)
+}
@@ -0,0 +1,144 @@
+package gofs
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields of the API representation of files, with the files document fields
+// they are read from
+var fileFieldSources = map[string][]string{
+	"id":         {"_id"},
+	"name":       {"filename"},
+	"size":       {"length"},
+	"uploadDate": {"uploadDate"},
+	"metadata":   {"metadata"},
+	"chunkSize":  {"chunkSize"},
+	"checksum":   {"md5", "metadata.sha256"},
+}
+
+// Files document fields which go by another name in the API representation
+var fileFieldNames = map[string]string{
+	"_id":      "id",
+	"filename": "name",
+	"length":   "size",
+	"md5":      "checksum",
+}
+
+// Fields of files selected by the fields query parameter
+type fieldSelection struct {
+	// Projection of the files documents
+	projection bson.M
+	// Fields of the API representation
+	keys map[string]bool
+}
+
+// Read comma separated fields query parameter, recording unknown fields in
+// v. Fields are named as in the API representation or in the files
+// document, e.g. name or filename, single metadata fields as metadata.<key>.
+// The id is always selected.
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @return *fieldSelection selection, nil for all fields
+func selectFields(c *fiber.Ctx, v *validation.Validator) *fieldSelection {
+	fields := splitList(c.Query("fields"))
+	if len(fields) == 0 {
+		return nil
+	}
+	s := &fieldSelection{projection: bson.M{}, keys: map[string]bool{"id": true}}
+	for _, field := range fields {
+		if key, ok := strings.CutPrefix(field, "metadata."); ok {
+			valid := key != "" && !strings.HasPrefix(key, "$") && !strings.Contains(key, ".")
+			if v.Check(valid, validation.Query, "fields", "Invalid metadata field "+field) {
+				s.keys["metadata"] = true
+				s.require(field)
+			}
+			continue
+		}
+		if name, ok := fileFieldNames[field]; ok {
+			field = name
+		}
+		sources, ok := fileFieldSources[field]
+		if !v.Check(ok, validation.Query, "fields", "Unknown field "+field) {
+			continue
+		}
+		s.keys[field] = true
+		for _, source := range sources {
+			s.require(source)
+		}
+	}
+	s.require("_id")
+	return s
+}
+
+// Add files document field to the projection. Selecting a document and one
+// of its fields collides, the document covers the field.
+// @param field string files document field
+func (s *fieldSelection) require(field string) {
+	if s == nil {
+		return
+	}
+	for selected := range s.projection {
+		if selected == field || strings.HasPrefix(field, selected+".") {
+			return
+		}
+		if strings.HasPrefix(selected, field+".") {
+			delete(s.projection, selected)
+		}
+	}
+	s.projection[field] = 1
+}
+
+// Get projection of the files documents
+// @return bson.M projection, nil for all fields
+func (s *fieldSelection) fileProjection() bson.M {
+	if s == nil {
+		return nil
+	}
+	return s.projection
+}
+
+// Remove fields which weren't selected from the API representation of a file
+// @param info fiber.Map
+// @return fiber.Map info
+func (s *fieldSelection) apply(info fiber.Map) fiber.Map {
+	if s == nil {
+		return info
+	}
+	for key := range info {
+		if !s.keys[key] {
+			delete(info, key)
+		}
+	}
+	return info
+}
+
+// Find selected fields of the files document of the image with the id in
+// request params, like findFileByParam
+// @param c *fiber.Ctx context
+// @param projection bson.M
+// @return bson.M files document
+// @return error error
+func findFileFieldsByParam(c *fiber.Ctx, projection bson.M) (bson.M, error) {
+	id, err := objectIdParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var fileDoc bson.M
+	ctx := c.Context()
+	err = withRetry(ctx, func() error {
+		findOptions := options.FindOne().SetProjection(projection)
+		return requestFilesCollection(ctx, readDatabase(ctx)).FindOne(ctx, activeFilter(bson.M{"_id": id}), findOptions).Decode(&fileDoc)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, newError(fiber.StatusNotFound, CodeFileNotFound, "Image not found")
+	}
+	return fileDoc, err
+}
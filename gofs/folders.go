@@ -0,0 +1,406 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Maximum length of a stored filename including its folder path
+const maxFilenameLength = 1024
+
+// Error returned for malformed virtual paths
+var errInvalidPath = errors.New("Invalid path")
+
+// Normalize virtual folder path, e.g. "/avatars/2024/" becomes "avatars/2024".
+// The root folder is the empty string.
+// @param folder string
+// @return string folder
+// @return error error
+func cleanFolder(folder string) (string, error) {
+	folder = strings.Trim(strings.TrimSpace(folder), "/")
+	if folder == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(folder, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errInvalidPath
+		}
+	}
+	return folder, nil
+}
+
+// Validate stored filename, which may contain a virtual folder path
+// @param filename string
+// @return error error
+func validateFilename(filename string) error {
+	if filename == "" || len(filename) > maxFilenameLength || strings.HasPrefix(filename, "/") {
+		return errInvalidPath
+	}
+	if _, err := cleanFolder(filename); err != nil {
+		return err
+	}
+	_, err := imageExtension(filename)
+	return err
+}
+
+// Get filename prefix of everything below folder
+// @param folder string cleaned folder
+// @return string prefix
+func folderPath(folder string) string {
+	if folder == "" {
+		return ""
+	}
+	return folder + "/"
+}
+
+// Build filename regex matching everything below folder
+// @param folder string cleaned folder
+// @return primitive.Regex regex
+func folderPrefix(folder string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(folderPath(folder))}
+}
+
+// Read folder path from the wildcard route param
+// @param c *fiber.Ctx context
+// @return string folder
+// @return error error
+func folderParam(c *fiber.Ctx) (string, error) {
+	folder, err := cleanFolder(c.Params("*"))
+	if err != nil {
+		return "", fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return folder, nil
+}
+
+// Get collection of explicitly created folders, which may be empty. Folders
+// containing images exist implicitly through the image filenames.
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func foldersCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(config.BucketName + ".folders")
+}
+
+// Filter matching folder and everything below it
+// @param key string filename or folder document key
+// @param folder string cleaned folder
+// @return bson.M filter
+func folderTreeFilter(key string, folder string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{key: folder},
+		bson.M{key: folderPrefix(folder)},
+	}}
+}
+
+// Create empty folder
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param folder string cleaned folder
+// @return error error
+func createFolder(ctx context.Context, db *mongo.Database, folder string) error {
+	_, err := foldersCollection(db).UpdateOne(ctx, bson.M{"_id": folder}, bson.M{"$setOnInsert": bson.M{"createdAt": time.Now()}}, options.Update().SetUpsert(true))
+	return err
+}
+
+// Check if folder exists, either created explicitly or containing images
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param folder string cleaned folder
+// @return bool exists
+// @return error error
+func folderExists(ctx context.Context, db *mongo.Database, folder string) (bool, error) {
+	if folder == "" {
+		return true, nil
+	}
+	count, err := foldersCollection(db).CountDocuments(ctx, folderTreeFilter("_id", folder), options.Count().SetLimit(1))
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	count, err = filesCollection(db).CountDocuments(ctx, activeFilter(bson.M{"filename": folderPrefix(folder)}), options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// List the direct subfolders and the current version of images in a folder
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param folder string cleaned folder
+// @return []string subfolder names, sorted
+// @return []bson.M files documents, sorted by filename
+// @return error error
+func listFolder(ctx context.Context, db *mongo.Database, folder string) ([]string, []bson.M, error) {
+	// Anchored prefix regexes can use the filename index
+	collection := filesCollection(db)
+	names, err := collection.Distinct(ctx, "filename", activeFilter(bson.M{"filename": folderPrefix(folder)}))
+	if err != nil {
+		return nil, nil, err
+	}
+	created, err := foldersCollection(db).Distinct(ctx, "_id", bson.M{"_id": folderPrefix(folder)})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	folderSet := map[string]bool{}
+	var fileNames []string
+	for _, name := range names {
+		rest := strings.TrimPrefix(name.(string), folderPath(folder))
+		if subfolder, _, found := strings.Cut(rest, "/"); found {
+			folderSet[subfolder] = true
+			continue
+		}
+		fileNames = append(fileNames, name.(string))
+	}
+	for _, path := range created {
+		subfolder, _, _ := strings.Cut(strings.TrimPrefix(path.(string), folderPath(folder)), "/")
+		folderSet[subfolder] = true
+	}
+	folders := make([]string, 0, len(folderSet))
+	for subfolder := range folderSet {
+		folders = append(folders, subfolder)
+	}
+	sort.Strings(folders)
+
+	// Current version of each image directly in this folder
+	var images []bson.M
+	if len(fileNames) > 0 {
+		findOptions := options.Find().SetSort(bson.D{{Key: "filename", Value: 1}, {Key: "metadata.current", Value: -1}, {Key: "uploadDate", Value: -1}})
+		cursor, err := collection.Find(ctx, activeFilter(bson.M{"filename": bson.M{"$in": fileNames}}), findOptions)
+		if err != nil {
+			return nil, nil, err
+		}
+		var fileDocs []bson.M
+		if err := cursor.All(ctx, &fileDocs); err != nil {
+			return nil, nil, err
+		}
+		for i, fileDoc := range fileDocs {
+			if i > 0 && fileDocs[i-1]["filename"] == fileDoc["filename"] {
+				continue
+			}
+			images = append(images, fileDoc)
+		}
+	}
+
+	return folders, images, nil
+}
+
+// Move folder with all its images and subfolders to another path
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param from string cleaned source folder
+// @param to string cleaned target folder
+// @return int64 number of moved files
+// @return error error
+func moveFolder(ctx context.Context, db *mongo.Database, from string, to string) (int64, error) {
+	if from == "" {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "Invalid from path")
+	}
+	if to == from || strings.HasPrefix(to+"/", from+"/") {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "Cannot move folder into itself")
+	}
+
+	// Refuse to merge with images already stored under the new names
+	collection := filesCollection(db)
+	names, err := collection.Distinct(ctx, "filename", bson.M{"filename": folderPrefix(from)})
+	if err != nil {
+		return 0, err
+	}
+	created, err := foldersCollection(db).Distinct(ctx, "_id", folderTreeFilter("_id", from))
+	if err != nil {
+		return 0, err
+	}
+	if len(names) == 0 && len(created) == 0 {
+		return 0, newError(fiber.StatusNotFound, CodeFolderNotFound, "Folder not found")
+	}
+	newNames := make([]string, 0, len(names))
+	for _, name := range names {
+		newNames = append(newNames, folderPath(to)+strings.TrimPrefix(name.(string), folderPath(from)))
+	}
+	count, err := collection.CountDocuments(ctx, activeFilter(bson.M{"filename": bson.M{"$in": newNames}}))
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, newError(fiber.StatusConflict, CodeFilenameTaken, "Target folder already contains images with the same names")
+	}
+
+	// Replace the folder prefix of every filename in one pipeline update
+	result, err := collection.UpdateMany(ctx, bson.M{"filename": folderPrefix(from)}, bson.A{
+		bson.M{"$set": bson.M{"filename": bson.M{"$concat": bson.A{
+			folderPath(to),
+			bson.M{"$substrCP": bson.A{"$filename", len([]rune(folderPath(from))), bson.M{"$strLenCP": "$filename"}}},
+		}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	forgetFileDocs(config.BucketName)
+	purgeCDN(bucketSurrogateKey(config.BucketName))
+
+	// Folder document ids can't be updated, create them under the new path
+	for _, path := range created {
+		newPath := to
+		if path != from {
+			newPath = folderPath(to) + strings.TrimPrefix(path.(string), folderPath(from))
+		}
+		if newPath == "" {
+			continue
+		}
+		if err := createFolder(ctx, db, newPath); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := foldersCollection(db).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": created}}); err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// Delete folder recursively, including all versions of its images
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param folder string cleaned folder
+// @return int number of deleted files
+// @return error error
+func deleteFolder(ctx context.Context, db *mongo.Database, folder string) (int, error) {
+	if folder == "" {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "Refusing to delete the root folder")
+	}
+
+	cursor, err := filesCollection(db).Find(ctx, bson.M{"filename": folderPrefix(folder)}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var fileDocs []bson.M
+	if err := cursor.All(ctx, &fileDocs); err != nil {
+		return 0, err
+	}
+	result, err := foldersCollection(db).DeleteMany(ctx, folderTreeFilter("_id", folder))
+	if err != nil {
+		return 0, err
+	}
+	if len(fileDocs) == 0 && result.DeletedCount == 0 {
+		return 0, newError(fiber.StatusNotFound, CodeFolderNotFound, "Folder not found")
+	}
+
+	for _, fileDoc := range fileDocs {
+		if err := deleteFile(ctx, fileDoc["_id"].(primitive.ObjectID)); err != nil {
+			return 0, err
+		}
+	}
+	return len(fileDocs), nil
+}
+
+// Request body of the folder move endpoint
+type moveFolderRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Register folder routes
+// @param app *fiber.App app
+func registerFolderRoutes(app *fiber.App) {
+	// List the direct subfolders and images of a folder
+	// @param path string folder path, empty for the root folder
+	// @return folder listing
+	app.Get("/api/folders/*", func(c *fiber.Ctx) error {
+		folder, err := folderParam(c)
+		if err != nil {
+			return err
+		}
+
+		folders, fileDocs, err := listFolder(c.Context(), readDatabase(c.Context()), folder)
+		if err != nil {
+			return err
+		}
+		images := make([]fiber.Map, 0, len(fileDocs))
+		for _, fileDoc := range fileDocs {
+			images = append(images, fileInfo(fileDoc))
+		}
+
+		return respond(c, fiber.StatusOK, "Folder fetched successfully", "folder", fiber.Map{
+			"path":    folder,
+			"folders": folders,
+			"images":  images,
+		})
+	})
+
+	// Move a folder with all its images and subfolders to another path
+	// @param from string
+	// @param to string
+	// @return moved image count
+	app.Post("/api/folders/move", func(c *fiber.Ctx) error {
+		var body moveFolderRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		from, err := cleanFolder(body.From)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid from path")
+		}
+		to, err := cleanFolder(body.To)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid to path")
+		}
+
+		moved, err := moveFolder(c.Context(), requestDatabase(c.Context()), from, to)
+		if err != nil {
+			return err
+		}
+
+		return respond(c, fiber.StatusOK, "Folder moved successfully", "folder", fiber.Map{
+			"from":  from,
+			"to":    to,
+			"moved": moved,
+		})
+	})
+
+	// Create an empty folder. Folders containing images need not be created.
+	// @param path string folder path
+	// @return folder path
+	app.Post("/api/folders/*", func(c *fiber.Ctx) error {
+		folder, err := folderParam(c)
+		if err != nil {
+			return err
+		}
+		if folder == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Root folder always exists")
+		}
+
+		if err := createFolder(c.Context(), requestDatabase(c.Context()), folder); err != nil {
+			return err
+		}
+
+		return respond(c, fiber.StatusCreated, "Folder created successfully", "folder", fiber.Map{
+			"path": folder,
+		})
+	})
+
+	// Delete a folder recursively, including all versions of its images
+	// @param path string folder path
+	// @return deleted image count
+	app.Delete("/api/folders/*", func(c *fiber.Ctx) error {
+		folder, err := folderParam(c)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := deleteFolder(c.Context(), requestDatabase(c.Context()), folder)
+		if err != nil {
+			return err
+		}
+
+		return respond(c, fiber.StatusOK, "Folder deleted successfully", "folder", fiber.Map{
+			"path":    folder,
+			"deleted": deleted,
+		})
+	})
+}
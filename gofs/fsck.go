@@ -0,0 +1,284 @@
+package gofs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Problems found by the consistency check
+const (
+	fsckMissingChunks    = "missing_chunks"
+	fsckExtraChunks      = "extra_chunks"
+	fsckChunkSize        = "chunk_size"
+	fsckChecksumMismatch = "checksum_mismatch"
+)
+
+// Repairs of problems found by the consistency check
+const (
+	// Delete chunks past the end of the file, its content is intact
+	fsckDeleteExtraChunks = "delete_extra_chunks"
+	// Delete the file, its content is lost
+	fsckDeleteFile = "delete_file"
+	// Nothing is repaired automatically, the file needs a look
+	fsckRepairNone = "none"
+)
+
+// Problem of a file found by the consistency check
+type fsckIssue struct {
+	FileId   primitive.ObjectID `json:"fileId"`
+	Filename string             `json:"filename"`
+	Problem  string             `json:"problem"`
+	Detail   string             `json:"detail"`
+	Repair   string             `json:"repair"`
+	Repaired bool               `json:"repaired"`
+}
+
+// Result of the consistency check of a bucket
+type fsckReport struct {
+	Bucket string `json:"bucket"`
+	// Content was re-hashed against stored checksums
+	Hashed bool `json:"hashed"`
+	// Repairs were applied
+	Repaired     bool        `json:"repaired"`
+	CheckedFiles int64       `json:"checkedFiles"`
+	HashedFiles  int64       `json:"hashedFiles"`
+	Issues       []fsckIssue `json:"issues"`
+}
+
+// Chunk of a file without its data
+type fsckChunk struct {
+	N    int64 `bson:"n"`
+	Size int64 `bson:"size"`
+}
+
+// Compare the chunks of a file with its length and chunk size. Only the first
+// problem is reported, later ones usually follow from it.
+// @param fileDoc bson.M files document
+// @param chunks []fsckChunk chunks sorted by n
+// @return string problem, empty if the chunks are consistent
+// @return string detail
+// @return string repair
+func checkChunks(fileDoc bson.M, chunks []fsckChunk) (string, string, string) {
+	chunkSize := fileChunkSize(fileDoc)
+	length := fileLength(fileDoc)
+	expected := (length + chunkSize - 1) / chunkSize
+
+	for i, chunk := range chunks {
+		if chunk.N != int64(i) {
+			return fsckMissingChunks, fmt.Sprintf("chunk %d is missing", i), fsckDeleteFile
+		}
+		if chunk.N >= expected {
+			return fsckExtraChunks, fmt.Sprintf("%d chunks, length %d needs %d", len(chunks), length, expected), fsckDeleteExtraChunks
+		}
+		size := chunkSize
+		if chunk.N == expected-1 {
+			size = length - chunk.N*chunkSize
+		}
+		if chunk.Size != size {
+			return fsckChunkSize, fmt.Sprintf("chunk %d has %d bytes, expected %d", chunk.N, chunk.Size, size), fsckDeleteFile
+		}
+	}
+	if int64(len(chunks)) < expected {
+		return fsckMissingChunks, fmt.Sprintf("%d chunks, length %d needs %d", len(chunks), length, expected), fsckDeleteFile
+	}
+	return "", "", ""
+}
+
+// Get chunk numbers and sizes of a file
+// @param ctx context.Context
+// @param chunks *mongo.Collection chunks collection
+// @param id interface{} file id
+// @return []fsckChunk chunks sorted by n
+// @return error error
+func fileChunks(ctx context.Context, chunks *mongo.Collection, id interface{}) ([]fsckChunk, error) {
+	cursor, err := chunks.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"files_id": id}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "n": 1, "size": bson.M{"$binarySize": "$data"}}}},
+		{{Key: "$sort", Value: bson.M{"n": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := []fsckChunk{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Re-hash content of a file and compare it with its stored md5 checksum.
+// Files written by current drivers and not uploaded through S3 have none.
+// @param ctx context.Context
+// @param bucket *gridfs.Bucket bucket
+// @param fileDoc bson.M files document
+// @return bool content was hashed
+// @return string detail of a mismatch, empty if the checksum matches
+// @return error error
+func verifyChecksum(ctx context.Context, bucket *gridfs.Bucket, fileDoc bson.M) (bool, string, error) {
+	stored, ok := fileDoc["md5"].(string)
+	if !ok {
+		return false, "", nil
+	}
+	stream, err := bucket.OpenDownloadStream(fileDoc["_id"])
+	if err != nil {
+		return false, "", err
+	}
+	defer stream.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, stream); err != nil {
+		return false, "", err
+	}
+	if computed := hex.EncodeToString(hash.Sum(nil)); computed != stored {
+		return true, "md5 " + computed + ", stored " + stored, nil
+	}
+	return true, "", nil
+}
+
+// Apply the repair of an issue
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param issue *fsckIssue issue, marked repaired on success
+// @param chunkCount int64 number of chunks the file should have
+// @return error error
+func repairIssue(ctx context.Context, db *mongo.Database, bucket string, issue *fsckIssue, chunkCount int64) error {
+	switch issue.Repair {
+	case fsckDeleteExtraChunks:
+		if _, err := namedChunksCollection(db, bucket).DeleteMany(ctx, bson.M{"files_id": issue.FileId, "n": bson.M{"$gte": chunkCount}}); err != nil {
+			return err
+		}
+	case fsckDeleteFile:
+		gridfsBucket, err := namedBucket(db, bucket)
+		if err != nil {
+			return err
+		}
+		if err := gridfsBucket.DeleteContext(ctx, issue.FileId); err != nil {
+			return err
+		}
+		forgetDownloads(ctx, db, issue.FileId)
+		uncacheFiles(ctx, bucket, issue.FileId)
+		purgeFile(bucket, issue.FileId, issue.Filename)
+		replicateFile(ctx, bucket, issue.FileId)
+		publishEvent(eventFileDeleted, fiber.Map{"id": issue.FileId, "reason": "corrupt"})
+	default:
+		return nil
+	}
+	issue.Repaired = true
+	return nil
+}
+
+// Check every file of a GridFS bucket: its chunks must be numbered without
+// gaps, each must hold chunkSize bytes except the last holding the rest, and
+// together they must hold length bytes. With hash the content of files with
+// a stored md5 checksum is re-hashed too. With repair the suggested repairs
+// are applied, except for checksum mismatches which need a look.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param hash bool re-hash content against stored checksums
+// @param repair bool apply suggested repairs
+// @return fsckReport report
+// @return error error
+func checkBucket(ctx context.Context, db *mongo.Database, bucket string, hash, repair bool) (fsckReport, error) {
+	report := fsckReport{Bucket: bucket, Hashed: hash, Repaired: repair, Issues: []fsckIssue{}}
+	gridfsBucket, err := namedBucket(db, bucket)
+	if err != nil {
+		return report, err
+	}
+	chunks := namedChunksCollection(db, bucket)
+
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	cursor, err := namedFilesCollection(db, bucket).Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return report, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var fileDoc bson.M
+		if err := cursor.Decode(&fileDoc); err != nil {
+			return report, err
+		}
+		report.CheckedFiles++
+		id, _ := fileDoc["_id"].(primitive.ObjectID)
+		filename, _ := fileDoc["filename"].(string)
+
+		fileChunkList, err := fileChunks(ctx, chunks, fileDoc["_id"])
+		if err != nil {
+			return report, err
+		}
+		issue := fsckIssue{FileId: id, Filename: filename}
+		issue.Problem, issue.Detail, issue.Repair = checkChunks(fileDoc, fileChunkList)
+
+		// Content with inconsistent chunks can't be hashed
+		if issue.Problem == "" && hash {
+			hashed, mismatch, err := verifyChecksum(ctx, gridfsBucket, fileDoc)
+			if err != nil {
+				return report, err
+			}
+			if hashed {
+				report.HashedFiles++
+			}
+			if mismatch != "" {
+				issue.Problem, issue.Detail, issue.Repair = fsckChecksumMismatch, mismatch, fsckRepairNone
+			}
+		}
+		if issue.Problem == "" {
+			continue
+		}
+
+		if repair {
+			chunkSize := fileChunkSize(fileDoc)
+			if err := repairIssue(ctx, db, bucket, &issue, (fileLength(fileDoc)+chunkSize-1)/chunkSize); err != nil {
+				return report, err
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	return report, cursor.Err()
+}
+
+// Register consistency check route on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerFsckRoutes(admin fiber.Router) {
+	// Check chunks of every file of a bucket against its length, optionally
+	// re-hashing content, and report or repair the problems found
+	// @param bucket string default bucket if empty
+	// @param hash bool re-hash content against stored checksums
+	// @param repair bool apply suggested repairs
+	// @return check report
+	admin.Post("/maintenance/fsck", func(c *fiber.Ctx) error {
+		if config.StorageBackend != "gridfs" {
+			return fiber.NewError(fiber.StatusConflict, "Storage backend "+config.StorageBackend+" has no GridFS chunks")
+		}
+		bucket := c.Query("bucket", config.BucketName)
+		if !managedBucket(bucket) {
+			return newError(fiber.StatusNotFound, CodeBucketNotFound, "Unknown bucket "+bucket)
+		}
+
+		report, err := checkBucket(c.Context(), database(), bucket, c.QueryBool("hash"), c.QueryBool("repair"))
+		if err != nil {
+			return err
+		}
+		if len(report.Issues) > 0 {
+			logger.Warn("consistency check found issues",
+				"bucket", report.Bucket,
+				"checked_files", report.CheckedFiles,
+				"issues", len(report.Issues),
+				"repaired", report.Repaired,
+			)
+		}
+		return respond(c, fiber.StatusOK, "Consistency check finished", "report", report)
+	})
+}
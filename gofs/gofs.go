@@ -0,0 +1,223 @@
+// Package gofs is an image file service on MongoDB GridFS. It can run as the
+// standalone server in the repository root or be mounted into an existing
+// Fiber application:
+//
+//	cfg, err := gofs.LoadConfig()
+//	if err != nil {
+//		return err
+//	}
+//	files, err := gofs.New(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	app.Mount("/files", files)
+//	if err := gofs.StartServices(cfg); err != nil {
+//		return err
+//	}
+//
+// Mounted apps are served with the configuration of the host app, which
+// sets the body limit and request body streaming, see AppConfig. The
+// configuration is global to the package, a process serves one.
+//
+// Call Shutdown after the host application stopped serving requests.
+package gofs
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+)
+
+// Register all routes of the file service on app. Errors returned by the
+// handlers are formatted by ErrorHandler, which app must be configured with.
+// Use New to get an app which can be mounted as route group of another one.
+// The configuration is global, registering the routes again with another
+// one changes it for the apps registered before.
+// @param app *fiber.App app
+// @param cfg Config configuration
+// @return error error
+func RegisterRoutes(app *fiber.App, cfg Config) error {
+	config = cfg
+	logLevel.Set(cfg.LogLevel)
+	if _, err := connectMongo(context.Background()); err != nil {
+		return err
+	}
+
+	// Routes registered before belong to the host application and are left
+	// out of the API documentation
+	hostRoutes := routeKeys(app)
+
+	// Register request ID and access log middleware
+	registerLoggingMiddleware(app)
+
+	// Answer handlers which panic with 500 instead of crashing the process
+	app.Use(recover.New())
+
+	// Register middleware holding streamed bodies other than forms to
+	// BODY_LIMIT
+	registerBodyLimitMiddleware(app)
+
+	// Register CORS middleware, answering preflight requests
+	registerCORSMiddleware(app)
+
+	// Register middleware attributing file operations to their actor
+	registerAuditMiddleware(app)
+
+	// Register middleware authenticating requests and enforcing their roles
+	registerAuthMiddleware(app)
+
+	// Register middleware selecting the tenant database of requests
+	registerTenantMiddleware(app)
+
+	// Register response compression middleware
+	registerCompressionMiddleware(app)
+
+	// Let GET and HEAD requests read with the configured read preference
+	app.Use(allowSecondaryReads)
+
+	// Register image routes
+	registerImageRoutes(app)
+
+	// Register file versioning routes
+	registerVersionRoutes(app)
+
+	// Register rename route
+	registerRenameRoutes(app)
+
+	// Register metadata routes
+	registerMetadataRoutes(app)
+
+	// Register listing routes
+	registerListRoutes(app)
+
+	// Register search routes
+	registerSearchRoutes(app)
+
+	// Register multi-file upload route
+	registerBatchUploadRoutes(app)
+
+	// Register archive download route
+	registerArchiveRoutes(app)
+
+	// Register copy and move routes
+	registerCopyRoutes(app)
+
+	// Register HLS streaming and poster routes
+	registerVideoRoutes(app)
+
+	// Register file preview route
+	registerPreviewRoutes(app)
+
+	// Register folder routes
+	registerFolderRoutes(app)
+
+	// Register remote upload route
+	registerRemoteUploadRoutes(app)
+
+	// Register upload progress route
+	registerProgressRoutes(app)
+
+	// Register GraphQL route
+	if err := registerGraphQLRoutes(app); err != nil {
+		return err
+	}
+
+	// Register download analytics routes
+	registerAnalyticsRoutes(app)
+
+	// Register OIDC login routes
+	registerOIDCRoutes(app)
+
+	// Register liveness and readiness routes
+	registerHealthRoutes(app)
+
+	// Register profiling, runtime stats, audit trail, maintenance and report
+	// routes
+	registerAdminRoutes(app)
+
+	// Register storage statistics and usage routes
+	registerStatsRoutes(app)
+
+	// Register API documentation routes, after all documented routes
+	registerDocsRoutes(app, hostRoutes)
+	return nil
+}
+
+// Create app serving the file service, configured like the standalone server
+// by AppConfig. Mounted into a host app, the configuration of the host app
+// applies instead: BODY_LIMIT, STREAM_REQUEST_BODY and the timeouts of
+// AppConfig have no effect, the host app has to set them itself.
+// @param cfg Config configuration
+// @return *fiber.App app
+// @return error error
+func New(cfg Config) (*fiber.App, error) {
+	app := fiber.New(AppConfig(cfg))
+	if err := RegisterRoutes(app, cfg); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// Start background services: index creation, expiry cleanup, replication,
+// video transcoding, document previews, change event publishing and the gRPC, S3, WebDAV and
+// SFTP servers enabled in cfg. Services started before one failed to start
+// keep running until Shutdown.
+// @param cfg Config configuration
+// @return error error
+func StartServices(cfg Config) error {
+	config = cfg
+	logLevel.Set(cfg.LogLevel)
+	if _, err := connectMongo(context.Background()); err != nil {
+		return err
+	}
+
+	// Create the GridFS indexes and those backing the query endpoints, in
+	// the databases of all tenants
+	tenants, err := managedTenants(context.Background())
+	if err != nil {
+		logger.Error("list tenants", "error", err)
+	}
+	for _, t := range tenants {
+		ensureIndexes(requestDatabase(withTenant(context.Background(), t)))
+	}
+
+	// Copy changed files to the replica cluster
+	if err := startReplication(); err != nil {
+		return err
+	}
+
+	// Transcode uploaded videos to HLS and extract their posters
+	registerHLSJobs()
+
+	// Convert uploaded Office documents to PDF previews
+	registerPreviewJobs()
+
+	// Deliver file lifecycle events to webhooks
+	registerWebhookJobs()
+
+	// Run the enabled maintenance tasks, e.g. deleting expired files, on
+	// their schedules
+	startMaintenanceSchedule()
+
+	// Run the background jobs of the services above, after them so the
+	// workers stop before the services on shutdown
+	startJobWorkers()
+
+	// Publish file changes to the message broker
+	startChangeStreamPublisher()
+
+	// Serve the gRPC API next to the REST API
+	if err := startGRPCServer(); err != nil {
+		return err
+	}
+
+	// Serve the S3 compatible API next to the REST API
+	startS3Server()
+
+	// Serve the image bucket over WebDAV
+	startWebDAVServer()
+
+	// Serve the image bucket over SFTP
+	return startSFTPServer()
+}
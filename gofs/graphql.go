@@ -0,0 +1,453 @@
+package gofs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Request body of the GraphQL endpoint
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Arbitrary JSON value, used for custom metadata
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Arbitrary JSON value",
+	Serialize: func(value interface{}) interface{} {
+		return value
+	},
+	ParseValue: func(value interface{}) interface{} {
+		return value
+	},
+	ParseLiteral: parseJSONLiteral,
+})
+
+// Convert GraphQL literal to its JSON value
+// @param valueAST ast.Value literal
+// @return interface{} value
+func parseJSONLiteral(valueAST ast.Value) interface{} {
+	switch value := valueAST.(type) {
+	case *ast.ObjectValue:
+		object := map[string]interface{}{}
+		for _, field := range value.Fields {
+			object[field.Name.Value] = parseJSONLiteral(field.Value)
+		}
+		return object
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(value.Values))
+		for _, item := range value.Values {
+			list = append(list, parseJSONLiteral(item))
+		}
+		return list
+	case *ast.IntValue:
+		return graphql.Int.ParseLiteral(value)
+	case *ast.FloatValue:
+		return graphql.Float.ParseLiteral(value)
+	case *ast.BooleanValue:
+		return value.Value
+	case *ast.StringValue:
+		return value.Value
+	case *ast.EnumValue:
+		return value.Value
+	}
+	return nil
+}
+
+// Read field of files document metadata
+// @param fileDoc bson.M files document
+// @param key string
+// @return interface{} value
+func metadataField(fileDoc bson.M, key string) interface{} {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	return metadata[key]
+}
+
+// Format BSON date as RFC 3339 timestamp
+// @param value interface{} date
+// @return interface{} timestamp, nil if value is not a date
+func formatDate(value interface{}) interface{} {
+	if date, ok := value.(primitive.DateTime); ok {
+		return date.Time().UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// Build resolver reading a value from the files document
+// @param read func(bson.M) interface{}
+// @return graphql.FieldResolveFn resolver
+func fileField(read func(fileDoc bson.M) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return read(p.Source.(bson.M)), nil
+	}
+}
+
+// File stored in the GridFS bucket
+var fileType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "File",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.ID),
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return fileDoc["_id"].(primitive.ObjectID).Hex()
+			}),
+		},
+		"filename": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.String),
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return fileDoc["filename"]
+			}),
+		},
+		"size": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.Float),
+			Description: "Size in bytes",
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return fileLength(fileDoc)
+			}),
+		},
+		"contentType": &graphql.Field{
+			Type: graphql.String,
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return contentTypes[fileExtension(fileDoc)]
+			}),
+		},
+		"uploadDate": &graphql.Field{
+			Type: graphql.String,
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return formatDate(fileDoc["uploadDate"])
+			}),
+		},
+		"version": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return fileVersion(fileDoc, 0)
+			}),
+		},
+		"current": &graphql.Field{
+			Type: graphql.Boolean,
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return metadataField(fileDoc, "current")
+			}),
+		},
+		"expiresAt": &graphql.Field{
+			Type: graphql.String,
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return formatDate(metadataField(fileDoc, "expiresAt"))
+			}),
+		},
+		"tags": &graphql.Field{
+			Type: graphql.NewList(graphql.NewNonNull(graphql.String)),
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return metadataField(fileDoc, "tags")
+			}),
+		},
+		"description": &graphql.Field{
+			Type: graphql.String,
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return metadataField(fileDoc, "description")
+			}),
+		},
+		"metadata": &graphql.Field{
+			Type:        jsonScalar,
+			Description: "Complete metadata document including custom fields",
+			Resolve: fileField(func(fileDoc bson.M) interface{} {
+				return fileDoc["metadata"]
+			}),
+		},
+	},
+})
+
+// Page of files matching a query
+var filePageType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "FilePage",
+	Fields: graphql.Fields{
+		"items": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType)))},
+		"total": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"skip":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"limit": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+// Criteria of the files query, same as the listing endpoint query parameters
+var fileFilterType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "FileFilter",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"tags":           &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		"match":          &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "all or any"},
+		"uploadedAfter":  &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "RFC 3339 timestamp"},
+		"uploadedBefore": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "RFC 3339 timestamp"},
+		"minSize":        &graphql.InputObjectFieldConfig{Type: graphql.Float},
+		"maxSize":        &graphql.InputObjectFieldConfig{Type: graphql.Float},
+		"contentType":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+// Files document keys of the sortable file fields
+var fileSortKeys = map[string]string{
+	"UPLOAD_DATE": "uploadDate",
+	"FILENAME":    "filename",
+	"SIZE":        "length",
+}
+
+// Sortable file fields
+var fileSortFieldType = graphql.NewEnum(graphql.EnumConfig{
+	Name: "FileSortField",
+	Values: graphql.EnumValueConfigMap{
+		"UPLOAD_DATE": &graphql.EnumValueConfig{Value: "UPLOAD_DATE"},
+		"FILENAME":    &graphql.EnumValueConfig{Value: "FILENAME"},
+		"SIZE":        &graphql.EnumValueConfig{Value: "SIZE"},
+	},
+})
+
+// Sort direction
+var sortOrderType = graphql.NewEnum(graphql.EnumConfig{
+	Name: "SortOrder",
+	Values: graphql.EnumValueConfigMap{
+		"ASC":  &graphql.EnumValueConfig{Value: "ASC"},
+		"DESC": &graphql.EnumValueConfig{Value: "DESC"},
+	},
+})
+
+// Convert files query filter argument to listing criteria
+// @param args map[string]interface{} filter argument, may be nil
+// @return FileFilter criteria
+func graphqlFileFilter(args map[string]interface{}) FileFilter {
+	var f FileFilter
+	if tags, ok := args["tags"].([]interface{}); ok {
+		for _, tag := range tags {
+			f.Tags = append(f.Tags, tag.(string))
+		}
+	}
+	f.Match, _ = args["match"].(string)
+	f.UploadedAfter, _ = args["uploadedAfter"].(string)
+	f.UploadedBefore, _ = args["uploadedBefore"].(string)
+	f.ContentType, _ = args["contentType"].(string)
+	if size, ok := args["minSize"].(float64); ok {
+		minSize := int64(size)
+		f.MinSize = &minSize
+	}
+	if size, ok := args["maxSize"].(float64); ok {
+		maxSize := int64(size)
+		f.MaxSize = &maxSize
+	}
+	return f
+}
+
+// Find files document by id argument
+// @param ctx context.Context
+// @param id interface{} id argument
+// @return bson.M files document
+// @return error error
+func graphqlFindFile(ctx context.Context, id interface{}) (bson.M, error) {
+	objectId, err := primitive.ObjectIDFromHex(id.(string))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	var fileDoc bson.M
+	if err := filesCollection(requestDatabase(ctx)).FindOne(ctx, activeFilter(bson.M{"_id": objectId})).Decode(&fileDoc); err != nil {
+		return nil, newError(fiber.StatusNotFound, CodeFileNotFound, "Image not found")
+	}
+	return fileDoc, nil
+}
+
+// Queries over file metadata
+var queryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"file": &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphqlFindFile(p.Context, p.Args["id"])
+			},
+		},
+		"files": &graphql.Field{
+			Type: graphql.NewNonNull(filePageType),
+			Args: graphql.FieldConfigArgument{
+				"filter": &graphql.ArgumentConfig{Type: fileFilterType},
+				"sortBy": &graphql.ArgumentConfig{Type: fileSortFieldType, DefaultValue: "UPLOAD_DATE"},
+				"order":  &graphql.ArgumentConfig{Type: sortOrderType, DefaultValue: "DESC"},
+				"skip":   &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultListLimit},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := authorize(p.Context, roleAdmin); err != nil {
+					return nil, err
+				}
+				filterArgs, _ := p.Args["filter"].(map[string]interface{})
+				filter, err := graphqlFileFilter(filterArgs).bson()
+				if err != nil {
+					return nil, err
+				}
+
+				skip, limit := p.Args["skip"].(int), p.Args["limit"].(int)
+				if limit <= 0 || limit > maxListLimit {
+					return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid limit")
+				}
+				if skip < 0 {
+					return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid skip")
+				}
+
+				// Break ties by id so pages don't overlap
+				order := -1
+				if p.Args["order"] == "ASC" {
+					order = 1
+				}
+				sortKey := fileSortKeys[p.Args["sortBy"].(string)]
+				findOptions := options.Find().
+					SetSort(bson.D{{Key: sortKey, Value: order}, {Key: "_id", Value: order}}).
+					SetSkip(int64(skip)).
+					SetLimit(int64(limit))
+				collection := filesCollection(requestDatabase(p.Context))
+				cursor, err := collection.Find(p.Context, filter, findOptions)
+				if err != nil {
+					return nil, err
+				}
+				fileDocs := []bson.M{}
+				if err := cursor.All(p.Context, &fileDocs); err != nil {
+					return nil, err
+				}
+				total, err := collection.CountDocuments(p.Context, filter)
+				if err != nil {
+					return nil, err
+				}
+
+				return map[string]interface{}{
+					"items": fileDocs,
+					"total": total,
+					"skip":  skip,
+					"limit": limit,
+				}, nil
+			},
+		},
+	},
+})
+
+// Mutations of file metadata
+var mutationType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Mutation",
+	Fields: graphql.Fields{
+		"deleteFile": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Boolean),
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := authorize(p.Context, roleAdmin); err != nil {
+					return nil, err
+				}
+				id, err := primitive.ObjectIDFromHex(p.Args["id"].(string))
+				if err != nil {
+					return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+				}
+				if err := deleteFile(p.Context, id); err != nil {
+					return nil, err
+				}
+				return true, nil
+			},
+		},
+		"renameFile": &graphql.Field{
+			Type:        graphql.NewNonNull(fileType),
+			Description: "Rename all versions of a file",
+			Args: graphql.FieldConfigArgument{
+				"id":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"filename": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := authorize(p.Context, roleUploader); err != nil {
+					return nil, err
+				}
+				fileDoc, err := graphqlFindFile(p.Context, p.Args["id"])
+				if err != nil {
+					return nil, err
+				}
+				filename := p.Args["filename"].(string)
+				if err := renameFile(p.Context, requestDatabase(p.Context), fileDoc, filename); err != nil {
+					return nil, err
+				}
+				fileDoc["filename"] = filename
+				return fileDoc, nil
+			},
+		},
+		"updateFileMetadata": &graphql.Field{
+			Type:        graphql.NewNonNull(fileType),
+			Description: "Merge custom metadata fields (null removes a field) or replace all of them",
+			Args: graphql.FieldConfigArgument{
+				"id":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"metadata": &graphql.ArgumentConfig{Type: graphql.NewNonNull(jsonScalar)},
+				"mode":     &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "merge", Description: "merge or replace"},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := authorize(p.Context, roleUploader); err != nil {
+					return nil, err
+				}
+				fileDoc, err := graphqlFindFile(p.Context, p.Args["id"])
+				if err != nil {
+					return nil, err
+				}
+				custom, ok := p.Args["metadata"].(map[string]interface{})
+				if !ok {
+					return nil, fiber.NewError(fiber.StatusBadRequest, "metadata must be an object")
+				}
+				metadata, err := updateFileMetadata(p.Context, requestDatabase(p.Context), fileDoc, custom, p.Args["mode"].(string))
+				if err != nil {
+					return nil, err
+				}
+				fileDoc["metadata"] = metadata
+				return fileDoc, nil
+			},
+		},
+	},
+})
+
+// Register GraphQL route
+// @param app *fiber.App app
+// @return error error building the schema
+func registerGraphQLRoutes(app *fiber.App) error {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: mutationType,
+	})
+	if err != nil {
+		return fmt.Errorf("build graphql schema: %w", err)
+	}
+
+	// Run GraphQL query or mutation over file metadata. The response follows
+	// the GraphQL spec, {data, errors}, regardless of the response format.
+	// @param query string
+	// @param operationName string
+	// @param variables object
+	// @return GraphQL result
+	app.Post("/graphql", func(c *fiber.Ctx) error {
+		var body graphqlRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if body.Query == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "query is required")
+		}
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  body.Query,
+			OperationName:  body.OperationName,
+			VariableValues: body.Variables,
+			Context:        c.Context(),
+		})
+		return c.JSON(result)
+	})
+	return nil
+}
@@ -0,0 +1,397 @@
+package gofs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	gofsv1 "github.com/roshanpaturkar/go-mongo-fs/api/gofs/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Size of content chunks sent by the Download RPC
+const grpcChunkSize = 64 * 1024
+
+// gRPC file service sharing the storage functions of the REST API
+type fileServiceServer struct {
+	gofsv1.UnimplementedFileServiceServer
+}
+
+// Convert error to gRPC status, keeping the meaning of HTTP status codes
+// @param err error
+// @return error status error
+func grpcError(err error) error {
+	switch errorStatus(err) {
+	case 400, 422:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case 401:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case 403:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case 404:
+		return status.Error(codes.NotFound, err.Error())
+	case 409:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case 413:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Roles required by the RPCs, following the policy of the REST routes:
+// listing all files requires admins like deleting them
+var grpcMethodRoles = map[string]string{
+	gofsv1.FileService_Upload_FullMethodName:   roleUploader,
+	gofsv1.FileService_Download_FullMethodName: roleReader,
+	gofsv1.FileService_List_FullMethodName:     roleAdmin,
+	gofsv1.FileService_Delete_FullMethodName:   roleAdmin,
+}
+
+// Authenticate a call by the authorization and x-api-key metadata, like REST
+// requests, select its tenant and check the role of its method. Registered
+// Authenticators read HTTP requests and are not asked.
+// @param ctx context.Context call context
+// @param method string full method name
+// @return context.Context context carrying the principal
+// @return error status error
+func grpcAuthorize(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	value := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	p, err := credentialPrincipal(ctx, value(fiber.HeaderAuthorization), value(apiKeyHeader))
+	if p == nil && err == nil {
+		p, err = anonymousPrincipal()
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ctx = context.WithValue(ctx, principalKey{}, p)
+	if config.TenantMode != "" {
+		// Calls name their tenant in the tenant header metadata in both modes
+		t, err := resolveTenant(ctx, value(config.TenantHeader), p)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		ctx = withTenant(ctx, t)
+	}
+	source := auditSourceFrom(ctx)
+	if p.Authenticated {
+		source.Actor = p.Actor
+	}
+	ctx = withAuditSource(ctx, source)
+
+	// Methods added without a role are for admins only
+	role, ok := grpcMethodRoles[method]
+	if !ok {
+		role = roleAdmin
+	}
+	if err := authorize(ctx, role); err != nil {
+		return nil, grpcError(err)
+	}
+	return ctx, nil
+}
+
+// Interceptor authorizing unary calls
+// @param ctx context.Context
+// @param req interface{} request
+// @param info *grpc.UnaryServerInfo
+// @param handler grpc.UnaryHandler
+// @return interface{} response
+// @return error error
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Server stream with the context of the authorized call
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Get context of the call, carrying the principal
+// @return context.Context context
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Interceptor authorizing streaming calls
+// @param srv interface{} service
+// @param stream grpc.ServerStream
+// @param info *grpc.StreamServerInfo
+// @param handler grpc.StreamHandler
+// @return error error
+func grpcStreamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthorize(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+}
+
+// Convert files document to gRPC file info
+// @param fileDoc bson.M files document
+// @return *gofsv1.FileInfo file info
+func grpcFileInfo(fileDoc bson.M) *gofsv1.FileInfo {
+	info := &gofsv1.FileInfo{
+		Id:          fileDoc["_id"].(primitive.ObjectID).Hex(),
+		Filename:    fileDoc["filename"].(string),
+		Size:        fileLength(fileDoc),
+		ContentType: contentTypes[fileExtension(fileDoc)],
+		Version:     int32(fileVersion(fileDoc, 0)),
+	}
+	if uploadDate, ok := fileDoc["uploadDate"].(primitive.DateTime); ok {
+		info.UploadDate = uploadDate.Time().UTC().Format(time.RFC3339)
+	}
+	if metadata, ok := fileDoc["metadata"].(bson.M); ok {
+		if tags, ok := metadata["tags"].(bson.A); ok {
+			for _, tag := range tags {
+				if tag, ok := tag.(string); ok {
+					info.Tags = append(info.Tags, tag)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// Reader over the content chunks of an upload stream
+type uploadStreamReader struct {
+	stream gofsv1.FileService_UploadServer
+	buffer []byte
+}
+
+// Read content, receiving the next chunk when the current one is used up
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (r *uploadStreamReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buffer = req.GetChunk()
+	}
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+// Upload file streamed by the client
+// @param stream gofsv1.FileService_UploadServer
+// @return error error
+func (s *fileServiceServer) Upload(stream gofsv1.FileService_UploadServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := req.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "first message must carry the upload header")
+	}
+
+	custom := map[string]interface{}{}
+	if len(header.Tags) > 0 {
+		tags := make([]interface{}, 0, len(header.Tags))
+		for _, tag := range header.Tags {
+			tags = append(tags, tag)
+		}
+		custom["tags"] = tags
+	}
+	if header.Description != "" {
+		custom["description"] = header.Description
+	}
+	if err := validateCustomMetadata(custom); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	expiresAt, err := parseExpiry(header.ExpiresAt)
+	if err != nil {
+		return grpcError(err)
+	}
+	collision, err := collisionPolicy(header.Collision)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	db := requestDatabase(stream.Context())
+	image, err := storeUpload(stream.Context(), db, header.Filename, &uploadStreamReader{stream: stream}, uploadOptions{
+		Folder:    header.Folder,
+		Collision: collision,
+		Custom:    custom,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+
+	var fileDoc bson.M
+	if err := filesCollection(db).FindOne(stream.Context(), bson.M{"_id": image["id"]}).Decode(&fileDoc); err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(grpcFileInfo(fileDoc))
+}
+
+// Download file by id or current version by filename
+// @param req *gofsv1.DownloadRequest
+// @param stream gofsv1.FileService_DownloadServer
+// @return error error
+func (s *fileServiceServer) Download(req *gofsv1.DownloadRequest, stream gofsv1.FileService_DownloadServer) error {
+	db := requestDatabase(stream.Context())
+
+	var fileDoc bson.M
+	var err error
+	switch {
+	case req.Id != "":
+		id, parseErr := primitive.ObjectIDFromHex(req.Id)
+		if parseErr != nil {
+			return status.Error(codes.InvalidArgument, parseErr.Error())
+		}
+		err = filesCollection(db).FindOne(stream.Context(), activeFilter(bson.M{"_id": id})).Decode(&fileDoc)
+	case req.Filename != "":
+		fileDoc, err = findCurrentByName(stream.Context(), db, req.Filename)
+	default:
+		return status.Error(codes.InvalidArgument, "id or filename is required")
+	}
+	if err != nil {
+		return status.Error(codes.NotFound, "Image not found")
+	}
+
+	if err := stream.Send(&gofsv1.DownloadResponse{Data: &gofsv1.DownloadResponse_Info{Info: grpcFileInfo(fileDoc)}}); err != nil {
+		return err
+	}
+
+	bucket, err := imageBucket(db)
+	if err != nil {
+		return grpcError(err)
+	}
+	downloadStream, err := bucket.OpenDownloadStream(fileDoc["_id"])
+	trackDownload(stream.Context(), fileDoc, err)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer downloadStream.Close()
+
+	buffer := make([]byte, grpcChunkSize)
+	for {
+		n, err := downloadStream.Read(buffer)
+		if n > 0 {
+			chunk := &gofsv1.DownloadResponse{Data: &gofsv1.DownloadResponse_Chunk{Chunk: buffer[:n]}}
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return grpcError(err)
+		}
+	}
+}
+
+// List files, optionally filtered by tags
+// @param ctx context.Context
+// @param req *gofsv1.ListRequest
+// @return *gofsv1.ListResponse files
+// @return error error
+func (s *fileServiceServer) List(ctx context.Context, req *gofsv1.ListRequest) (*gofsv1.ListResponse, error) {
+	filter, err := FileFilter{Tags: req.Tags, Match: strings.ToLower(req.Match)}.bson()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if limit < 0 || limit > maxListLimit || req.Skip < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Invalid skip or limit")
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "uploadDate", Value: -1}}).SetSkip(req.Skip).SetLimit(limit)
+	cursor, err := filesCollection(requestDatabase(ctx)).Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	var fileDocs []bson.M
+	if err := cursor.All(ctx, &fileDocs); err != nil {
+		return nil, grpcError(err)
+	}
+
+	res := &gofsv1.ListResponse{Files: make([]*gofsv1.FileInfo, 0, len(fileDocs))}
+	for _, fileDoc := range fileDocs {
+		res.Files = append(res.Files, grpcFileInfo(fileDoc))
+	}
+	return res, nil
+}
+
+// Delete file by id
+// @param ctx context.Context
+// @param req *gofsv1.DeleteRequest
+// @return *gofsv1.DeleteResponse empty response
+// @return error error
+func (s *fileServiceServer) Delete(ctx context.Context, req *gofsv1.DeleteRequest) (*gofsv1.DeleteResponse, error) {
+	id, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := deleteFile(ctx, id); err != nil {
+		return nil, grpcError(err)
+	}
+	return &gofsv1.DeleteResponse{}, nil
+}
+
+// Serve the gRPC API in the background if a listen address is configured
+// @return error error listening
+func startGRPCServer() error {
+	if config.GRPCListenAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", config.GRPCListenAddr)
+	if err != nil {
+		return fmt.Errorf("grpc server: %w", err)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpcUnaryAuth), grpc.StreamInterceptor(grpcStreamAuth))
+	gofsv1.RegisterFileServiceServer(server, &fileServiceServer{})
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("grpc server stopped", "error", err)
+		}
+	}()
+
+	// Let running calls finish, cancelling them at the drain deadline
+	onShutdown(func(ctx context.Context) {
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			server.Stop()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,58 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Check that MongoDB answers and the default bucket can be queried
+// @param ctx context.Context
+// @return string failed check, empty if ready
+// @return error error
+func checkReadiness(ctx context.Context) (string, error) {
+	client, err := connectMongo(ctx)
+	if err != nil {
+		return "MongoDB is not reachable", err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		return "MongoDB is not reachable", err
+	}
+
+	db := client.Database(config.DatabaseName)
+	findOptions := options.FindOne().SetProjection(bson.M{"_id": 1})
+	err = filesCollection(db).FindOne(ctx, bson.M{}, findOptions).Err()
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return "Bucket " + config.BucketName + " is not accessible", err
+	}
+	return "", nil
+}
+
+// Register liveness and readiness routes
+// @param app *fiber.App app
+func registerHealthRoutes(app *fiber.App) {
+	// Report that the process is up, without touching the database
+	// @return success message
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return respond(c, fiber.StatusOK, "OK", "", nil)
+	})
+
+	// Report whether requests can be served: MongoDB answers a ping and the
+	// default bucket can be queried within the readiness timeout
+	// @return success message
+	app.Get("/readyz", func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.Context(), config.ReadinessTimeout)
+		defer cancel()
+
+		// Details stay in the log, probes may be reachable from outside
+		if check, err := checkReadiness(ctx); err != nil {
+			requestLogger(c).Warn("not ready", "check", check, "error", err)
+			return respondError(c, fiber.StatusServiceUnavailable, CodeUnavailable, check)
+		}
+		return respond(c, fiber.StatusOK, "Ready", "", nil)
+	})
+}
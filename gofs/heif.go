@@ -0,0 +1,249 @@
+package gofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Error returned for content which is not a HEIF image
+var errInvalidHEIF = errors.New("heif: invalid format")
+
+// Content types of HEIF images. HEIC is HEIF with HEVC coded images, phones
+// use both for the same files.
+var heifContentTypes = map[string]bool{
+	"image/heic": true,
+	"image/heif": true,
+}
+
+// Register HEIF with the image package by the brands of its ftyp box. Only
+// the header is parsed, image data is checked by checkHEIF.
+func init() {
+	for _, brand := range []string{"heic", "heix", "hevc", "hevx"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+	for _, brand := range []string{"mif1", "msf1"} {
+		image.RegisterFormat("heif", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+// Decode HEIF image, not supported as HEVC is not decoded in process
+// @param r io.Reader
+// @return image.Image image
+// @return error error
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	return nil, errors.New("heif: decoding is not supported")
+}
+
+// Read header of an ISO base media file box
+// @param r io.Reader
+// @return string box type
+// @return int64 payload size, -1 if the box extends to the end of the file
+// @return error error
+func readBoxHeader(r io.Reader) (string, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	switch size {
+	case 0:
+		return string(header[4:8]), -1, nil
+	case 1:
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(large[:])) - 8
+	}
+	if size < 8 {
+		return "", 0, errors.New("invalid box size")
+	}
+	return string(header[4:8]), size - 8, nil
+}
+
+// Call fn with the type and payload of each box in data
+// @param data []byte boxes
+// @param fn func(string, []byte) error
+// @return error error
+func eachBox(data []byte, fn func(typ string, payload []byte) error) error {
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		typ, size, err := readBoxHeader(reader)
+		if err != nil {
+			return errors.New("invalid box")
+		}
+		if size < 0 || size > int64(reader.Len()) {
+			size = int64(reader.Len())
+		}
+		payload := data[len(data)-reader.Len():][:size]
+		reader.Seek(size, io.SeekCurrent)
+		if err := fn(typ, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode dimensions of a HEIF image from the image spatial extents (ispe)
+// properties of its meta box. Images may be tiled, the largest extent is
+// the one of the whole image.
+// @param r io.Reader
+// @return image.Config config
+// @return error error
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	for {
+		typ, size, err := readBoxHeader(r)
+		if err != nil {
+			return image.Config{}, errInvalidHEIF
+		}
+		if typ == "mdat" || size < 0 {
+			// Image data before the metadata is not supported
+			return image.Config{}, errInvalidHEIF
+		}
+		if typ != "meta" {
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return image.Config{}, errInvalidHEIF
+			}
+			continue
+		}
+
+		if size > maxImageHeaderBytes {
+			return image.Config{}, errInvalidHEIF
+		}
+		meta := make([]byte, size)
+		if _, err := io.ReadFull(r, meta); err != nil || size < 4 {
+			return image.Config{}, errInvalidHEIF
+		}
+		cfg := image.Config{ColorModel: color.YCbCrModel}
+		// meta is a full box, its children follow version and flags
+		err = eachBox(meta[4:], func(typ string, payload []byte) error {
+			if typ != "iprp" {
+				return nil
+			}
+			return eachBox(payload, func(typ string, payload []byte) error {
+				if typ != "ipco" {
+					return nil
+				}
+				return eachBox(payload, func(typ string, payload []byte) error {
+					if typ != "ispe" || len(payload) < 12 {
+						return nil
+					}
+					width := int(binary.BigEndian.Uint32(payload[4:8]))
+					height := int(binary.BigEndian.Uint32(payload[8:12]))
+					if int64(width)*int64(height) > int64(cfg.Width)*int64(cfg.Height) {
+						cfg.Width, cfg.Height = width, height
+					}
+					return nil
+				})
+			})
+		})
+		if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+			return image.Config{}, errInvalidHEIF
+		}
+		return cfg, nil
+	}
+}
+
+// Check the top-level boxes of a HEIF image: their sizes have to add up to
+// the file size and the image data has to follow the metadata
+// @param data []byte HEIF image
+// @return error error if the image is invalid or truncated
+func checkHEIF(data []byte) error {
+	reader := bytes.NewReader(data)
+	var meta, mdat bool
+	for reader.Len() > 0 {
+		typ, size, err := readBoxHeader(reader)
+		if err != nil {
+			return errors.New("heif: truncated box")
+		}
+		if size < 0 {
+			size = int64(reader.Len())
+		}
+		if size > int64(reader.Len()) {
+			return errors.New("heif: truncated box " + typ)
+		}
+		reader.Seek(size, io.SeekCurrent)
+		switch typ {
+		case "meta":
+			meta = true
+		case "mdat":
+			mdat = true
+		}
+	}
+	if !meta || !mdat {
+		return errors.New("heif: missing image data")
+	}
+	return nil
+}
+
+// Check if a file is a HEIF image
+// @param fileDoc bson.M files document
+// @return bool heif
+func isHEIF(fileDoc bson.M) bool {
+	return heifContentTypes[contentTypes[fileExtension(fileDoc)]]
+}
+
+// Check if an Accept header names a HEIF content type, other than with
+// q=0
+// @param accept string Accept header
+// @return bool accepted
+func acceptsHEIF(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !heifContentTypes[strings.ToLower(strings.TrimSpace(params[0]))] {
+			continue
+		}
+		accepted := true
+		for _, param := range params[1:] {
+			if q, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				weight, err := strconv.ParseFloat(q, 64)
+				accepted = err != nil || weight > 0
+			}
+		}
+		if accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a HEIF image is to be sent as JPEG rendition: when asked for
+// with format=jpeg, or with format auto if the Accept header names no HEIF
+// content type and HEIC_CONVERTER is configured. format=original always
+// sends the stored image.
+// @param c *fiber.Ctx context
+// @return bool send JPEG rendition
+// @return error error if the format is unknown or conversion not configured
+func wantsJPEG(c *fiber.Ctx) (bool, error) {
+	c.Vary(fiber.HeaderAccept)
+	switch strings.ToLower(c.Query("format")) {
+	case "", "auto":
+		accept := c.Get(fiber.HeaderAccept)
+		return config.HEICConverter != "" && accept != "" && !acceptsHEIF(accept), nil
+	case "original":
+		return false, nil
+	case "jpeg", "jpg":
+		if config.HEICConverter == "" {
+			return false, newError(fiber.StatusNotAcceptable, CodeNotAcceptable, "JPEG renditions are not available")
+		}
+		return true, nil
+	default:
+		return false, validation.Errors{{In: validation.Query, Field: "format", Code: string(CodeValidation), Message: "format must be one of auto, original, jpeg"}}
+	}
+}
+
+// Get JPEG rendition of HEIF images, converted by HEIC_CONVERTER
+// @return rendition rendition
+func heicRendition() rendition {
+	return rendition{name: "jpeg", command: config.HEICConverter, format: "jpeg", ext: ".jpg"}
+}
@@ -0,0 +1,595 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Delays and limits of the transcoding workers
+const (
+	// Time a worker has to transcode a video before another one may take the
+	// job over, also the time limit of ffmpeg
+	hlsLease = time.Hour
+	// Delay before the first retry of a failed job, doubled on every further
+	// attempt
+	hlsRetryDelay = time.Minute
+	// Attempts after which a failing job is dead, as a video ffmpeg can't
+	// read fails every time
+	hlsMaxAttempts = 5
+	// Target duration of the segments in seconds
+	hlsSegmentSeconds = 6
+	// Bitrate of the audio of all renditions
+	hlsAudioBitrate = 128000
+)
+
+// Names of the master playlist and the poster in the derived bucket, under
+// the id of their video
+const (
+	hlsMasterPlaylist = "master.m3u8"
+	hlsPoster         = "poster.jpg"
+)
+
+// Content types of the files of the derived bucket
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".jpg":  "image/jpeg",
+}
+
+// Indexes on the files of the derived bucket, finding the renditions of a
+// video
+var hlsFileIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "metadata.source", Value: 1}},
+		Options: options.Index().SetName("metadata.source"),
+	},
+}
+
+// Check if a filename names a video
+// @param filename string
+// @return bool video
+func isVideoFilename(filename string) bool {
+	return strings.HasPrefix(contentTypes[strings.ToLower(path.Ext(filename))], "video/")
+}
+
+// Enqueue transcoding of an uploaded video, or removal of the renditions of a
+// deleted file, if HLS_FFMPEG is configured. Failing to enqueue is logged, it
+// does not fail the operation.
+// @param ctx context.Context context of the operation
+// @param bucket string bucket name
+// @param fileId primitive.ObjectID id of the uploaded or deleted file
+func transcodeVideo(ctx context.Context, bucket string, fileId primitive.ObjectID) {
+	// Only videos of the default database are transcoded
+	if config.HLSFFmpeg == "" || tenantFromContext(ctx) != nil {
+		return
+	}
+	enqueueFileJob(ctx, jobTranscoding, bucket, fileId)
+}
+
+// Get name of a file of the renditions of a video in the derived bucket
+// @param id primitive.ObjectID video id
+// @param name string path of the file below the video's directory
+// @return string filename
+func hlsFilename(id primitive.ObjectID, name string) string {
+	return id.Hex() + "/" + name
+}
+
+// Delete the renditions of a video from the derived bucket, newest first so
+// the master playlist goes before the files it references
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param id primitive.ObjectID video id
+// @param keep ...string files to keep, by path below the video's directory
+// @return error error
+func deleteHLS(ctx context.Context, db *mongo.Database, id primitive.ObjectID, keep ...string) error {
+	bucket, err := namedBucket(db, config.HLSBucket)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"metadata.source": id}
+	if len(keep) > 0 {
+		var filenames []string
+		for _, name := range keep {
+			filenames = append(filenames, hlsFilename(id, name))
+		}
+		filter["filename"] = bson.M{"$nin": filenames}
+	}
+	cursor, err := namedFilesCollection(db, config.HLSBucket).Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.D{{Key: "uploadDate", Value: -1}}))
+	if err != nil {
+		return err
+	}
+	var files []bson.M
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := bucket.DeleteContext(ctx, file["_id"]); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get integer field of the video metadata of a files document
+// @param fileDoc bson.M files document
+// @param key string width or height
+// @return int value, 0 if the video has no metadata
+func videoDimension(fileDoc bson.M, key string) int {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	video, _ := metadata["video"].(bson.M)
+	switch value := video[key].(type) {
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	}
+	return 0
+}
+
+// Get duration of a video from the video metadata of its files document
+// @param fileDoc bson.M files document
+// @return float64 duration in seconds, 0 if the video has no metadata
+func videoDuration(fileDoc bson.M) float64 {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	video, _ := metadata["video"].(bson.M)
+	duration, _ := video["duration"].(float64)
+	return duration
+}
+
+// Get video bitrate of a rendition, growing with its pixel count
+// @param height int rendition height
+// @return int bits per second
+func hlsBitrate(height int) int {
+	return height * height * 11 / 2
+}
+
+// Get heights of the renditions of a video: the configured heights up to
+// the height of the video, or the height of the video if it is smaller than
+// all of them
+// @param height int video height, 0 if unknown
+// @return []int heights
+func hlsHeights(height int) []int {
+	if height == 0 {
+		return config.HLSRenditions
+	}
+	var heights []int
+	for _, rendition := range config.HLSRenditions {
+		if rendition <= height {
+			heights = append(heights, rendition)
+		}
+	}
+	if len(heights) == 0 {
+		heights = append(heights, max(height-height%2, 2))
+	}
+	return heights
+}
+
+// Run HLS_FFMPEG with arguments
+// @param ctx context.Context
+// @param args ...string arguments following those of HLS_FFMPEG
+// @return error error, with the ffmpeg output if there is any
+func runFFmpeg(ctx context.Context, args ...string) error {
+	fields := strings.Fields(config.HLSFFmpeg)
+	args = append(append(fields[1:], "-hide_banner", "-loglevel", "error", "-nostdin", "-y"), args...)
+	output, err := exec.CommandContext(ctx, fields[0], args...).CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("%v: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
+
+// Transcode video into one rendition with ffmpeg, writing its playlist and
+// segments to dir
+// @param ctx context.Context
+// @param source string path of the video
+// @param dir string rendition directory
+// @param width int rendition width, 0 to keep the aspect ratio of the video
+// @param height int rendition height
+// @return error error
+func transcodeRendition(ctx context.Context, source, dir string, width, height int) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	scale := fmt.Sprintf("scale=%d:%d", width, height)
+	if width == 0 {
+		scale = fmt.Sprintf("scale=-2:%d", height)
+	}
+	bitrate := hlsBitrate(height)
+
+	return runFFmpeg(ctx,
+		"-i", source,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", scale,
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main", "-pix_fmt", "yuv420p",
+		"-b:v", strconv.Itoa(bitrate), "-maxrate", strconv.Itoa(bitrate*11/10), "-bufsize", strconv.Itoa(bitrate*2),
+		// Key frames at the segment boundaries keep the renditions switchable
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+		"-c:a", "aac", "-b:a", strconv.Itoa(hlsAudioBitrate), "-ac", "2",
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "segment_%04d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	)
+}
+
+// Extract the frame at VIDEO_POSTER_AT as JPEG poster, writing it to dir.
+// Videos shorter than that get the frame in their middle.
+// @param ctx context.Context
+// @param fileDoc bson.M files document of the video
+// @param source string path of the video
+// @param dir string output directory
+// @return error error
+func extractPoster(ctx context.Context, fileDoc bson.M, source, dir string) error {
+	ctx, cancel := context.WithTimeout(ctx, renditionTimeout)
+	defer cancel()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	at := config.VideoPosterAt.Seconds()
+	if duration := videoDuration(fileDoc); duration > 0 && at >= duration {
+		at = duration / 2
+	}
+	poster := filepath.Join(dir, hlsPoster)
+	err := runFFmpeg(ctx,
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64),
+		"-i", source,
+		"-frames:v", "1", "-q:v", "3", "-f", "image2",
+		poster,
+	)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(poster)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, format, err := image.DecodeConfig(file); err != nil || format != "jpeg" {
+		return errors.New("ffmpeg output is no JPEG image")
+	}
+	return nil
+}
+
+// Transcode video into the configured renditions, writing a directory per
+// rendition and the master playlist to dir
+// @param ctx context.Context
+// @param fileDoc bson.M files document of the video
+// @param source string path of the video
+// @param dir string output directory
+// @return error error
+func transcodeHLS(ctx context.Context, fileDoc bson.M, source, dir string) error {
+	ctx, cancel := context.WithTimeout(ctx, hlsLease)
+	defer cancel()
+
+	sourceWidth, sourceHeight := videoDimension(fileDoc, "width"), videoDimension(fileDoc, "height")
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, height := range hlsHeights(sourceHeight) {
+		name := strconv.Itoa(height) + "p"
+		width := 0
+		if sourceWidth > 0 && sourceHeight > 0 {
+			// Encoders need even dimensions
+			width = (sourceWidth*height/sourceHeight + 1) &^ 1
+		}
+		if err := transcodeRendition(ctx, source, filepath.Join(dir, name), width, height); err != nil {
+			return err
+		}
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d", hlsBitrate(height)*11/10+hlsAudioBitrate)
+		if width > 0 {
+			fmt.Fprintf(&master, ",RESOLUTION=%dx%d", width, height)
+		}
+		fmt.Fprintf(&master, "\n%s/index.m3u8\n", name)
+	}
+	return os.WriteFile(filepath.Join(dir, hlsMasterPlaylist), []byte(master.String()), 0o600)
+}
+
+// Upload the files written by transcodeHLS or extractPoster to the derived
+// bucket, the master playlist last so renditions are complete once it exists.
+// Files
+// keep the bucket and visibility of the video for their Cache-Control header.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucketName string bucket of the video
+// @param fileDoc bson.M files document of the video
+// @param dir string output directory
+// @return error error
+func storeHLS(ctx context.Context, db *mongo.Database, bucketName string, fileDoc bson.M, dir string) error {
+	id := fileDoc["_id"].(primitive.ObjectID)
+	bucket, err := namedBucket(db, config.HLSBucket)
+	if err != nil {
+		return err
+	}
+	var names []string
+	master := false
+	err = filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(dir, name)
+		if err == nil && relative == hlsMasterPlaylist {
+			master = true
+		} else if err == nil {
+			names = append(names, filepath.ToSlash(relative))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if master {
+		names = append(names, hlsMasterPlaylist)
+	}
+
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		uploadOptions := options.GridFSUpload().SetMetadata(bson.M{"source": id, "bucket": bucketName, "visibility": fileVisibility(fileDoc), "ext": path.Ext(name)})
+		_, err = bucket.UploadFromStream(hlsFilename(id, name), file, uploadOptions)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find out if a file of the renditions of a video exists in the derived
+// bucket
+// @param ctx context.Context
+// @param files *mongo.Collection files collection of the derived bucket
+// @param id primitive.ObjectID video id
+// @param name string path of the file below the video's directory
+// @return bool exists
+// @return error error
+func hlsFileExists(ctx context.Context, files *mongo.Collection, id primitive.ObjectID, name string) (bool, error) {
+	err := files.FindOne(ctx, bson.M{"filename": hlsFilename(id, name)}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Bring the renditions of a file up to date: extract the poster and
+// transcode it if it is a video missing them, or delete its renditions if it
+// is gone. Renditions left behind by an interrupted job are replaced.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucketName string bucket of the file
+// @param id primitive.ObjectID file id
+// @return error error
+func syncHLS(ctx context.Context, db *mongo.Database, bucketName string, id primitive.ObjectID) error {
+	fileDoc, err := fileStorage().Stat(withBucket(ctx, bucketName), id)
+	if errors.Is(err, ErrFileNotFound) || (err == nil && !isVideoFilename(fileDoc["filename"].(string))) {
+		return deleteHLS(ctx, db, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	files := namedFilesCollection(db, config.HLSBucket)
+	master, err := hlsFileExists(ctx, files, id, hlsMasterPlaylist)
+	if err != nil {
+		return err
+	}
+	poster, err := hlsFileExists(ctx, files, id, hlsPoster)
+	if err != nil || (master && poster) {
+		return err
+	}
+	if !master {
+		if err := deleteHLS(ctx, db, id, hlsPoster); err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "gofs-hls-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// ffmpeg seeks in its input, which needs a file rather than a pipe
+	content, err := fileStorage().Get(withBucket(ctx, bucketName), id)
+	if err != nil {
+		return err
+	}
+	source := filepath.Join(dir, "source"+fileExtension(fileDoc))
+	file, err := os.Create(source)
+	if err == nil {
+		_, err = io.Copy(file, content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	// The poster is stored first, it is ready long before the renditions
+	if !poster {
+		output := filepath.Join(dir, "poster")
+		if err := extractPoster(ctx, fileDoc, source, output); err != nil {
+			return err
+		}
+		if err := storeHLS(ctx, db, bucketName, fileDoc, output); err != nil {
+			return err
+		}
+	}
+	if !master {
+		output := filepath.Join(dir, "hls")
+		if err := transcodeHLS(ctx, fileDoc, source, output); err != nil {
+			return err
+		}
+		return storeHLS(ctx, db, bucketName, fileDoc, output)
+	}
+	return nil
+}
+
+// Register the handler of transcoding jobs, which transcode uploaded videos
+// to HLS in the background
+func registerHLSJobs() {
+	if config.HLSFFmpeg == "" {
+		return
+	}
+	db := database()
+	backgroundJobs().Register(jobTranscoding, jobs.Handler{
+		Run: func(ctx context.Context, job *jobs.Job) error {
+			bucket, id := fileJobTarget(job)
+			return syncHLS(ctx, db, bucket, id)
+		},
+		Workers:     config.HLSWorkers,
+		Lease:       hlsLease,
+		RetryDelay:  hlsRetryDelay,
+		MaxAttempts: hlsMaxAttempts,
+	})
+}
+
+// Send file of the renditions of a video from the derived bucket
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document in the derived bucket
+// @return error error
+func sendHLSFile(c *fiber.Ctx, fileDoc bson.M) error {
+	db := database()
+	bucket, err := namedBucket(db, config.HLSBucket)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, hlsContentTypes[path.Ext(fileDoc["filename"].(string))])
+	c.Set(fiber.HeaderContentLength, strconv.FormatInt(fileLength(fileDoc), 10))
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	bucketName, _ := metadata["bucket"].(string)
+	c.Set(fiber.HeaderCacheControl, cacheControl(bucketName, fileDoc))
+	c.Set(fiber.HeaderETag, `"`+fileDoc["_id"].(primitive.ObjectID).Hex()+`"`)
+	setSecurityHeaders(c)
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	stream, err := bucket.OpenDownloadStream(fileDoc["_id"])
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	content, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	return c.Send(content)
+}
+
+// Find file of the renditions of a video in the derived bucket
+// @param ctx context.Context
+// @param id primitive.ObjectID video id
+// @param name string path of the file below the video's directory
+// @return bson.M files document, nil if there is none
+// @return error error
+func findHLSFile(ctx context.Context, id primitive.ObjectID, name string) (bson.M, error) {
+	var fileDoc bson.M
+	err := namedFilesCollection(database(), config.HLSBucket).FindOne(ctx, bson.M{"filename": hlsFilename(id, name)}).Decode(&fileDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return fileDoc, err
+}
+
+// Get handler sending a file made by the transcoding worker, or 202 Accepted
+// while the video's job is queued
+// @param name string path of the file below the video's directory
+// @return fiber.Handler handler
+func sendVideoRendition(name string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+		if config.HLSFFmpeg == "" || tenantFromContext(c.Context()) != nil {
+			return respondError(c, fiber.StatusNotFound, CodeNotFound, "HLS streaming is not available")
+		}
+
+		fileDoc, err := findHLSFile(c.Context(), id, name)
+		if err != nil {
+			return err
+		}
+		if fileDoc != nil {
+			return sendHLSFile(c, fileDoc)
+		}
+
+		job, err := pendingFileJob(c.Context(), jobTranscoding, id)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return respondError(c, fiber.StatusNotFound, CodeNotFound, "No renditions for this file")
+		}
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(hlsSegmentSeconds))
+		return respond(c, fiber.StatusAccepted, "Video is being transcoded", "transcoding", job)
+	}
+}
+
+// Register HLS streaming and poster routes
+// @param app *fiber.App app
+func registerVideoRoutes(app *fiber.App) {
+	router := app.Group("/api/video")
+
+	// Get HLS master playlist of a video for adaptive streaming. Videos
+	// still being transcoded get 202 Accepted.
+	// HEAD requests get the same headers without the content.
+	// @param id string
+	// @return master playlist
+	router.Get("/:id/"+hlsMasterPlaylist, sendVideoRendition(hlsMasterPlaylist))
+
+	// Get JPEG poster of a video, the frame at VIDEO_POSTER_AT. Videos
+	// still being processed get 202 Accepted.
+	// HEAD requests get the same headers without the content.
+	// @param id string
+	// @return JPEG image
+	router.Get("/:id/poster", sendVideoRendition(hlsPoster))
+
+	// Get rendition playlist or segment of a video, as referenced by its
+	// master playlist.
+	// HEAD requests get the same headers without the content.
+	// @param id string
+	// @return playlist or MPEG-TS segment
+	router.Get("/:id/*", func(c *fiber.Ctx) error {
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+		if config.HLSFFmpeg == "" || tenantFromContext(c.Context()) != nil {
+			return respondError(c, fiber.StatusNotFound, CodeNotFound, "HLS streaming is not available")
+		}
+
+		fileDoc, err := findHLSFile(c.Context(), id, c.Params("*"))
+		if err != nil {
+			return err
+		}
+		if fileDoc == nil {
+			return respondError(c, fiber.StatusNotFound, CodeFileNotFound, "HLS file not found")
+		}
+		return sendHLSFile(c, fileDoc)
+	})
+}
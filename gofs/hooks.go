@@ -0,0 +1,112 @@
+package gofs
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Plugin run by custom builds around the uploads and deletes of every API,
+// e.g. to enforce naming conventions, fill in metadata or notify other
+// systems. Errors of BeforeStore and BeforeDelete reject the operation,
+// with the status of a *fiber.Error, e.g. fiber.NewError(fiber.StatusBadRequest,
+// "..."), or 500 for other errors. Errors of AfterStore are logged,
+// the file is stored by then.
+type Hook interface {
+	// Check or change an upload before its content is stored
+	BeforeStore(ctx context.Context, upload *Upload) error
+	// Act on a stored upload
+	AfterStore(ctx context.Context, file FileInfo) error
+	// Check a file before it is deleted on request, moved to another bucket
+	// or replaced by an upload overwriting it
+	BeforeDelete(ctx context.Context, file FileInfo) error
+}
+
+// Upload about to be stored, see Hook. Requests to named buckets carry the
+// bucket in ctx, see BucketFromContext.
+type Upload struct {
+	// Filename including the folder path. Hooks may rename uploads, but not
+	// new versions of an existing file or copies, where changes are ignored.
+	Filename string
+	// Custom metadata fields, validated again after the hooks changed them
+	Metadata map[string]interface{}
+	// Expiry time, nil if the file never expires
+	ExpiresAt *time.Time
+	// Actor uploading the file, empty if anonymous
+	Owner string
+}
+
+// Stored file, see Hook
+type FileInfo struct {
+	Id       primitive.ObjectID
+	Bucket   string
+	Filename string
+	Size     int64
+	// Metadata of the files document, custom fields next to reserved ones
+	// like ext and version
+	Metadata bson.M
+}
+
+// Hooks in registration order
+var hooks []Hook
+
+// Register hook run on the uploads and deletes of every API. Hooks run in
+// registration order, the first error stops the others. Must be called
+// before the routes are registered.
+// @param hook Hook
+func RegisterHook(hook Hook) {
+	hooks = append(hooks, hook)
+}
+
+// Run BeforeStore of the hooks on an upload
+// @param ctx context.Context
+// @param upload *Upload
+// @return error error rejecting the upload
+func beforeStore(ctx context.Context, upload *Upload) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	for _, hook := range hooks {
+		if err := hook.BeforeStore(ctx, upload); err != nil {
+			return err
+		}
+	}
+	return validateCustomMetadata(upload.Metadata)
+}
+
+// Run AfterStore of the hooks on a stored upload, logging their errors
+// @param ctx context.Context
+// @param file FileInfo
+func afterStore(ctx context.Context, file FileInfo) {
+	for _, hook := range hooks {
+		if err := hook.AfterStore(ctx, file); err != nil {
+			logger.Error("after store hook", "bucket", file.Bucket, "file_id", file.Id, "filename", file.Filename, "error", err)
+		}
+	}
+}
+
+// Run BeforeDelete of the hooks on a file
+// @param ctx context.Context
+// @param fileDoc bson.M files document
+// @return error error rejecting the delete
+func beforeDelete(ctx context.Context, fileDoc bson.M) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	file := FileInfo{
+		Id:       fileDoc["_id"].(primitive.ObjectID),
+		Bucket:   BucketFromContext(ctx),
+		Filename: fileDoc["filename"].(string),
+		Size:     fileLength(fileDoc),
+		Metadata: metadata,
+	}
+	for _, hook := range hooks {
+		if err := hook.BeforeDelete(ctx, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
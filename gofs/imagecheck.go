@@ -0,0 +1,165 @@
+package gofs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	_ "image/jpeg" // Register JPEG decoder
+	_ "image/png"  // Register PNG decoder
+	"io"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Bytes of an upload read at most to find the image header. JPEG headers
+// may follow large EXIF and ICC segments.
+const maxImageHeaderBytes = 1024 * 1024
+
+// Reader remembering the error of the underlying reader, to tell upload
+// failures apart from invalid image data
+type headerReader struct {
+	reader io.Reader
+	err    error
+}
+
+// Read from the underlying reader
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (r *headerReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// Image verification modes of IMAGE_VERIFICATION
+const (
+	verifyNone   = "none"
+	verifyHeader = "header"
+	verifyDecode = "decode"
+)
+
+// Check if any image dimension limit is configured
+// @return bool limited
+func imageLimitsEnabled() bool {
+	return config.MaxImageWidth > 0 || config.MaxImageHeight > 0 || config.MaxImagePixels > 0
+}
+
+// Inspect upload content before it is stored. With IMAGE_VERIFICATION
+// header the image header has to match the file extension, with decode the
+// whole image has to decode, rejecting truncated and disguised files.
+// Animated GIF and WebP images are stored as uploaded, keeping all frames.
+// The dimensions in the header are checked against MAX_IMAGE_WIDTH,
+// MAX_IMAGE_HEIGHT and MAX_IMAGE_MEGAPIXELS, rejecting decompression bombs
+// before they are decoded or stored. The returned reader replays the content
+// read for the inspection followed by the rest. SVG documents are
+// sanitized instead, see inspectSVG, PDF documents, videos, audio, Office
+// documents and text files inspected by inspectPDF, inspectVideo,
+// inspectAudio, inspectOffice and inspectText.
+// @param content io.Reader upload content
+// @param ext string file extension
+// @return io.Reader content
+// @return bson.M metadata extracted from the content, nil for images
+// @return error unprocessable entity error if the image is invalid or too
+// large
+func inspectImage(content io.Reader, ext string) (io.Reader, bson.M, error) {
+	switch ext {
+	case ".svg":
+		content, err := inspectSVG(content)
+		return content, nil, err
+	case ".pdf":
+		return inspectPDF(content)
+	case ".mp4", ".webm":
+		return inspectVideo(content, ext)
+	case ".mp3", ".ogg", ".flac":
+		return inspectAudio(content, ext)
+	case ".docx", ".xlsx", ".pptx":
+		content, err := inspectOffice(content, ext)
+		return content, nil, err
+	case ".txt", ".log", ".csv", ".md", ".json":
+		content, err := inspectText(content, ext)
+		return content, nil, err
+	}
+	if config.ImageVerification == verifyNone && !imageLimitsEnabled() {
+		return content, nil, nil
+	}
+
+	// Only the header is read
+	var head bytes.Buffer
+	reader := &headerReader{reader: io.LimitReader(content, maxImageHeaderBytes)}
+	header, format, err := image.DecodeConfig(io.TeeReader(reader, &head))
+	if reader.err != nil {
+		return nil, nil, reader.err
+	}
+	if err != nil {
+		return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid "+imageFormatName(ext)+" image")
+	}
+	if config.ImageVerification != verifyNone && !formatMatches(format, ext) {
+		return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is a "+strings.ToUpper(format)+" image, not "+imageFormatName(ext))
+	}
+
+	width, height := int64(header.Width), int64(header.Height)
+	switch {
+	case config.MaxImageWidth > 0 && width > int64(config.MaxImageWidth),
+		config.MaxImageHeight > 0 && height > int64(config.MaxImageHeight),
+		config.MaxImagePixels > 0 && width*height > config.MaxImagePixels:
+		return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeImageTooLarge, fmt.Sprintf("Image of %dx%d pixels exceeds the maximum dimensions", width, height))
+	}
+	content = io.MultiReader(&head, content)
+	if config.ImageVerification != verifyDecode {
+		return content, nil, nil
+	}
+
+	// Decoding needs the whole image, which is held in memory until stored
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := decodeImage(data, format); err != nil {
+		return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid "+imageFormatName(ext)+" image: "+err.Error())
+	}
+	return bytes.NewReader(data), nil, nil
+}
+
+// Decode whole image. Animated images are checked frame by frame, where
+// image.Decode only decodes the first frame.
+// @param data []byte image
+// @param format string format name of image.DecodeConfig
+// @return error error if the image is invalid or truncated
+func decodeImage(data []byte, format string) error {
+	switch format {
+	case "gif":
+		_, err := gif.DecodeAll(bytes.NewReader(data))
+		return err
+	case "webp":
+		return checkWebP(data)
+	case "heic", "heif":
+		return checkHEIF(data)
+	}
+	_, _, err := image.Decode(bytes.NewReader(data))
+	return err
+}
+
+// Check if an image format is the one stored with a file extension. HEIC
+// and HEIF are told apart by brands phones don't use consistently, either
+// matches both extensions.
+// @param format string format name of image.DecodeConfig
+// @param ext string file extension
+// @return bool matches
+func formatMatches(format, ext string) bool {
+	contentType := "image/" + format
+	return contentType == contentTypes[ext] || heifContentTypes[contentType] && heifContentTypes[contentTypes[ext]]
+}
+
+// Get name of the format stored with a file extension, e.g. JPEG
+// @param ext string file extension
+// @return string format name
+func imageFormatName(ext string) string {
+	_, subtype, _ := strings.Cut(contentTypes[ext], "/")
+	return strings.ToUpper(strings.TrimSuffix(subtype, "+xml"))
+}
@@ -0,0 +1,350 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// MongoDB client shared by all requests, connected on first use
+var (
+	sharedClientMu sync.Mutex
+	sharedClient   *mongo.Client
+)
+
+// Get shared MongoDB client, connected by RegisterRoutes and StartServices.
+// The client connects in the background, while MongoDB is not reachable
+// operations fail with errors answered with 503, see databaseUnavailable.
+// @return *mongo.Client client
+func mongoClient() *mongo.Client {
+	client, err := connectMongo(context.Background())
+	if err != nil {
+		// Only an invalid connection string fails, which RegisterRoutes and
+		// StartServices report before any request is served
+		panic(err)
+	}
+	return client
+}
+
+// Get shared MongoDB client, creating it on first use. Creating the client
+// doesn't wait for MongoDB, only an invalid connection string fails.
+// @param ctx context.Context
+// @return *mongo.Client client
+// @return error error
+func connectMongo(ctx context.Context) (*mongo.Client, error) {
+	sharedClientMu.Lock()
+	defer sharedClientMu.Unlock()
+	if sharedClient != nil {
+		return sharedClient, nil
+	}
+
+	serverAPIOptions := options.ServerAPI(options.ServerAPIVersion1)
+	clientOptions := options.Client().ApplyURI(config.MongoURI).SetServerAPIOptions(serverAPIOptions)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("connect to MongoDB: %w", err)
+	}
+
+	sharedClient = client
+	return client, nil
+}
+
+// Check if an error means MongoDB can't be reached: no server could be
+// selected or the connection failed
+// @param err error
+// @return bool unavailable
+func databaseUnavailable(err error) bool {
+	var selection topology.ServerSelectionError
+	return errors.As(err, &selection) || mongo.IsNetworkError(err) || errors.Is(err, mongo.ErrClientDisconnected)
+}
+
+// Disconnect shared MongoDB client if it was connected
+// @return error error
+func disconnectMongo() error {
+	sharedClientMu.Lock()
+	defer sharedClientMu.Unlock()
+	if sharedClient == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := sharedClient.Disconnect(ctx)
+	sharedClient = nil
+	return err
+}
+
+// Read ObjectID path parameter
+// @param c *fiber.Ctx context
+// @param name string parameter name
+// @return primitive.ObjectID id
+// @return error validation.Errors if the parameter is no ObjectID
+func objectIdParam(c *fiber.Ctx, name string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params(name))
+	if err != nil {
+		return id, validation.Errors{{In: validation.Path, Field: name, Code: string(CodeInvalidId), Message: name + " must be a 24 character hex ObjectID"}}
+	}
+	return id, nil
+}
+
+// Set response headers according to files document
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+// @return error error
+func setResponseHeaders(c *fiber.Ctx, fileDoc bson.M) error {
+	if contentType, ok := contentTypes[fileExtension(fileDoc)]; ok {
+		c.Set("Content-Type", contentType)
+	}
+	setSecurityHeaders(c)
+
+	bucket := BucketFromContext(c.Context())
+	c.Set("Cache-Control", cacheControl(bucket, fileDoc))
+	setSurrogateKeys(c, bucket, fileDoc)
+	c.Set("Content-Length", strconv.FormatInt(fileLength(fileDoc), 10))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	// Content stored under an id never changes, so the id is a strong validator
+	c.Set("ETag", `"`+fileDoc["_id"].(primitive.ObjectID).Hex()+`"`)
+	if uploadDate, ok := fileDoc["uploadDate"].(primitive.DateTime); ok {
+		c.Set(fiber.HeaderLastModified, uploadDate.Time().UTC().Format(http.TimeFormat))
+	}
+
+	return nil
+}
+
+// Check conditional headers of a download against the ETag and
+// Last-Modified headers of the response: If-None-Match if it is sent,
+// If-Modified-Since otherwise. HTTP dates have whole seconds, upload dates
+// are compared truncated to them.
+// @param c *fiber.Ctx context, with the response headers set
+// @return bool client's copy is current, a 304 response suffices
+func notModified(c *fiber.Ctx) bool {
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		// Weak comparison, compressed responses carry weak ETags
+		etag := strings.TrimPrefix(string(c.Response().Header.Peek(fiber.HeaderETag)), "W/")
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(string(c.Response().Header.Peek(fiber.HeaderLastModified)))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// Encode filename for the Content-Disposition header with an ASCII fallback
+// and an RFC 5987 encoded filename* parameter for non-ASCII names
+// @param filename string
+// @return string header value
+func attachmentDisposition(filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(filename) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
+
+// Register image upload, download and delete routes on the default bucket
+// and, under /api/:bucket/file, on the configured named buckets
+// @param app *fiber.App app
+func registerImageRoutes(app *fiber.App) {
+	registerFileRoutes(app.Group("/api/image"))
+	registerFileRoutes(app.Group("/api/:bucket/file", selectBucket))
+}
+
+// Register upload, download and delete routes of a bucket
+// @param router fiber.Router router of the bucket's routes
+func registerFileRoutes(router fiber.Router) {
+	// Upload image to GridFS bucket in MongoDB, either as multipart form or as
+	// JSON with base64 encoded data
+	// @param file file
+	// @param collision string reject|overwrite|auto-suffix|version
+	// @return image metadata
+	router.Post("", trackUploadProgress, func(c *fiber.Ctx) error {
+		// Clients which can't send multipart forms upload base64 encoded JSON
+		if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+			image, err := uploadBase64(c, requestDatabase(c.Context()))
+			if err != nil {
+				return err
+			}
+			return respond(c, fiber.StatusCreated, "Image uploaded successfully", "image", image)
+		}
+
+		// Streamed forms are copied into the storage backend as received
+		if body := streamedForm(c); body != nil {
+			image, err := uploadStreamedImage(c, requestDatabase(c.Context()), body)
+			if err != nil {
+				return err
+			}
+			return respond(c, fiber.StatusCreated, "Image uploaded successfully", "image", image)
+		}
+
+		// Check if file is present in request body or not
+		fileHeader, err := c.FormFile("image")
+		if err != nil {
+			return respondError(c, fiber.StatusBadRequest, CodeBadRequest, err.Error())
+		}
+
+		// Validate and upload file to GridFS bucket
+		image, err := uploadImage(c, requestDatabase(c.Context()), fileHeader)
+		if err != nil {
+			return err
+		}
+
+		// Return response
+		return respond(c, fiber.StatusCreated, "Image uploaded successfully", "image", image)
+	})
+
+	// Get image from GridFS bucket in MongoDB using image id.
+	// HEAD requests get the same headers without the content.
+	// @param id string
+	// @param download bool save as attachment instead of rendering
+	// @return image content
+	router.Get("/id/:id", func(c *fiber.Ctx) error {
+		// Get image id from request params and convert it to ObjectID
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+
+		// Get image metadata from the storage backend, or the in-memory cache
+		avatarMetadata, err := cachedFileDoc(c.Context(), "id:"+id.Hex(), func() (bson.M, error) {
+			return fileStorage().Stat(c.Context(), id)
+		})
+		if err != nil {
+			return respondError(c, fiber.StatusNotFound, CodeFileNotFound, "Avatar not found")
+		}
+
+		// Return image
+		return sendImage(c, avatarMetadata)
+	})
+
+	// Get thumbnail of a document, the first page of a PDF rendered by
+	// PDF_THUMBNAILER.
+	// HEAD requests get the same headers without the content.
+	// @param id string
+	// @param download bool save as attachment instead of rendering
+	// @return PNG image
+	router.Get("/id/:id/thumbnail", func(c *fiber.Ctx) error {
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+
+		fileDoc, err := cachedFileDoc(c.Context(), "id:"+id.Hex(), func() (bson.M, error) {
+			return fileStorage().Stat(c.Context(), id)
+		})
+		if err != nil {
+			return respondError(c, fiber.StatusNotFound, CodeFileNotFound, "Avatar not found")
+		}
+		if contentTypes[fileExtension(fileDoc)] != "application/pdf" || config.PDFThumbnailer == "" {
+			return respondError(c, fiber.StatusNotFound, CodeNotFound, "No thumbnail available for this file")
+		}
+
+		setResponseHeaders(c, fileDoc)
+		return pdfThumbnail().send(c, fileDoc)
+	})
+
+	// Get image transformed by a pipeline of operations applied in order,
+	// e.g. resize:800x0,grayscale,quality:80. Results are cached under the
+	// normalized pipeline.
+	// HEAD requests get the same headers without the content.
+	// @param id string
+	// @param transforms string comma separated operations
+	// @param download bool save as attachment instead of rendering
+	// @return transformed image
+	router.Get("/id/:id/t/:transforms", func(c *fiber.Ctx) error {
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+
+		fileDoc, err := cachedFileDoc(c.Context(), "id:"+id.Hex(), func() (bson.M, error) {
+			return fileStorage().Stat(c.Context(), id)
+		})
+		if err != nil {
+			return respondError(c, fiber.StatusNotFound, CodeFileNotFound, "Avatar not found")
+		}
+		transformed, err := transformRendition(fileDoc, c.Params("transforms"))
+		if err != nil {
+			return err
+		}
+
+		setResponseHeaders(c, fileDoc)
+		return transformed.send(c, fileDoc)
+	})
+
+	// Get current version of image from GridFS bucket in MongoDB using image name.
+	// The name may include a folder path, e.g. avatars/2024/user1.png.
+	// HEAD requests get the same headers without the content.
+	// @param name string
+	// @param download bool save as attachment instead of rendering
+	// @return image content
+	router.Get("/name/*", func(c *fiber.Ctx) error {
+		// Get image name from request params
+		name := c.Params("*")
+
+		// Create db connection, reading with the configured read preference
+		db := readDatabase(c.Context())
+
+		// Get metadata of current version, falling back to the latest upload
+		avatarMetadata, err := cachedFileDoc(c.Context(), "name:"+name, func() (bson.M, error) {
+			return findCurrentByName(c.Context(), db, name)
+		})
+		if err != nil {
+			return respondError(c, fiber.StatusNotFound, CodeFileNotFound, "Avatar not found")
+		}
+
+		// Return image
+		return sendImage(c, avatarMetadata)
+	})
+
+	// Delete image from GridFS bucket in MongoDB using image id
+	// @param id string
+	// @return success message
+	router.Delete("/id/:id", func(c *fiber.Ctx) error {
+		// Get image id from request params and convert it to ObjectID
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+
+		// Delete image from GridFS bucket
+		if err := deleteFile(c.Context(), id); err != nil {
+			return err
+		}
+
+		// Return success message
+		return respond(c, fiber.StatusOK, "Image deleted successfully", "", nil)
+	})
+}
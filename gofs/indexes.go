@@ -0,0 +1,209 @@
+package gofs
+
+import (
+	"context"
+	"time"
+
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Indexes on the files collections: the standard GridFS index, named like
+// drivers create it on the first upload, and indexes backing the query
+// endpoints
+var fileIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "filename", Value: 1}, {Key: "uploadDate", Value: 1}},
+		Options: options.Index().SetName("filename_1_uploadDate_1"),
+	},
+	{
+		Keys:    bson.D{{Key: "metadata.tags", Value: 1}},
+		Options: options.Index().SetName("metadata_tags"),
+	},
+	{
+		Keys:    bson.D{{Key: "uploadDate", Value: -1}},
+		Options: options.Index().SetName("uploadDate"),
+	},
+	{
+		// Listings break ties of the upload date by id
+		Keys:    bson.D{{Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("uploadDate_id"),
+	},
+	{
+		Keys:    bson.D{{Key: "length", Value: 1}},
+		Options: options.Index().SetName("length"),
+	},
+	{
+		// Listings sorted by size or filename, read in either direction
+		Keys:    bson.D{{Key: "length", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("length_id"),
+	},
+	{
+		Keys:    bson.D{{Key: "filename", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("filename_id"),
+	},
+	{
+		Keys:    bson.D{{Key: "metadata.ext", Value: 1}, {Key: "uploadDate", Value: -1}},
+		Options: options.Index().SetName("metadata_ext_uploadDate"),
+	},
+	{
+		Keys:    bson.D{{Key: "metadata.owner", Value: 1}},
+		Options: options.Index().SetName("metadata_owner"),
+	},
+	{
+		// Files stored before content hashes were recorded lack the field
+		Keys:    bson.D{{Key: "metadata.sha256", Value: 1}, {Key: "length", Value: 1}},
+		Options: options.Index().SetName("metadata_sha256_length").SetSparse(true),
+	},
+	searchIndex,
+}
+
+// Standard GridFS index on the chunks collections, named like drivers create
+// it on the first upload
+var chunkIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "files_id", Value: 1}, {Key: "n", Value: 1}},
+		Options: options.Index().SetName("files_id_1_n_1").SetUnique(true),
+	},
+}
+
+// Indexes on the audit trail backing queries by file and by actor
+var auditIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "fileId", Value: 1}, {Key: "timestamp", Value: -1}},
+		Options: options.Index().SetName("fileId_timestamp"),
+	},
+	{
+		Keys:    bson.D{{Key: "actor", Value: 1}, {Key: "timestamp", Value: -1}},
+		Options: options.Index().SetName("actor_timestamp"),
+	},
+	{
+		Keys:    bson.D{{Key: "timestamp", Value: -1}},
+		Options: options.Index().SetName("timestamp"),
+	},
+	{
+		// Pages of the audit trail break ties of the timestamp by id
+		Keys:    bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("timestamp_id"),
+	},
+}
+
+// Indexes on the download counters backing the top downloads
+var downloadStatsIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "bucket", Value: 1}, {Key: "downloads", Value: -1}},
+		Options: options.Index().SetName("bucket_downloads"),
+	},
+}
+
+// Indexes on the tenant registry. Each database belongs to one tenant only,
+// API keys are looked up by hash.
+var tenantIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "database", Value: 1}},
+		Options: options.Index().SetName("database").SetUnique(true),
+	},
+	{
+		// Tenants without keys lack the field, the index is sparse
+		Keys:    bson.D{{Key: "keys.hash", Value: 1}},
+		Options: options.Index().SetName("keys_hash").SetUnique(true).SetSparse(true),
+	},
+}
+
+// Indexes on the daily download counters. The rollup merges counters by file
+// and day, which needs a unique index on both.
+var dailyDownloadsIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "fileId", Value: 1}, {Key: "start", Value: 1}},
+		Options: options.Index().SetName("fileId_start").SetUnique(true),
+	},
+	{
+		Keys:    bson.D{{Key: "start", Value: 1}},
+		Options: options.Index().SetName("start"),
+	},
+}
+
+// Indexes on the hourly download counters. Counters are upserted by file and
+// hour, and removed by a TTL index after the retention period.
+// @return []mongo.IndexModel indexes
+func hourlyDownloadsIndexes() []mongo.IndexModel {
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "fileId", Value: 1}, {Key: "start", Value: 1}},
+			Options: options.Index().SetName("fileId_start").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "bucket", Value: 1}, {Key: "start", Value: 1}},
+			Options: options.Index().SetName("bucket_start"),
+		},
+	}
+	if config.StatsRetention > 0 {
+		indexes = append(indexes, mongo.IndexModel{
+			Keys:    bson.D{{Key: "start", Value: 1}},
+			Options: options.Index().SetName("start_ttl").SetExpireAfterSeconds(int32(config.StatsRetention.Seconds())),
+		})
+	}
+	return indexes
+}
+
+// Create indexes of collection which don't exist yet, logging which ones
+// were created
+// @param ctx context.Context
+// @param collection *mongo.Collection
+// @param indexes []mongo.IndexModel
+func createIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) {
+	// Listing the indexes of a collection which doesn't exist yet gives none
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		logger.Error("list indexes", "collection", collection.Name(), "error", err)
+		return
+	}
+	existing := map[string]bool{}
+	for _, spec := range specs {
+		existing[spec.Name] = true
+	}
+
+	names, err := collection.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		logger.Error("create indexes", "collection", collection.Name(), "error", err)
+		return
+	}
+	created := []string{}
+	for _, name := range names {
+		if !existing[name] {
+			created = append(created, name)
+		}
+	}
+	logger.Info("ensured indexes", "collection", collection.Name(), "created", created, "existing", len(names)-len(created))
+}
+
+// Create the standard GridFS indexes and those used by the query endpoints
+// in all buckets, and the indexes of the audit trail, the download counters
+// and the job queue, if they don't exist yet. The drivers only create the GridFS
+// indexes on the first upload to an empty bucket.
+// @param db *mongo.Database database
+func ensureIndexes(db *mongo.Database) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, bucket := range managedBuckets() {
+		createIndexes(ctx, namedFilesCollection(db, bucket), fileIndexes)
+		createIndexes(ctx, namedChunksCollection(db, bucket), chunkIndexes)
+	}
+	createIndexes(ctx, auditCollection(db), auditIndexes)
+	createIndexes(ctx, downloadStatsCollection(db), downloadStatsIndexes)
+	createIndexes(ctx, hourlyDownloadsCollection(db), hourlyDownloadsIndexes())
+	createIndexes(ctx, dailyDownloadsCollection(db), dailyDownloadsIndexes)
+	if db.Name() == config.DatabaseName {
+		createIndexes(ctx, db.Collection(jobsCollection), jobIndexes)
+		createIndexes(ctx, webhookDeadLetterCollection(db), jobs.DeadLetterIndexes)
+	}
+	if config.HLSFFmpeg != "" && db.Name() == config.DatabaseName {
+		createIndexes(ctx, namedFilesCollection(db, config.HLSBucket), hlsFileIndexes)
+	}
+	if config.TenantMode != "" && db.Name() == config.DatabaseName {
+		createIndexes(ctx, tenantCollection(db), tenantIndexes)
+	}
+}
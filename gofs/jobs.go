@@ -0,0 +1,207 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection queueing background jobs in the default database
+const jobsCollection = "jobs"
+
+// Kinds of background jobs
+const (
+	jobReplication = "replication"
+	jobTranscoding = "transcoding"
+	jobPreview     = "preview"
+	jobWebhook     = "webhook"
+	jobMaintenance = "maintenance"
+)
+
+// Indexes on the job queue backing the claims of the workers and the lookup
+// of the jobs of a file
+var jobIndexes = append(slices.Clone(jobs.Indexes), mongo.IndexModel{
+	Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "payload.fileId", Value: 1}},
+	Options: options.Index().SetName("kind_payload.fileId"),
+})
+
+var (
+	jobQueue     *jobs.Queue
+	jobQueueOnce sync.Once
+)
+
+// Get queue of the background jobs, created on first use
+// @return *jobs.Queue queue
+func backgroundJobs() *jobs.Queue {
+	jobQueueOnce.Do(func() {
+		jobQueue = jobs.New(database().Collection(jobsCollection), logger)
+	})
+	return jobQueue
+}
+
+// Enqueue background job. Failing to enqueue is logged, it does not fail the
+// operation.
+// @param ctx context.Context context of the operation
+// @param kind string
+// @param payload bson.M
+func enqueueJob(ctx context.Context, kind string, payload bson.M) {
+	// Enqueue the job even if the request was canceled meanwhile
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if _, err := backgroundJobs().Enqueue(writeCtx, kind, payload); err != nil {
+		logger.Error("enqueue job", "kind", kind, "payload", payload, "error", err)
+	}
+}
+
+// Enqueue job bringing something derived from a file up to date, e.g. its
+// replica or its renditions. Jobs don't say what changed, the handler
+// compares the file with what is derived from it, so jobs for the same file
+// can run in any order and more than once.
+// @param ctx context.Context context of the operation
+// @param kind string
+// @param bucket string bucket name
+// @param fileId primitive.ObjectID id of the uploaded, changed or deleted file
+func enqueueFileJob(ctx context.Context, kind, bucket string, fileId primitive.ObjectID) {
+	enqueueJob(ctx, kind, bson.M{"bucket": bucket, "fileId": fileId})
+}
+
+// Get file a job enqueued by enqueueFileJob works on
+// @param job *jobs.Job
+// @return string bucket name
+// @return primitive.ObjectID file id
+func fileJobTarget(job *jobs.Job) (string, primitive.ObjectID) {
+	bucket, _ := job.Payload["bucket"].(string)
+	fileId, _ := job.Payload["fileId"].(primitive.ObjectID)
+	return bucket, fileId
+}
+
+// Find queued or running job of a file
+// @param ctx context.Context
+// @param kind string
+// @param fileId primitive.ObjectID
+// @return *jobs.Job job, nil if there is none
+// @return error error
+func pendingFileJob(ctx context.Context, kind string, fileId primitive.ObjectID) (*jobs.Job, error) {
+	return backgroundJobs().Pending(ctx, kind, bson.M{"fileId": fileId})
+}
+
+// Start the workers running the background jobs registered by the services
+// started before, JOB_WORKERS for kinds without worker setting of their own
+func startJobWorkers() {
+	queue := backgroundJobs()
+	ctx, cancel := context.WithCancel(context.Background())
+	onShutdown(func(context.Context) {
+		// Jobs interrupted by the shutdown are retried once their lease ends
+		cancel()
+		queue.Wait()
+	})
+	queue.Start(ctx)
+}
+
+// Read job id from request params
+// @param c *fiber.Ctx context
+// @return primitive.ObjectID id
+// @return error error
+func jobIdParam(c *fiber.Ctx) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return primitive.NilObjectID, newError(fiber.StatusBadRequest, CodeInvalidId, "Invalid job id")
+	}
+	return id, nil
+}
+
+// Translate errors of the job queue to responses
+// @param err error
+// @return error error
+func jobError(err error) error {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		return newError(fiber.StatusNotFound, CodeNotFound, "Job not found, it finished or was deleted")
+	case errors.Is(err, jobs.ErrRunning):
+		return newError(fiber.StatusConflict, CodeConflict, "Job is running")
+	}
+	return err
+}
+
+// Register background job routes on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerJobRoutes(admin fiber.Router) {
+	// List queued, running and dead jobs, oldest first
+	// @param kind string
+	// @param status string queued|running|dead
+	// @param failed bool only jobs which failed at least once
+	// @param skip int
+	// @param limit int
+	// @return jobs
+	admin.Get("/jobs", func(c *fiber.Ctx) error {
+		v := &validation.Validator{}
+		filter := jobs.Filter{Kind: c.Query("kind"), Status: c.Query("status"), Failed: c.QueryBool("failed")}
+		if filter.Status != "" {
+			v.OneOf(validation.Query, "status", filter.Status, jobs.StatusQueued, jobs.StatusRunning, jobs.StatusDead)
+		}
+		skip, limit := pageParams(c, v)
+		if err := v.Err(); err != nil {
+			return err
+		}
+
+		list, err := backgroundJobs().Find(c.Context(), filter, skip, limit)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Jobs fetched successfully", "jobs", list)
+	})
+
+	// Get job
+	// @param id string
+	// @return job
+	admin.Get("/jobs/:id", func(c *fiber.Ctx) error {
+		id, err := jobIdParam(c)
+		if err != nil {
+			return err
+		}
+		job, err := backgroundJobs().Get(c.Context(), id)
+		if err != nil {
+			return jobError(err)
+		}
+		return respond(c, fiber.StatusOK, "Job fetched successfully", "job", job)
+	})
+
+	// Run dead or waiting job again now, with a fresh count of attempts
+	// @param id string
+	// @return job
+	admin.Post("/jobs/:id/retry", func(c *fiber.Ctx) error {
+		id, err := jobIdParam(c)
+		if err != nil {
+			return err
+		}
+		job, err := backgroundJobs().Retry(c.Context(), id)
+		if err != nil {
+			return jobError(err)
+		}
+		return respond(c, fiber.StatusOK, "Job queued successfully", "job", job)
+	})
+
+	// Delete job which is not running, e.g. a dead one which will never
+	// succeed
+	// @param id string
+	// @return success message
+	admin.Delete("/jobs/:id", func(c *fiber.Ctx) error {
+		id, err := jobIdParam(c)
+		if err != nil {
+			return err
+		}
+		if err := backgroundJobs().Delete(c.Context(), id); err != nil {
+			return jobError(err)
+		}
+		return respond(c, fiber.StatusOK, "Job deleted successfully", "", nil)
+	})
+}
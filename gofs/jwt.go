@@ -0,0 +1,190 @@
+package gofs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Clock skew tolerated when checking the validity period of tokens
+const jwtLeeway = time.Minute
+
+// Claims of a verified JWT
+type jwtClaims map[string]interface{}
+
+// Get claim by name, nested claims are named by path, e.g.
+// realm_access.roles
+// @param name string claim name or path
+// @return interface{} value, nil if missing
+func (claims jwtClaims) claim(name string) interface{} {
+	var value interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// Get string values of a claim holding a string or an array of strings
+// @param name string claim name or path
+// @return []string values
+func (claims jwtClaims) strings(name string) []string {
+	switch value := claims.claim(name).(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Get owner of the token from the JWT_OWNER_CLAIM claim, recorded as actor
+// in the audit trail and as owner of uploaded files
+// @return string owner
+func (claims jwtClaims) owner() string {
+	if owner, _ := claims.claim(config.JWTOwnerClaim).(string); owner != "" {
+		return owner
+	}
+	if sub, _ := claims["sub"].(string); sub != "" {
+		return sub
+	}
+	return "jwt"
+}
+
+// Get highest known role of the JWT_ROLE_CLAIM claim
+// @return string role, empty if the token carries no known role
+func (claims jwtClaims) role() string {
+	role := ""
+	for _, value := range claims.strings(config.JWTRoleClaim) {
+		if validRole(value) && roleRanks[value] > roleRanks[role] {
+			role = value
+		}
+	}
+	return role
+}
+
+// Get tenant the token is bound to, from the JWT_TENANT_CLAIM claim
+// @return string tenant id, empty if the token is not bound to a tenant
+func (claims jwtClaims) tenant() string {
+	tenant, _ := claims.claim(config.JWTTenantClaim).(string)
+	return tenant
+}
+
+// Check the registered claims of a token: expiry, not before, issuer and
+// audience
+// @param issuer string required issuer, empty accepts any
+// @param audiences []string accepted audiences, empty accepts any
+// @return error error
+func (claims jwtClaims) validate(issuer string, audiences []string) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if issuer != "" && claims["iss"] != issuer {
+		return errors.New("wrong issuer")
+	}
+	if len(audiences) == 0 {
+		return nil
+	}
+	for _, aud := range claims.strings("aud") {
+		for _, accepted := range audiences {
+			if aud == accepted {
+				return nil
+			}
+		}
+	}
+	return errors.New("wrong audience")
+}
+
+// Verify JWT and check its claims. Tokens signed with HS256 are verified
+// with JWT_SECRET, tokens signed with RS* or ES* with the keys of the OIDC
+// provider.
+// @param ctx context.Context
+// @param token string compact serialized token
+// @return jwtClaims claims
+// @return error error
+func verifyJWT(ctx context.Context, token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	var issuer string
+	var audiences []string
+	switch {
+	case header.Alg == "HS256" && config.JWTSecret != "":
+		mac := hmac.New(sha256.New, []byte(config.JWTSecret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+		issuer = config.JWTIssuer
+		if config.JWTAudience != "" {
+			audiences = []string{config.JWTAudience}
+		}
+	case (strings.HasPrefix(header.Alg, "RS") || strings.HasPrefix(header.Alg, "ES")) && config.OIDCIssuer != "":
+		if err := verifyOIDCSignature(ctx, header.Alg, header.Kid, signed, signature); err != nil {
+			return nil, err
+		}
+		issuer, audiences = config.OIDCIssuer, oidcAudiences()
+	default:
+		return nil, errors.New("unsupported algorithm " + header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.validate(issuer, audiences); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Decode base64url encoded JSON part of a token
+// @param part string
+// @param value interface{} pointer to the decoded value
+// @return error error
+func decodeJWTPart(part string, value interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gofs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Sign token with HS256, or another algorithm named in the header
+// @param t *testing.T
+// @param alg string header algorithm
+// @param secret string
+// @param claims map[string]interface{}
+// @return string token
+func signTestJWT(t *testing.T, alg, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = Config{JWTSecret: "secret", JWTIssuer: "https://issuer.example", JWTAudience: "gofs"}
+
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "iss": "https://issuer.example", "aud": "gofs", "exp": now + 3600}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", signTestJWT(t, "HS256", "secret", valid()), true},
+		{"audience in array", signTestJWT(t, "HS256", "secret", with("aud", []string{"other", "gofs"})), true},
+		{"expired within leeway", signTestJWT(t, "HS256", "secret", with("exp", now-30)), true},
+		{"wrong secret", signTestJWT(t, "HS256", "other", valid()), false},
+		{"alg none", signTestJWT(t, "none", "secret", valid()), false},
+		{"alg HS512", signTestJWT(t, "HS512", "secret", valid()), false},
+		{"alg RS256 without OIDC", signTestJWT(t, "RS256", "secret", valid()), false},
+		{"expired", signTestJWT(t, "HS256", "secret", with("exp", now-3600)), false},
+		{"missing exp", signTestJWT(t, "HS256", "secret", with("exp", nil)), false},
+		{"not valid yet", signTestJWT(t, "HS256", "secret", with("nbf", now+3600)), false},
+		{"wrong issuer", signTestJWT(t, "HS256", "secret", with("iss", "https://other.example")), false},
+		{"wrong audience", signTestJWT(t, "HS256", "secret", with("aud", "other")), false},
+		{"missing audience", signTestJWT(t, "HS256", "secret", with("aud", nil)), false},
+		{"malformed", "not.a-token", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := verifyJWT(context.Background(), test.token)
+			if test.ok && err != nil {
+				t.Fatalf("verifyJWT() error = %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("verifyJWT() accepted token with claims %v", claims)
+			}
+			if test.ok && claims.owner() != "alice" {
+				t.Errorf("owner() = %q, want alice", claims.owner())
+			}
+		})
+	}
+}
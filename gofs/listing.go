@@ -0,0 +1,369 @@
+package gofs
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page size limits of the listing endpoint
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// Fields listings can be sorted by, with their default order. Filenames are
+// listed alphabetically, dates and sizes largest first.
+var listSortOrders = map[string]string{
+	"uploadDate": "desc",
+	"length":     "desc",
+	"filename":   "asc",
+}
+
+// Convert files document to API representation
+// @param fileDoc bson.M files document
+// @return fiber.Map file info
+func fileInfo(fileDoc bson.M) fiber.Map {
+	return fiber.Map{
+		"id":         fileDoc["_id"],
+		"name":       fileDoc["filename"],
+		"size":       fileDoc["length"],
+		"uploadDate": fileDoc["uploadDate"],
+		"metadata":   fileDoc["metadata"],
+	}
+}
+
+// Split comma separated query parameter into trimmed non-empty values
+// @param value string
+// @return []string values
+func splitList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// Criteria of file listings
+type FileFilter struct {
+	// Tags in metadata.tags, matching all of them or any of them
+	Tags  []string
+	Match string
+	// RFC 3339 upload date range
+	UploadedAfter  string
+	UploadedBefore string
+	// Size range in bytes
+	MinSize *int64
+	MaxSize *int64
+	// Content type, e.g. image/png
+	ContentType string
+	// Sort field of listSortOrders, uploadDate if empty, and direction.
+	// Files with the same value are sorted by id in the same direction.
+	Sort      string
+	Ascending bool
+	// Last file of the previous page, nil for the first page
+	After *FileCursor
+	// Fields of the files documents listed, all if nil
+	Projection bson.M
+}
+
+// Position of a file in a listing
+type FileCursor struct {
+	// Sort field and direction of the listing
+	Sort      string
+	Ascending bool
+	// Value of the sort field and id of the file
+	Key interface{}
+	Id  primitive.ObjectID
+}
+
+// Get sort field of the listing
+// @return string field, uploadDate by default
+func (f FileFilter) sortField() string {
+	if f.Sort == "" {
+		return "uploadDate"
+	}
+	return f.Sort
+}
+
+// Get sort order of the listing
+// @return int 1 for ascending, -1 for descending
+func (f FileFilter) sortOrder() int {
+	if f.Ascending {
+		return 1
+	}
+	return -1
+}
+
+// Build sort of the listing, with the id breaking ties
+// @return bson.D sort
+func (f FileFilter) sort() bson.D {
+	return bson.D{{Key: f.sortField(), Value: f.sortOrder()}, {Key: "_id", Value: f.sortOrder()}}
+}
+
+// Build files filter from listing criteria
+// @return bson.M filter
+// @return error error
+func (f FileFilter) bson() (bson.M, error) {
+	filter := bson.M{}
+
+	// Filter by tags, matching all of them or any of them
+	if len(f.Tags) > 0 {
+		switch f.Match {
+		case "", "all":
+			filter["metadata.tags"] = bson.M{"$all": f.Tags}
+		case "any":
+			filter["metadata.tags"] = bson.M{"$in": f.Tags}
+		default:
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid match, expected all or any")
+		}
+	}
+
+	// Filter by upload date range
+	uploadDate := bson.M{}
+	for _, bound := range []struct{ param, value, operator string }{
+		{"uploadedAfter", f.UploadedAfter, "$gte"},
+		{"uploadedBefore", f.UploadedBefore, "$lt"},
+	} {
+		if bound.value != "" {
+			date, err := time.Parse(time.RFC3339, bound.value)
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+bound.param+", expected RFC 3339 timestamp")
+			}
+			uploadDate[bound.operator] = date
+		}
+	}
+	if len(uploadDate) > 0 {
+		filter["uploadDate"] = uploadDate
+	}
+
+	// Filter by size range in bytes
+	length := bson.M{}
+	for _, bound := range []struct {
+		param    string
+		value    *int64
+		operator string
+	}{
+		{"minSize", f.MinSize, "$gte"},
+		{"maxSize", f.MaxSize, "$lte"},
+	} {
+		if bound.value != nil {
+			if *bound.value < 0 {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+bound.param)
+			}
+			length[bound.operator] = *bound.value
+		}
+	}
+	if len(length) > 0 {
+		filter["length"] = length
+	}
+
+	// Filter by content type, stored as file extension
+	if f.ContentType != "" {
+		extensions := contentTypeExtensions(strings.ToLower(f.ContentType))
+		if len(extensions) == 0 {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Unsupported contentType")
+		}
+		filter["metadata.ext"] = bson.M{"$in": extensions}
+	}
+
+	// Files after the previous page
+	if f.After != nil {
+		filter["$and"] = bson.A{keysetFilter([]string{f.sortField(), "_id"}, []interface{}{f.After.Key, f.After.Id}, f.sortOrder())}
+	}
+
+	return activeFilter(filter), nil
+}
+
+// Read listing criteria from query parameters, recording invalid ones in v
+// before they reach the storage backend
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @return FileFilter criteria
+func listFilter(c *fiber.Ctx, v *validation.Validator) FileFilter {
+	f := FileFilter{
+		Tags:           splitList(c.Query("tags")),
+		Match:          c.Query("match", "all"),
+		UploadedAfter:  c.Query("uploadedAfter"),
+		UploadedBefore: c.Query("uploadedBefore"),
+		MinSize:        v.Size(validation.Query, "minSize", c.Query("minSize")),
+		MaxSize:        v.Size(validation.Query, "maxSize", c.Query("maxSize")),
+		ContentType:    c.Query("contentType"),
+	}
+	v.OneOf(validation.Query, "match", f.Match, "all", "any")
+	v.Time(validation.Query, "uploadedAfter", f.UploadedAfter)
+	v.Time(validation.Query, "uploadedBefore", f.UploadedBefore)
+	if f.ContentType != "" {
+		v.Check(len(contentTypeExtensions(strings.ToLower(f.ContentType))) > 0, validation.Query, "contentType", "Unsupported contentType")
+	}
+	return f
+}
+
+// Read sort and order query parameters into filter, recording invalid ones
+// in v
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @param filter *FileFilter
+func listSort(c *fiber.Ctx, v *validation.Validator, filter *FileFilter) {
+	filter.Sort = c.Query("sort", "uploadDate")
+	order, ok := listSortOrders[filter.Sort]
+	v.Check(ok, validation.Query, "sort", "sort must be one of uploadDate, length, filename")
+	order = c.Query("order", order)
+	v.OneOf(validation.Query, "order", order, "asc", "desc")
+	filter.Ascending = order == "asc"
+}
+
+// Read skip and limit query parameters, recording invalid ones in v
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @return int64 skip
+// @return int64 limit
+func pageParams(c *fiber.Ctx, v *validation.Validator) (int64, int64) {
+	limit := v.Int(validation.Query, "limit", c.Query("limit"), defaultListLimit, 1, maxListLimit)
+	skip := v.Int(validation.Query, "skip", c.Query("skip"), 0, 0, math.MaxInt32)
+	return int64(skip), int64(limit)
+}
+
+// Read skip and limit query parameters
+// @param c *fiber.Ctx context
+// @return int64 skip
+// @return int64 limit
+// @return error validation.Errors if they are invalid
+func listPage(c *fiber.Ctx) (int64, int64, error) {
+	v := &validation.Validator{}
+	skip, limit := pageParams(c, v)
+	return skip, limit, v.Err()
+}
+
+// Register listing routes of the default bucket and the named buckets
+// @param app *fiber.App app
+func registerListRoutes(app *fiber.App) {
+	app.Get("/api/images", requireRole(roleAdmin), listImages)
+	app.Get("/api/:bucket/files", selectBucket, requireRole(roleAdmin), listImages)
+	app.Get("/api/images/recent", requireRole(roleAdmin), recentImages)
+	app.Get("/api/:bucket/files/recent", selectBucket, requireRole(roleAdmin), recentImages)
+}
+
+// List images, optionally filtered by tags, upload date, size and content
+// type, newest first unless sorted otherwise. Pages are fetched with the
+// nextCursor of the previous page, or with skip, which gets slow deep into
+// large buckets.
+// @param sort string uploadDate|length|filename
+// @param order string asc|desc, asc for filename and desc otherwise by
+// default
+// @param tags string comma separated tags
+// @param match string all|any
+// @param uploadedAfter string RFC 3339 timestamp
+// @param uploadedBefore string RFC 3339 timestamp
+// @param minSize int bytes
+// @param maxSize int bytes
+// @param contentType string
+// @param fields string comma separated fields of the images listed
+// @param cursor string nextCursor of the previous page
+// @param skip int
+// @param limit int
+// @return images metadata and cursor of the next page
+func listImages(c *fiber.Ctx) error {
+	v := &validation.Validator{}
+	filter := listFilter(c, v)
+	listSort(c, v, &filter)
+	fields := selectFields(c, v)
+	skip, limit := pageParams(c, v)
+	var after FileCursor
+	if decodeCursor(v, c.Query("cursor"), &after.Sort, &after.Ascending, &after.Key, &after.Id) {
+		v.Check(skip == 0, validation.Query, "skip", "skip can't be combined with cursor")
+		v.Check(after.Sort == filter.Sort && after.Ascending == filter.Ascending, validation.Query, "cursor", "cursor belongs to another sort order")
+		filter.After = &after
+	}
+	if err := v.Err(); err != nil {
+		return err
+	}
+	// The cursor needs the sort field even if it isn't selected
+	fields.require(filter.Sort)
+	filter.Projection = fields.fileProjection()
+
+	// One more than the page tells if there is a next one
+	fileDocs, err := fileStorage().List(c.Context(), filter, skip, limit+1)
+	if err != nil {
+		return err
+	}
+	nextCursor := ""
+	if int64(len(fileDocs)) > limit {
+		fileDocs = fileDocs[:limit]
+		last := fileDocs[limit-1]
+		nextCursor = encodeCursor(filter.Sort, filter.Ascending, last[filter.Sort], last["_id"])
+	}
+
+	images := make([]fiber.Map, 0, len(fileDocs))
+	for _, fileDoc := range fileDocs {
+		images = append(images, fields.apply(fileInfo(fileDoc)))
+	}
+
+	return respondPage(c, "Images fetched successfully", "images", images, nextCursor)
+}
+
+// List newest images first, a page at a time: the nextCursor of a page
+// fetches the next one. Pages are read from the _id index and don't shift
+// when images are uploaded in between, unlike skip.
+// @param cursor string nextCursor of the previous page, empty for the first
+// @param limit int
+// @param tags string comma separated tags
+// @param match string all|any
+// @param uploadedAfter string RFC 3339 timestamp
+// @param uploadedBefore string RFC 3339 timestamp
+// @param minSize int bytes
+// @param maxSize int bytes
+// @param contentType string
+// @return images metadata and cursor of the next page
+func recentImages(c *fiber.Ctx) error {
+	v := &validation.Validator{}
+	filter := listFilter(c, v)
+	limit := v.Int(validation.Query, "limit", c.Query("limit"), defaultListLimit, 1, maxListLimit)
+	var after primitive.ObjectID
+	paged := decodeCursor(v, c.Query("cursor"), &after)
+	if err := v.Err(); err != nil {
+		return err
+	}
+
+	query, err := filter.bson()
+	if err != nil {
+		return err
+	}
+	if paged {
+		query["_id"] = bson.M{"$lt": after}
+	}
+	// One more than the page tells if there is a next one
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(limit) + 1)
+	var fileDocs []bson.M
+	err = withRetry(c.Context(), func() error {
+		cursor, err := requestFilesCollection(c.Context(), readDatabase(c.Context())).Find(c.Context(), query, findOptions)
+		if err != nil {
+			return err
+		}
+		return cursor.All(c.Context(), &fileDocs)
+	})
+	if err != nil {
+		return err
+	}
+
+	nextCursor := ""
+	if len(fileDocs) > limit {
+		fileDocs = fileDocs[:limit]
+		nextCursor = encodeCursor(fileDocs[limit-1]["_id"])
+	}
+	images := make([]fiber.Map, 0, len(fileDocs))
+	for _, fileDoc := range fileDocs {
+		images = append(images, fileInfo(fileDoc))
+	}
+	return respondPage(c, "Images fetched successfully", "images", images, nextCursor)
+}
@@ -0,0 +1,84 @@
+package gofs
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+// Locals key of the request ID
+const requestIDKey = "requestid"
+
+// Minimum level of logged records, set from the configuration
+var logLevel = new(slog.LevelVar)
+
+// JSON logger of the file service
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// Get JSON logger of the file service, e.g. to make it the default logger
+// of the application with slog.SetDefault
+// @return *slog.Logger logger
+func Logger() *slog.Logger {
+	return logger
+}
+
+// Get logger with the request ID of c
+// @param c *fiber.Ctx context
+// @return *slog.Logger logger
+func requestLogger(c *fiber.Ctx) *slog.Logger {
+	id, _ := c.Locals(requestIDKey).(string)
+	return logger.With("request_id", id)
+}
+
+// Middleware logging every request with method, path, status and duration.
+// Errors are formatted here already, so the log has the final status, and
+// server errors are logged with the file id of the request.
+// @param c *fiber.Ctx context
+// @return error error
+func accessLog(c *fiber.Ctx) error {
+	start := time.Now()
+	if err := c.Next(); err != nil {
+		if handlerErr := ErrorHandler(c, err); handlerErr != nil {
+			c.Status(fiber.StatusInternalServerError)
+		}
+		if errorStatus(err) >= fiber.StatusInternalServerError {
+			requestLogger(c).Error("request failed",
+				"method", c.Method(),
+				"path", c.Path(),
+				"file_id", c.Params("id"),
+				"error", err.Error(),
+			)
+		}
+	}
+
+	// Streamed bodies are not buffered, only their announced length is known
+	size := c.Response().Header.ContentLength()
+	if !c.Response().IsBodyStream() {
+		size = len(c.Response().Body())
+	}
+
+	status := c.Response().StatusCode()
+	level := slog.LevelInfo
+	if status >= fiber.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	requestLogger(c).Log(c.Context(), level, "request",
+		"method", c.Method(),
+		"path", c.Path(),
+		"status", status,
+		"duration_ms", time.Since(start).Milliseconds(),
+		"bytes", size,
+		"ip", c.IP(),
+	)
+	return nil
+}
+
+// Register request ID and access log middleware
+// @param app *fiber.App app
+func registerLoggingMiddleware(app *fiber.App) {
+	app.Use(requestid.New(requestid.Config{ContextKey: requestIDKey}))
+	app.Use(accessLog)
+}
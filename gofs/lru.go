@@ -0,0 +1,131 @@
+package gofs
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// In-process LRU cache bounded by the total size of its values
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxItem  int64
+	bytes    int64
+	order    *list.List
+	items    map[string]*list.Element
+	hits     atomic.Int64
+	misses   atomic.Int64
+	evicted  atomic.Int64
+}
+
+// Entry of the LRU cache, the front of the list is the most recently used
+type lruEntry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// Create LRU cache
+// @param maxBytes int64 total size of the values
+// @param maxItem int64 largest value cached
+// @return *lruCache cache
+func newLRUCache(maxBytes, maxItem int64) *lruCache {
+	return &lruCache{maxBytes: maxBytes, maxItem: maxItem, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get value of key, counting the hit or miss
+// @param key string
+// @return interface{} value
+// @return bool key was found and has not expired
+func (l *lruCache) Get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.items[key]
+	if ok {
+		entry := element.Value.(*lruEntry)
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			l.order.MoveToFront(element)
+			l.hits.Add(1)
+			return entry.value, true
+		}
+		l.remove(element)
+	}
+	l.misses.Add(1)
+	return nil, false
+}
+
+// Check if values of a size are cached
+// @param size int64 size of the value in bytes
+// @return bool
+func (l *lruCache) fits(size int64) bool {
+	return size <= l.maxItem && size <= l.maxBytes
+}
+
+// Set value of key, evicting the least recently used values to stay within
+// the memory budget. Values larger than the item limit are not cached.
+// @param key string
+// @param value interface{}
+// @param size int64 size of the value in bytes
+// @param ttl time.Duration how long the value is kept, 0 until evicted
+func (l *lruCache) Set(key string, value interface{}, size int64, ttl time.Duration) {
+	if !l.fits(size) {
+		return
+	}
+	entry := &lruEntry{key: key, value: value, size: size}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.items[key]; ok {
+		l.remove(element)
+	}
+	l.items[key] = l.order.PushFront(entry)
+	l.bytes += size
+	for l.bytes > l.maxBytes {
+		l.remove(l.order.Back())
+		l.evicted.Add(1)
+	}
+}
+
+// Delete keys
+// @param keys ...string
+func (l *lruCache) Delete(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := l.items[key]; ok {
+			l.remove(element)
+		}
+	}
+}
+
+// Remove entry, the lock must be held
+// @param element *list.Element
+func (l *lruCache) remove(element *list.Element) {
+	entry := l.order.Remove(element).(*lruEntry)
+	delete(l.items, entry.key)
+	l.bytes -= entry.size
+}
+
+// Get size, hit and miss counters of the cache
+// @return fiber.Map stats
+func (l *lruCache) Stats() fiber.Map {
+	l.mu.Lock()
+	items, bytes := len(l.items), l.bytes
+	l.mu.Unlock()
+	return fiber.Map{
+		"items":    items,
+		"bytes":    bytes,
+		"maxBytes": l.maxBytes,
+		"hits":     l.hits.Load(),
+		"misses":   l.misses.Load(),
+		"evicted":  l.evicted.Load(),
+	}
+}
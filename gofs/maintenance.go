@@ -0,0 +1,342 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection keeping the next and the last run of each maintenance task in
+// the default database
+const maintenanceCollection = "maintenance"
+
+// Limits of maintenance runs
+const (
+	// How often instances look for due tasks
+	maintenanceCheckInterval = 15 * time.Second
+	// Time a run has before another instance may take it over
+	maintenanceLease = time.Hour
+	// Delay before retrying a failed run, doubled on every further attempt
+	maintenanceRetryDelay = time.Minute
+	// Attempts after which a failing run is dead, the next scheduled run
+	// starts over
+	maintenanceMaxAttempts = 3
+)
+
+// States of the last run of a maintenance task
+const (
+	maintenanceRunning   = "running"
+	maintenanceSucceeded = "succeeded"
+	maintenanceFailed    = "failed"
+)
+
+// Periodic maintenance task
+type maintenanceTask struct {
+	// Name in the MAINTENANCE_<NAME>_ENABLED and _SCHEDULE settings
+	setting     string
+	description string
+	// Default of the enable flag and the schedule
+	enabled  bool
+	schedule string
+	// Run the task on all buckets of every tenant, returning a summary
+	run func(ctx context.Context) (fiber.Map, error)
+	// Check if the task applies to the configuration, nil if it always does
+	supported func() bool
+}
+
+// Maintenance tasks by name
+var maintenanceTasks = map[string]maintenanceTask{
+	"expiredFiles": {
+		setting:     "EXPIRED_FILES",
+		description: "Delete expired files",
+		enabled:     true,
+		schedule:    "@every 1m",
+		run: func(ctx context.Context) (fiber.Map, error) {
+			deleted, err := deleteAllExpiredFiles(ctx)
+			return fiber.Map{"deleted": deleted}, err
+		},
+	},
+	"orphans": {
+		setting:     "ORPHANS",
+		description: "Delete chunks without files document and files missing chunks",
+		schedule:    "0 3 * * *",
+		run: func(ctx context.Context) (fiber.Map, error) {
+			report, err := cleanAllOrphans(ctx)
+			return fiber.Map{
+				"orphanedChunks":  report.OrphanedChunks,
+				"reclaimedBytes":  report.ReclaimedBytes,
+				"incompleteFiles": len(report.IncompleteFiles),
+			}, err
+		},
+		// Only GridFS keeps its content in chunks
+		supported: func() bool { return config.StorageBackend == "gridfs" },
+	},
+	"statsRollup": {
+		setting:     "STATS_ROLLUP",
+		description: "Roll hourly download counters of past days up into daily counters",
+		enabled:     true,
+		schedule:    "15 0 * * *",
+		run: func(ctx context.Context) (fiber.Map, error) {
+			days, err := forEachTenantDatabase(ctx, func(db *mongo.Database) (int, error) {
+				return rollupDownloads(ctx, db)
+			})
+			return fiber.Map{"days": days}, err
+		},
+	},
+	"indexes": {
+		setting:     "INDEXES",
+		description: "Create missing indexes of all buckets and collections",
+		enabled:     true,
+		schedule:    "30 4 * * *",
+		run: func(ctx context.Context) (fiber.Map, error) {
+			databases, err := forEachTenantDatabase(ctx, func(db *mongo.Database) (int, error) {
+				ensureIndexes(db)
+				return 1, nil
+			})
+			return fiber.Map{"databases": databases}, err
+		},
+	},
+}
+
+// Get names of the maintenance tasks in order
+// @return []string names
+func maintenanceTaskNames() []string {
+	names := make([]string, 0, len(maintenanceTasks))
+	for name := range maintenanceTasks {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Run and schedule of a maintenance task, as stored
+type maintenanceState struct {
+	Task      string    `bson:"_id" json:"task"`
+	Schedule  string    `bson:"schedule" json:"schedule"`
+	NextRunAt time.Time `bson:"nextRunAt" json:"nextRunAt"`
+	// Last run which started, nil if the task never ran
+	LastRun *maintenanceRun `bson:"lastRun,omitempty" json:"lastRun"`
+}
+
+// Run of a maintenance task
+type maintenanceRun struct {
+	// running, succeeded or failed
+	Status     string     `bson:"status" json:"status"`
+	Attempt    int        `bson:"attempt" json:"attempt"`
+	StartedAt  time.Time  `bson:"startedAt" json:"startedAt"`
+	FinishedAt *time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+	Error      string     `bson:"error,omitempty" json:"error,omitempty"`
+	Result     bson.M     `bson:"result,omitempty" json:"result,omitempty"`
+}
+
+// Open collection of the maintenance schedule
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func maintenanceStates(db *mongo.Database) *mongo.Collection {
+	return db.Collection(maintenanceCollection)
+}
+
+// Get setting key of a maintenance task
+// @param task maintenanceTask
+// @param setting string ENABLED or SCHEDULE
+// @return string key
+func maintenanceKey(task maintenanceTask, setting string) string {
+	return "MAINTENANCE_" + task.setting + "_" + setting
+}
+
+// Run function on the database of every tenant
+// @param ctx context.Context
+// @param run func(*mongo.Database) (int, error) returns a count
+// @return int sum of the counts
+// @return error error of the databases which failed
+func forEachTenantDatabase(ctx context.Context, run func(db *mongo.Database) (int, error)) (int, error) {
+	tenants, err := managedTenants(ctx)
+	if err != nil {
+		logger.Error("list tenants", "error", err)
+	}
+	total := 0
+	var errs []error
+	for _, t := range tenants {
+		db := requestDatabase(withTenant(ctx, t))
+		count, err := run(db)
+		total += count
+		if err != nil {
+			errs = append(errs, errors.New(db.Name()+": "+err.Error()))
+		}
+	}
+	return total, errors.Join(errs...)
+}
+
+// Check if a maintenance task runs with the configuration
+// @param name string
+// @return bool enabled
+func maintenanceEnabled(name string) bool {
+	task := maintenanceTasks[name]
+	return config.Maintenance[name].Enabled && (task.supported == nil || task.supported())
+}
+
+// Run maintenance task queued by the scheduler, recording the run
+// @param ctx context.Context
+// @param job *jobs.Job
+// @return error error
+func runMaintenanceJob(ctx context.Context, job *jobs.Job) error {
+	name, _ := job.Payload["task"].(string)
+	task, ok := maintenanceTasks[name]
+	if !ok {
+		return errors.New("unknown maintenance task " + name)
+	}
+	states := maintenanceStates(database())
+	run := maintenanceRun{Status: maintenanceRunning, Attempt: job.Attempts, StartedAt: time.Now().UTC()}
+	if _, err := states.UpdateOne(ctx, bson.M{"_id": name}, bson.M{"$set": bson.M{"lastRun": run}}); err != nil {
+		return err
+	}
+
+	result, err := task.run(ctx)
+	finishedAt := time.Now().UTC()
+	run.FinishedAt = &finishedAt
+	run.Status = maintenanceSucceeded
+	run.Result = bson.M(result)
+	if err != nil {
+		run.Status = maintenanceFailed
+		run.Error = err.Error()
+	}
+	logger.Info("maintenance task finished", "task", name, "status", run.Status, "duration", finishedAt.Sub(run.StartedAt), "result", result)
+
+	// Record the run even if the service shuts down meanwhile
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if _, updateErr := states.UpdateOne(writeCtx, bson.M{"_id": name}, bson.M{"$set": bson.M{"lastRun": run}}); updateErr != nil {
+		logger.Error("record maintenance run", "task", name, "error", updateErr)
+	}
+	return err
+}
+
+// Queue enabled maintenance tasks which are due. Each due run is claimed by
+// moving the next run of the task on, so only one instance queues it.
+// @param ctx context.Context
+// @param states *mongo.Collection maintenance schedule
+// @param schedules map[string]*cronSchedule schedules of the enabled tasks
+func queueDueMaintenance(ctx context.Context, states *mongo.Collection, schedules map[string]*cronSchedule) {
+	now := time.Now().UTC()
+	for name, schedule := range schedules {
+		result, err := states.UpdateOne(ctx,
+			bson.M{"_id": name, "schedule": config.Maintenance[name].Schedule, "nextRunAt": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"nextRunAt": schedule.next(now)}},
+		)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("claim maintenance run", "task", name, "error", err)
+			}
+			continue
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		// A run still going on is not overlapped, the next one is skipped
+		if _, err := backgroundJobs().EnqueueUnique(ctx, jobMaintenance, name, bson.M{"task": name}); err != nil {
+			logger.Error("enqueue maintenance run", "task", name, "error", err)
+		}
+	}
+}
+
+// Register the handler of maintenance jobs and start queueing the enabled
+// maintenance tasks on their schedules. Tasks whose schedule changed start
+// over with the next run of the new schedule.
+func startMaintenanceSchedule() {
+	backgroundJobs().Register(jobMaintenance, jobs.Handler{
+		Run:         runMaintenanceJob,
+		Workers:     config.JobWorkers,
+		Lease:       maintenanceLease,
+		RetryDelay:  maintenanceRetryDelay,
+		MaxAttempts: maintenanceMaxAttempts,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	states := maintenanceStates(database())
+	now := time.Now().UTC()
+	schedules := map[string]*cronSchedule{}
+	for name := range maintenanceTasks {
+		if !maintenanceEnabled(name) {
+			continue
+		}
+		// Validated when the configuration is loaded
+		spec := config.Maintenance[name].Schedule
+		schedule, _ := parseCron(spec)
+		_, err := states.UpdateOne(ctx,
+			bson.M{"_id": name, "schedule": bson.M{"$ne": spec}},
+			bson.M{"$set": bson.M{"schedule": spec, "nextRunAt": schedule.next(now)}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			logger.Error("schedule maintenance task", "task", name, "error", err)
+		}
+		schedules[name] = schedule
+	}
+	if len(schedules) == 0 {
+		cancel()
+		return
+	}
+
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	onShutdown(func(context.Context) {
+		ticker.Stop()
+		cancel()
+	})
+	go func() {
+		for {
+			queueDueMaintenance(ctx, states, schedules)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Register maintenance schedule route on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerMaintenanceRoutes(admin fiber.Router) {
+	// Get maintenance tasks with their schedule, next run and last run
+	// @return tasks
+	admin.Get("/maintenance/schedule", func(c *fiber.Ctx) error {
+		cursor, err := maintenanceStates(database()).Find(c.Context(), bson.M{})
+		if err != nil {
+			return err
+		}
+		var stored []maintenanceState
+		if err := cursor.All(c.Context(), &stored); err != nil {
+			return err
+		}
+		states := map[string]maintenanceState{}
+		for _, state := range stored {
+			states[state.Task] = state
+		}
+
+		tasks := []fiber.Map{}
+		for _, name := range maintenanceTaskNames() {
+			task := maintenanceTasks[name]
+			enabled := maintenanceEnabled(name)
+			var nextRunAt *time.Time
+			if state, ok := states[name]; ok && enabled && state.Schedule == config.Maintenance[name].Schedule {
+				nextRunAt = &state.NextRunAt
+			}
+			tasks = append(tasks, fiber.Map{
+				"task":        name,
+				"description": task.description,
+				"enabled":     enabled,
+				"schedule":    config.Maintenance[name].Schedule,
+				"nextRunAt":   nextRunAt,
+				"lastRun":     states[name].LastRun,
+			})
+		}
+		return respond(c, fiber.StatusOK, "Maintenance schedule fetched successfully", "tasks", tasks)
+	})
+}
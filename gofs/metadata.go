@@ -0,0 +1,386 @@
+package gofs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Metadata keys managed by the server which clients cannot set
+var reservedMetadataKeys = map[string]bool{
+	"ext":        true,
+	"version":    true,
+	"current":    true,
+	"expiresAt":  true,
+	"copiedFrom": true,
+	"movedFrom":  true,
+	"sourceUrl":  true,
+	"owner":      true,
+	"document":   true,
+	"video":      true,
+	"audio":      true,
+	"sha256":     true,
+	"revision":   true,
+}
+
+// Maximum number of ids of a batch info request
+const maxBatchInfoIds = 100
+
+// Request body of the batch info endpoint
+type batchInfoRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// Convert files document to the API representation of the info endpoint,
+// with chunk size and checksums
+// @param fileDoc bson.M files document
+// @return fiber.Map image details
+func fileDetails(fileDoc bson.M) fiber.Map {
+	info := fileInfo(fileDoc)
+	info["chunkSize"] = fileDoc["chunkSize"]
+	// Only files written by older drivers carry an md5 checksum, and only
+	// files stored since content hashes are recorded a SHA-256 hash
+	checksum := fiber.Map{}
+	if md5, ok := fileDoc["md5"]; ok {
+		checksum["md5"] = md5
+	}
+	if metadata, ok := fileDoc["metadata"].(bson.M); ok && metadata["sha256"] != nil {
+		checksum["sha256"] = metadata["sha256"]
+	}
+	info["checksum"] = nil
+	if len(checksum) > 0 {
+		info["checksum"] = checksum
+	}
+	return info
+}
+
+// Validate custom metadata fields supplied by a client
+// @param custom map[string]interface{}
+// @return error validation.Errors with all invalid fields
+func validateCustomMetadata(custom map[string]interface{}) error {
+	v := &validation.Validator{}
+	invalid := func(key, msg string) {
+		v.Add("", "metadata."+key, string(CodeInvalidMetadata), msg)
+	}
+
+	// Report fields in a stable order
+	keys := make([]string, 0, len(custom))
+	for key := range custom {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := custom[key]
+		if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			invalid(key, fmt.Sprintf("Invalid metadata key %q", key))
+			continue
+		}
+		if reservedMetadataKeys[key] {
+			invalid(key, fmt.Sprintf("Metadata key %q is reserved", key))
+			continue
+		}
+
+		switch key {
+		case "tags":
+			tags, ok := value.([]interface{})
+			for _, tag := range tags {
+				if tag, isString := tag.(string); !isString || strings.TrimSpace(tag) == "" {
+					ok = false
+				}
+			}
+			if !ok {
+				invalid(key, "Metadata field tags must be an array of strings")
+			}
+		case "description":
+			if _, ok := value.(string); !ok && value != nil {
+				invalid(key, "Metadata field description must be a string")
+			}
+		case "visibility":
+			if value != visibilityPublic && value != visibilityPrivate {
+				invalid(key, "Metadata field visibility must be public or private")
+			}
+		}
+	}
+	return v.Err()
+}
+
+// Check encoded size of metadata document against the configured cap
+// @param metadata bson.M
+// @return error error
+func checkMetadataSize(metadata bson.M) error {
+	encoded, err := bson.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if len(encoded) > config.MaxMetadataBytes {
+		return fmt.Errorf("Metadata exceeds maximum size of %d bytes", config.MaxMetadataBytes)
+	}
+	return nil
+}
+
+// Read custom metadata from upload form fields. Arbitrary fields can be sent
+// as a JSON object in the "metadata" part, the "tags" (comma separated or
+// repeated), "description" and "category" fields take precedence over it.
+// @param form map[string][]string form field values
+// @return map[string]interface{} custom metadata
+// @return error error
+func uploadMetadata(form map[string][]string) (map[string]interface{}, error) {
+	custom := map[string]interface{}{}
+	if values := form["metadata"]; len(values) > 0 && values[0] != "" {
+		if err := json.Unmarshal([]byte(values[0]), &custom); err != nil {
+			return nil, validation.Errors{{Field: "metadata", Code: string(CodeInvalidMetadata), Message: "Invalid metadata, expected JSON object"}}
+		}
+	}
+
+	var tags []interface{}
+	for _, value := range form["tags"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if tags != nil {
+		custom["tags"] = tags
+	}
+	for _, key := range []string{"description", "category"} {
+		if values := form[key]; len(values) > 0 && values[0] != "" {
+			custom[key] = values[0]
+		}
+	}
+
+	if err := validateCustomMetadata(custom); err != nil {
+		return nil, err
+	}
+	return custom, nil
+}
+
+// Build metadata document for a new upload
+// @param opts uploadOptions
+// @param ext string file extension
+// @param version int
+// @return bson.M metadata
+// @return error error
+func buildFileMetadata(opts uploadOptions, ext string, version int) (bson.M, error) {
+	metadata := bson.M{}
+	for key, value := range opts.Custom {
+		metadata[key] = value
+	}
+	metadata["ext"] = ext
+	metadata["version"] = version
+	metadata["current"] = true
+	if opts.ExpiresAt != nil {
+		metadata["expiresAt"] = opts.ExpiresAt
+	}
+	if opts.Owner != "" {
+		metadata["owner"] = opts.Owner
+	}
+
+	if err := checkMetadataSize(metadata); err != nil {
+		return nil, newError(fiber.StatusRequestEntityTooLarge, CodeMetadataTooLarge, err.Error())
+	}
+	return metadata, nil
+}
+
+// Update custom metadata of a file, merging fields into the existing
+// metadata or replacing all custom fields. Changes are recorded in the audit
+// trail, failed ones too.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param fileDoc bson.M files document
+// @param custom map[string]interface{} custom fields, nil values remove a field
+// @param mode string merge|replace
+// @return bson.M updated metadata
+// @return error error
+func updateFileMetadata(ctx context.Context, db *mongo.Database, fileDoc bson.M, custom map[string]interface{}, mode string) (bson.M, error) {
+	metadata, err := writeFileMetadata(ctx, db, fileDoc, custom, mode)
+	recordAudit(ctx, auditMetadata, fileDoc["_id"].(primitive.ObjectID), fileDoc["filename"].(string), err)
+	if err == nil {
+		forgetFileDocs(BucketFromContext(ctx))
+		purgeFile(BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID), fileDoc["filename"].(string))
+		replicateFile(ctx, BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID))
+	}
+	return metadata, err
+}
+
+// Write custom metadata of a file, see updateFileMetadata
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param fileDoc bson.M files document
+// @param custom map[string]interface{} custom fields, nil values remove a field
+// @param mode string merge|replace
+// @return bson.M updated metadata
+// @return error error
+func writeFileMetadata(ctx context.Context, db *mongo.Database, fileDoc bson.M, custom map[string]interface{}, mode string) (bson.M, error) {
+	if mode != "merge" && mode != "replace" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid mode, expected merge or replace")
+	}
+	if err := validateCustomMetadata(custom); err != nil {
+		return nil, err
+	}
+
+	// Build the new metadata document
+	existing, _ := fileDoc["metadata"].(bson.M)
+	metadata := bson.M{}
+	for key, value := range existing {
+		if mode == "merge" || reservedMetadataKeys[key] {
+			metadata[key] = value
+		}
+	}
+	for key, value := range custom {
+		if value == nil {
+			delete(metadata, key)
+			continue
+		}
+		metadata[key] = value
+	}
+	if err := checkMetadataSize(metadata); err != nil {
+		return nil, newError(fiber.StatusRequestEntityTooLarge, CodeMetadataTooLarge, err.Error())
+	}
+
+	// Fails if the metadata changed since fileDoc was read
+	metadata["revision"] = metadataRevision(fileDoc) + 1
+	err := withRetry(ctx, func() error {
+		return updateRevision(ctx, filesCollection(db), fileDoc, bson.M{"metadata": metadata})
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishEvent(eventFileMetadataUpdated, fiber.Map{"id": fileDoc["_id"], "metadata": metadata})
+	return metadata, nil
+}
+
+// Register metadata routes
+// @param app *fiber.App app
+func registerMetadataRoutes(app *fiber.App) {
+	// Get GridFS files document of an image without its content
+	// @param id string
+	// @param fields string comma separated fields of the image
+	// @return image metadata
+	app.Get("/api/image/id/:id/info", func(c *fiber.Ctx) error {
+		v := &validation.Validator{}
+		fields := selectFields(c, v)
+		if err := v.Err(); err != nil {
+			return err
+		}
+		var fileDoc bson.M
+		var err error
+		if fields == nil {
+			fileDoc, err = findFileByParam(c)
+		} else {
+			// The ETag needs the revision even if it isn't selected
+			fields.require("metadata.revision")
+			fileDoc, err = findFileFieldsByParam(c, fields.fileProjection())
+		}
+		if err != nil {
+			return err
+		}
+
+		c.Set(fiber.HeaderETag, metadataETag(fileDoc))
+		return respond(c, fiber.StatusOK, "Image info fetched successfully", "image", fields.apply(fileDetails(fileDoc)))
+	})
+
+	// Get GridFS files documents of several images in one request, in request
+	// order. Images which don't exist are listed as {"id": id, "notFound":
+	// true}.
+	// @param ids []string
+	// @param fields string comma separated fields of the images
+	// @return images metadata
+	app.Post("/api/images/info", func(c *fiber.Ctx) error {
+		v := &validation.Validator{}
+		fields := selectFields(c, v)
+		if err := v.Err(); err != nil {
+			return err
+		}
+		var body batchInfoRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if len(body.Ids) == 0 || len(body.Ids) > maxBatchInfoIds {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Expected between 1 and %d ids", maxBatchInfoIds))
+		}
+		ids := make([]primitive.ObjectID, 0, len(body.Ids))
+		for _, hex := range body.Ids {
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				return newError(fiber.StatusBadRequest, CodeInvalidId, "Invalid id "+hex)
+			}
+			ids = append(ids, id)
+		}
+
+		findOptions := options.Find().SetProjection(fields.fileProjection())
+		var found []bson.M
+		err := withRetry(c.Context(), func() error {
+			cursor, err := requestFilesCollection(c.Context(), readDatabase(c.Context())).Find(c.Context(), activeFilter(bson.M{"_id": bson.M{"$in": ids}}), findOptions)
+			if err != nil {
+				return err
+			}
+			return cursor.All(c.Context(), &found)
+		})
+		if err != nil {
+			return err
+		}
+		byId := map[primitive.ObjectID]bson.M{}
+		for _, fileDoc := range found {
+			byId[fileDoc["_id"].(primitive.ObjectID)] = fileDoc
+		}
+
+		images := make([]fiber.Map, 0, len(ids))
+		for _, id := range ids {
+			fileDoc, ok := byId[id]
+			if !ok {
+				images = append(images, fiber.Map{"id": id, "notFound": true})
+				continue
+			}
+			images = append(images, fields.apply(fileDetails(fileDoc)))
+		}
+		return respond(c, fiber.StatusOK, "Images info fetched successfully", "images", images)
+	})
+
+	// Update custom metadata of an image. Fields are merged into the existing
+	// metadata by default (null removes a field), ?mode=replace replaces all
+	// custom fields. Server managed fields are always kept. With If-Match the
+	// update fails with 412 if the image changed since the client read it.
+	// @param id string
+	// @param mode string merge|replace
+	// @return image metadata with the new ETag
+	app.Patch("/api/image/id/:id/metadata", func(c *fiber.Ctx) error {
+		db := requestDatabase(c.Context())
+
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, fileDoc); err != nil {
+			return err
+		}
+
+		// Parse custom fields
+		var custom map[string]interface{}
+		if err := c.BodyParser(&custom); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		metadata, err := updateFileMetadata(c.Context(), db, fileDoc, custom, c.Query("mode", "merge"))
+		if err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderETag, revisionETag(fileDoc["_id"].(primitive.ObjectID), metadata["revision"].(int64)))
+
+		return respond(c, fiber.StatusOK, "Image metadata updated successfully", "image", fiber.Map{
+			"id":       fileDoc["_id"],
+			"name":     fileDoc["filename"],
+			"metadata": metadata,
+		})
+	})
+}
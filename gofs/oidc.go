@@ -0,0 +1,444 @@
+package gofs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Cookies of the login flow: the session holding the ID token, and the
+// state of a login in progress
+const (
+	sessionCookie = "gofs_session"
+	loginCookie   = "gofs_login"
+)
+
+// How long a login may take at the OIDC provider
+const loginTimeout = 10 * time.Minute
+
+// Shortest time between two fetches of the provider keys, tokens signed with
+// unknown keys refetch them at most this often
+const jwksRefreshInterval = time.Minute
+
+// HTTP client used for OIDC discovery, key and token requests
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// Hashes of the RS* and ES* signature algorithms
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// Endpoints of the OIDC provider, from its discovery document
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Key of the provider's JSON Web Key Set
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Discovered provider and its signing keys by key id
+var oidcState struct {
+	sync.Mutex
+	provider *oidcProvider
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+}
+
+// Get audiences accepted in OIDC tokens: OIDC_AUDIENCE for access tokens of
+// API clients and the client id for ID tokens of the login flow
+// @return []string audiences
+func oidcAudiences() []string {
+	var audiences []string
+	for _, aud := range []string{config.OIDCAudience, config.OIDCClientId} {
+		if aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+	return audiences
+}
+
+// Get JSON document
+// @param ctx context.Context
+// @param url string
+// @param value interface{} pointer to the decoded document
+// @return error error
+func fetchJSON(ctx context.Context, url string, value interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(value)
+}
+
+// Get endpoints of the OIDC provider, discovered once from its issuer URL.
+// The lock must be held.
+// @param ctx context.Context
+// @return *oidcProvider provider
+// @return error error
+func discoverOIDC(ctx context.Context) (*oidcProvider, error) {
+	if oidcState.provider != nil {
+		return oidcState.provider, nil
+	}
+	var provider oidcProvider
+	if err := fetchJSON(ctx, strings.TrimSuffix(config.OIDCIssuer, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	oidcState.provider = &provider
+	return oidcState.provider, nil
+}
+
+// Get endpoints of the OIDC provider
+// @param ctx context.Context
+// @return *oidcProvider provider
+// @return error error
+func oidcEndpoints(ctx context.Context) (*oidcProvider, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	return discoverOIDC(ctx)
+}
+
+// Get signing keys of the OIDC provider, refetching them if kid is unknown,
+// as the provider may have rotated its keys
+// @param ctx context.Context
+// @param kid string key id of a token, empty if it names none
+// @return []crypto.PublicKey candidate keys
+// @return error error
+func oidcKeys(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	if _, ok := oidcState.keys[kid]; (oidcState.keys == nil || (kid != "" && !ok)) && time.Since(oidcState.fetched) > jwksRefreshInterval {
+		provider, err := discoverOIDC(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		if err := fetchJSON(ctx, provider.JWKSURI, &set); err != nil {
+			return nil, err
+		}
+		keys := map[string]crypto.PublicKey{}
+		for _, jwk := range set.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			key, err := parseJWK(jwk)
+			if err != nil {
+				logger.Warn("skip OIDC provider key", "kid", jwk.Kid, "error", err)
+				continue
+			}
+			keys[jwk.Kid] = key
+		}
+		oidcState.keys, oidcState.fetched = keys, time.Now()
+	}
+
+	// Tokens without key id may be signed with any key
+	if kid == "" {
+		candidates := make([]crypto.PublicKey, 0, len(oidcState.keys))
+		for _, key := range oidcState.keys {
+			candidates = append(candidates, key)
+		}
+		return candidates, nil
+	}
+	if key, ok := oidcState.keys[kid]; ok {
+		return []crypto.PublicKey{key}, nil
+	}
+	return nil, errors.New("unknown key " + kid)
+}
+
+// Parse RSA or EC public key of a JSON Web Key Set
+// @param jwk jsonWebKey
+// @return crypto.PublicKey key
+// @return error error
+func parseJWK(jwk jsonWebKey) (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+// Verify RS* or ES* signature of a token with the keys of the OIDC provider
+// @param ctx context.Context
+// @param alg string algorithm of the token header, e.g. RS256
+// @param kid string key id of the token header
+// @param signed []byte signed header and payload
+// @param signature []byte
+// @return error error
+func verifyOIDCSignature(ctx context.Context, alg string, kid string, signed []byte, signature []byte) error {
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return errors.New("unsupported algorithm " + alg)
+	}
+	keys, err := oidcKeys(ctx, kid)
+	if err != nil {
+		return err
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				if ecdsa.Verify(key, digest, r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// Get ID token of the login session of a request
+// @param c *fiber.Ctx context
+// @return string token, empty without session
+func sessionToken(c *fiber.Ctx) string {
+	if config.OIDCIssuer == "" {
+		return ""
+	}
+	return c.Cookies(sessionCookie)
+}
+
+// Generate random base64url encoded value, e.g. a login state
+// @return string value
+func randomToken() string {
+	value := make([]byte, 32)
+	rand.Read(value)
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+// Get local path to return to after login or logout. Other sites are not
+// redirected to, the Swagger UI is the default.
+// @param value string requested path
+// @return string path
+func localRedirect(value string) string {
+	if strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//") && !strings.HasPrefix(value, "/\\") {
+		return value
+	}
+	return "../docs/"
+}
+
+// Set cookie of the login flow, only sent back by the browser on same-site
+// navigation
+// @param c *fiber.Ctx context
+// @param name string
+// @param value string
+// @param expires time.Time
+func setLoginCookie(c *fiber.Ctx, name string, value string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// Exchange authorization code of the login flow for an ID token
+// @param ctx context.Context
+// @param provider *oidcProvider
+// @param code string authorization code
+// @param verifier string PKCE code verifier
+// @return string ID token
+// @return error error
+func exchangeOIDCCode(ctx context.Context, provider *oidcProvider, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.OIDCRedirectURL},
+		"client_id":     {config.OIDCClientId},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	if config.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.OIDCClientId), url.QueryEscape(config.OIDCClientSecret))
+	}
+
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var body struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Error != "" || body.IdToken == "" {
+		return "", fmt.Errorf("token request failed with status %d: %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+	}
+	return body.IdToken, nil
+}
+
+// Register OIDC login routes for the built-in web views, if the login flow
+// is configured. The session cookie authenticates the requests of the
+// browser like a bearer token.
+// @param app *fiber.App app
+func registerOIDCRoutes(app *fiber.App) {
+	if config.OIDCIssuer == "" || config.OIDCRedirectURL == "" {
+		return
+	}
+
+	// Redirect to the OIDC provider to log in, with PKCE
+	// @param redirect string local path to return to
+	// @return redirect to the provider
+	app.Get("/auth/login", func(c *fiber.Ctx) error {
+		provider, err := oidcEndpoints(c.Context())
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadGateway, "OIDC discovery failed: "+err.Error())
+		}
+		state, nonce, verifier := randomToken(), randomToken(), randomToken()
+		challenge := sha256.Sum256([]byte(verifier))
+		redirect := base64.RawURLEncoding.EncodeToString([]byte(localRedirect(c.Query("redirect"))))
+		setLoginCookie(c, loginCookie, strings.Join([]string{state, nonce, verifier, redirect}, "."), time.Now().Add(loginTimeout))
+
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {config.OIDCClientId},
+			"redirect_uri":          {config.OIDCRedirectURL},
+			"scope":                 {strings.Join(config.OIDCScopes, " ")},
+			"state":                 {state},
+			"nonce":                 {nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		return c.Redirect(provider.AuthorizationEndpoint+"?"+query.Encode(), fiber.StatusFound)
+	})
+
+	// Complete login: exchange the authorization code for an ID token and
+	// keep it in the session cookie until it expires
+	// @param code string
+	// @param state string
+	// @return redirect to the page the login started from
+	app.Get("/auth/callback", func(c *fiber.Ctx) error {
+		if c.Query("error") != "" {
+			return fiber.NewError(fiber.StatusUnauthorized, "Login failed: "+c.Query("error")+" "+c.Query("error_description"))
+		}
+		login := strings.Split(c.Cookies(loginCookie), ".")
+		if len(login) != 4 || c.Query("state") == "" || c.Query("state") != login[0] {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid login state")
+		}
+		setLoginCookie(c, loginCookie, "", time.Unix(0, 0))
+
+		provider, err := oidcEndpoints(c.Context())
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadGateway, "OIDC discovery failed: "+err.Error())
+		}
+		idToken, err := exchangeOIDCCode(c.Context(), provider, c.Query("code"), login[2])
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadGateway, err.Error())
+		}
+		claims, err := verifyJWT(c.Context(), idToken)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid ID token: "+err.Error())
+		}
+		if claims["nonce"] != login[1] {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid ID token: wrong nonce")
+		}
+
+		exp, _ := claims["exp"].(float64)
+		setLoginCookie(c, sessionCookie, idToken, time.Unix(int64(exp), 0))
+		redirect, _ := base64.RawURLEncoding.DecodeString(login[3])
+		return c.Redirect(localRedirect(string(redirect)), fiber.StatusFound)
+	})
+
+	// End the login session, also at the OIDC provider if it supports it
+	// @param redirect string local path to return to
+	// @return redirect
+	app.Get("/auth/logout", func(c *fiber.Ctx) error {
+		idToken := c.Cookies(sessionCookie)
+		setLoginCookie(c, sessionCookie, "", time.Unix(0, 0))
+		if provider, err := oidcEndpoints(c.Context()); err == nil && provider.EndSessionEndpoint != "" && idToken != "" {
+			query := url.Values{"id_token_hint": {idToken}, "client_id": {config.OIDCClientId}}
+			return c.Redirect(provider.EndSessionEndpoint+"?"+query.Encode(), fiber.StatusFound)
+		}
+		return c.Redirect(localRedirect(c.Query("redirect")), fiber.StatusFound)
+	})
+}
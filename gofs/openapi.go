@@ -0,0 +1,1564 @@
+package gofs
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// Parameter of a documented route
+type apiParam struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+	Schema      fiber.Map
+}
+
+// Response of a documented route
+type apiResponse struct {
+	Description string
+	ContentType string
+	Schema      fiber.Map
+}
+
+// Documentation of a route. Every route of the app needs an entry in
+// apiOperations, routes without one are reported at startup.
+type apiOperation struct {
+	Tag         string
+	Summary     string
+	Description string
+	Params      []apiParam
+	// Request body schemas by content type
+	Body      map[string]fiber.Map
+	Responses map[int]apiResponse
+}
+
+// Reference to a schema of the components section
+// @param name string
+// @return fiber.Map schema
+func schemaRef(name string) fiber.Map {
+	return fiber.Map{"$ref": "#/components/schemas/" + name}
+}
+
+// Schema of a plain type, e.g. "string" or "integer"
+// @param typ string
+// @return fiber.Map schema
+func typeSchema(typ string) fiber.Map {
+	return fiber.Map{"type": typ}
+}
+
+// Schema of an array
+// @param items fiber.Map item schema
+// @return fiber.Map schema
+func arraySchema(items fiber.Map) fiber.Map {
+	return fiber.Map{"type": "array", "items": items}
+}
+
+// Schema of an object with the given properties
+// @param properties fiber.Map property schemas
+// @return fiber.Map schema
+func objectSchema(properties fiber.Map) fiber.Map {
+	return fiber.Map{"type": "object", "properties": properties}
+}
+
+// Path parameter
+// @param name string
+// @param description string
+// @return apiParam param
+func pathParam(name, description string) apiParam {
+	return apiParam{Name: name, In: "path", Description: description, Required: true, Schema: typeSchema("string")}
+}
+
+// Optional query parameter
+// @param name string
+// @param typ string schema type
+// @param description string
+// @return apiParam param
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: "query", Description: description, Schema: typeSchema(typ)}
+}
+
+// JSON response, the payload is placed under key in the response envelope
+// @param description string
+// @param key string envelope key, empty if there is no payload
+// @param payload fiber.Map payload schema
+// @return apiResponse response
+func jsonResponse(description, key string, payload fiber.Map) apiResponse {
+	schema := schemaRef("Envelope")
+	if key != "" {
+		schema = fiber.Map{"allOf": []fiber.Map{schema, objectSchema(fiber.Map{key: payload})}}
+	}
+	return apiResponse{Description: description, ContentType: fiber.MIMEApplicationJSON, Schema: schema}
+}
+
+// JSON response with a page of a list, placed under key in the response
+// envelope next to the cursor of the next page
+// @param description string
+// @param key string envelope key
+// @param item fiber.Map schema of the list items
+// @return apiResponse response
+func pageResponse(description, key string, item fiber.Map) apiResponse {
+	schema := fiber.Map{"allOf": []fiber.Map{schemaRef("Envelope"), objectSchema(fiber.Map{
+		key:          arraySchema(item),
+		"nextCursor": fiber.Map{"type": "string", "nullable": true},
+	})}}
+	return apiResponse{Description: description, ContentType: fiber.MIMEApplicationJSON, Schema: schema}
+}
+
+// Error response
+// @param description string
+// @return apiResponse response
+func errorResponse(description string) apiResponse {
+	return apiResponse{Description: description, ContentType: problemContentType, Schema: schemaRef("Problem")}
+}
+
+// Image content response
+// @param description string
+// @return apiResponse response
+func imageResponse(description string) apiResponse {
+	return apiResponse{Description: description, ContentType: "image/*", Schema: fiber.Map{"type": "string", "format": "binary"}}
+}
+
+// Parameters shared by several routes
+var (
+	idParam         = pathParam("id", "Image id (ObjectID hex)")
+	bucketParam     = pathParam("bucket", "GridFS bucket, one of the configured BUCKETS")
+	versionParam    = apiParam{Name: "version", In: "path", Description: "Version number", Required: true, Schema: typeSchema("integer")}
+	folderPathParam = pathParam("path", "Folder path, e.g. avatars/2024")
+	downloadParam   = queryParam("download", "boolean", "Send as attachment instead of rendering inline")
+	formatParam     = queryParam("format", "string", "HEIC images only: auto sends a JPEG rendition if the Accept header names no HEIF type, original the stored image, jpeg the JPEG rendition")
+	fieldsParam     = queryParam("fields", "string", "Comma separated fields to return, e.g. name,size,metadata.tags, by their API or files document name. The id is always returned.")
+	ifMatchParam    = apiParam{Name: fiber.HeaderIfMatch, In: "header", Description: "ETag of the image info, the change fails with 412 if the image changed since. Required if METADATA_IF_MATCH is required.", Schema: typeSchema("string")}
+	contentMD5Param = apiParam{Name: contentMD5Header, In: "header", Description: "Base64 encoded MD5 digest of the file, the upload fails with 400 if the content doesn't match", Schema: typeSchema("string")}
+	sha256Param     = apiParam{Name: checksumSHA256Header, In: "header", Description: "Hex or base64 encoded SHA-256 digest of the file, the upload fails with 400 if the content doesn't match", Schema: typeSchema("string")}
+	uploadIdParam   = apiParam{Name: uploadIdHeader, In: "header", Description: "Upload session id to report progress to, see /api/uploads/{uploadId}/progress", Schema: typeSchema("string")}
+)
+
+// GridFS chunk size of an upload
+var chunkSizeSchema = fiber.Map{
+	"type":        "integer",
+	"minimum":     minChunkSize,
+	"maximum":     maxChunkSize,
+	"description": "GridFS chunk size in bytes, larger chunks need fewer round trips for large files. Defaults to GRIDFS_CHUNK_SIZE_BYTES.",
+}
+
+// Multipart form fields of image uploads
+var uploadFormSchema = objectSchema(fiber.Map{
+	"image":       fiber.Map{"type": "string", "format": "binary"},
+	"folder":      fiber.Map{"type": "string", "description": "Folder the image is placed in"},
+	"collision":   schemaRef("CollisionPolicy"),
+	"expiresAt":   fiber.Map{"type": "string", "format": "date-time"},
+	"metadata":    fiber.Map{"type": "string", "description": "Custom metadata as JSON object, visibility \"private\" keeps downloads out of shared caches"},
+	"tags":        fiber.Map{"type": "string", "description": "Comma separated tags"},
+	"description": typeSchema("string"),
+	"category":    typeSchema("string"),
+	"chunkSize":   chunkSizeSchema,
+})
+
+// Reusable schemas of the components section
+var apiSchemas = fiber.Map{
+	"Envelope": fiber.Map{
+		"type":        "object",
+		"description": "Response envelope. With RESPONSE_FORMAT=bare or Accept profile=bare only the payload is returned.",
+		"properties": fiber.Map{
+			"error": typeSchema("boolean"),
+			"msg":   typeSchema("string"),
+		},
+	},
+	"Problem": fiber.Map{
+		"type":        "object",
+		"description": "RFC 7807 problem details. With ERROR_FORMAT=legacy errors are application/json Error objects, unless the client accepts application/problem+json.",
+		"required":    []string{"type", "title", "status", "code"},
+		"properties": fiber.Map{
+			"type":      fiber.Map{"type": "string", "format": "uri-reference"},
+			"title":     typeSchema("string"),
+			"status":    typeSchema("integer"),
+			"detail":    typeSchema("string"),
+			"code":      schemaRef("ErrorCode"),
+			"instance":  fiber.Map{"type": "string", "format": "uri-reference"},
+			"requestId": typeSchema("string"),
+			"errors":    arraySchema(schemaRef("Violation")),
+		},
+	},
+	"Error": fiber.Map{
+		"type":        "object",
+		"description": "Legacy error format of ERROR_FORMAT=legacy",
+		"required":    []string{"msg", "code"},
+		"properties": fiber.Map{
+			"error":  fiber.Map{"type": "boolean", "enum": []bool{true}},
+			"msg":    typeSchema("string"),
+			"code":   schemaRef("ErrorCode"),
+			"errors": arraySchema(schemaRef("Violation")),
+		},
+	},
+	"Violation": fiber.Map{
+		"type":        "object",
+		"description": "Invalid request field, all of them are reported at once",
+		"required":    []string{"field", "message"},
+		"properties": fiber.Map{
+			"in":      fiber.Map{"type": "string", "enum": []string{validation.Path, validation.Query, validation.Header, validation.Form, validation.Body}},
+			"field":   fiber.Map{"type": "string", "description": "Field name, nested fields are named by path, e.g. metadata.tags"},
+			"code":    schemaRef("ErrorCode"),
+			"message": typeSchema("string"),
+		},
+	},
+	"ErrorCode": fiber.Map{
+		"type":        "string",
+		"description": "Stable machine-readable error code, unlike the message",
+		"enum":        errorCodes,
+	},
+	"CollisionPolicy": fiber.Map{
+		"type": "string",
+		"enum": []string{collisionReject, collisionOverwrite, collisionAutoSuffix, collisionVersion},
+	},
+	"Metadata": fiber.Map{
+		"type":                 "object",
+		"description":          "Custom metadata fields next to server managed ones",
+		"additionalProperties": true,
+	},
+	"UploadedImage": objectSchema(fiber.Map{
+		"id":        typeSchema("string"),
+		"name":      typeSchema("string"),
+		"size":      typeSchema("integer"),
+		"version":   typeSchema("integer"),
+		"expiresAt": fiber.Map{"type": "string", "format": "date-time", "nullable": true},
+		"metadata":  schemaRef("Metadata"),
+	}),
+	"UploadResult": objectSchema(fiber.Map{
+		"id":       typeSchema("string"),
+		"name":     typeSchema("string"),
+		"size":     typeSchema("integer"),
+		"version":  typeSchema("integer"),
+		"metadata": schemaRef("Metadata"),
+		"uploaded": typeSchema("boolean"),
+		"status":   fiber.Map{"type": "integer", "description": "Error status of rejected files"},
+		"code":     schemaRef("ErrorCode"),
+		"error":    fiber.Map{"type": "string", "description": "Why the file was rejected"},
+	}),
+	"ImageInfo": objectSchema(fiber.Map{
+		"id":         typeSchema("string"),
+		"name":       typeSchema("string"),
+		"size":       typeSchema("integer"),
+		"uploadDate": fiber.Map{"type": "string", "format": "date-time"},
+		"metadata":   schemaRef("Metadata"),
+	}),
+	"ImageDetails": fiber.Map{"allOf": []fiber.Map{schemaRef("ImageInfo"), objectSchema(fiber.Map{
+		"chunkSize": typeSchema("integer"),
+		"checksum":  fiber.Map{"type": "object", "nullable": true, "properties": fiber.Map{"md5": typeSchema("string"), "sha256": typeSchema("string")}},
+	})}},
+	"Version": objectSchema(fiber.Map{
+		"id":         typeSchema("string"),
+		"version":    typeSchema("integer"),
+		"size":       typeSchema("integer"),
+		"uploadDate": fiber.Map{"type": "string", "format": "date-time"},
+		"current":    typeSchema("boolean"),
+	}),
+	"Tenant": objectSchema(fiber.Map{
+		"id":       typeSchema("string"),
+		"database": typeSchema("string"),
+		"disabled": typeSchema("boolean"),
+		"keys": arraySchema(objectSchema(fiber.Map{
+			"id":        typeSchema("string"),
+			"role":      typeSchema("string"),
+			"createdAt": fiber.Map{"type": "string", "format": "date-time"},
+		})),
+		"createdAt": fiber.Map{"type": "string", "format": "date-time"},
+	}),
+	"Job": objectSchema(fiber.Map{
+		"id":         typeSchema("string"),
+		"kind":       fiber.Map{"type": "string", "enum": []string{jobReplication, jobTranscoding, jobPreview, jobWebhook, jobMaintenance}},
+		"key":        typeSchema("string"),
+		"payload":    typeSchema("object"),
+		"status":     fiber.Map{"type": "string", "enum": []string{jobs.StatusQueued, jobs.StatusRunning, jobs.StatusDead}},
+		"runAt":      fiber.Map{"type": "string", "format": "date-time"},
+		"enqueuedAt": fiber.Map{"type": "string", "format": "date-time"},
+		"attempts":   typeSchema("integer"),
+		"lastError":  typeSchema("string"),
+		"diedAt":     fiber.Map{"type": "string", "format": "date-time"},
+	}),
+	"JSONUpload": objectSchema(fiber.Map{
+		"filename":  typeSchema("string"),
+		"folder":    typeSchema("string"),
+		"collision": schemaRef("CollisionPolicy"),
+		"expiresAt": fiber.Map{"type": "string", "format": "date-time"},
+		"metadata":  schemaRef("Metadata"),
+		"chunkSize": chunkSizeSchema,
+	}),
+}
+
+// Documentation of all routes, keyed by method and route path
+var apiOperations = map[string]apiOperation{
+	"POST /api/image": {
+		Tag:         "images",
+		Summary:     "Upload image",
+		Description: "Upload a PNG, JPEG, GIF, WebP, HEIC or SVG image, a PDF document, an MP4 or WebM video, MP3, Ogg or FLAC audio, a DOCX, XLSX or PPTX Office document, or a TXT, LOG, CSV, Markdown or JSON text file, as multipart form, or as JSON with base64 encoded data for clients which can't send forms. Animated GIF and WebP images keep all frames. HEIC images are stored as uploaded and downloaded as JPEG by clients which can't display them. Page count and title of PDF documents are stored in the document metadata field, duration and resolution of videos in the video field, duration, bitrate and tags of audio in the audio field. Office documents get PDF previews if OFFICE_CONVERTER is configured. Text files have to be UTF-8, JSON files valid JSON. SVG images are stored sanitized, without scripts, event handlers and external references. With STREAM_REQUEST_BODY the image part is stored as it is received, form fields after it are ignored.",
+		Params:      []apiParam{uploadIdParam, contentMD5Param, sha256Param},
+		Body: map[string]fiber.Map{
+			fiber.MIMEMultipartForm: uploadFormSchema,
+			fiber.MIMEApplicationJSON: {"allOf": []fiber.Map{schemaRef("JSONUpload"), objectSchema(fiber.Map{
+				"data": fiber.Map{"type": "string", "description": "Base64 encoded content, optionally as data URL"},
+			})}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated:             jsonResponse("Image uploaded", "image", schemaRef("UploadedImage")),
+			fiber.StatusBadRequest:          errorResponse("Invalid fields, or content doesn't match Content-MD5 or X-Checksum-SHA256"),
+			fiber.StatusConflict:            errorResponse("Filename is taken and the collision policy is reject"),
+			fiber.StatusUnprocessableEntity: errorResponse("Content is no valid image of the file type or exceeds the maximum dimensions"),
+		},
+	},
+	"POST /api/images": {
+		Tag:         "images",
+		Summary:     "Upload several images",
+		Description: "Every \"images\" part is stored independently, the response lists the result of each file in request order.",
+		Params:      []apiParam{uploadIdParam},
+		Body: map[string]fiber.Map{
+			fiber.MIMEMultipartForm: objectSchema(fiber.Map{
+				"images":    arraySchema(fiber.Map{"type": "string", "format": "binary"}),
+				"folder":    typeSchema("string"),
+				"collision": schemaRef("CollisionPolicy"),
+				"expiresAt": fiber.Map{"type": "string", "format": "date-time"},
+				"metadata":  fiber.Map{"type": "string", "description": "Custom metadata as JSON object"},
+				"chunkSize": chunkSizeSchema,
+			}),
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated:     jsonResponse("All images uploaded", "images", arraySchema(schemaRef("UploadResult"))),
+			fiber.StatusMultiStatus: jsonResponse("Some images could not be uploaded", "images", arraySchema(schemaRef("UploadResult"))),
+			fiber.StatusBadRequest:  jsonResponse("No images uploaded", "images", arraySchema(schemaRef("UploadResult"))),
+		},
+	},
+	"POST /api/image/url": {
+		Tag:     "images",
+		Summary: "Upload image from remote URL",
+		Params:  []apiParam{uploadIdParam},
+		Body: map[string]fiber.Map{
+			fiber.MIMEApplicationJSON: {"allOf": []fiber.Map{schemaRef("JSONUpload"), objectSchema(fiber.Map{
+				"url": fiber.Map{"type": "string", "format": "uri"},
+			})}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated:             jsonResponse("Image uploaded", "image", schemaRef("UploadedImage")),
+			fiber.StatusBadGateway:          errorResponse("Remote URL could not be fetched"),
+			fiber.StatusUnprocessableEntity: errorResponse("Content is no valid image of the file type or exceeds the maximum dimensions"),
+		},
+	},
+	"GET /api/image/id/:id": {
+		Tag:         "images",
+		Summary:     "Download image by id",
+		Description: "HEAD requests get the same headers without the content. Single byte ranges are sent as partial content, e.g. for video and audio seeking. Last-Modified is the upload date, requests with a current If-None-Match or If-Modified-Since get 304.",
+		Params:      []apiParam{idParam, downloadParam, formatParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:                           imageResponse("Image content"),
+			fiber.StatusNotFound:                     errorResponse("Image not found"),
+			fiber.StatusNotAcceptable:                errorResponse("JPEG rendition requested but HEIC_CONVERTER is not configured"),
+			fiber.StatusPartialContent:               imageResponse("Byte range requested with a Range header"),
+			fiber.StatusNotModified:                  {Description: "Copy of the client is current, by If-None-Match or If-Modified-Since"},
+			fiber.StatusRequestedRangeNotSatisfiable: errorResponse("Range can't be satisfied"),
+		},
+	},
+	"GET /api/image/id/:id/thumbnail": {
+		Tag:         "images",
+		Summary:     "Download thumbnail of document",
+		Description: "The first page of a PDF document as PNG image, rendered by PDF_THUMBNAILER. HEAD requests get the same headers without the content.",
+		Params:      []apiParam{idParam, downloadParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:       imageResponse("Thumbnail PNG image"),
+			fiber.StatusNotFound: errorResponse("File not found or no thumbnail available"),
+		},
+	},
+	"GET /api/image/id/:id/t/:transforms": {
+		Tag:         "images",
+		Summary:     "Download transformed image",
+		Description: "JPEG, PNG or still GIF image with comma separated operations applied in order: resize:WxH (0 keeps the aspect ratio), crop:WxH (centered), rotate:90|180|270 (clockwise), flip:h|v, grayscale, format:jpeg|png and quality:1-100 (JPEG output). Results are cached under the normalized operations. HEAD requests get the same headers without the content.",
+		Params: []apiParam{
+			idParam,
+			pathParam("transforms", "Operations, e.g. resize:800x0,grayscale,quality:80"),
+			downloadParam,
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:                   imageResponse("Transformed image"),
+			fiber.StatusBadRequest:           errorResponse("Unknown or invalid operation"),
+			fiber.StatusNotFound:             errorResponse("File not found"),
+			fiber.StatusUnsupportedMediaType: errorResponse("File is no JPEG, PNG or still GIF image"),
+			fiber.StatusUnprocessableEntity:  errorResponse("Image is corrupt or too large to transform"),
+		},
+	},
+	"GET /api/video/:id/master.m3u8": {
+		Tag:         "video",
+		Summary:     "Get HLS master playlist of video",
+		Description: "Adaptive streaming playlist of the renditions transcoded by HLS_FFMPEG, referencing rendition playlists and segments relative to its URL. Videos still being transcoded get 202 with the queued job. HEAD requests get the same headers without the content.",
+		Params:      []apiParam{pathParam("id", "Video id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:       {Description: "Master playlist", ContentType: "application/vnd.apple.mpegurl", Schema: typeSchema("string")},
+			fiber.StatusAccepted: jsonResponse("Video is being transcoded", "transcoding", schemaRef("Job")),
+			fiber.StatusNotFound: errorResponse("HLS not configured, or no renditions for this file"),
+		},
+	},
+	"GET /api/video/:id/poster": {
+		Tag:         "video",
+		Summary:     "Get poster of video",
+		Description: "JPEG of the frame at VIDEO_POSTER_AT, extracted by HLS_FFMPEG. Videos still being processed get 202 with the queued job. HEAD requests get the same headers without the content.",
+		Params:      []apiParam{pathParam("id", "Video id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:       imageResponse("Poster JPEG image"),
+			fiber.StatusAccepted: jsonResponse("Video is being processed", "transcoding", schemaRef("Job")),
+			fiber.StatusNotFound: errorResponse("HLS_FFMPEG not configured, or no poster for this file"),
+		},
+	},
+	"GET /api/file/:id/preview": {
+		Tag:         "images",
+		Summary:     "Get preview of file",
+		Description: "PDF conversion of a DOCX, XLSX or PPTX document made by OFFICE_CONVERTER, or the first lines of a text file, read up to 64 KiB, as plain text or JSON. Invalid UTF-8 in text files is replaced, X-Preview-Truncated or the truncated field tell if the file goes on. Documents still being converted get 202 with the queued job. HEAD requests get the same headers without the content.",
+		Params: []apiParam{
+			pathParam("id", "File id (ObjectID hex)"),
+			downloadParam,
+			queryParam("lines", "integer", "Text files only: number of lines, 1 to 1000, default 20"),
+			queryParam("format", "string", "Text files only: text (default) or json"),
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:       {Description: "PDF preview of documents, plain text or JSON lines of text files", ContentType: "application/pdf", Schema: fiber.Map{"type": "string", "format": "binary"}},
+			fiber.StatusAccepted: jsonResponse("Preview is being converted", "preview", schemaRef("Job")),
+			fiber.StatusNotFound: errorResponse("File not found or no preview available"),
+		},
+	},
+	"GET /api/video/:id/*": {
+		Tag:         "video",
+		Summary:     "Get HLS rendition playlist or segment",
+		Description: "Files referenced by the master playlist, e.g. 720p/index.m3u8 and 720p/segment_0000.ts. HEAD requests get the same headers without the content.",
+		Params:      []apiParam{pathParam("id", "Video id (ObjectID hex)"), pathParam("path", "File of the renditions, e.g. 720p/index.m3u8")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:       {Description: "Playlist or MPEG-TS segment", ContentType: "application/octet-stream", Schema: fiber.Map{"type": "string", "format": "binary"}},
+			fiber.StatusNotFound: errorResponse("HLS not configured, or file not found"),
+		},
+	},
+	"GET /api/image/name/*": {
+		Tag:         "images",
+		Summary:     "Download current version of image by name",
+		Description: "HEAD requests get the same headers without the content. Single byte ranges are sent as partial content, e.g. for video and audio seeking. Last-Modified is the upload date, requests with a current If-None-Match or If-Modified-Since get 304.",
+		Params:      []apiParam{pathParam("path", "Image name including folders, e.g. avatars/2024/user1.png"), downloadParam, formatParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:                           imageResponse("Image content"),
+			fiber.StatusNotFound:                     errorResponse("Image not found"),
+			fiber.StatusNotAcceptable:                errorResponse("JPEG rendition requested but HEIC_CONVERTER is not configured"),
+			fiber.StatusPartialContent:               imageResponse("Byte range requested with a Range header"),
+			fiber.StatusNotModified:                  {Description: "Copy of the client is current, by If-None-Match or If-Modified-Since"},
+			fiber.StatusRequestedRangeNotSatisfiable: errorResponse("Range can't be satisfied"),
+		},
+	},
+	"DELETE /api/image/id/:id": {
+		Tag:         "images",
+		Summary:     "Delete image",
+		Description: "Requires the admin role.",
+		Params:      []apiParam{idParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:        jsonResponse("Image deleted", "", nil),
+			fiber.StatusForbidden: errorResponse("Role admin required"),
+			fiber.StatusNotFound:  errorResponse("Image not found"),
+		},
+	},
+	"GET /api/image/id/:id/info": {
+		Tag:     "metadata",
+		Summary: "Get image metadata without content",
+		Params:  []apiParam{idParam, fieldsParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:         jsonResponse("Image metadata, only the selected fields with fields. The ETag header is sent in If-Match of metadata changes.", "image", schemaRef("ImageDetails")),
+			fiber.StatusBadRequest: errorResponse("Unknown field"),
+			fiber.StatusNotFound:   errorResponse("Image not found"),
+		},
+	},
+	"GET /api/image/id/:id/stats": {
+		Tag:         "analytics",
+		Summary:     "Get download stats of an image",
+		Description: "Total downloads, last access and downloads per time bucket, by default per day over the last 7 days.",
+		Params: []apiParam{
+			idParam,
+			{Name: "interval", In: "query", Schema: fiber.Map{"type": "string", "enum": []string{"hour", "day", "week"}, "default": "day"}},
+			{Name: "since", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "until", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Download stats", "stats", objectSchema(fiber.Map{
+				"id":             typeSchema("string"),
+				"name":           typeSchema("string"),
+				"downloads":      typeSchema("integer"),
+				"lastAccessedAt": fiber.Map{"type": "string", "format": "date-time", "nullable": true},
+				"interval":       typeSchema("string"),
+				"series": arraySchema(objectSchema(fiber.Map{
+					"start":     fiber.Map{"type": "string", "format": "date-time"},
+					"downloads": typeSchema("integer"),
+				})),
+			})),
+			fiber.StatusBadRequest: errorResponse("Invalid interval or period"),
+			fiber.StatusNotFound:   errorResponse("Image not found"),
+		},
+	},
+	"PATCH /api/image/id/:id/metadata": {
+		Tag:         "metadata",
+		Summary:     "Update custom metadata",
+		Description: "Fields are merged into the existing metadata by default, null removes a field. Server managed fields are always kept. The response carries the new ETag.",
+		Params:      []apiParam{idParam, {Name: "mode", In: "query", Schema: fiber.Map{"type": "string", "enum": []string{"merge", "replace"}, "default": "merge"}}, ifMatchParam},
+		Body:        map[string]fiber.Map{fiber.MIMEApplicationJSON: schemaRef("Metadata")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Metadata updated", "image", objectSchema(fiber.Map{
+				"id":       typeSchema("string"),
+				"name":     typeSchema("string"),
+				"metadata": schemaRef("Metadata"),
+			})),
+			fiber.StatusPreconditionFailed:    errorResponse("Image changed since the ETag in If-Match was read"),
+			fiber.StatusPreconditionRequired:  errorResponse("If-Match missing"),
+			fiber.StatusRequestEntityTooLarge: errorResponse("Metadata exceeds the maximum size"),
+		},
+	},
+	"PATCH /api/image/id/:id/filename": {
+		Tag:     "images",
+		Summary: "Rename image",
+		Params:  []apiParam{idParam, ifMatchParam},
+		Body:    map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{"filename": typeSchema("string")})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Image renamed", "image", objectSchema(fiber.Map{
+				"id":   typeSchema("string"),
+				"name": typeSchema("string"),
+			})),
+			fiber.StatusConflict:             errorResponse("Filename is taken"),
+			fiber.StatusPreconditionFailed:   errorResponse("Image changed since the ETag in If-Match was read"),
+			fiber.StatusPreconditionRequired: errorResponse("If-Match missing"),
+		},
+	},
+	"GET /api/images": {
+		Tag:         "images",
+		Summary:     "List images",
+		Description: "Newest first unless sorted by sort and order, images with the same value are sorted by id. Pass the nextCursor of a page as cursor to get the next one, nextCursor is null on the last page and is also sent in the X-Next-Cursor header. Requires the admin role.",
+		Params: []apiParam{
+			queryParam("tags", "string", "Comma separated tags"),
+			{Name: "match", In: "query", Description: "Whether all or any tags must match", Schema: fiber.Map{"type": "string", "enum": []string{"all", "any"}, "default": "all"}},
+			{Name: "uploadedAfter", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "uploadedBefore", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			queryParam("minSize", "integer", "Minimum size in bytes"),
+			queryParam("maxSize", "integer", "Maximum size in bytes"),
+			queryParam("contentType", "string", "e.g. image/png"),
+			{Name: "sort", In: "query", Schema: fiber.Map{"type": "string", "enum": []string{"uploadDate", "length", "filename"}, "default": "uploadDate"}},
+			{Name: "order", In: "query", Description: "asc for filename and desc otherwise by default", Schema: fiber.Map{"type": "string", "enum": []string{"asc", "desc"}}},
+			fieldsParam,
+			queryParam("cursor", "string", "nextCursor of the previous page, empty for the first page"),
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:         pageResponse("Images in the requested order", "images", schemaRef("ImageInfo")),
+			fiber.StatusBadRequest: errorResponse("Invalid filter, sort, fields or cursor"),
+			fiber.StatusForbidden:  errorResponse("Role admin required"),
+		},
+	},
+	"GET /api/images/recent": {
+		Tag:         "images",
+		Summary:     "List recent uploads",
+		Description: "Newest images first, a page at a time for infinite scrolling: pass the nextCursor of a page as cursor to get the next one, nextCursor is null on the last page. The cursor is also sent in the X-Next-Cursor header, the only place in bare response format. Pages don't shift when images are uploaded in between. Takes the filters of the listing. Requires the admin role.",
+		Params: []apiParam{
+			queryParam("cursor", "string", "nextCursor of the previous page, empty for the first page"),
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+			queryParam("tags", "string", "Comma separated tags"),
+			{Name: "match", In: "query", Description: "Whether all or any tags must match", Schema: fiber.Map{"type": "string", "enum": []string{"all", "any"}, "default": "all"}},
+			{Name: "uploadedAfter", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "uploadedBefore", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			queryParam("minSize", "integer", "Minimum size in bytes"),
+			queryParam("maxSize", "integer", "Maximum size in bytes"),
+			queryParam("contentType", "string", "e.g. image/png"),
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:        pageResponse("Images, newest first", "images", schemaRef("ImageInfo")),
+			fiber.StatusForbidden: errorResponse("Role admin required"),
+		},
+	},
+	"GET /api/images/search": {
+		Tag:         "images",
+		Summary:     "Search images",
+		Description: "Full-text search over filenames and descriptions, most relevant first, with the filters of the listing. Words are separated by spaces, dots, slashes and hyphens and matched whole, filename matches weigh more. With ATLAS_SEARCH_INDEX tags are searched too and words match with one typo, quotes and minus signs have no special meaning. Pass the nextCursor of a page as cursor to get the next one. Requires the admin role.",
+		Params: []apiParam{
+			{Name: "q", In: "query", Required: true, Description: "Words, \"quoted phrases\" and -excluded words", Schema: fiber.Map{"type": "string", "maxLength": maxSearchQueryBytes}},
+			queryParam("tags", "string", "Comma separated tags"),
+			{Name: "match", In: "query", Description: "Whether all or any tags must match", Schema: fiber.Map{"type": "string", "enum": []string{"all", "any"}, "default": "all"}},
+			{Name: "uploadedAfter", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "uploadedBefore", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			queryParam("minSize", "integer", "Minimum size in bytes"),
+			queryParam("maxSize", "integer", "Maximum size in bytes"),
+			queryParam("contentType", "string", "e.g. image/png"),
+			queryParam("cursor", "string", "nextCursor of the previous page, empty for the first page"),
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: pageResponse("Images, most relevant first", "images", fiber.Map{"allOf": []fiber.Map{schemaRef("ImageInfo"), objectSchema(fiber.Map{
+				"score": typeSchema("number"),
+			})}}),
+			fiber.StatusForbidden: errorResponse("Role admin required"),
+		},
+	},
+	"GET /api/images/search/facets": {
+		Tag:         "images",
+		Summary:     "Count search results by content type and upload month",
+		Description: "Counts the images matching q with Atlas Search, by content type and by upload month for the last 12 months, without the listing filters. Requires ATLAS_SEARCH_INDEX and the admin role.",
+		Params: []apiParam{
+			{Name: "q", In: "query", Required: true, Description: "Words", Schema: fiber.Map{"type": "string", "maxLength": maxSearchQueryBytes}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Facets", "facets", objectSchema(fiber.Map{
+				"count": typeSchema("integer"),
+				"contentTypes": arraySchema(objectSchema(fiber.Map{
+					"contentType": typeSchema("string"),
+					"count":       typeSchema("integer"),
+				})),
+				"uploadMonths": arraySchema(objectSchema(fiber.Map{
+					"from":  fiber.Map{"type": "string", "format": "date-time", "nullable": true},
+					"until": fiber.Map{"type": "string", "format": "date-time"},
+					"count": typeSchema("integer"),
+				})),
+			})),
+			fiber.StatusForbidden: errorResponse("Role admin required"),
+			fiber.StatusNotFound:  errorResponse("ATLAS_SEARCH_INDEX not configured"),
+		},
+	},
+	"GET /api/images/top": {
+		Tag:         "analytics",
+		Summary:     "List most downloaded images",
+		Description: "Counts all downloads, or those since the given time. Downloads older than DOWNLOAD_STATS_RETENTION are only part of the all-time counts. Requires the admin role.",
+		Params: []apiParam{
+			{Name: "since", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Images, most downloaded first", "images", arraySchema(objectSchema(fiber.Map{
+				"id":             typeSchema("string"),
+				"name":           typeSchema("string"),
+				"downloads":      typeSchema("integer"),
+				"lastAccessedAt": fiber.Map{"type": "string", "format": "date-time"},
+			}))),
+		},
+	},
+	"GET /api/images/cold": {
+		Tag:         "analytics",
+		Summary:     "List images accessed least recently",
+		Description: "Images which were never downloaded come first, oldest uploads first. Requires the admin role.",
+		Params: []apiParam{
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Images, least recently accessed first", "images", arraySchema(fiber.Map{"allOf": []fiber.Map{
+				schemaRef("ImageInfo"),
+				objectSchema(fiber.Map{
+					"downloads":      typeSchema("integer"),
+					"lastAccessedAt": fiber.Map{"type": "string", "format": "date-time", "nullable": true},
+				}),
+			}})),
+		},
+	},
+	"POST /api/images/info": {
+		Tag:         "metadata",
+		Summary:     "Get metadata of several images",
+		Description: "Metadata of up to " + strconv.Itoa(maxBatchInfoIds) + " images in request order, instead of one info request per image. Images which don't exist are listed as {\"id\": id, \"notFound\": true}.",
+		Params:      []apiParam{fieldsParam},
+		Body:        map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{"ids": arraySchema(typeSchema("string"))})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Image metadata or not found markers, in request order", "images", arraySchema(fiber.Map{"oneOf": []fiber.Map{
+				schemaRef("ImageDetails"),
+				objectSchema(fiber.Map{"id": typeSchema("string"), "notFound": typeSchema("boolean")}),
+			}})),
+			fiber.StatusBadRequest: errorResponse("Invalid id, field or number of ids"),
+		},
+	},
+	"POST /api/images/archive": {
+		Tag:     "images",
+		Summary: "Download several images as zip archive",
+		Body:    map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{"ids": arraySchema(typeSchema("string"))})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:       {Description: "Zip archive", ContentType: "application/zip", Schema: fiber.Map{"type": "string", "format": "binary"}},
+			fiber.StatusNotFound: errorResponse("Some images were not found"),
+		},
+	},
+	"POST /api/image/id/:id/copy": {
+		Tag:         "images",
+		Summary:     "Copy image",
+		Description: "Duplicate an image server-side, optionally with a new filename or into another configured bucket.",
+		Params:      []apiParam{idParam},
+		Body: map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{
+			"filename": typeSchema("string"),
+			"bucket":   typeSchema("string"),
+		})},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated: jsonResponse("Image copied", "image", objectSchema(fiber.Map{
+				"id":     typeSchema("string"),
+				"name":   typeSchema("string"),
+				"size":   typeSchema("integer"),
+				"bucket": typeSchema("string"),
+			})),
+			fiber.StatusConflict: errorResponse("Filename is taken in the target bucket"),
+		},
+	},
+	"POST /api/image/id/:id/move": {
+		Tag:         "images",
+		Summary:     "Move image to another bucket",
+		Description: "Deletes the image from its bucket, so it requires the admin role.",
+		Params:      []apiParam{idParam},
+		Body:        map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{"bucket": typeSchema("string")})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Image moved", "image", objectSchema(fiber.Map{
+				"id":        typeSchema("string"),
+				"name":      typeSchema("string"),
+				"size":      typeSchema("integer"),
+				"bucket":    typeSchema("string"),
+				"movedFrom": objectSchema(fiber.Map{"bucket": typeSchema("string"), "id": typeSchema("string")}),
+			})),
+			fiber.StatusForbidden: errorResponse("Role admin required"),
+		},
+	},
+	"POST /api/image/id/:id/versions": {
+		Tag:     "versions",
+		Summary: "Upload new version of image",
+		Params:  []apiParam{idParam, contentMD5Param, sha256Param},
+		Body:    map[string]fiber.Map{fiber.MIMEMultipartForm: uploadFormSchema},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated:             jsonResponse("Version uploaded", "image", schemaRef("UploadedImage")),
+			fiber.StatusUnprocessableEntity: errorResponse("Content is no valid image of the file type or exceeds the maximum dimensions"),
+		},
+	},
+	"GET /api/image/id/:id/versions": {
+		Tag:     "versions",
+		Summary: "List versions of image",
+		Params:  []apiParam{idParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Versions, oldest first", "versions", arraySchema(schemaRef("Version"))),
+		},
+	},
+	"GET /api/image/id/:id/versions/:version": {
+		Tag:     "versions",
+		Summary: "Download specific version of image",
+		Params:  []apiParam{idParam, versionParam, downloadParam, formatParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:                           imageResponse("Image content"),
+			fiber.StatusNotFound:                     errorResponse("Version not found"),
+			fiber.StatusNotAcceptable:                errorResponse("JPEG rendition requested but HEIC_CONVERTER is not configured"),
+			fiber.StatusPartialContent:               imageResponse("Byte range requested with a Range header"),
+			fiber.StatusNotModified:                  {Description: "Copy of the client is current, by If-None-Match or If-Modified-Since"},
+			fiber.StatusRequestedRangeNotSatisfiable: errorResponse("Range can't be satisfied"),
+		},
+	},
+	"POST /api/image/id/:id/versions/:version/promote": {
+		Tag:     "versions",
+		Summary: "Make version the current one",
+		Params:  []apiParam{idParam, versionParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Version promoted", "", nil),
+		},
+	},
+	"GET /api/folders/*": {
+		Tag:     "folders",
+		Summary: "List subfolders and images of folder",
+		Params:  []apiParam{{Name: "path", In: "path", Description: "Folder path, empty for the root folder", Required: true, Schema: typeSchema("string")}},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Folder listing", "folder", objectSchema(fiber.Map{
+				"path":    typeSchema("string"),
+				"folders": arraySchema(typeSchema("string")),
+				"images":  arraySchema(schemaRef("ImageInfo")),
+			})),
+		},
+	},
+	"POST /api/folders/move": {
+		Tag:     "folders",
+		Summary: "Move folder with all its images and subfolders",
+		Body: map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{
+			"from": typeSchema("string"),
+			"to":   typeSchema("string"),
+		})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Folder moved", "folder", objectSchema(fiber.Map{
+				"from":  typeSchema("string"),
+				"to":    typeSchema("string"),
+				"moved": typeSchema("integer"),
+			})),
+			fiber.StatusConflict: errorResponse("Target contains images with the same names"),
+		},
+	},
+	"POST /api/folders/*": {
+		Tag:     "folders",
+		Summary: "Create empty folder",
+		Params:  []apiParam{folderPathParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated: jsonResponse("Folder created", "folder", objectSchema(fiber.Map{"path": typeSchema("string")})),
+		},
+	},
+	"DELETE /api/folders/*": {
+		Tag:         "folders",
+		Summary:     "Delete folder recursively",
+		Description: "Requires the admin role.",
+		Params:      []apiParam{folderPathParam},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Folder deleted", "folder", objectSchema(fiber.Map{
+				"path":    typeSchema("string"),
+				"deleted": typeSchema("integer"),
+			})),
+		},
+	},
+	"GET /api/uploads/:uploadId/progress": {
+		Tag:         "uploads",
+		Summary:     "Stream upload progress",
+		Description: "Server-Sent Events with \"progress\" events, subscribe before starting an upload with the same X-Upload-Id header.",
+		Params:      []apiParam{pathParam("uploadId", "Upload session id")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: {Description: "Event stream", ContentType: "text/event-stream", Schema: typeSchema("string")},
+		},
+	},
+	"GET /healthz": {
+		Tag:         "health",
+		Summary:     "Liveness probe",
+		Description: "Succeeds while the process is up, without checking the database.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Process is up", "", nil),
+		},
+	},
+	"GET /readyz": {
+		Tag:         "health",
+		Summary:     "Readiness probe",
+		Description: "Succeeds when MongoDB answers a ping and the default bucket can be queried within READINESS_TIMEOUT.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:                 jsonResponse("Ready to serve requests", "", nil),
+			fiber.StatusServiceUnavailable: errorResponse("MongoDB or the bucket is not reachable"),
+		},
+	},
+	"GET /admin/debug/pprof": {
+		Tag:         "admin",
+		Summary:     "List pprof profiles",
+		Description: "Requires credentials of the admin role, e.g. the admin token as bearer token. Without trailing slash the request is redirected, as the links of the index are relative.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           {Description: "HTML index of profiles", ContentType: fiber.MIMETextHTML, Schema: typeSchema("string")},
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"GET /admin/debug/pprof/:profile": {
+		Tag:         "admin",
+		Summary:     "Get pprof profile",
+		Description: "Requires credentials of the admin role, e.g. the admin token as bearer token. CPU profiles and traces take ?seconds=N, ?debug=1 returns text instead of the pprof format.",
+		Params: []apiParam{
+			{Name: "profile", In: "path", Required: true, Schema: fiber.Map{"type": "string", "enum": []string{"allocs", "block", "cmdline", "goroutine", "heap", "mutex", "profile", "symbol", "threadcreate", "trace"}}},
+			queryParam("seconds", "integer", "Duration of CPU profiles and traces"),
+			queryParam("debug", "integer", "Return text format"),
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           {Description: "Profile", ContentType: "application/octet-stream", Schema: fiber.Map{"type": "string", "format": "binary"}},
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown profile"),
+		},
+	},
+	"GET /admin/debug/runtime": {
+		Tag:         "admin",
+		Summary:     "Get runtime stats",
+		Description: "Memory, garbage collector, goroutine and transfer counts. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Runtime stats", "runtime", fiber.Map{"type": "object", "additionalProperties": true}),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"GET /admin/audit": {
+		Tag:         "admin",
+		Summary:     "Query audit trail",
+		Description: "Uploads, downloads, deletes, renames and metadata changes, newest first. Pass the nextCursor of a page as cursor to get the next one. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("fileId", "string", "File id"),
+			queryParam("actor", "string", "Actor, e.g. admin, anonymous or the user named by AUDIT_ACTOR_HEADER"),
+			{Name: "action", In: "query", Schema: fiber.Map{"type": "string", "enum": []string{auditUpload, auditDownload, auditDelete, auditRename, auditMetadata, auditCopy}}},
+			{Name: "result", In: "query", Schema: fiber.Map{"type": "string", "enum": []string{auditSuccess, auditFailure}}},
+			queryParam("tenant", "string", "Tenant id"),
+			{Name: "since", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "until", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			queryParam("cursor", "string", "nextCursor of the previous page, empty for the first page"),
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: pageResponse("Audit entries", "entries", objectSchema(fiber.Map{
+				"id":        typeSchema("string"),
+				"timestamp": fiber.Map{"type": "string", "format": "date-time"},
+				"action":    typeSchema("string"),
+				"result":    typeSchema("string"),
+				"error":     typeSchema("string"),
+				"actor":     typeSchema("string"),
+				"ip":        typeSchema("string"),
+				"protocol":  typeSchema("string"),
+				"tenant":    typeSchema("string"),
+				"requestId": typeSchema("string"),
+				"bucket":    typeSchema("string"),
+				"fileId":    typeSchema("string"),
+				"filename":  typeSchema("string"),
+			})),
+			fiber.StatusBadRequest:   errorResponse("Invalid filter or cursor"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"POST /admin/maintenance/orphans": {
+		Tag:         "admin",
+		Summary:     "Clean up orphaned GridFS data",
+		Description: "Deletes chunks without files document and files documents missing chunks, older than ORPHAN_GRACE_PERIOD. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("bucket", "string", "Configured bucket, the default bucket if empty"),
+			queryParam("dryRun", "boolean", "Only report what would be deleted"),
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Cleanup report", "report", objectSchema(fiber.Map{
+				"bucket":          typeSchema("string"),
+				"dryRun":          typeSchema("boolean"),
+				"orphanedChunks":  typeSchema("integer"),
+				"orphanedFileIds": arraySchema(typeSchema("string")),
+				"reclaimedBytes":  typeSchema("integer"),
+				"incompleteFiles": arraySchema(typeSchema("string")),
+			})),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown bucket"),
+			fiber.StatusConflict:     errorResponse("Storage backend has no GridFS chunks"),
+		},
+	},
+	"POST /admin/maintenance/fsck": {
+		Tag:         "admin",
+		Summary:     "Check consistency of GridFS files",
+		Description: "Checks that the chunks of every file of a bucket are numbered without gaps and hold its length in bytes, optionally re-hashing content against stored md5 checksums. Every issue names a repair, applied with repair except for checksum mismatches. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("bucket", "string", "Configured bucket, the default bucket if empty"),
+			queryParam("hash", "boolean", "Re-hash content of files with a stored checksum"),
+			queryParam("repair", "boolean", "Apply the suggested repairs"),
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Check report", "report", objectSchema(fiber.Map{
+				"bucket":       typeSchema("string"),
+				"hashed":       typeSchema("boolean"),
+				"repaired":     typeSchema("boolean"),
+				"checkedFiles": typeSchema("integer"),
+				"hashedFiles":  typeSchema("integer"),
+				"issues": arraySchema(objectSchema(fiber.Map{
+					"fileId":   typeSchema("string"),
+					"filename": typeSchema("string"),
+					"problem":  fiber.Map{"type": "string", "enum": []string{fsckMissingChunks, fsckExtraChunks, fsckChunkSize, fsckChecksumMismatch}},
+					"detail":   typeSchema("string"),
+					"repair":   fiber.Map{"type": "string", "enum": []string{fsckDeleteExtraChunks, fsckDeleteFile, fsckRepairNone}},
+					"repaired": typeSchema("boolean"),
+				})),
+			})),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown bucket"),
+			fiber.StatusConflict:     errorResponse("Storage backend has no GridFS chunks"),
+		},
+	},
+	"GET /admin/duplicates": {
+		Tag:         "admin",
+		Summary:     "Report duplicate files",
+		Description: "Groups the files of a bucket by the SHA-256 hash of their content, stored on upload, and lists the sets of files storing the same content, most reclaimable bytes first. Files of a set are listed oldest first, the oldest is marked to be kept by a cleanup. All revisions count. Files stored before content hashes were recorded are only counted. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("bucket", "string", "Configured bucket, the default bucket if empty"),
+			queryParam("minSize", "integer", "Smallest file size in bytes considered"),
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Duplicates report", "report", objectSchema(fiber.Map{
+				"bucket":           typeSchema("string"),
+				"sets":             typeSchema("integer"),
+				"files":            typeSchema("integer"),
+				"reclaimableBytes": typeSchema("integer"),
+				"unhashedFiles":    typeSchema("integer"),
+				"duplicates": arraySchema(objectSchema(fiber.Map{
+					"sha256":           typeSchema("string"),
+					"size":             typeSchema("integer"),
+					"reclaimableBytes": typeSchema("integer"),
+					"files": arraySchema(objectSchema(fiber.Map{
+						"id":         typeSchema("string"),
+						"filename":   typeSchema("string"),
+						"uploadDate": fiber.Map{"type": "string", "format": "date-time"},
+						"keep":       typeSchema("boolean"),
+					})),
+				})),
+			})),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown bucket"),
+			fiber.StatusConflict:     errorResponse("Storage backend stores no content hashes"),
+		},
+	},
+	"GET /admin/replication": {
+		Tag:         "admin",
+		Summary:     "Get replication status",
+		Description: "Number of files waiting to be copied to the replica cluster, the age of the oldest waiting change and the oldest failing jobs, which are retried with growing delays. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Replication status", "replication", objectSchema(fiber.Map{
+				"database":   typeSchema("string"),
+				"pending":    typeSchema("integer"),
+				"lagSeconds": typeSchema("number"),
+				"failing":    arraySchema(schemaRef("Job")),
+			})),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusConflict:     errorResponse("Replication is not configured"),
+		},
+	},
+	"GET /admin/jobs": {
+		Tag:         "admin",
+		Summary:     "List background jobs",
+		Description: "Queued, running and dead jobs of the background workers, oldest first: replication, transcoding, previews, webhook deliveries and maintenance tasks. Finished jobs are removed, dead ones failed on their last attempt and are kept until retried or deleted, except webhook deliveries, which are moved to /admin/webhooks/dead-letters. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("kind", "string", "Only jobs of this kind"),
+			queryParam("status", "string", "Only jobs in this state: queued, running or dead"),
+			queryParam("failed", "boolean", "Only jobs which failed at least once"),
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Jobs", "jobs", arraySchema(schemaRef("Job"))),
+			fiber.StatusBadRequest:   errorResponse("Invalid query parameters"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"GET /admin/jobs/:id": {
+		Tag:         "admin",
+		Summary:     "Get background job",
+		Description: "Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Job id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Job", "job", schemaRef("Job")),
+			fiber.StatusBadRequest:   errorResponse("Invalid job id"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Job finished or was deleted"),
+		},
+	},
+	"POST /admin/jobs/:id/retry": {
+		Tag:         "admin",
+		Summary:     "Retry background job",
+		Description: "Runs a dead job, or a queued one waiting for its next attempt, again now with a fresh count of attempts. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Job id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Queued job", "job", schemaRef("Job")),
+			fiber.StatusBadRequest:   errorResponse("Invalid job id"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Job finished or was deleted"),
+			fiber.StatusConflict:     errorResponse("Job is running"),
+		},
+	},
+	"DELETE /admin/jobs/:id": {
+		Tag:         "admin",
+		Summary:     "Delete background job",
+		Description: "Drops a queued or dead job, e.g. one which will never succeed. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Job id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Job deleted", "", nil),
+			fiber.StatusBadRequest:   errorResponse("Invalid job id"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Job finished or was deleted"),
+			fiber.StatusConflict:     errorResponse("Job is running"),
+		},
+	},
+	"GET /admin/webhooks/dead-letters": {
+		Tag:         "admin",
+		Summary:     "List webhook dead letters",
+		Description: "Webhook deliveries which failed on all WEBHOOK_RETRIES retries, oldest first. Their payload holds the url, the event type and the signed event body. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("url", "string", "Only deliveries to this webhook URL"),
+			queryParam("event", "string", "Only deliveries of this event type, e.g. file.uploaded"),
+			{Name: "skip", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 0, "default": 0}},
+			{Name: "limit", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxListLimit, "default": defaultListLimit}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Dead letters", "deadLetters", arraySchema(schemaRef("Job"))),
+			fiber.StatusBadRequest:   errorResponse("Invalid query parameters"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"GET /admin/webhooks/dead-letters/:id": {
+		Tag:         "admin",
+		Summary:     "Get webhook dead letter",
+		Description: "Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Dead letter id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Dead letter", "deadLetter", schemaRef("Job")),
+			fiber.StatusBadRequest:   errorResponse("Invalid dead letter id"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Dead letter was replayed or deleted"),
+		},
+	},
+	"POST /admin/webhooks/dead-letters/:id/replay": {
+		Tag:         "admin",
+		Summary:     "Replay webhook dead letter",
+		Description: "Moves the delivery back into the job queue, due now with a fresh count of attempts. It is sent to the URL it failed on, with its original event id and body. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Dead letter id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Queued delivery", "job", schemaRef("Job")),
+			fiber.StatusBadRequest:   errorResponse("Invalid dead letter id"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Dead letter was replayed or deleted"),
+			fiber.StatusConflict:     errorResponse("Webhooks are not configured"),
+		},
+	},
+	"DELETE /admin/webhooks/dead-letters/:id": {
+		Tag:         "admin",
+		Summary:     "Delete webhook dead letter",
+		Description: "Drops the delivery without replaying it. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Dead letter id (ObjectID hex)")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Dead letter deleted", "", nil),
+			fiber.StatusBadRequest:   errorResponse("Invalid dead letter id"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Dead letter was replayed or deleted"),
+		},
+	},
+	"GET /admin/maintenance/schedule": {
+		Tag:         "admin",
+		Summary:     "Get maintenance schedule",
+		Description: "Maintenance tasks with their MAINTENANCE_<TASK>_ENABLED flag, MAINTENANCE_<TASK>_SCHEDULE cron expression, next run and last run. Runs are queued as background jobs of kind maintenance. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Maintenance tasks", "tasks", arraySchema(objectSchema(fiber.Map{
+				"task":        fiber.Map{"type": "string", "enum": maintenanceTaskNames()},
+				"description": typeSchema("string"),
+				"enabled":     typeSchema("boolean"),
+				"schedule":    typeSchema("string"),
+				"nextRunAt":   fiber.Map{"type": "string", "format": "date-time", "nullable": true},
+				"lastRun": objectSchema(fiber.Map{
+					"status":     fiber.Map{"type": "string", "enum": []string{maintenanceRunning, maintenanceSucceeded, maintenanceFailed}},
+					"attempt":    typeSchema("integer"),
+					"startedAt":  fiber.Map{"type": "string", "format": "date-time"},
+					"finishedAt": fiber.Map{"type": "string", "format": "date-time"},
+					"error":      typeSchema("string"),
+					"result":     typeSchema("object"),
+				}),
+			}))),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"GET /admin/tenants": {
+		Tag:         "admin",
+		Summary:     "List tenants",
+		Description: "Registered tenants, disabled ones included. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Tenants", "tenants", arraySchema(schemaRef("Tenant"))),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+		},
+	},
+	"PUT /admin/tenants/:id": {
+		Tag:         "admin",
+		Summary:     "Register tenant",
+		Description: "Registers a tenant, or enables a disabled one, and creates the indexes of its database. The database defaults to <DATABASE_NAME>-<id>. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Tenant id")},
+		Body:        map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{"database": typeSchema("string")})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Registered tenant", "tenant", schemaRef("Tenant")),
+			fiber.StatusBadRequest:   errorResponse("Invalid tenant id or database"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusConflict:     errorResponse("Database belongs to another tenant"),
+		},
+	},
+	"POST /admin/tenants/:id/keys": {
+		Tag:         "admin",
+		Summary:     "Issue tenant API key",
+		Description: "Issues an API key giving access to the files of the tenant only. The key is returned once, only its hash is stored. Rotate keys by issuing a new one and revoking the old one, or at once with revokeExisting. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Tenant id")},
+		Body: map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{
+			"role":           fiber.Map{"type": "string", "enum": []string{roleReader, roleUploader, roleAdmin}, "default": roleUploader},
+			"revokeExisting": typeSchema("boolean"),
+		})},
+		Responses: map[int]apiResponse{
+			fiber.StatusCreated: jsonResponse("Issued key", "key", objectSchema(fiber.Map{
+				"id":        typeSchema("string"),
+				"key":       typeSchema("string"),
+				"role":      typeSchema("string"),
+				"createdAt": fiber.Map{"type": "string", "format": "date-time"},
+			})),
+			fiber.StatusBadRequest:   errorResponse("Invalid body"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown tenant"),
+		},
+	},
+	"DELETE /admin/tenants/:id/keys/:keyId": {
+		Tag:         "admin",
+		Summary:     "Revoke tenant API key",
+		Description: "Other instances reject the key after at most 30 seconds. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Tenant id"), pathParam("keyId", "Key id")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Key revoked", "", nil),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown API key"),
+		},
+	},
+	"DELETE /admin/tenants/:id": {
+		Tag:         "admin",
+		Summary:     "Disable tenant",
+		Description: "Requests of a disabled tenant are rejected, its database is kept. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params:      []apiParam{pathParam("id", "Tenant id")},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK:           jsonResponse("Tenant disabled", "", nil),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown tenant"),
+		},
+	},
+	"GET /auth/login": {
+		Tag:         "auth",
+		Summary:     "Log in with OIDC",
+		Description: "Redirects to the OIDC provider. After login the ID token is kept in an HTTP-only session cookie, which authenticates the requests of the browser.",
+		Params:      []apiParam{queryParam("redirect", "string", "Local path to return to, the Swagger UI by default")},
+		Responses: map[int]apiResponse{
+			fiber.StatusFound:      {Description: "Redirect to the OIDC provider"},
+			fiber.StatusBadGateway: errorResponse("OIDC discovery failed"),
+		},
+	},
+	"GET /auth/callback": {
+		Tag:         "auth",
+		Summary:     "Complete OIDC login",
+		Description: "Redirect target of the OIDC provider, set OIDC_REDIRECT_URL to its absolute URL.",
+		Params:      []apiParam{queryParam("code", "string", "Authorization code"), queryParam("state", "string", "Login state")},
+		Responses: map[int]apiResponse{
+			fiber.StatusFound:        {Description: "Redirect to the page the login started from"},
+			fiber.StatusBadRequest:   errorResponse("Invalid login state"),
+			fiber.StatusUnauthorized: errorResponse("Login failed or invalid ID token"),
+			fiber.StatusBadGateway:   errorResponse("Token request failed"),
+		},
+	},
+	"GET /auth/logout": {
+		Tag:         "auth",
+		Summary:     "Log out",
+		Description: "Clears the session cookie and ends the session at the OIDC provider if it supports it.",
+		Params:      []apiParam{queryParam("redirect", "string", "Local path to return to, the Swagger UI by default")},
+		Responses: map[int]apiResponse{
+			fiber.StatusFound: {Description: "Redirect"},
+		},
+	},
+	"GET /api/admin/stats": {
+		Tag:         "admin",
+		Summary:     "Get storage statistics",
+		Description: "File count and total size of a bucket, by content type and by owner, and its largest files. All revisions count. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("bucket", "string", "Configured bucket, the default bucket if empty"),
+			{Name: "largest", In: "query", Schema: fiber.Map{"type": "integer", "minimum": 1, "maximum": maxLargestFiles, "default": defaultLargestFiles}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Storage statistics", "stats", objectSchema(fiber.Map{
+				"bucket": typeSchema("string"),
+				"files":  typeSchema("integer"),
+				"bytes":  typeSchema("integer"),
+				"byContentType": arraySchema(objectSchema(fiber.Map{
+					"contentType": typeSchema("string"),
+					"files":       typeSchema("integer"),
+					"bytes":       typeSchema("integer"),
+				})),
+				"byOwner": arraySchema(objectSchema(fiber.Map{
+					"owner": typeSchema("string"),
+					"files": typeSchema("integer"),
+					"bytes": typeSchema("integer"),
+				})),
+				"largest": arraySchema(schemaRef("ImageInfo")),
+			})),
+			fiber.StatusBadRequest:   errorResponse("Invalid largest"),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown bucket"),
+		},
+	},
+	"GET /api/admin/usage": {
+		Tag:         "admin",
+		Summary:     "Get storage usage by owner, tag, content type and month",
+		Description: "File count and total size of a bucket grouped by the combination of the groupBy dimensions, largest groups first, e.g. groupBy=owner,month for monthly billing. Files with several tags count for each of them, untagged files under tag null, files without owner under owner unknown. Months are UTC. All revisions count. Requires credentials of the admin role, e.g. the admin token as bearer token.",
+		Params: []apiParam{
+			queryParam("bucket", "string", "Configured bucket, the default bucket if empty"),
+			{Name: "groupBy", In: "query", Description: "Comma separated dimensions: owner, tag, contentType, month", Schema: fiber.Map{"type": "string", "default": "owner"}},
+			{Name: "uploadedAfter", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+			{Name: "uploadedBefore", In: "query", Schema: fiber.Map{"type": "string", "format": "date-time"}},
+		},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: jsonResponse("Storage usage", "usage", objectSchema(fiber.Map{
+				"bucket":  typeSchema("string"),
+				"groupBy": arraySchema(typeSchema("string")),
+				"groups": arraySchema(objectSchema(fiber.Map{
+					"owner":       typeSchema("string"),
+					"tag":         fiber.Map{"type": "string", "nullable": true},
+					"contentType": typeSchema("string"),
+					"month":       fiber.Map{"type": "string", "example": "2024-05"},
+					"files":       typeSchema("integer"),
+					"bytes":       typeSchema("integer"),
+				})),
+			})),
+			fiber.StatusUnauthorized: errorResponse("Admin credentials missing or wrong"),
+			fiber.StatusForbidden:    errorResponse("Role admin required"),
+			fiber.StatusNotFound:     errorResponse("Unknown bucket"),
+		},
+	},
+
+	"POST /graphql": {
+		Tag:     "graphql",
+		Summary: "Query and update file metadata with GraphQL",
+		Body: map[string]fiber.Map{fiber.MIMEApplicationJSON: objectSchema(fiber.Map{
+			"query":         typeSchema("string"),
+			"operationName": typeSchema("string"),
+			"variables":     fiber.Map{"type": "object", "additionalProperties": true},
+		})},
+		Responses: map[int]apiResponse{
+			fiber.StatusOK: {Description: "GraphQL result", ContentType: fiber.MIMEApplicationJSON, Schema: objectSchema(fiber.Map{
+				"data":   fiber.Map{"type": "object", "additionalProperties": true},
+				"errors": arraySchema(fiber.Map{"type": "object", "additionalProperties": true}),
+			})},
+		},
+	},
+}
+
+// Route path parameters, e.g. ":id" or "*"
+var routeParamRegexp = regexp.MustCompile(`:[A-Za-z0-9_]+|\*`)
+
+// Routes of named buckets documented like the same route on the default
+// bucket
+var bucketRouteDocs = map[string]string{
+	"POST /api/:bucket/file":                     "POST /api/image",
+	"GET /api/:bucket/file/id/:id":               "GET /api/image/id/:id",
+	"GET /api/:bucket/file/id/:id/thumbnail":     "GET /api/image/id/:id/thumbnail",
+	"GET /api/:bucket/file/id/:id/t/:transforms": "GET /api/image/id/:id/t/:transforms",
+	"GET /api/:bucket/file/name/*":               "GET /api/image/name/*",
+	"DELETE /api/:bucket/file/id/:id":            "DELETE /api/image/id/:id",
+	"GET /api/:bucket/files":                     "GET /api/images",
+	"GET /api/:bucket/files/recent":              "GET /api/images/recent",
+	"GET /api/:bucket/files/search":              "GET /api/images/search",
+	"GET /api/:bucket/files/search/facets":       "GET /api/images/search/facets",
+}
+
+// Get documentation of route
+// @param key string route, e.g. "GET /api/images"
+// @return apiOperation documentation
+// @return bool found
+func routeOperation(key string) (apiOperation, bool) {
+	if op, ok := apiOperations[key]; ok {
+		return op, true
+	}
+	op, ok := apiOperations[bucketRouteDocs[key]]
+	if !ok {
+		return op, false
+	}
+
+	op.Tag = "buckets"
+	op.Params = append([]apiParam{bucketParam}, op.Params...)
+	responses := map[int]apiResponse{}
+	for status, response := range op.Responses {
+		responses[status] = response
+	}
+	if _, ok := responses[fiber.StatusNotFound]; !ok {
+		responses[fiber.StatusNotFound] = errorResponse("Unknown bucket")
+	}
+	op.Responses = responses
+	return op, true
+}
+
+// Convert route path to OpenAPI path, "/api/image/id/:id" becomes
+// "/api/image/id/{id}" and wildcards become "{path}"
+// @param route string
+// @return string path
+func openAPIPath(route string) string {
+	return routeParamRegexp.ReplaceAllStringFunc(route, func(param string) string {
+		if param == "*" {
+			return "{path}"
+		}
+		return "{" + strings.TrimPrefix(param, ":") + "}"
+	})
+}
+
+// Build OpenAPI operation object
+// @param op apiOperation
+// @return fiber.Map operation
+func (op apiOperation) openAPI() fiber.Map {
+	operation := fiber.Map{
+		"tags":    []string{op.Tag},
+		"summary": op.Summary,
+	}
+	if op.Description != "" {
+		operation["description"] = op.Description
+	}
+
+	if len(op.Params) > 0 {
+		params := make([]fiber.Map, 0, len(op.Params))
+		for _, param := range op.Params {
+			p := fiber.Map{"name": param.Name, "in": param.In, "required": param.Required, "schema": param.Schema}
+			if param.Description != "" {
+				p["description"] = param.Description
+			}
+			params = append(params, p)
+		}
+		operation["parameters"] = params
+	}
+
+	if len(op.Body) > 0 {
+		content := fiber.Map{}
+		for contentType, schema := range op.Body {
+			content[contentType] = fiber.Map{"schema": schema}
+		}
+		operation["requestBody"] = fiber.Map{"content": content}
+	}
+
+	// Any route may fail with an error in the response envelope
+	responses := fiber.Map{"default": errorResponse("Error").openAPI()}
+	for status, response := range op.Responses {
+		responses[strconv.Itoa(status)] = response.openAPI()
+	}
+	operation["responses"] = responses
+	return operation
+}
+
+// Build OpenAPI response object
+// @param response apiResponse
+// @return fiber.Map response
+func (response apiResponse) openAPI() fiber.Map {
+	body := fiber.Map{"description": response.Description}
+	if response.ContentType != "" {
+		body["content"] = fiber.Map{response.ContentType: fiber.Map{"schema": response.Schema}}
+	}
+	return body
+}
+
+// Get method and path of every route registered on app
+// @param app *fiber.App app
+// @return map[string]bool routes, e.g. "GET /api/images"
+func routeKeys(app *fiber.App) map[string]bool {
+	keys := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		keys[route.Method+" "+route.Path] = true
+	}
+	return keys
+}
+
+// Build OpenAPI specification of the routes registered on app. Routes without
+// documentation are still listed so the specification never misses a route.
+// @param app *fiber.App app
+// @param skip map[string]bool routes left out, e.g. those of a host application
+// @return fiber.Map specification
+// @return []string undocumented routes
+func openAPISpec(app *fiber.App, skip map[string]bool) (fiber.Map, []string) {
+	paths := fiber.Map{}
+	var undocumented []string
+	for _, route := range app.GetRoutes(true) {
+		// HEAD is registered along with every GET route
+		if route.Method == fiber.MethodHead {
+			continue
+		}
+
+		key := route.Method + " " + route.Path
+		if skip[key] {
+			continue
+		}
+		op, ok := routeOperation(key)
+		if !ok {
+			undocumented = append(undocumented, key)
+			op = apiOperation{Tag: "undocumented", Summary: key}
+			for _, name := range route.Params {
+				if strings.HasPrefix(name, "*") {
+					name = "path"
+				}
+				op.Params = append(op.Params, pathParam(name, ""))
+			}
+		}
+
+		path := openAPIPath(route.Path)
+		item, _ := paths[path].(fiber.Map)
+		if item == nil {
+			item = fiber.Map{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = op.openAPI()
+	}
+	sort.Strings(undocumented)
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":       "go-mongo-fs",
+			"description": "Image storage on MongoDB GridFS. Responses are wrapped in an {error, msg, ...} envelope unless the bare format is configured or requested with an Accept profile, e.g. Accept: application/json; profile=bare. Requests authenticate with a tenant API key or a JWT carrying a role: readers may only GET, uploaders may also upload and change files, only admins may delete and list all files.",
+			"version":     "1.0.0",
+		},
+		"paths": paths,
+		"components": fiber.Map{
+			"schemas": apiSchemas,
+			"securitySchemes": fiber.Map{
+				"bearer": fiber.Map{"type": "http", "scheme": "bearer", "description": "Admin token, tenant API key, JWT or OIDC access token"},
+				"apiKey": fiber.Map{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+			},
+		},
+		// Anonymous requests get ANONYMOUS_ROLE
+		"security": []fiber.Map{{"bearer": []string{}}, {"apiKey": []string{}}, {}},
+	}, undocumented
+}
+
+// Register OpenAPI specification and Swagger UI routes. The specification is
+// built from the routes registered so far, so this must be registered last.
+// @param app *fiber.App app
+// @param skip map[string]bool routes left out of the specification
+func registerDocsRoutes(app *fiber.App, skip map[string]bool) {
+	spec, undocumented := openAPISpec(app, skip)
+	for _, route := range undocumented {
+		logger.Warn("route has no OpenAPI documentation", "route", route)
+	}
+
+	// Get OpenAPI specification
+	// @return OpenAPI 3 document
+	var mounted sync.Once
+	app.Get("/openapi.json", func(c *fiber.Ctx) error {
+		// Paths are relative to the prefix the app is mounted at, which is
+		// only known once the app is mounted
+		mounted.Do(func() {
+			if prefix := app.MountPath(); prefix != "" && prefix != "/" {
+				spec["servers"] = []fiber.Map{{"url": prefix}}
+			}
+		})
+		return c.JSON(spec)
+	})
+
+	// Point the bundled Swagger UI to the specification
+	app.Get("/docs/swagger-initializer.js", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJavaScriptCharsetUTF8)
+		return c.SendString(`window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "../openapi.json",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    layout: "StandaloneLayout"
+  });
+};`)
+	})
+
+	// Serve Swagger UI, relative asset paths need the trailing slash. URLs
+	// are relative as the app may be mounted below a prefix.
+	app.Get("/docs", func(c *fiber.Ctx) error {
+		if path, _, _ := strings.Cut(c.OriginalURL(), "?"); !strings.HasSuffix(path, "/") {
+			return c.Redirect(path+"/", fiber.StatusMovedPermanently)
+		}
+		return c.Next()
+	})
+	app.Use("/docs", filesystem.New(filesystem.Config{
+		Root: http.FS(swaggerFiles.FS),
+	}))
+}
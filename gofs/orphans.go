@@ -0,0 +1,237 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Number of orphaned file ids whose chunks are deleted with one query
+const orphanDeleteBatch = 1000
+
+// GridFS data left behind by interrupted uploads and deletes of a bucket
+type orphanReport struct {
+	Bucket string `json:"bucket"`
+	// Only reported, nothing was deleted
+	DryRun bool `json:"dryRun"`
+	// Chunks whose files document does not exist, by the file id they
+	// belong to, and their size
+	OrphanedChunks  int64                `json:"orphanedChunks"`
+	OrphanedFileIds []primitive.ObjectID `json:"orphanedFileIds"`
+	ReclaimedBytes  int64                `json:"reclaimedBytes"`
+	// Files documents missing some of their chunks
+	IncompleteFiles []primitive.ObjectID `json:"incompleteFiles"`
+}
+
+// Find chunks without files document, grouped by the file id they belong to.
+// Uploads write their chunks before the files document, so only chunks of
+// uploads started before cutoff count as orphaned.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param cutoff time.Time
+// @param report *orphanReport report receiving the orphaned chunks
+// @return error error
+func findOrphanedChunks(ctx context.Context, db *mongo.Database, bucket string, cutoff time.Time, report *orphanReport) error {
+	aggregateOptions := options.Aggregate().SetAllowDiskUse(true)
+	cursor, err := namedChunksCollection(db, bucket).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"files_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(cutoff)}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$files_id",
+			"chunks": bson.M{"$sum": 1},
+			"bytes":  bson.M{"$sum": bson.M{"$binarySize": "$data"}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{"from": bucket + ".files", "localField": "_id", "foreignField": "_id", "as": "file"}}},
+		{{Key: "$match", Value: bson.M{"file": bson.M{"$size": 0}}}},
+		{{Key: "$project", Value: bson.M{"chunks": 1, "bytes": 1}}},
+	}, aggregateOptions)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var orphan struct {
+			FileId primitive.ObjectID `bson:"_id"`
+			Chunks int64              `bson:"chunks"`
+			Bytes  int64              `bson:"bytes"`
+		}
+		if err := cursor.Decode(&orphan); err != nil {
+			return err
+		}
+		report.OrphanedFileIds = append(report.OrphanedFileIds, orphan.FileId)
+		report.OrphanedChunks += orphan.Chunks
+		report.ReclaimedBytes += orphan.Bytes
+	}
+	return cursor.Err()
+}
+
+// Find files documents uploaded before cutoff which miss some of their chunks
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param cutoff time.Time
+// @param report *orphanReport report receiving the incomplete files
+// @return error error
+func findIncompleteFiles(ctx context.Context, db *mongo.Database, bucket string, cutoff time.Time, report *orphanReport) error {
+	findOptions := options.Find().SetProjection(bson.M{"length": 1, "chunkSize": 1})
+	cursor, err := namedFilesCollection(db, bucket).Find(ctx, bson.M{
+		"length":     bson.M{"$gt": 0},
+		"uploadDate": bson.M{"$lt": cutoff},
+	}, findOptions)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	chunks := namedChunksCollection(db, bucket)
+	for cursor.Next(ctx) {
+		var fileDoc bson.M
+		if err := cursor.Decode(&fileDoc); err != nil {
+			return err
+		}
+		chunkSize := fileChunkSize(fileDoc)
+		expected := (fileLength(fileDoc) + chunkSize - 1) / chunkSize
+
+		count, err := chunks.CountDocuments(ctx, bson.M{"files_id": fileDoc["_id"]})
+		if err != nil {
+			return err
+		}
+		if count < expected {
+			report.IncompleteFiles = append(report.IncompleteFiles, fileDoc["_id"].(primitive.ObjectID))
+		}
+	}
+	return cursor.Err()
+}
+
+// Find orphaned chunks and incomplete files of a bucket and, unless dryRun is
+// set, delete them. Incomplete files can't be downloaded anymore, they are
+// deleted like expired files.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param dryRun bool only report what would be deleted
+// @return orphanReport report
+// @return error error
+func cleanOrphans(ctx context.Context, db *mongo.Database, bucket string, dryRun bool) (orphanReport, error) {
+	report := orphanReport{
+		Bucket:          bucket,
+		DryRun:          dryRun,
+		OrphanedFileIds: []primitive.ObjectID{},
+		IncompleteFiles: []primitive.ObjectID{},
+	}
+	cutoff := time.Now().Add(-config.OrphanGracePeriod)
+	if err := findOrphanedChunks(ctx, db, bucket, cutoff, &report); err != nil {
+		return report, err
+	}
+	if err := findIncompleteFiles(ctx, db, bucket, cutoff, &report); err != nil {
+		return report, err
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	chunks := namedChunksCollection(db, bucket)
+	for start := 0; start < len(report.OrphanedFileIds); start += orphanDeleteBatch {
+		end := min(start+orphanDeleteBatch, len(report.OrphanedFileIds))
+		if _, err := chunks.DeleteMany(ctx, bson.M{"files_id": bson.M{"$in": report.OrphanedFileIds[start:end]}}); err != nil {
+			return report, err
+		}
+	}
+
+	gridfsBucket, err := namedBucket(db, bucket)
+	if err != nil {
+		return report, err
+	}
+	for _, id := range report.IncompleteFiles {
+		// Delete removes the files document and the chunks which are left
+		if err := gridfsBucket.DeleteContext(ctx, id); err != nil {
+			return report, err
+		}
+		forgetDownloads(ctx, db, id)
+		uncacheFiles(ctx, bucket, id)
+		replicateFile(ctx, bucket, id)
+		publishEvent(eventFileDeleted, fiber.Map{"id": id, "reason": "incomplete"})
+	}
+	return report, nil
+}
+
+// Log result of an orphan cleanup
+// @param report orphanReport
+func logOrphanReport(report orphanReport) {
+	if report.OrphanedChunks == 0 && len(report.IncompleteFiles) == 0 {
+		return
+	}
+	logger.Info("cleaned up orphaned GridFS data",
+		"bucket", report.Bucket,
+		"dry_run", report.DryRun,
+		"orphaned_chunks", report.OrphanedChunks,
+		"orphaned_files", len(report.OrphanedFileIds),
+		"incomplete_files", len(report.IncompleteFiles),
+		"reclaimed_bytes", report.ReclaimedBytes,
+	)
+}
+
+// Delete orphaned chunks and incomplete files of all buckets, of every
+// tenant
+// @param ctx context.Context
+// @return orphanReport totals of the reports of all buckets
+// @return error error of the buckets which failed
+func cleanAllOrphans(ctx context.Context) (orphanReport, error) {
+	var total orphanReport
+	tenants, err := managedTenants(ctx)
+	if err != nil {
+		logger.Error("list tenants", "error", err)
+	}
+	var errs []error
+	for _, t := range tenants {
+		tenantCtx := withTenant(ctx, t)
+		db := requestDatabase(tenantCtx)
+		for _, bucket := range managedBuckets() {
+			report, err := cleanOrphans(tenantCtx, db, bucket, false)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", db.Name(), bucket, err))
+				continue
+			}
+			logOrphanReport(report)
+			total.OrphanedChunks += report.OrphanedChunks
+			total.OrphanedFileIds = append(total.OrphanedFileIds, report.OrphanedFileIds...)
+			total.ReclaimedBytes += report.ReclaimedBytes
+			total.IncompleteFiles = append(total.IncompleteFiles, report.IncompleteFiles...)
+		}
+	}
+	return total, errors.Join(errs...)
+}
+
+// Register orphan cleanup route on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerOrphanRoutes(admin fiber.Router) {
+	// Delete orphaned chunks and incomplete files of a bucket now, or only
+	// report them with dryRun
+	// @param bucket string default bucket if empty
+	// @param dryRun bool
+	// @return cleanup report
+	admin.Post("/maintenance/orphans", func(c *fiber.Ctx) error {
+		if config.StorageBackend != "gridfs" {
+			return fiber.NewError(fiber.StatusConflict, "Storage backend "+config.StorageBackend+" has no GridFS chunks")
+		}
+		bucket := c.Query("bucket", config.BucketName)
+		if !managedBucket(bucket) {
+			return newError(fiber.StatusNotFound, CodeBucketNotFound, "Unknown bucket "+bucket)
+		}
+
+		report, err := cleanOrphans(c.Context(), database(), bucket, c.QueryBool("dryRun"))
+		if err != nil {
+			return err
+		}
+		logOrphanReport(report)
+		return respond(c, fiber.StatusOK, "Orphan cleanup finished", "report", report)
+	})
+}
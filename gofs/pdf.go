@@ -0,0 +1,288 @@
+package gofs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Largest decompressed object stream searched for document information
+const maxPDFObjectStream = 16 * 1024 * 1024
+
+// Longest document title kept in the metadata
+const maxPDFTitle = 256
+
+var (
+	pdfObjStmRegexp    = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfStreamRegexp    = regexp.MustCompile(`stream\r?\n`)
+	pdfPagesRegexp     = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfPageRegexp      = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfCountRegexp     = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfInfoRegexp      = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfTitleRegexp     = regexp.MustCompile(`/Title\s*`)
+	pdfEncryptedRegexp = regexp.MustCompile(`/Encrypt\s`)
+)
+
+// Inspect uploaded PDF document and extract its document information. With
+// IMAGE_VERIFICATION header the content has to start like a PDF document,
+// with decode it also has to end like one, rejecting truncated files.
+// @param content io.Reader upload content
+// @return io.Reader content
+// @return bson.M document metadata, see pdfInfo
+// @return error unprocessable entity error if the content is not a PDF
+// document
+func inspectPDF(content io.Reader) (io.Reader, bson.M, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Readers accept junk before the header, up to 1024 bytes
+	if config.ImageVerification != verifyNone && !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid PDF document")
+	}
+	if config.ImageVerification == verifyDecode && !bytes.Contains(data[max(len(data)-1024, 0):], []byte("%%EOF")) {
+		return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid PDF document: missing end of file marker")
+	}
+	return bytes.NewReader(data), bson.M{"document": pdfInfo(data)}, nil
+}
+
+// Get page count and title of a PDF document. Dictionaries are searched in
+// the document and in compressed object streams, without a full parse.
+// @param data []byte PDF document
+// @return bson.M pages and title, if found
+func pdfInfo(data []byte) bson.M {
+	sources := [][]byte{data}
+	encrypted := pdfEncryptedRegexp.Match(data)
+	if !encrypted {
+		sources = append(sources, pdfObjectStreams(data)...)
+	}
+
+	info := bson.M{}
+	// The root of the page tree counts all pages, other nodes count less
+	pages := 0
+	for _, source := range sources {
+		for _, loc := range pdfPagesRegexp.FindAllIndex(source, -1) {
+			if match := pdfCountRegexp.FindSubmatch(pdfDictionary(source, loc[0])); match != nil {
+				if count, err := strconv.Atoi(string(match[1])); err == nil && count > pages {
+					pages = count
+				}
+			}
+		}
+	}
+	if pages == 0 {
+		for _, source := range sources {
+			pages += len(pdfPageRegexp.FindAllIndex(source, -1))
+		}
+	}
+	if pages > 0 {
+		info["pages"] = pages
+	}
+
+	// Strings of encrypted documents are encrypted too
+	if !encrypted {
+		if title := pdfTitle(data); title != "" {
+			info["title"] = title
+		}
+	}
+	return info
+}
+
+// Decompress the object streams of a PDF document
+// @param data []byte PDF document
+// @return [][]byte decompressed streams
+func pdfObjectStreams(data []byte) [][]byte {
+	var streams [][]byte
+	budget := int64(maxPDFObjectStream)
+	for _, loc := range pdfObjStmRegexp.FindAllIndex(data, -1) {
+		start := pdfStreamRegexp.FindIndex(data[loc[1]:])
+		if start == nil || budget <= 0 {
+			continue
+		}
+		reader, err := zlib.NewReader(bytes.NewReader(data[loc[1]+start[1]:]))
+		if err != nil {
+			continue
+		}
+		// Streams cut short by the limit are still searched
+		stream, _ := io.ReadAll(io.LimitReader(reader, budget))
+		budget -= int64(len(stream))
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// Get dictionary enclosing an offset of a PDF document
+// @param data []byte PDF document
+// @param offset int
+// @return []byte dictionary, empty if the offset is not in one
+func pdfDictionary(data []byte, offset int) []byte {
+	start, depth := -1, 0
+	for i := offset - 1; i > 0; i-- {
+		if data[i-1] == '>' && data[i] == '>' {
+			depth++
+			i--
+		} else if data[i-1] == '<' && data[i] == '<' {
+			if depth == 0 {
+				start = i - 1
+				break
+			}
+			depth--
+			i--
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	depth = 0
+	for i := offset; i+1 < len(data); i++ {
+		if data[i] == '<' && data[i+1] == '<' {
+			depth++
+			i++
+		} else if data[i] == '>' && data[i+1] == '>' {
+			if depth == 0 {
+				return data[start : i+2]
+			}
+			depth--
+			i++
+		}
+	}
+	return nil
+}
+
+// Get title of a PDF document from the document information dictionary
+// named by the last trailer
+// @param data []byte PDF document
+// @return string title, empty if not found
+func pdfTitle(data []byte) string {
+	refs := pdfInfoRegexp.FindAllSubmatch(data, -1)
+	if len(refs) == 0 {
+		return ""
+	}
+	ref := refs[len(refs)-1]
+	object := regexp.MustCompile(`(?:^|\s)` + string(ref[1]) + `\s+` + string(ref[2]) + `\s+obj\b`)
+	locs := object.FindAllIndex(data, -1)
+	if len(locs) == 0 {
+		return ""
+	}
+	loc := locs[len(locs)-1]
+	end := bytes.Index(data[loc[1]:], []byte("endobj"))
+	if end < 0 {
+		return ""
+	}
+	dictionary := data[loc[1] : loc[1]+end]
+	title := pdfTitleRegexp.FindIndex(dictionary)
+	if title == nil {
+		return ""
+	}
+	value := strings.TrimSpace(pdfString(dictionary[title[1]:]))
+	if runes := []rune(value); len(runes) > maxPDFTitle {
+		value = string(runes[:maxPDFTitle])
+	}
+	return value
+}
+
+// Decode PDF string object at the start of data, a literal (string) or a
+// <hex> string. Strings starting with a byte order mark are UTF-16, others
+// are read as Latin-1, which PDFDocEncoding mostly agrees with.
+// @param data []byte
+// @return string value, empty if data starts with no string
+func pdfString(data []byte) string {
+	var raw []byte
+	switch {
+	case len(data) > 0 && data[0] == '(':
+		depth := 0
+	literal:
+		for i := 1; i < len(data); i++ {
+			switch b := data[i]; b {
+			case '\\':
+				i++
+				if i == len(data) {
+					break literal
+				}
+				switch e := data[i]; e {
+				case 'n':
+					raw = append(raw, '\n')
+				case 'r':
+					raw = append(raw, '\r')
+				case 't':
+					raw = append(raw, '\t')
+				case 'b':
+					raw = append(raw, '\b')
+				case 'f':
+					raw = append(raw, '\f')
+				case '\r', '\n':
+					// Line continuation
+				default:
+					if e >= '0' && e <= '7' {
+						code := 0
+						for j := 0; j < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; j++ {
+							code = code*8 + int(data[i]-'0')
+							i++
+						}
+						i--
+						raw = append(raw, byte(code))
+					} else {
+						raw = append(raw, e)
+					}
+				}
+			case '(':
+				depth++
+				raw = append(raw, b)
+			case ')':
+				if depth == 0 {
+					break literal
+				}
+				depth--
+				raw = append(raw, b)
+			default:
+				raw = append(raw, b)
+			}
+		}
+	case len(data) > 0 && data[0] == '<':
+		end := bytes.IndexByte(data, '>')
+		if end < 0 {
+			return ""
+		}
+		var digits []byte
+		for _, b := range data[1:end] {
+			if _, err := strconv.ParseUint(string(b), 16, 8); err == nil {
+				digits = append(digits, b)
+			}
+		}
+		if len(digits)%2 == 1 {
+			digits = append(digits, '0')
+		}
+		for i := 0; i < len(digits); i += 2 {
+			value, _ := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+			raw = append(raw, byte(value))
+		}
+	default:
+		return ""
+	}
+
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		units := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Get thumbnail rendition of PDF documents, the first page rendered by
+// PDF_THUMBNAILER
+// @return rendition rendition
+func pdfThumbnail() rendition {
+	return rendition{name: "thumbnail", command: config.PDFThumbnailer, format: "png", ext: ".png"}
+}
@@ -0,0 +1,202 @@
+package gofs
+
+import (
+	"context"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Bytes of chunks fetched by one query of a parallel download. Larger
+// batches need fewer round trips, but every running query holds one in
+// memory.
+const prefetchBatchBytes = 4 * 1024 * 1024
+
+// Chunks of a file fetched by one query
+type prefetchBatch struct {
+	data []byte
+	err  error
+}
+
+// Reader of GridFS file content fetching batches of chunks with up to
+// DOWNLOAD_PARALLELISM concurrent queries, returning them in order. Batches
+// are fetched ahead of the reader only as far as the parallelism allows, so
+// slow clients don't make it buffer the whole file.
+type chunkPrefetcher struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	chunks      *mongo.Collection
+	id          primitive.ObjectID
+	length      int64
+	chunkSize   int64
+	parallelism int
+	// Byte the first batch is read from, set by Skip before the first read
+	offset int64
+	// Result channels of the running queries in file order
+	batches chan chan prefetchBatch
+	buf     []byte
+	err     error
+}
+
+// Create reader of a file fetching its chunks concurrently
+// @param ctx context.Context
+// @param chunks *mongo.Collection chunks collection of the bucket
+// @param fileDoc bson.M files document with _id, length and chunkSize
+// @param parallelism int concurrent queries
+// @return *chunkPrefetcher reader
+func newChunkPrefetcher(ctx context.Context, chunks *mongo.Collection, fileDoc bson.M, parallelism int) *chunkPrefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &chunkPrefetcher{
+		ctx:         ctx,
+		cancel:      cancel,
+		chunks:      chunks,
+		id:          fileDoc["_id"].(primitive.ObjectID),
+		length:      fileLength(fileDoc),
+		chunkSize:   fileChunkSize(fileDoc),
+		parallelism: parallelism,
+	}
+}
+
+// Skip bytes at the start of the file without fetching their chunks. Once
+// reading started, skipped bytes are read and discarded.
+// @param skip int64 bytes
+// @return int64 bytes skipped
+// @return error error
+func (r *chunkPrefetcher) Skip(skip int64) (int64, error) {
+	if r.batches != nil {
+		return io.CopyN(io.Discard, r, skip)
+	}
+	if skip > r.length-r.offset {
+		skip = r.length - r.offset
+	}
+	r.offset += skip
+	return skip, nil
+}
+
+// Start fetching batches of chunks from the offset on. The result channel
+// of a batch is queued before its query starts, a full queue holds further
+// queries back until the reader caught up.
+func (r *chunkPrefetcher) start() {
+	batchChunks := prefetchBatchBytes / r.chunkSize
+	if batchChunks < 1 {
+		batchChunks = 1
+	}
+	chunkCount := (r.length + r.chunkSize - 1) / r.chunkSize
+	r.batches = make(chan chan prefetchBatch, r.parallelism-1)
+	go func() {
+		defer close(r.batches)
+		for from := r.offset / r.chunkSize; from < chunkCount; from += batchChunks {
+			to := from + batchChunks
+			if to > chunkCount {
+				to = chunkCount
+			}
+			result := make(chan prefetchBatch, 1)
+			select {
+			case r.batches <- result:
+			case <-r.ctx.Done():
+				return
+			}
+			go func(from, to int64) {
+				data, err := r.fetch(from, to)
+				result <- prefetchBatch{data, err}
+			}(from, to)
+		}
+	}()
+}
+
+// Fetch chunks from index from up to to and check they are complete
+// @param from int64 first chunk index
+// @param to int64 chunk index after the last one
+// @return []byte content of the chunks
+// @return error error
+func (r *chunkPrefetcher) fetch(from, to int64) ([]byte, error) {
+	var chunkDocs []struct {
+		N    int64  `bson:"n"`
+		Data []byte `bson:"data"`
+	}
+	err := withRetry(r.ctx, func() error {
+		chunkDocs = nil
+		filter := bson.M{"files_id": r.id, "n": bson.M{"$gte": from, "$lt": to}}
+		cursor, err := r.chunks.Find(r.ctx, filter, options.Find().SetSort(bson.D{{Key: "n", Value: 1}}))
+		if err != nil {
+			return err
+		}
+		return cursor.All(r.ctx, &chunkDocs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(chunkDocs)) != to-from {
+		return nil, gridfs.ErrWrongIndex
+	}
+
+	data := make([]byte, 0, (to-from)*r.chunkSize)
+	for i, chunkDoc := range chunkDocs {
+		n := from + int64(i)
+		if chunkDoc.N != n {
+			return nil, gridfs.ErrWrongIndex
+		}
+		// Only the last chunk may be smaller
+		size := r.chunkSize
+		if rest := r.length - n*r.chunkSize; rest < size {
+			size = rest
+		}
+		if int64(len(chunkDoc.Data)) != size {
+			return nil, gridfs.ErrWrongSize
+		}
+		data = append(data, chunkDoc.Data...)
+	}
+	return data, nil
+}
+
+// Read file content
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (r *chunkPrefetcher) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.batches == nil {
+			r.start()
+			// The first batch starts at the chunk of the offset
+			batch := r.next()
+			if batch.err == nil {
+				batch.data = batch.data[r.offset%r.chunkSize:]
+			}
+			r.buf, r.err = batch.data, batch.err
+			continue
+		}
+		batch := r.next()
+		r.buf, r.err = batch.data, batch.err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Wait for the next batch in file order
+// @return prefetchBatch batch, io.EOF after the last one
+func (r *chunkPrefetcher) next() prefetchBatch {
+	result, ok := <-r.batches
+	if !ok {
+		if err := r.ctx.Err(); err != nil {
+			return prefetchBatch{err: err}
+		}
+		return prefetchBatch{err: io.EOF}
+	}
+	return <-result
+}
+
+// Stop fetching chunks. Running queries are canceled, their results are
+// dropped.
+// @return error error
+func (r *chunkPrefetcher) Close() error {
+	r.cancel()
+	return nil
+}
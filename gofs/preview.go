@@ -0,0 +1,393 @@
+package gofs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Delays and limits of the preview workers
+const (
+	// Time a worker has to convert a document before another one may take
+	// the job over, also the time limit of the converter
+	previewLease = 5 * time.Minute
+	// Delay before the first retry of a failed job, doubled on every further
+	// attempt
+	previewRetryDelay = 30 * time.Second
+	// Attempts after which a failing job is dead
+	previewMaxAttempts = 5
+	// Time clients are asked to wait before asking for a queued preview
+	// again
+	previewRetryAfter = 10 * time.Second
+)
+
+// Part each Office Open XML format can't do without, telling documents,
+// workbooks and presentations apart
+var officeMainParts = map[string]string{
+	".docx": "word/document.xml",
+	".xlsx": "xl/workbook.xml",
+	".pptx": "ppt/presentation.xml",
+}
+
+// Client of a Gotenberg converter
+var previewClient = &http.Client{Timeout: previewLease}
+
+// Check if a filename names an Office document
+// @param filename string
+// @return bool office document
+func isOfficeFilename(filename string) bool {
+	_, ok := officeMainParts[strings.ToLower(path.Ext(filename))]
+	return ok
+}
+
+// Inspect uploaded Office document. Unless IMAGE_VERIFICATION is none the
+// content has to be a ZIP package with the content types part and the main
+// part of the format of the file extension.
+// @param content io.Reader upload content
+// @param ext string file extension
+// @return io.Reader content
+// @return error unprocessable entity error if the content is not an Office
+// document
+func inspectOffice(content io.Reader, ext string) (io.Reader, error) {
+	if config.ImageVerification == verifyNone {
+		return content, nil
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid "+strings.ToUpper(ext[1:])+" document: "+err.Error())
+	}
+	parts := map[string]bool{}
+	for _, file := range archive.File {
+		parts[file.Name] = true
+	}
+	for _, part := range []string{"[Content_Types].xml", officeMainParts[ext]} {
+		if !parts[part] {
+			return nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid "+strings.ToUpper(ext[1:])+" document: missing "+part)
+		}
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Enqueue conversion of an uploaded Office document, or removal of the
+// preview of a deleted file, if OFFICE_CONVERTER is configured. Failing to
+// enqueue is logged, it does not fail the operation.
+// @param ctx context.Context context of the operation
+// @param bucket string bucket name
+// @param fileId primitive.ObjectID id of the uploaded or deleted file
+func previewDocument(ctx context.Context, bucket string, fileId primitive.ObjectID) {
+	// Only documents of the default database are converted
+	if config.OfficeConverter == "" || tenantFromContext(ctx) != nil {
+		return
+	}
+	enqueueFileJob(ctx, jobPreview, bucket, fileId)
+}
+
+// Get name of the preview of a document in the preview bucket
+// @param id primitive.ObjectID document id
+// @return string filename
+func previewFilename(id primitive.ObjectID) string {
+	return id.Hex() + ".pdf"
+}
+
+// Delete the preview of a document from the preview bucket
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param id primitive.ObjectID document id
+// @return error error
+func deletePreview(ctx context.Context, db *mongo.Database, id primitive.ObjectID) error {
+	bucket, err := namedBucket(db, config.PreviewBucket)
+	if err != nil {
+		return err
+	}
+	cursor, err := namedFilesCollection(db, config.PreviewBucket).Find(ctx, bson.M{"filename": previewFilename(id)}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var files []bson.M
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := bucket.DeleteContext(ctx, file["_id"]); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Convert Office document to PDF with OFFICE_CONVERTER: a Gotenberg URL the
+// document is posted to, or a command run with the path of the document
+// appended, writing the PDF next to it like soffice --convert-to pdf
+// @param ctx context.Context
+// @param filename string document name, its extension tells the format
+// @param content []byte document
+// @return []byte PDF
+// @return error error
+func convertOffice(ctx context.Context, filename string, content []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, previewLease)
+	defer cancel()
+
+	var output []byte
+	var err error
+	if strings.HasPrefix(config.OfficeConverter, "http://") || strings.HasPrefix(config.OfficeConverter, "https://") {
+		output, err = convertWithGotenberg(ctx, filename, content)
+	} else {
+		output, err = convertWithCommand(ctx, filename, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(output, []byte("%PDF-")) {
+		return nil, errors.New("converter output is no PDF document")
+	}
+	return output, nil
+}
+
+// Convert Office document with the LibreOffice route of a Gotenberg server
+// @param ctx context.Context
+// @param filename string document name
+// @param content []byte document
+// @return []byte PDF
+// @return error error
+func convertWithGotenberg(ctx context.Context, filename string, content []byte) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", "document"+strings.ToLower(path.Ext(filename)))
+	if err != nil {
+		return nil, err
+	}
+	part.Write(content)
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(config.OfficeConverter, "/") + "/forms/libreoffice/convert"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fiber.HeaderContentType, form.FormDataContentType())
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	output, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("converter returned %s: %s", resp.Status, strings.TrimSpace(string(output[:min(len(output), 512)])))
+	}
+	return output, nil
+}
+
+// Convert Office document with a command, run in a temporary directory
+// holding the document
+// @param ctx context.Context
+// @param filename string document name
+// @param content []byte document
+// @return []byte PDF
+// @return error error, with the command output if there is any
+func convertWithCommand(ctx context.Context, filename string, content []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "gofs-preview-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "document"+strings.ToLower(path.Ext(filename)))
+	if err := os.WriteFile(input, content, 0o600); err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(config.OfficeConverter)
+	cmd := exec.CommandContext(ctx, fields[0], append(fields[1:], input)...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, "document.pdf"))
+}
+
+// Bring the preview of a file up to date: convert it if it is an Office
+// document without preview, or delete its preview if it is gone
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucketName string bucket of the file
+// @param id primitive.ObjectID file id
+// @return error error
+func syncPreview(ctx context.Context, db *mongo.Database, bucketName string, id primitive.ObjectID) error {
+	bucketCtx := withBucket(ctx, bucketName)
+	fileDoc, err := fileStorage().Stat(bucketCtx, id)
+	if errors.Is(err, ErrFileNotFound) || (err == nil && !isOfficeFilename(fileDoc["filename"].(string))) {
+		return deletePreview(ctx, db, id)
+	}
+	if err != nil {
+		return err
+	}
+	preview, err := findPreview(ctx, db, id)
+	if err != nil || preview != nil {
+		return err
+	}
+
+	content, _, err := readFileContent(bucketCtx, fileDoc)
+	if err != nil {
+		return err
+	}
+	output, err := convertOffice(ctx, fileDoc["filename"].(string), content)
+	if err != nil {
+		return err
+	}
+	bucket, err := namedBucket(db, config.PreviewBucket)
+	if err != nil {
+		return err
+	}
+	// Previews keep the bucket and visibility of their document for their
+	// Cache-Control header
+	uploadOptions := options.GridFSUpload().SetMetadata(bson.M{"source": id, "bucket": bucketName, "visibility": fileVisibility(fileDoc), "ext": ".pdf"})
+	_, err = bucket.UploadFromStream(previewFilename(id), bytes.NewReader(output), uploadOptions)
+	return err
+}
+
+// Register the handler of preview jobs, which convert uploaded Office
+// documents to PDF previews in the background
+func registerPreviewJobs() {
+	if config.OfficeConverter == "" {
+		return
+	}
+	db := database()
+	backgroundJobs().Register(jobPreview, jobs.Handler{
+		Run: func(ctx context.Context, job *jobs.Job) error {
+			bucket, id := fileJobTarget(job)
+			return syncPreview(ctx, db, bucket, id)
+		},
+		Workers:     config.PreviewWorkers,
+		Lease:       previewLease,
+		RetryDelay:  previewRetryDelay,
+		MaxAttempts: previewMaxAttempts,
+	})
+}
+
+// Find the preview of a document in the preview bucket
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param id primitive.ObjectID document id
+// @return bson.M files document, nil if there is none
+// @return error error
+func findPreview(ctx context.Context, db *mongo.Database, id primitive.ObjectID) (bson.M, error) {
+	var fileDoc bson.M
+	err := namedFilesCollection(db, config.PreviewBucket).FindOne(ctx, bson.M{"filename": previewFilename(id)}).Decode(&fileDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return fileDoc, err
+}
+
+// Send PDF preview of an Office document, or 202 Accepted while its job is
+// queued
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document of the document
+// @return error error
+func sendOfficePreview(c *fiber.Ctx, fileDoc bson.M) error {
+	id := fileDoc["_id"].(primitive.ObjectID)
+	db := database()
+	preview, err := findPreview(c.Context(), db, id)
+	if err != nil {
+		return err
+	}
+	if preview == nil {
+		job, err := pendingFileJob(c.Context(), jobPreview, id)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return respondError(c, fiber.StatusNotFound, CodeNotFound, "No preview available for this file")
+		}
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(previewRetryAfter.Seconds())))
+		return respond(c, fiber.StatusAccepted, "Preview is being converted", "preview", job)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentLength, strconv.FormatInt(fileLength(preview), 10))
+	c.Set(fiber.HeaderCacheControl, cacheControl(BucketFromContext(c.Context()), fileDoc))
+	c.Set(fiber.HeaderETag, `"`+preview["_id"].(primitive.ObjectID).Hex()+`"`)
+	setSecurityHeaders(c)
+	if c.QueryBool("download") {
+		name := fileDoc["filename"].(string)
+		c.Set(fiber.HeaderContentDisposition, attachmentDisposition(strings.TrimSuffix(name, path.Ext(name))+".pdf"))
+	}
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	bucket, err := namedBucket(db, config.PreviewBucket)
+	if err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if _, err := bucket.DownloadToStream(preview["_id"], &content); err != nil {
+		return err
+	}
+	return c.Send(content.Bytes())
+}
+
+// Register file preview route
+// @param app *fiber.App app
+func registerPreviewRoutes(app *fiber.App) {
+	// Get preview of a file: the PDF conversion of an Office document made by
+	// OFFICE_CONVERTER, or the first lines of a text file. Documents still
+	// being converted get 202 Accepted. HEAD requests get the same headers
+	// without the content.
+	// @param id string
+	// @param download bool save as attachment instead of rendering
+	// @param lines int text files only: number of lines, default 20
+	// @param format string text files only: text|json
+	// @return PDF document or text
+	app.Get("/api/file/:id/preview", func(c *fiber.Ctx) error {
+		id, err := objectIdParam(c, "id")
+		if err != nil {
+			return err
+		}
+		fileDoc, err := cachedFileDoc(c.Context(), "id:"+id.Hex(), func() (bson.M, error) {
+			return fileStorage().Stat(c.Context(), id)
+		})
+		if err != nil {
+			return respondError(c, fiber.StatusNotFound, CodeFileNotFound, "File not found")
+		}
+
+		if isOfficeFilename(fileDoc["filename"].(string)) && config.OfficeConverter != "" && tenantFromContext(c.Context()) == nil {
+			return sendOfficePreview(c, fileDoc)
+		}
+		if isTextFile(fileDoc) {
+			return sendTextPreview(c, fileDoc)
+		}
+		return respondError(c, fiber.StatusNotFound, CodeNotFound, "No preview available for this file")
+	})
+}
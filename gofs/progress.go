@@ -0,0 +1,187 @@
+package gofs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Header carrying the client chosen upload session id
+const uploadIdHeader = "X-Upload-Id"
+
+// How long progress of an upload is kept, so late subscribers still see the
+// final state and abandoned sessions are dropped
+const uploadProgressRetention = 10 * time.Minute
+
+// Interval between progress events
+const uploadProgressInterval = 250 * time.Millisecond
+
+// Valid upload session ids
+var uploadIdRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Persistence progress of one upload session
+type uploadProgress struct {
+	written atomic.Int64
+	total   atomic.Int64
+	done    atomic.Bool
+	failed  atomic.Value
+	expires atomic.Int64
+}
+
+// Snapshot of upload progress sent to subscribers
+type uploadProgressEvent struct {
+	Written int64  `json:"written"`
+	Total   int64  `json:"total"`
+	Done    bool   `json:"done"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Upload sessions by id
+var uploadSessions = struct {
+	sync.Mutex
+	byId map[string]*uploadProgress
+}{byId: map[string]*uploadProgress{}}
+
+// Get progress of upload session, creating it when unknown. Expired sessions
+// are dropped on the way.
+// @param id string
+// @return *uploadProgress progress
+func uploadSession(id string) *uploadProgress {
+	uploadSessions.Lock()
+	defer uploadSessions.Unlock()
+
+	now := time.Now().UnixNano()
+	for sessionId, progress := range uploadSessions.byId {
+		if progress.expires.Load() < now {
+			delete(uploadSessions.byId, sessionId)
+		}
+	}
+
+	progress, ok := uploadSessions.byId[id]
+	if !ok {
+		progress = &uploadProgress{}
+		uploadSessions.byId[id] = progress
+	}
+	progress.expires.Store(time.Now().Add(uploadProgressRetention).UnixNano())
+	return progress
+}
+
+// Get snapshot of upload progress
+// @return uploadProgressEvent event
+func (p *uploadProgress) event() uploadProgressEvent {
+	failed, _ := p.failed.Load().(string)
+	return uploadProgressEvent{
+		Written: p.written.Load(),
+		Total:   p.total.Load(),
+		Done:    p.done.Load(),
+		Error:   failed,
+	}
+}
+
+// Mark upload as finished
+// @param err error nil on success
+func (p *uploadProgress) finish(err error) {
+	if err != nil {
+		p.failed.Store(err.Error())
+	}
+	p.done.Store(true)
+}
+
+// Reader counting the bytes passed on to GridFS
+type progressReader struct {
+	reader   io.Reader
+	progress *uploadProgress
+}
+
+// Read from the underlying reader, adding the bytes read to the progress
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.progress.written.Add(int64(n))
+	return n, err
+}
+
+// Track progress of uploads sending an X-Upload-Id header. The progress is
+// available to handlers through c.Locals("uploadProgress") and marked as
+// done once the handler returned.
+// @param c *fiber.Ctx context
+// @return error error
+func trackUploadProgress(c *fiber.Ctx) error {
+	id := c.Get(uploadIdHeader)
+	if id == "" {
+		return c.Next()
+	}
+	if !uploadIdRegexp.MatchString(id) {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid "+uploadIdHeader)
+	}
+
+	progress := uploadSession(id)
+	c.Locals("uploadProgress", progress)
+
+	err := c.Next()
+	if err == nil && c.Response().StatusCode() >= fiber.StatusBadRequest {
+		err = fmt.Errorf("upload failed with status %d", c.Response().StatusCode())
+	}
+	progress.finish(err)
+	return err
+}
+
+// Get progress of the current upload request
+// @param c *fiber.Ctx context
+// @return *uploadProgress progress, nil if not tracked
+func requestProgress(c *fiber.Ctx) *uploadProgress {
+	progress, _ := c.Locals("uploadProgress").(*uploadProgress)
+	return progress
+}
+
+// Register upload progress route
+// @param app *fiber.App app
+func registerProgressRoutes(app *fiber.App) {
+	// Stream persistence progress of an upload session as Server-Sent Events.
+	// Subscribe before starting the upload with the same X-Upload-Id header,
+	// the stream ends once the upload is done.
+	// @param uploadId string
+	// @return event stream
+	app.Get("/api/uploads/:uploadId/progress", func(c *fiber.Ctx) error {
+		id := c.Params("uploadId")
+		if !uploadIdRegexp.MatchString(id) {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid upload id")
+		}
+		progress := uploadSession(id)
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			ticker := time.NewTicker(uploadProgressInterval)
+			defer ticker.Stop()
+			deadline := time.Now().Add(uploadProgressRetention)
+
+			var last uploadProgressEvent
+			first := true
+			for time.Now().Before(deadline) {
+				event := progress.event()
+				if first || event != last {
+					data, _ := json.Marshal(event)
+					fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+					// A failed flush means the client went away
+					if err := w.Flush(); err != nil || event.Done {
+						return
+					}
+					last, first = event, false
+				}
+				<-ticker.C
+			}
+		})
+		return nil
+	})
+}
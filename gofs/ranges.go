@@ -0,0 +1,148 @@
+package gofs
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Error returned for Range headers which can't be served
+var errInvalidRange = newError(fiber.StatusRequestedRangeNotSatisfiable, CodeRangeNotSatisfiable, "Requested range not satisfiable")
+
+// Parse single byte range of a Range header
+// @param header string
+// @param size int64 object size
+// @return int64 first byte
+// @return int64 last byte
+// @return error error
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, errInvalidRange
+	}
+	startValue, endValue, _ := strings.Cut(spec, "-")
+
+	// Suffix range, e.g. bytes=-500 for the last 500 bytes
+	if startValue == "" {
+		suffix, err := strconv.ParseInt(endValue, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, errInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, nil
+	}
+
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errInvalidRange
+	}
+	end := size - 1
+	if endValue != "" {
+		end, err = strconv.ParseInt(endValue, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, nil
+}
+
+// Stream of a byte range of a file, closed after the response is sent
+type rangeStream struct {
+	io.Reader
+	io.Closer
+}
+
+// Closer of a transferred stream, ending the transfer once closed, see
+// startTransfer
+type transferCloser struct {
+	io.Closer
+	done func()
+}
+
+// Close stream and end the transfer
+// @return error error
+func (t transferCloser) Close() error {
+	err := t.Closer.Close()
+	t.done()
+	return err
+}
+
+// Check if a Range header applies: without If-Range, or if If-Range names
+// the current entity tag. Ranges of a changed file are not sent, the whole
+// file is.
+// @param c *fiber.Ctx context, with the ETag set
+// @return bool range applies
+func ifRangeMatches(c *fiber.Ctx) bool {
+	ifRange := c.Get(fiber.HeaderIfRange)
+	return ifRange == "" || ifRange == string(c.Response().Header.Peek(fiber.HeaderETag))
+}
+
+// Send single byte range of a file as partial content, letting video
+// players seek. The range is taken from the in-memory cache or streamed from
+// the storage backend, skipping to its start. Only ranges from the start of
+// the file count as downloads, players fetch the rest in further ranges.
+// @param c *fiber.Ctx context, with the file headers set
+// @param fileDoc bson.M files document
+// @param header string Range header
+// @return error error
+func sendRange(c *fiber.Ctx, fileDoc bson.M, header string) error {
+	size := fileLength(fileDoc)
+	start, end, err := parseByteRange(header, size)
+	if err != nil {
+		c.Set(fiber.HeaderContentRange, "bytes */"+strconv.FormatInt(size, 10))
+		return err
+	}
+	length := end - start + 1
+	setRange := func() {
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentRange, "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10))
+		c.Set(fiber.HeaderContentLength, strconv.FormatInt(length, 10))
+	}
+	if c.Method() == fiber.MethodHead {
+		setRange()
+		return nil
+	}
+
+	id := fileDoc["_id"].(primitive.ObjectID)
+	if local := localCache(); local != nil {
+		if content, ok := local.Get(contentCacheKey(c.Context(), BucketFromContext(c.Context()), id)); ok {
+			if start == 0 {
+				trackDownload(c.Context(), fileDoc, nil)
+			}
+			setRange()
+			c.Set("X-Cache", "HIT")
+			return c.Send(content.([]byte)[start : end+1])
+		}
+	}
+
+	stream, err := fileStorage().Get(c.Context(), id)
+	if start == 0 {
+		trackDownload(c.Context(), fileDoc, err)
+	}
+	if err != nil {
+		return err
+	}
+	// GridFS streams skip whole chunks without reading them
+	if skipper, ok := stream.(interface{ Skip(int64) (int64, error) }); ok {
+		_, err = skipper.Skip(start)
+	} else {
+		_, err = io.CopyN(io.Discard, stream, start)
+	}
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	setRange()
+	reader, done := startTransfer(io.LimitReader(stream, length))
+	return c.SendStream(rangeStream{reader, transferCloser{stream, done}}, int(length))
+}
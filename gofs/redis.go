@@ -0,0 +1,238 @@
+package gofs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time limit of Redis commands whose context has no deadline
+const redisTimeout = 2 * time.Second
+
+// Number of idle Redis connections kept for reuse
+const redisIdleConns = 8
+
+// Client speaking the Redis protocol (RESP) over a small connection pool
+type redisClient struct {
+	address  string
+	username string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// Connection to Redis with buffered reader
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Error reply of the Redis server
+type redisError string
+
+// Get message of the error reply
+// @return string message
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Create client for a redis://[user:password@]host:port[/db] URL. Connections
+// are opened on first use.
+// @param rawURL string
+// @return *redisClient client
+// @return error error
+func newRedisClient(rawURL string) (*redisClient, error) {
+	server, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if server.Scheme != "redis" || server.Host == "" {
+		return nil, fmt.Errorf("expected redis://host:port URL, got %q", rawURL)
+	}
+	client := &redisClient{address: server.Host, idle: make(chan *redisConn, redisIdleConns)}
+	if _, _, err := net.SplitHostPort(server.Host); err != nil {
+		client.address = net.JoinHostPort(server.Host, "6379")
+	}
+	if user := server.User; user != nil {
+		client.username = user.Username()
+		client.password, _ = user.Password()
+	}
+	if db := strings.Trim(server.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return client, nil
+}
+
+// Open connection, authenticating and selecting the database
+// @param ctx context.Context
+// @return *redisConn connection
+// @return error error
+func (r *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	var setup [][]string
+	switch {
+	case r.password != "" && r.username != "":
+		setup = append(setup, []string{"AUTH", r.username, r.password})
+	case r.password != "":
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.do(ctx, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Send command and read its reply
+// @param ctx context.Context
+// @param args ...string command and arguments
+// @return interface{} reply: nil, string, int64, []byte or []interface{}
+// @return error error, redisError for error replies
+func (rc *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	rc.conn.SetDeadline(deadline)
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// Read one reply
+// @return interface{} reply
+// @return error error
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// Run command on a pooled connection. Connections are only reused after a
+// complete reply, error replies included.
+// @param ctx context.Context
+// @param args ...string command and arguments
+// @return interface{} reply, see redisConn.do
+// @return error error
+func (r *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-r.idle:
+	default:
+		var err error
+		if rc, err = r.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// Get value of key
+// @param ctx context.Context
+// @param key string
+// @return []byte value, nil if the key doesn't exist
+// @return error error
+func (r *redisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := r.do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := reply.([]byte)
+	return value, nil
+}
+
+// Set value of key expiring after ttl
+// @param ctx context.Context
+// @param key string
+// @param value []byte
+// @param ttl time.Duration
+// @return error error
+func (r *redisClient) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := r.do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Delete keys
+// @param ctx context.Context
+// @param keys ...string
+// @return error error
+func (r *redisClient) Del(ctx context.Context, keys ...string) error {
+	_, err := r.do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
@@ -0,0 +1,190 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Maximum number of redirects followed when fetching a remote file
+const maxRemoteRedirects = 3
+
+// Error returned when a remote file is larger than allowed
+var errFileTooLarge = newError(fiber.StatusRequestEntityTooLarge, CodeUploadTooLarge, "File too large")
+
+// Request body of the remote upload endpoint
+type remoteUploadRequest struct {
+	jsonUpload
+	URL string `json:"url"`
+}
+
+// Reader failing with errFileTooLarge once more than limit bytes were read
+type limitReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+// Read from the underlying reader, counting the bytes read
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+// Check if address may be fetched. Loopback, private, link-local and other
+// non-public addresses are refused so the server can't be used to reach
+// internal services.
+// @param ip net.IP
+// @return bool public
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Non-public networks the net.IP checks don't cover: "this network", which
+// some systems route to the host itself, and the shared address space of
+// carrier-grade NAT, used for internal addresses by some clouds
+var blockedNetworks = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+// HTTP client for remote uploads. Addresses are checked when connecting, after
+// DNS resolution, which also covers redirects and DNS rebinding.
+var remoteClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("address %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRemoteRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("unsupported redirect scheme")
+		}
+		return nil
+	},
+}
+
+// Fetch remote file and store it like a form upload
+// @param ctx context.Context
+// @param body remoteUploadRequest
+// @param opts uploadOptions
+// @return fiber.Map image metadata
+// @return error error
+func uploadFromURL(ctx context.Context, body remoteUploadRequest, opts uploadOptions) (fiber.Map, error) {
+	source, err := url.Parse(body.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid url, expected http or https URL")
+	}
+
+	opts.Custom["sourceUrl"] = source.String()
+
+	// Name the file after the last URL path segment unless given
+	filename := strings.TrimSpace(body.Filename)
+	if filename == "" {
+		filename = path.Base(source.Path)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.RemoteTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	res, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Fetching url failed: "+err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Fetching url failed with status "+res.Status)
+	}
+	if res.ContentLength > config.RemoteMaxBytes {
+		return nil, errFileTooLarge
+	}
+	if opts.Progress != nil && res.ContentLength > 0 {
+		opts.Progress.total.Store(res.ContentLength)
+	}
+
+	// The remote content type has to match the file extension
+	ext, err := imageExtension(filename)
+	if err != nil {
+		return nil, err
+	}
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get(fiber.HeaderContentType))
+	if contentType != contentTypes[ext] {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Remote content type "+contentType+" does not match "+ext)
+	}
+
+	return storeUpload(ctx, requestDatabase(ctx), filename, &limitReader{reader: res.Body, remaining: config.RemoteMaxBytes}, opts)
+}
+
+// Register remote upload route
+// @param app *fiber.App app
+func registerRemoteUploadRoutes(app *fiber.App) {
+	// Upload image fetched by the server from a remote http(s) URL
+	// @param url string
+	// @param filename string optional, defaults to the URL path
+	// @return image metadata
+	app.Post("/api/image/url", trackUploadProgress, func(c *fiber.Ctx) error {
+		var body remoteUploadRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		opts, err := body.options()
+		if err != nil {
+			return err
+		}
+		opts.Progress = requestProgress(c)
+
+		image, err := uploadFromURL(c.Context(), body, opts)
+		if err != nil {
+			return err
+		}
+
+		return respond(c, fiber.StatusCreated, "Image uploaded successfully", "image", image)
+	})
+}
@@ -0,0 +1,30 @@
+package gofs
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":     true,
+		"2606:4700::1111":   true,
+		"100.63.255.255":    true,
+		"100.128.0.0":       true,
+		"127.0.0.1":         false,
+		"10.1.2.3":          false,
+		"169.254.169.254":   false,
+		"0.0.0.0":           false,
+		"0.1.2.3":           false,
+		"100.64.0.1":        false,
+		"100.127.255.255":   false,
+		"::ffff:100.64.0.1": false,
+		"::1":               false,
+		"fd00::1":           false,
+	}
+	for address, want := range tests {
+		if got := publicIP(net.ParseIP(address)); got != want {
+			t.Errorf("publicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package gofs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Request body of the rename endpoint
+type renameRequest struct {
+	Filename string `json:"filename"`
+}
+
+// Rename all revisions of a file after validating the new filename. Fails
+// with 409 if another image already uses it. Renames are recorded in the
+// audit trail, failed ones too.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param fileDoc bson.M files document
+// @param newName string
+// @return error error
+func renameFile(ctx context.Context, db *mongo.Database, fileDoc bson.M, newName string) error {
+	err := renameRevisions(ctx, db, fileDoc, newName)
+	recordAudit(ctx, auditRename, fileDoc["_id"].(primitive.ObjectID), newName, err)
+	if err == nil {
+		forgetFileDocs(BucketFromContext(ctx))
+		purgeFile(BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID), fileDoc["filename"].(string), newName)
+		replicateFile(ctx, BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID))
+	}
+	return err
+}
+
+// Rename all revisions of a file, see renameFile
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param fileDoc bson.M files document
+// @param newName string
+// @return error error
+func renameRevisions(ctx context.Context, db *mongo.Database, fileDoc bson.M, newName string) error {
+	if err := validateFilename(newName); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	oldName := fileDoc["filename"].(string)
+	if newName == oldName {
+		return nil
+	}
+
+	// Refuse to merge with the versions of another image
+	collection := filesCollection(db)
+	count, err := collection.CountDocuments(ctx, activeFilter(bson.M{"filename": newName}))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return newError(fiber.StatusConflict, CodeFilenameTaken, "Filename already in use")
+	}
+
+	// The renamed revision counts as changed, other revisions follow it
+	err = withRetry(ctx, func() error {
+		return updateRevision(ctx, collection, fileDoc, bson.M{"filename": newName, "metadata.revision": metadataRevision(fileDoc) + 1})
+	})
+	if err != nil {
+		return err
+	}
+	err = withRetry(ctx, func() error {
+		_, err := collection.UpdateMany(ctx, bson.M{"filename": oldName}, bson.M{"$set": bson.M{"filename": newName}})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	publishEvent(eventFileRenamed, fiber.Map{"id": fileDoc["_id"], "oldName": oldName, "name": newName})
+	return nil
+}
+
+// Register rename route
+// @param app *fiber.App app
+func registerRenameRoutes(app *fiber.App) {
+	// Rename image, keeping its id. All versions of the image are renamed
+	// together so they stay grouped under the same filename. The filename may
+	// contain a folder path to move the image to another folder. With
+	// If-Match the rename fails with 412 if the image changed since the
+	// client read it.
+	// @param id string
+	// @param filename string
+	// @return image metadata with the new ETag
+	app.Patch("/api/image/id/:id/filename", func(c *fiber.Ctx) error {
+		db := requestDatabase(c.Context())
+
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, fileDoc); err != nil {
+			return err
+		}
+
+		// Parse new filename
+		var body renameRequest
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		newName := strings.TrimSpace(body.Filename)
+
+		if err := renameFile(c.Context(), db, fileDoc, newName); err != nil {
+			return err
+		}
+		revision := metadataRevision(fileDoc)
+		if newName != fileDoc["filename"] {
+			revision++
+		}
+		c.Set(fiber.HeaderETag, revisionETag(fileDoc["_id"].(primitive.ObjectID), revision))
+
+		return respond(c, fiber.StatusOK, "Image renamed successfully", "image", fiber.Map{
+			"id":   fileDoc["_id"],
+			"name": newName,
+		})
+	})
+}
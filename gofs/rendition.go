@@ -0,0 +1,140 @@
+package gofs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long a command may take to render a file
+const renditionTimeout = 30 * time.Second
+
+// Rendition of a stored file made on first use by an external command, e.g.
+// a JPEG of a HEIC image, or by a transform pipeline. Renditions are kept in
+// the in-memory cache along with file contents, unless they have their own.
+type rendition struct {
+	// Name of the rendition, part of its cache key and ETag
+	name string
+	// Command reading the file from stdin and writing the rendition to stdout
+	command string
+	// Function making the rendition instead of a command
+	transform func(content []byte) ([]byte, error)
+	// Cache of the rendition, nil for the in-memory cache
+	cache *lruCache
+	// Image format of the rendition, as named by image.DecodeConfig
+	format string
+	// File extension of the rendition, for download filenames
+	ext string
+}
+
+// Run command with input on stdin
+// @param ctx context.Context
+// @param command string command and arguments separated by spaces
+// @param input []byte
+// @return []byte stdout
+// @return error error, with the stderr output if there is any
+func runCommand(ctx context.Context, command string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, renditionTimeout)
+	defer cancel()
+
+	args := strings.Fields(command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// Get rendition of a file, from the in-memory cache or made by the command
+// @param ctx context.Context context carrying the bucket
+// @param fileDoc bson.M files document
+// @return []byte rendition
+// @return error error
+func (r rendition) render(ctx context.Context, fileDoc bson.M) ([]byte, error) {
+	key := contentCacheKey(ctx, BucketFromContext(ctx), fileDoc["_id"].(primitive.ObjectID)) + ":" + r.name
+	local := r.cache
+	if local == nil {
+		local = localCache()
+	}
+	if local != nil {
+		if content, ok := local.Get(key); ok {
+			return content.([]byte), nil
+		}
+	}
+
+	content, _, err := readFileContent(ctx, fileDoc)
+	if err != nil {
+		return nil, err
+	}
+	var output []byte
+	if r.transform != nil {
+		output, err = r.transform(content)
+	} else {
+		output, err = runCommand(ctx, r.command, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(output)); err != nil || format != r.format {
+		return nil, errors.New("rendition is no " + strings.ToUpper(r.format) + " image")
+	}
+	if local != nil {
+		local.Set(key, output, int64(len(output)), 0)
+	}
+	return output, nil
+}
+
+// Send rendition of a file instead of the file. Headers were set for the
+// file by setResponseHeaders. Conditional requests for a current copy get
+// 304 Not Modified without rendering.
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+// @return error error
+func (r rendition) send(c *fiber.Ctx, fileDoc bson.M) error {
+	c.Set(fiber.HeaderETag, `"`+fileDoc["_id"].(primitive.ObjectID).Hex()+"-"+r.name+`"`)
+	if notModified(c) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	content, err := r.render(c.Context(), fileDoc)
+	if c.Method() != fiber.MethodHead {
+		trackDownload(c.Context(), fileDoc, err)
+	}
+	if err != nil {
+		// Files which can't be rendered, e.g. corrupt ones, keep their
+		// status, as does MongoDB being unreachable
+		if status := errorStatus(err); status < fiber.StatusInternalServerError || status == fiber.StatusServiceUnavailable {
+			return err
+		}
+		return respondError(c, fiber.StatusInternalServerError, CodeInternal, "Rendering "+r.name+" failed: "+err.Error())
+	}
+
+	c.Set(fiber.HeaderContentType, "image/"+r.format)
+	c.Set(fiber.HeaderContentLength, strconv.Itoa(len(content)))
+	c.Set(fiber.HeaderAcceptRanges, "none")
+	if c.QueryBool("download") {
+		name := fileDoc["filename"].(string)
+		c.Set(fiber.HeaderContentDisposition, attachmentDisposition(strings.TrimSuffix(name, path.Ext(name))+r.ext))
+	}
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+	return c.Send(content)
+}
@@ -0,0 +1,269 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Delays of the replication workers
+const (
+	// Time a worker has to finish a claimed job before another one may take
+	// it over
+	replicationLease = 5 * time.Minute
+	// Delay before the first retry of a failed job, doubled on every further
+	// attempt
+	replicationRetryDelay = time.Second
+	// Longest delay between retries
+	replicationMaxDelay = time.Hour
+)
+
+// Database of the replica cluster, nil if replication is disabled
+var replicaDB *mongo.Database
+
+// Enqueue replication of a changed file if a replica is configured. Failing
+// to enqueue is logged, it does not fail the operation.
+// @param ctx context.Context context of the operation
+// @param bucket string bucket name
+// @param fileId primitive.ObjectID id of the uploaded, changed or deleted file
+func replicateFile(ctx context.Context, bucket string, fileId primitive.ObjectID) {
+	// Only the default database is replicated
+	if config.ReplicaURI == "" || tenantFromContext(ctx) != nil {
+		return
+	}
+	enqueueFileJob(ctx, jobReplication, bucket, fileId)
+}
+
+// Delete file from the replica, if it is there
+// @param ctx context.Context
+// @param bucket *gridfs.Bucket replica bucket
+// @param id primitive.ObjectID file id
+// @return error error
+func deleteReplica(ctx context.Context, bucket *gridfs.Bucket, id primitive.ObjectID) error {
+	if err := bucket.DeleteContext(ctx, id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Copy content of a file into the replica bucket under the same id, then
+// replace the files document written by the upload with the primary one
+// @param ctx context.Context
+// @param db *mongo.Database primary database
+// @param replica *mongo.Database replica database
+// @param bucketName string bucket name
+// @param fileDoc bson.M primary files document
+// @return error error
+func copyToReplica(ctx context.Context, db, replica *mongo.Database, bucketName string, fileDoc bson.M) error {
+	source, err := namedBucket(db, bucketName)
+	if err != nil {
+		return err
+	}
+	destination, err := namedBucket(replica, bucketName)
+	if err != nil {
+		return err
+	}
+
+	// Chunks left behind by an interrupted copy are replaced
+	if _, err := namedChunksCollection(replica, bucketName).DeleteMany(ctx, bson.M{"files_id": fileDoc["_id"]}); err != nil {
+		return err
+	}
+	downloadStream, err := source.OpenDownloadStream(fileDoc["_id"])
+	if err != nil {
+		return err
+	}
+	defer downloadStream.Close()
+
+	uploadOptions := options.GridFSUpload().SetChunkSizeBytes(int32(fileChunkSize(fileDoc)))
+	uploadStream, err := destination.OpenUploadStreamWithID(fileDoc["_id"], fileDoc["filename"].(string), uploadOptions)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(uploadStream, downloadStream); err != nil {
+		uploadStream.Abort()
+		return err
+	}
+	if err := uploadStream.Close(); err != nil {
+		return err
+	}
+	_, err = namedFilesCollection(replica, bucketName).ReplaceOne(ctx, bson.M{"_id": fileDoc["_id"]}, fileDoc)
+	return err
+}
+
+// Find files document by id
+// @param ctx context.Context
+// @param files *mongo.Collection files collection
+// @param id interface{} file id
+// @return bson.M files document, nil if there is none
+// @return error error
+func findFileDoc(ctx context.Context, files *mongo.Collection, id interface{}) (bson.M, error) {
+	var fileDoc bson.M
+	err := files.FindOne(ctx, bson.M{"_id": id}).Decode(&fileDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return fileDoc, err
+}
+
+// Bring the replica of a file up to date: copy it if it is missing, update
+// its files document, or delete it if the primary has none. The other
+// revisions sharing its filename before and after the change are updated
+// too, as uploads change their current flag or delete them and renames
+// rename them.
+// @param ctx context.Context
+// @param db *mongo.Database primary database
+// @param replica *mongo.Database replica database
+// @param bucketName string bucket name
+// @param id primitive.ObjectID file id
+// @return error error
+func syncReplica(ctx context.Context, db, replica *mongo.Database, bucketName string, id primitive.ObjectID) error {
+	files := namedFilesCollection(db, bucketName)
+	replicaFiles := namedFilesCollection(replica, bucketName)
+	replicaBucket, err := namedBucket(replica, bucketName)
+	if err != nil {
+		return err
+	}
+
+	primaryDoc, err := findFileDoc(ctx, files, id)
+	if err != nil {
+		return err
+	}
+	replicaDoc, err := findFileDoc(ctx, replicaFiles, id)
+	if err != nil {
+		return err
+	}
+
+	var filenames []string
+	for _, fileDoc := range []bson.M{primaryDoc, replicaDoc} {
+		if filename, ok := fileDoc["filename"].(string); ok {
+			filenames = append(filenames, filename)
+		}
+	}
+
+	switch {
+	case primaryDoc == nil:
+		err = deleteReplica(ctx, replicaBucket, id)
+	case replicaDoc == nil || fileLength(replicaDoc) != fileLength(primaryDoc):
+		if err = deleteReplica(ctx, replicaBucket, id); err == nil {
+			err = copyToReplica(ctx, db, replica, bucketName, primaryDoc)
+		}
+	default:
+		_, err = replicaFiles.ReplaceOne(ctx, bson.M{"_id": id}, primaryDoc)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Update the other revisions the replica has under these filenames
+	cursor, err := replicaFiles.Find(ctx, bson.M{"filename": bson.M{"$in": filenames}, "_id": bson.M{"$ne": id}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var siblings []bson.M
+	if err := cursor.All(ctx, &siblings); err != nil {
+		return err
+	}
+	for _, sibling := range siblings {
+		siblingDoc, err := findFileDoc(ctx, files, sibling["_id"])
+		if err != nil {
+			return err
+		}
+		if siblingDoc == nil {
+			err = deleteReplica(ctx, replicaBucket, sibling["_id"].(primitive.ObjectID))
+		} else {
+			_, err = replicaFiles.ReplaceOne(ctx, bson.M{"_id": sibling["_id"]}, siblingDoc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect to the replica cluster and register the handler of replication
+// jobs, which replicate uploads, deletes, renames and metadata changes in the
+// background. Replication
+// copies GridFS files and needs the gridfs backend.
+// @return error error connecting to the replica
+func startReplication() error {
+	if config.ReplicaURI == "" {
+		return nil
+	}
+	serverAPIOptions := options.ServerAPI(options.ServerAPIVersion1)
+	clientOptions := options.Client().ApplyURI(config.ReplicaURI).SetServerAPIOptions(serverAPIOptions)
+	client, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		return fmt.Errorf("connect to replica: %w", err)
+	}
+	replicaDB = client.Database(config.ReplicaDatabase)
+	db := database()
+	// The replica is disconnected once the job workers stopped, they stop
+	// first as they start last
+	onShutdown(func(shutdownCtx context.Context) {
+		client.Disconnect(shutdownCtx)
+	})
+
+	// Failed copies are retried until they succeed
+	backgroundJobs().Register(jobReplication, jobs.Handler{
+		Run: func(ctx context.Context, job *jobs.Job) error {
+			bucket, id := fileJobTarget(job)
+			return syncReplica(ctx, db, replicaDB, bucket, id)
+		},
+		Workers:    config.ReplicaWorkers,
+		Lease:      replicationLease,
+		RetryDelay: replicationRetryDelay,
+		MaxDelay:   replicationMaxDelay,
+	})
+	return nil
+}
+
+// Register replication status route on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerReplicationRoutes(admin fiber.Router) {
+	// Get number of queued replication jobs, the age of the oldest one and
+	// the oldest jobs which failed
+	// @return replication status
+	admin.Get("/replication", func(c *fiber.Ctx) error {
+		if config.ReplicaURI == "" {
+			return fiber.NewError(fiber.StatusConflict, "Replication is not configured")
+		}
+		queue := backgroundJobs()
+		filter := jobs.Filter{Kind: jobReplication}
+
+		pending, err := queue.Count(c.Context(), filter)
+		if err != nil {
+			return err
+		}
+		var lag float64
+		oldest, err := queue.Find(c.Context(), filter, 0, 1)
+		if err != nil {
+			return err
+		}
+		if len(oldest) > 0 {
+			lag = time.Since(oldest[0].EnqueuedAt).Seconds()
+		}
+
+		filter.Failed = true
+		failing, err := queue.Find(c.Context(), filter, 0, defaultListLimit)
+		if err != nil {
+			return err
+		}
+
+		return respond(c, fiber.StatusOK, "Replication status fetched successfully", "replication", fiber.Map{
+			"database":   config.ReplicaDatabase,
+			"pending":    pending,
+			"lagSeconds": lag,
+			"failing":    failing,
+		})
+	})
+}
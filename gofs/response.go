@@ -0,0 +1,199 @@
+package gofs
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+)
+
+// Media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// Error response in the RFC 7807 problem details format
+type problem struct {
+	// URI identifying the problem type, about:blank if the status says it all
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Error code, see ErrorCode
+	Code ErrorCode `json:"code"`
+	// Request URI the problem occurred at
+	Instance  string `json:"instance,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+	// Violations of request fields, all of them
+	Errors validation.Errors `json:"errors,omitempty"`
+}
+
+// Read the profile parameter from the Accept header, e.g.
+// Accept: application/json; profile=bare
+// @param c *fiber.Ctx context
+// @return string profile
+func acceptProfile(c *fiber.Ctx) string {
+	for _, mediaRange := range strings.Split(c.Get(fiber.HeaderAccept), ",") {
+		for _, param := range strings.Split(mediaRange, ";")[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(key, "profile") {
+				return strings.ToLower(strings.Trim(value, `"`))
+			}
+		}
+	}
+	return ""
+}
+
+// Check whether the response should be wrapped in the {error, msg, ...} envelope.
+// The Accept profile takes precedence over the configured default.
+// @param c *fiber.Ctx context
+// @return bool envelope
+func useEnvelope(c *fiber.Ctx) bool {
+	switch acceptProfile(c) {
+	case "bare":
+		return false
+	case "envelope":
+		return true
+	}
+	return config.ResponseEnvelope
+}
+
+// Write success response. In envelope mode the payload is placed under key,
+// in bare mode the payload is written as is.
+// @param c *fiber.Ctx context
+// @param status int
+// @param msg string
+// @param key string
+// @param payload interface{}
+// @return error error
+func respond(c *fiber.Ctx, status int, msg string, key string, payload interface{}) error {
+	if !useEnvelope(c) {
+		if payload == nil {
+			return c.Status(status).JSON(fiber.Map{"msg": msg})
+		}
+		return c.Status(status).JSON(payload)
+	}
+
+	body := fiber.Map{
+		"error": false,
+		"msg":   msg,
+	}
+	if key != "" {
+		body[key] = payload
+	}
+	return c.Status(status).JSON(body)
+}
+
+// Response header carrying the cursor of the next page of a list
+const nextCursorHeader = "X-Next-Cursor"
+
+// Write page of a list with the cursor of the next page. In envelope mode
+// the cursor is in the nextCursor field, null on the last page, in bare mode
+// only in the X-Next-Cursor header, which is left out on the last page.
+// @param c *fiber.Ctx context
+// @param msg string
+// @param key string
+// @param items interface{} page
+// @param nextCursor string empty on the last page
+// @return error error
+func respondPage(c *fiber.Ctx, msg string, key string, items interface{}, nextCursor string) error {
+	if nextCursor != "" {
+		c.Set(nextCursorHeader, nextCursor)
+	}
+	if !useEnvelope(c) {
+		return c.Status(fiber.StatusOK).JSON(items)
+	}
+
+	body := fiber.Map{
+		"error":      false,
+		"msg":        msg,
+		key:          items,
+		"nextCursor": nil,
+	}
+	if nextCursor != "" {
+		body["nextCursor"] = nextCursor
+	}
+	return c.Status(fiber.StatusOK).JSON(body)
+}
+
+// Check whether errors should be written as problem details. Clients asking
+// for application/problem+json get them with ERROR_FORMAT=legacy too.
+// @param c *fiber.Ctx context
+// @return bool problem details
+func useProblem(c *fiber.Ctx) bool {
+	return config.ProblemErrors || strings.Contains(c.Get(fiber.HeaderAccept), problemContentType)
+}
+
+// Write error response, as problem details or in the legacy {error, msg}
+// format of ERROR_FORMAT=legacy
+// @param c *fiber.Ctx context
+// @param status int
+// @param code ErrorCode
+// @param msg string
+// @return error error
+func respondError(c *fiber.Ctx, status int, code ErrorCode, msg string) error {
+	return respondViolations(c, status, code, msg, nil)
+}
+
+// Write error response listing the violations of request fields, see
+// respondError
+// @param c *fiber.Ctx context
+// @param status int
+// @param code ErrorCode
+// @param msg string
+// @param violations validation.Errors violations, nil if there are none
+// @return error error
+func respondViolations(c *fiber.Ctx, status int, code ErrorCode, msg string, violations validation.Errors) error {
+	if useProblem(c) {
+		requestId, _ := c.Locals(requestIDKey).(string)
+		err := c.Status(status).JSON(problem{
+			Type:      "about:blank",
+			Title:     utils.StatusMessage(status),
+			Status:    status,
+			Detail:    msg,
+			Code:      code,
+			Instance:  c.OriginalURL(),
+			RequestId: requestId,
+			Errors:    violations,
+		})
+		c.Set(fiber.HeaderContentType, problemContentType)
+		return err
+	}
+	body := fiber.Map{"msg": msg, "code": code}
+	if useEnvelope(c) {
+		body["error"] = true
+	}
+	if violations != nil {
+		body["errors"] = violations
+	}
+	return c.Status(status).JSON(body)
+}
+
+// Format errors returned from handlers using the configured response format.
+// Errors created with fiber.NewError or newError keep their status code,
+// MongoDB being unreachable is reported as service unavailable, anything
+// else as an internal server error.
+// @param c *fiber.Ctx context
+// @param err error
+// @return error error
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	return respondViolations(c, errorStatus(err), errorCode(err), err.Error(), errorViolations(err))
+}
+
+// Get HTTP status code of error, violations of request fields are bad
+// requests
+// @param err error
+// @return int status
+func errorStatus(err error) int {
+	var fiberError *fiber.Error
+	if errors.As(err, &fiberError) {
+		return fiberError.Code
+	}
+	if errorViolations(err) != nil {
+		return fiber.StatusBadRequest
+	}
+	if databaseUnavailable(err) {
+		return fiber.StatusServiceUnavailable
+	}
+	return fiber.StatusInternalServerError
+}
@@ -0,0 +1,81 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Longest delay between two attempts of a MongoDB operation
+const maxRetryDelay = 5 * time.Second
+
+// Server error codes of failovers and shutting down members, the operation
+// succeeds once a new primary is elected
+var transientErrorCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// Check if a MongoDB error is transient, e.g. caused by a primary election,
+// so the operation may succeed when tried again
+// @param err error
+// @return bool transient
+func transientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var labeled mongo.LabeledError
+	if errors.As(err, &labeled) && (labeled.HasErrorLabel("RetryableWriteError") || labeled.HasErrorLabel("TransientTransactionError")) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, code := range transientErrorCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run a MongoDB operation, trying it again with exponential backoff and
+// jitter while it fails with a transient error, up to MONGO_RETRY_ATTEMPTS
+// attempts. The operation must be safe to repeat.
+// @param ctx context.Context
+// @param operation func() error
+// @return error error of the last attempt
+func withRetry(ctx context.Context, operation func() error) error {
+	delay := config.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if attempt >= config.RetryAttempts || !transientError(err) {
+			return err
+		}
+
+		// Full jitter spreads the attempts of concurrent requests
+		wait := time.Duration(rand.Int63n(int64(delay) + 1))
+		logger.Warn("retry MongoDB operation", "attempt", attempt, "retry_in", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
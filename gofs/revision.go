@@ -0,0 +1,93 @@
+package gofs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Get revision of the metadata of a file, counted up by every metadata
+// update and rename
+// @param fileDoc bson.M files document
+// @return int64 revision, 0 for files not changed since revisions are counted
+func metadataRevision(fileDoc bson.M) int64 {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	switch revision := metadata["revision"].(type) {
+	case int32:
+		return int64(revision)
+	case int64:
+		return revision
+	}
+	return 0
+}
+
+// Get ETag of the metadata of a file, which changes with its revision
+// @param fileDoc bson.M files document
+// @return string ETag
+func metadataETag(fileDoc bson.M) string {
+	return revisionETag(fileDoc["_id"].(primitive.ObjectID), metadataRevision(fileDoc))
+}
+
+// Get ETag of a revision of the metadata of a file
+// @param id primitive.ObjectID file id
+// @param revision int64
+// @return string ETag
+func revisionETag(id primitive.ObjectID, revision int64) string {
+	return `"` + id.Hex() + "-rev" + strconv.FormatInt(revision, 10) + `"`
+}
+
+// Check If-Match header of a metadata change against the ETag of the
+// metadata. Fails with 412 if the metadata changed since the client read
+// it, and with 428 if the header is missing and METADATA_IF_MATCH is
+// required. Weak ETags match too, compressed responses carry one.
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+// @return error error
+func checkIfMatch(c *fiber.Ctx, fileDoc bson.M) error {
+	ifMatch := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if ifMatch == "" {
+		if config.RequireIfMatch {
+			return newError(fiber.StatusPreconditionRequired, CodePreconditionRequired, "If-Match header with the ETag of the image info is required")
+		}
+		return nil
+	}
+	etag := metadataETag(fileDoc)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return nil
+		}
+	}
+	return newError(fiber.StatusPreconditionFailed, CodePreconditionFailed, "Image changed since it was read")
+}
+
+// Update files document if its metadata revision is still the one of
+// fileDoc. Updates have to set metadata.revision to the next revision.
+// @param ctx context.Context
+// @param collection *mongo.Collection files collection
+// @param fileDoc bson.M files document read before the update
+// @param set bson.M fields to set
+// @return error error, 412 if the file changed in between
+func updateRevision(ctx context.Context, collection *mongo.Collection, fileDoc bson.M, set bson.M) error {
+	// Compare to the stored value, custom fields named revision written
+	// before revisions were counted may not be numbers
+	filter := bson.M{"_id": fileDoc["_id"], "metadata.revision": bson.M{"$exists": false}}
+	if metadata, ok := fileDoc["metadata"].(bson.M); ok {
+		if revision, ok := metadata["revision"]; ok {
+			filter["metadata.revision"] = revision
+		}
+	}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return newError(fiber.StatusPreconditionFailed, CodePreconditionFailed, "Image changed concurrently")
+	}
+	return nil
+}
@@ -0,0 +1,605 @@
+package gofs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Namespace and timestamp format of S3 XML documents
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MetaPrefix = "X-Amz-Meta-"
+	maxS3Keys    = 1000
+)
+
+// S3 error response with its HTTP status
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Get error message
+// @return string message
+func (e *s3Error) Error() string {
+	return e.Message
+}
+
+// Errors of the S3 API
+var (
+	s3ErrorAccessDenied            = &s3Error{fiber.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3ErrorInvalidAccessKey        = &s3Error{fiber.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	s3ErrorSignatureDoesNotMatch   = &s3Error{fiber.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	s3ErrorRequestTimeTooSkewed    = &s3Error{fiber.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	s3ErrorContentSHA256Mismatch   = &s3Error{fiber.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	s3ErrorBadDigest               = &s3Error{fiber.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	s3ErrorIncompleteBody          = &s3Error{fiber.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	s3ErrorInvalidArgument         = &s3Error{fiber.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	s3ErrorNoSuchBucket            = &s3Error{fiber.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	s3ErrorNoSuchKey               = &s3Error{fiber.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	s3ErrorInvalidRange            = &s3Error{fiber.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable."}
+	s3ErrorEntityTooLarge          = &s3Error{fiber.StatusRequestEntityTooLarge, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	s3ErrorNotImplemented          = &s3Error{fiber.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	s3ErrorBucketAlreadyOwnedByYou = &s3Error{fiber.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."}
+)
+
+// Error document of the S3 API
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// Owner of all buckets, the server has a single user
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// Result of ListBuckets
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+// Bucket entry of ListBuckets
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// Object entry of ListObjects
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// Common prefix entry of ListObjects
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// Result of ListObjects and ListObjectsV2
+type s3ListObjectsResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// Result of GetBucketLocation
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// Send XML document
+// @param c *fiber.Ctx context
+// @param status int
+// @param document interface{}
+// @return error error
+func sendXML(c *fiber.Ctx, status int, document interface{}) error {
+	body, err := xml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationXML)
+	return c.Status(status).Send(append([]byte(xml.Header), body...))
+}
+
+// Format errors as S3 error documents
+// @param c *fiber.Ctx context
+// @param err error
+// @return error error
+func s3ErrorHandler(c *fiber.Ctx, err error) error {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		switch errorStatus(err) {
+		case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity:
+			s3Err = &s3Error{fiber.StatusBadRequest, "InvalidArgument", err.Error()}
+		case fiber.StatusNotFound:
+			s3Err = s3ErrorNoSuchKey
+		case fiber.StatusMethodNotAllowed:
+			s3Err = &s3Error{fiber.StatusMethodNotAllowed, "MethodNotAllowed", err.Error()}
+		case fiber.StatusRequestEntityTooLarge:
+			s3Err = s3ErrorEntityTooLarge
+		default:
+			s3Err = &s3Error{fiber.StatusInternalServerError, "InternalError", err.Error()}
+		}
+	}
+
+	// HEAD responses have no body, clients only see the status
+	if c.Method() == fiber.MethodHead {
+		return c.SendStatus(s3Err.Status)
+	}
+	return sendXML(c, s3Err.Status, s3ErrorResponse{
+		Code:     s3Err.Code,
+		Message:  s3Err.Message,
+		Resource: c.Path(),
+	})
+}
+
+// Route middleware authenticating requests, checking that S3_ROLE has at
+// least role and that they address the exposed bucket
+// @param role string role of the operation
+// @return fiber.Handler middleware
+func authorizeS3(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		signature, err := verifyS3Signature(c)
+		if err != nil {
+			return err
+		}
+		if !hasRole(config.S3Role, role) {
+			return s3ErrorAccessDenied
+		}
+		c.Locals("s3Signature", signature)
+		c.Locals(principalKey{}, &principal{Actor: config.S3AccessKey, Role: config.S3Role, Authenticated: true})
+		c.Locals(auditSourceKey{}, auditSource{Actor: config.S3AccessKey, IP: c.IP(), Protocol: "s3"})
+
+		if bucket := c.Params("bucket"); bucket != "" && bucket != config.BucketName {
+			return s3ErrorNoSuchBucket
+		}
+		return c.Next()
+	}
+}
+
+// Read object key from the route params
+// @param c *fiber.Ctx context
+// @return string key
+func s3Key(c *fiber.Ctx) string {
+	key, err := url.PathUnescape(c.Params("*"))
+	if err != nil {
+		return c.Params("*")
+	}
+	return key
+}
+
+// Find current revision stored under key
+// @param c *fiber.Ctx context
+// @param db *mongo.Database database
+// @return bson.M files document
+// @return error error
+func findS3Object(c *fiber.Ctx, db *mongo.Database) (bson.M, error) {
+	fileDoc, err := findCurrentByName(c.Context(), db, s3Key(c))
+	if err != nil {
+		return nil, s3ErrorNoSuchKey
+	}
+	return fileDoc, nil
+}
+
+// Get entity tag of object, the MD5 of its content if known
+// @param fileDoc bson.M files document
+// @return string quoted entity tag
+func s3ETag(fileDoc bson.M) string {
+	if md5, ok := fileDoc["md5"].(string); ok {
+		return `"` + md5 + `"`
+	}
+	return `"` + fileDoc["_id"].(primitive.ObjectID).Hex() + `"`
+}
+
+// Get last modification time of object
+// @param fileDoc bson.M files document
+// @return time.Time upload date
+func s3LastModified(fileDoc bson.M) time.Time {
+	uploadDate, _ := fileDoc["uploadDate"].(primitive.DateTime)
+	return uploadDate.Time().UTC()
+}
+
+// Set object headers, custom metadata strings are returned as x-amz-meta-*
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+func setS3ObjectHeaders(c *fiber.Ctx, fileDoc bson.M) {
+	if contentType, ok := contentTypes[fileExtension(fileDoc)]; ok {
+		c.Set(fiber.HeaderContentType, contentType)
+	}
+	setSecurityHeaders(c)
+	c.Set(fiber.HeaderETag, s3ETag(fileDoc))
+	c.Set(fiber.HeaderLastModified, s3LastModified(fileDoc).Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	for key, value := range metadata {
+		if value, ok := value.(string); ok && !reservedMetadataKeys[key] {
+			c.Set(s3MetaPrefix+key, value)
+		}
+	}
+}
+
+// Encode value of a list response if the client asked for URL encoding
+// @param value string
+// @param encodingType string
+// @return string value
+func s3ListValue(value string, encodingType string) string {
+	if encodingType == "url" {
+		return url.QueryEscape(value)
+	}
+	return value
+}
+
+// List objects of the bucket, handling both ListObjects and ListObjectsV2
+// @param c *fiber.Ctx context
+// @return error error
+func listS3Objects(c *fiber.Ctx) error {
+	v2 := c.Query("list-type") == "2"
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+	encodingType := c.Query("encoding-type")
+
+	maxKeys := maxS3Keys
+	if value := c.Query("max-keys"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return s3ErrorInvalidArgument
+		}
+		if parsed < maxKeys {
+			maxKeys = parsed
+		}
+	}
+
+	// Listing resumes after the marker, which may be a common prefix
+	result := s3ListObjectsResult{
+		Xmlns:        s3Namespace,
+		Name:         config.BucketName,
+		Prefix:       s3ListValue(prefix, encodingType),
+		MaxKeys:      maxKeys,
+		Delimiter:    s3ListValue(delimiter, encodingType),
+		EncodingType: encodingType,
+	}
+	after := c.Query("marker")
+	if v2 {
+		after = c.Query("start-after")
+		result.StartAfter = s3ListValue(after, encodingType)
+		if token := c.Query("continuation-token"); token != "" {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return s3ErrorInvalidArgument
+			}
+			after = string(decoded)
+			result.ContinuationToken = token
+		}
+	} else {
+		marker := s3ListValue(after, encodingType)
+		result.Marker = &marker
+	}
+
+	// One entry per key with its current revision, sorted by key
+	filter := bson.M{"filename": bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}, "$gt": after}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: activeFilter(filter)}},
+		{{Key: "$sort", Value: bson.D{{Key: "filename", Value: 1}, {Key: "metadata.current", Value: -1}, {Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$filename", "doc": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := filesCollection(database()).Aggregate(c.Context(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(c.Context())
+
+	lastPrefix, last := "", ""
+	if delimiter != "" && strings.HasSuffix(after, delimiter) {
+		lastPrefix = after
+	}
+	count := 0
+	for cursor.Next(c.Context()) {
+		var entry struct {
+			Key string `bson:"_id"`
+			Doc bson.M `bson:"doc"`
+		}
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+
+		// Keys containing the delimiter after the prefix are rolled up
+		commonPrefix := ""
+		if delimiter != "" {
+			if index := strings.Index(strings.TrimPrefix(entry.Key, prefix), delimiter); index >= 0 {
+				commonPrefix = entry.Key[:len(prefix)+index+len(delimiter)]
+				if commonPrefix == lastPrefix {
+					continue
+				}
+			}
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		count++
+
+		if commonPrefix != "" {
+			lastPrefix, last = commonPrefix, commonPrefix
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: s3ListValue(commonPrefix, encodingType)})
+			continue
+		}
+		last = entry.Key
+		result.Contents = append(result.Contents, s3Object{
+			Key:          s3ListValue(entry.Key, encodingType),
+			LastModified: s3LastModified(entry.Doc).Format(s3TimeFormat),
+			ETag:         s3ETag(entry.Doc),
+			Size:         fileLength(entry.Doc),
+			StorageClass: "STANDARD",
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated {
+		result.NextMarker = s3ListValue(last, encodingType)
+	}
+	return sendXML(c, fiber.StatusOK, result)
+}
+
+// Start S3 compatible API in the background if a listen address is configured.
+// It exposes the image bucket under its GridFS name with path-style URLs,
+// e.g. PUT /images/avatars/user1.png.
+func startS3Server() {
+	if config.S3ListenAddr == "" {
+		return
+	}
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler:          s3ErrorHandler,
+		BodyLimit:             int(config.S3MaxObjectBytes),
+		DisableStartupMessage: true,
+	})
+	app.Use(recover.New())
+	registerS3Routes(app)
+
+	go func() {
+		if err := app.Listen(config.S3ListenAddr); err != nil {
+			logger.Error("s3 server stopped", "error", err)
+		}
+	}()
+
+	onShutdown(func(ctx context.Context) {
+		shutdown := app.Shutdown
+		if timeout := drainTimeout(ctx); timeout > 0 {
+			shutdown = func() error { return app.ShutdownWithTimeout(timeout) }
+		}
+		if err := shutdown(); err != nil {
+			logger.Error("s3 server shutdown", "error", err)
+		}
+	})
+}
+
+// Register S3 API routes
+// @param app *fiber.App app
+func registerS3Routes(app *fiber.App) {
+	created := time.Now().UTC()
+
+	// ListBuckets
+	// @return buckets
+	app.Get("/", authorizeS3(roleReader), func(c *fiber.Ctx) error {
+		return sendXML(c, fiber.StatusOK, s3ListBucketsResult{
+			Xmlns:   s3Namespace,
+			Owner:   s3Owner{ID: "gofs", DisplayName: "gofs"},
+			Buckets: []s3Bucket{{Name: config.BucketName, CreationDate: created.Format(s3TimeFormat)}},
+		})
+	})
+
+	// HeadBucket
+	// @param bucket string
+	app.Head("/:bucket", authorizeS3(roleReader), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	// CreateBucket, only succeeds for the existing bucket so that tools
+	// creating buckets on first use keep working
+	// @param bucket string
+	app.Put("/:bucket", authorizeS3(roleUploader), func(c *fiber.Ctx) error {
+		return s3ErrorBucketAlreadyOwnedByYou
+	})
+
+	// GetBucketLocation, ListObjects or ListObjectsV2
+	// @param bucket string
+	// @param list-type int 2 for ListObjectsV2
+	// @param prefix string
+	// @param delimiter string
+	// @param max-keys int
+	// @param marker string ListObjects only
+	// @param start-after string ListObjectsV2 only
+	// @param continuation-token string ListObjectsV2 only
+	// @return objects
+	app.Get("/:bucket", authorizeS3(roleReader), func(c *fiber.Ctx) error {
+		if c.Request().URI().QueryArgs().Has("location") {
+			return sendXML(c, fiber.StatusOK, s3LocationConstraint{Xmlns: s3Namespace})
+		}
+		// Listing all objects requires admins, like listing all files
+		if !hasRole(config.S3Role, roleAdmin) {
+			return s3ErrorAccessDenied
+		}
+		return listS3Objects(c)
+	})
+
+	// HeadObject
+	// @param bucket string
+	// @param key string
+	app.Head("/:bucket/*", authorizeS3(roleReader), func(c *fiber.Ctx) error {
+		fileDoc, err := findS3Object(c, database())
+		if err != nil {
+			return err
+		}
+		setS3ObjectHeaders(c, fileDoc)
+		c.Set(fiber.HeaderContentLength, strconv.FormatInt(fileLength(fileDoc), 10))
+		return nil
+	})
+
+	// GetObject, optionally a single byte range
+	// @param bucket string
+	// @param key string
+	// @return object content
+	app.Get("/:bucket/*", authorizeS3(roleReader), func(c *fiber.Ctx) error {
+		db := database()
+		fileDoc, err := findS3Object(c, db)
+		if err != nil {
+			return err
+		}
+
+		size := fileLength(fileDoc)
+		start, end := int64(0), size-1
+		status := fiber.StatusOK
+		if header := c.Get(fiber.HeaderRange); header != "" {
+			if start, end, err = parseByteRange(header, size); err != nil {
+				c.Set(fiber.HeaderContentRange, "bytes */"+strconv.FormatInt(size, 10))
+				return s3ErrorInvalidRange
+			}
+			status = fiber.StatusPartialContent
+			c.Set(fiber.HeaderContentRange, "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10))
+		}
+
+		bucket, err := imageBucket(db)
+		if err != nil {
+			return err
+		}
+		downloadStream, err := bucket.OpenDownloadStream(fileDoc["_id"])
+		trackDownload(c.Context(), fileDoc, err)
+		if err != nil {
+			return err
+		}
+		if _, err := downloadStream.Skip(start); err != nil {
+			downloadStream.Close()
+			return err
+		}
+
+		setS3ObjectHeaders(c, fileDoc)
+		c.Status(status)
+		length := end - start + 1
+		return c.SendStream(rangeStream{io.LimitReader(downloadStream, length), downloadStream}, int(length))
+	})
+
+	// PutObject, replacing all revisions stored under the key. Headers
+	// x-amz-meta-* are stored as custom metadata.
+	// @param bucket string
+	// @param key string
+	// @return entity tag
+	app.Put("/:bucket/*", authorizeS3(roleUploader), func(c *fiber.Ctx) error {
+		if c.Get("X-Amz-Copy-Source") != "" {
+			return s3ErrorNotImplemented
+		}
+		signature, _ := c.Locals("s3Signature").(*s3Signature)
+		content, err := s3RequestBody(c, signature)
+		if err != nil {
+			return err
+		}
+
+		checksum := md5.Sum(content)
+		if contentMD5 := c.Get("Content-MD5"); contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(checksum[:]) {
+			return s3ErrorBadDigest
+		}
+
+		custom := map[string]interface{}{}
+		c.Request().Header.VisitAll(func(key, value []byte) {
+			if name, found := strings.CutPrefix(string(key), s3MetaPrefix); found {
+				custom[strings.ToLower(name)] = string(value)
+			}
+		})
+		if err := validateCustomMetadata(custom); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		expiresAt, err := parseExpiry("")
+		if err != nil {
+			return err
+		}
+
+		db := database()
+		image, err := storeUpload(c.Context(), db, s3Key(c), bytes.NewReader(content), uploadOptions{
+			Collision: collisionOverwrite,
+			Custom:    custom,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		// S3 clients expect the MD5 of the content as entity tag
+		etag := hex.EncodeToString(checksum[:])
+		if _, err := filesCollection(db).UpdateOne(c.Context(), bson.M{"_id": image["id"]}, bson.M{"$set": bson.M{"md5": etag}}); err != nil {
+			return err
+		}
+
+		c.Set(fiber.HeaderETag, `"`+etag+`"`)
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	// DeleteObject, removing all revisions stored under the key. Deleting a
+	// missing key succeeds like on S3.
+	// @param bucket string
+	// @param key string
+	app.Delete("/:bucket/*", authorizeS3(roleAdmin), func(c *fiber.Ctx) error {
+		db := database()
+		revisions, err := listRevisions(c.Context(), db, s3Key(c))
+		if err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			if err := deleteFile(c.Context(), revision["_id"].(primitive.ObjectID)); err != nil {
+				return err
+			}
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
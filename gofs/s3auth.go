@@ -0,0 +1,294 @@
+package gofs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Signature algorithm and payload hashes of AWS Signature Version 4
+const (
+	sigV4Algorithm        = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat       = "20060102T150405Z"
+	unsignedPayload       = "UNSIGNED-PAYLOAD"
+	streamingPayload      = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsigned     = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptyPayloadHash      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxRequestTimeSkew    = 15 * time.Minute
+	maxPresignedURLExpiry = 7 * 24 * time.Hour
+)
+
+// Verified signature of a request, needed to check signed payload chunks
+type s3Signature struct {
+	signingKey []byte
+	amzDate    string
+	scope      string
+	seed       string
+}
+
+// URI encode value as required for canonical requests
+// @param value string
+// @param encodeSlash bool
+// @return string encoded value
+func s3URIEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// Compute HMAC-SHA256
+// @param key []byte
+// @param data string
+// @return []byte mac
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Compute hex encoded SHA-256
+// @param data []byte
+// @return string hash
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Build canonical request of Signature Version 4
+// @param c *fiber.Ctx context
+// @param signedHeaders []string lowercase header names
+// @param payloadHash string
+// @return string canonical request
+func canonicalRequest(c *fiber.Ctx, signedHeaders []string, payloadHash string) string {
+	path := string(c.Request().URI().PathOriginal())
+	path, _, _ = strings.Cut(path, "?")
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+
+	// Query parameters sorted by key, the signature itself is excluded
+	var query []string
+	c.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
+		if string(key) != "X-Amz-Signature" {
+			query = append(query, s3URIEncode(string(key), true)+"="+s3URIEncode(string(value), true))
+		}
+	})
+	sort.Strings(query)
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := c.Get(name)
+		if name == "host" {
+			value = string(c.Request().Host())
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		c.Method(),
+		s3URIEncode(path, false),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// Derive signing key of credential scope date/region/service
+// @param secret string secret key
+// @param scope []string date, region and service
+// @return []byte signing key
+func signingKey(secret string, scope []string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range append(scope, "aws4_request") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// Verify Signature Version 4 of a request, given in the Authorization header
+// or as presigned URL query parameters
+// @param c *fiber.Ctx context
+// @return *s3Signature verified signature
+// @return error error
+func verifyS3Signature(c *fiber.Ctx) (*s3Signature, error) {
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	var expires time.Duration
+	if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+		algorithm, params, _ := strings.Cut(auth, " ")
+		if algorithm != sigV4Algorithm {
+			return nil, s3ErrorAccessDenied
+		}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = c.Get("X-Amz-Date")
+		payloadHash = c.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = emptyPayloadHash
+		}
+	} else if c.Query("X-Amz-Algorithm") == sigV4Algorithm {
+		credential = c.Query("X-Amz-Credential")
+		signedHeaders = c.Query("X-Amz-SignedHeaders")
+		signature = c.Query("X-Amz-Signature")
+		amzDate = c.Query("X-Amz-Date")
+		payloadHash = unsignedPayload
+		seconds, err := strconv.Atoi(c.Query("X-Amz-Expires"))
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPresignedURLExpiry {
+			return nil, s3ErrorAccessDenied
+		}
+		expires = time.Duration(seconds) * time.Second
+	} else {
+		return nil, s3ErrorAccessDenied
+	}
+
+	// Credential is <access key>/<date>/<region>/<service>/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, s3ErrorAccessDenied
+	}
+	if parts[0] != config.S3AccessKey {
+		return nil, s3ErrorInvalidAccessKey
+	}
+
+	date, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, parts[1]) {
+		return nil, s3ErrorAccessDenied
+	}
+	now := time.Now()
+	if expires > 0 {
+		if now.After(date.Add(expires)) || date.After(now.Add(maxRequestTimeSkew)) {
+			return nil, s3ErrorAccessDenied
+		}
+	} else if now.Sub(date) > maxRequestTimeSkew || date.Sub(now) > maxRequestTimeSkew {
+		return nil, s3ErrorRequestTimeTooSkewed
+	}
+
+	scope := strings.Join(parts[1:], "/")
+	key := signingKey(config.S3SecretKey, parts[1:4])
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest(c, strings.Split(signedHeaders, ";"), payloadHash))),
+	}, "\n")
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(key, stringToSign))), []byte(signature)) {
+		return nil, s3ErrorSignatureDoesNotMatch
+	}
+
+	// Signed payloads must match their hash
+	if len(payloadHash) == sha256.Size*2 && sha256Hex(c.Body()) != payloadHash {
+		return nil, s3ErrorContentSHA256Mismatch
+	}
+
+	return &s3Signature{signingKey: key, amzDate: amzDate, scope: scope, seed: signature}, nil
+}
+
+// Read request body, decoding aws-chunked payloads and verifying their chunk
+// signatures
+// @param c *fiber.Ctx context
+// @param signature *s3Signature verified request signature
+// @return []byte content
+// @return error error
+func s3RequestBody(c *fiber.Ctx, signature *s3Signature) ([]byte, error) {
+	payloadHash := c.Get("X-Amz-Content-Sha256")
+	if payloadHash != streamingPayload && payloadHash != streamingUnsigned {
+		return c.Body(), nil
+	}
+
+	// Each chunk is <hex size>[;chunk-signature=<signature>]\r\n<data>\r\n,
+	// the last one has size zero and may be followed by trailing headers
+	// Chunk sizes are checked against the decoded length before allocating,
+	// a forged size must not exhaust the memory
+	limit := config.S3MaxObjectBytes
+	decoded := c.Get("X-Amz-Decoded-Content-Length")
+	if decoded != "" {
+		length, err := strconv.ParseInt(decoded, 10, 64)
+		if err != nil || length < 0 {
+			return nil, s3ErrorInvalidArgument
+		}
+		if length > limit {
+			return nil, s3ErrorEntityTooLarge
+		}
+		limit = length
+	}
+
+	var content bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(c.Body()))
+	previous := signature.seed
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, s3ErrorIncompleteBody
+		}
+		sizeHex, extension, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size < 0 {
+			return nil, s3ErrorIncompleteBody
+		}
+		if size > limit-int64(content.Len()) {
+			if decoded != "" {
+				return nil, s3ErrorIncompleteBody
+			}
+			return nil, s3ErrorEntityTooLarge
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, s3ErrorIncompleteBody
+		}
+
+		if payloadHash == streamingPayload {
+			chunkSignature := strings.TrimPrefix(extension, "chunk-signature=")
+			stringToSign := strings.Join([]string{
+				sigV4Algorithm + "-PAYLOAD",
+				signature.amzDate,
+				signature.scope,
+				previous,
+				emptyPayloadHash,
+				sha256Hex(chunk),
+			}, "\n")
+			if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(signature.signingKey, stringToSign))), []byte(chunkSignature)) {
+				return nil, s3ErrorSignatureDoesNotMatch
+			}
+			previous = chunkSignature
+		}
+
+		if size == 0 {
+			break
+		}
+		content.Write(chunk)
+		if _, err := reader.Discard(2); err != nil {
+			return nil, s3ErrorIncompleteBody
+		}
+	}
+
+	if decoded != "" && int64(content.Len()) != limit {
+		return nil, s3ErrorIncompleteBody
+	}
+	return content.Bytes(), nil
+}
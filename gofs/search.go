@@ -0,0 +1,187 @@
+package gofs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Longest accepted search query in bytes
+const maxSearchQueryBytes = 256
+
+// Text index on the files collections backing the search endpoint. A
+// collection can only have one text index, it covers the filename and the
+// description. Filenames aren't written in one language, so words are
+// matched without stemming and stop words. Filename matches weigh more.
+var searchIndex = mongo.IndexModel{
+	Keys: bson.D{{Key: "filename", Value: "text"}, {Key: "metadata.description", Value: "text"}},
+	Options: options.Index().
+		SetName("filename_metadata_description_text").
+		SetDefaultLanguage("none").
+		SetWeights(bson.D{{Key: "filename", Value: 10}, {Key: "metadata.description", Value: 1}}),
+}
+
+// Position of a file in search results, which are sorted by relevance,
+// upload date and id
+type searchCursor struct {
+	Score      float64
+	UploadDate time.Time
+	Id         primitive.ObjectID
+}
+
+// Search files by the words of their filename and description, most
+// relevant first, narrowed down by the listing criteria. With
+// ATLAS_SEARCH_INDEX Atlas Search matches tags too and tolerates typos.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param query string words, "quoted phrases" and -excluded words
+// @param filter FileFilter listing criteria
+// @param after *searchCursor last file of the previous page, nil for the
+// first page
+// @param skip int64
+// @param limit int64
+// @return []fiber.Map files with relevance scores
+// @return error error
+func searchFiles(ctx context.Context, db *mongo.Database, query string, filter FileFilter, after *searchCursor, skip, limit int64) ([]fiber.Map, error) {
+	match, err := filter.bson()
+	if err != nil {
+		return nil, err
+	}
+	var page mongo.Pipeline
+	if config.AtlasSearchIndex != "" {
+		page = mongo.Pipeline{
+			{{Key: "$search", Value: bson.M{"index": config.AtlasSearchIndex, "compound": atlasSearchOperator(query)}}},
+			{{Key: "$match", Value: match}},
+			{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "searchScore"}}}},
+		}
+	} else {
+		match["$text"] = bson.M{"$search": query}
+		page = mongo.Pipeline{
+			{{Key: "$match", Value: match}},
+			{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+		}
+	}
+	if after != nil {
+		keys := []interface{}{after.Score, after.UploadDate, after.Id}
+		page = append(page, bson.D{{Key: "$match", Value: keysetFilter([]string{"score", "uploadDate", "_id"}, keys, -1)}})
+	}
+	page = append(page,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}}}},
+		bson.D{{Key: "$skip", Value: skip}},
+		bson.D{{Key: "$limit", Value: limit}},
+	)
+
+	var fileDocs []bson.M
+	err = withRetry(ctx, func() error {
+		cursor, err := requestFilesCollection(ctx, db).Aggregate(ctx, page)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &fileDocs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]fiber.Map, 0, len(fileDocs))
+	for _, fileDoc := range fileDocs {
+		file := fileInfo(fileDoc)
+		file["score"] = fileDoc["score"]
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Read search query from the q query parameter, recording it in v if it is
+// missing or too long
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @return string query
+func searchQuery(c *fiber.Ctx, v *validation.Validator) string {
+	query := strings.TrimSpace(c.Query("q"))
+	if v.Check(query != "", validation.Query, "q", "q is required") {
+		v.Check(len(query) <= maxSearchQueryBytes, validation.Query, "q", "q must be at most "+strconv.Itoa(maxSearchQueryBytes)+" bytes")
+	}
+	return query
+}
+
+// Register search routes of the default bucket and the named buckets
+// @param app *fiber.App app
+func registerSearchRoutes(app *fiber.App) {
+	app.Get("/api/images/search", requireRole(roleAdmin), searchImages)
+	app.Get("/api/:bucket/files/search", selectBucket, requireRole(roleAdmin), searchImages)
+	app.Get("/api/images/search/facets", requireRole(roleAdmin), searchFacets)
+	app.Get("/api/:bucket/files/search/facets", selectBucket, requireRole(roleAdmin), searchFacets)
+}
+
+// Search images by filename and description, and with ATLAS_SEARCH_INDEX by
+// tags, most relevant first, with the filters of the listing endpoint
+// @param q string words, "quoted phrases" and -excluded words
+// @param tags string comma separated tags
+// @param match string all|any
+// @param uploadedAfter string RFC 3339 timestamp
+// @param uploadedBefore string RFC 3339 timestamp
+// @param minSize int bytes
+// @param maxSize int bytes
+// @param contentType string
+// @param cursor string nextCursor of the previous page
+// @param skip int
+// @param limit int
+// @return images metadata with relevance scores and cursor of the next page
+func searchImages(c *fiber.Ctx) error {
+	v := &validation.Validator{}
+	query := searchQuery(c, v)
+	filter := listFilter(c, v)
+	skip, limit := pageParams(c, v)
+	var after *searchCursor
+	var cursor searchCursor
+	if decodeCursor(v, c.Query("cursor"), &cursor.Score, &cursor.UploadDate, &cursor.Id) {
+		v.Check(skip == 0, validation.Query, "skip", "skip can't be combined with cursor")
+		after = &cursor
+	}
+	if err := v.Err(); err != nil {
+		return err
+	}
+
+	// One more than the page tells if there is a next one
+	images, err := searchFiles(c.Context(), readDatabase(c.Context()), query, filter, after, skip, limit+1)
+	if err != nil {
+		return err
+	}
+	nextCursor := ""
+	if int64(len(images)) > limit {
+		images = images[:limit]
+		last := images[limit-1]
+		nextCursor = encodeCursor(last["score"], last["uploadDate"], last["id"])
+	}
+	return respondPage(c, "Images fetched successfully", "images", images, nextCursor)
+}
+
+// Count images matching a search by content type and upload month. Needs
+// ATLAS_SEARCH_INDEX, the text index has no facets.
+// @param q string words, "quoted phrases" and -excluded words
+// @return counts by content type and upload month
+func searchFacets(c *fiber.Ctx) error {
+	if config.AtlasSearchIndex == "" {
+		return respondError(c, fiber.StatusNotFound, CodeNotFound, "Facets need ATLAS_SEARCH_INDEX")
+	}
+	v := &validation.Validator{}
+	query := searchQuery(c, v)
+	if err := v.Err(); err != nil {
+		return err
+	}
+
+	facets, err := atlasFacets(c.Context(), readDatabase(c.Context()), query)
+	if err != nil {
+		return err
+	}
+	return respond(c, fiber.StatusOK, "Facets fetched successfully", "facets", facets)
+}
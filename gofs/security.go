@@ -0,0 +1,45 @@
+package gofs
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Content types browsers render as documents able to run scripts, served
+// with DOWNLOAD_CSP
+var activeContentTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// Set security headers of a file download after its Content-Type: nosniff,
+// so browsers don't render files as another type, the referrer and framing
+// policies, and for HTML and SVG files a Content Security Policy keeping
+// their scripts from running with the origin of the service. SVG files get
+// svgCSP even if SECURITY_DOWNLOAD_CSP is empty, as they are accepted as
+// uploads.
+// @param c *fiber.Ctx context
+func setSecurityHeaders(c *fiber.Ctx) {
+	if config.NoSniff {
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	}
+	if config.ReferrerPolicy != "" {
+		c.Set(fiber.HeaderReferrerPolicy, config.ReferrerPolicy)
+	}
+	if config.FrameOptions != "" {
+		c.Set(fiber.HeaderXFrameOptions, config.FrameOptions)
+	}
+
+	mediaType, _, _ := strings.Cut(string(c.Response().Header.ContentType()), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case config.DownloadCSP != "" && activeContentTypes[mediaType]:
+		c.Set(fiber.HeaderContentSecurityPolicy, config.DownloadCSP)
+	case mediaType == "image/svg+xml":
+		c.Set(fiber.HeaderContentSecurityPolicy, svgCSP)
+	}
+}
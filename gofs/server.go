@@ -0,0 +1,62 @@
+package gofs
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Get configuration of the standalone server app, with errors formatted by
+// ErrorHandler and the timeouts, limits and process model of cfg
+// @param cfg Config configuration
+// @return fiber.Config app configuration
+func AppConfig(cfg Config) fiber.Config {
+	return fiber.Config{
+		ErrorHandler:      ErrorHandler,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		Concurrency:       cfg.Concurrency,
+		BodyLimit:         cfg.BodyLimit,
+		StreamRequestBody: cfg.StreamRequestBody,
+		// Upload handlers read streamed multipart forms part by part instead
+		// of fasthttp spooling them to temporary files first
+		DisablePreParseMultipartForm: cfg.StreamRequestBody,
+		Prefork:                      cfg.Prefork,
+	}
+}
+
+// Listen on the Unix domain socket LISTEN_SOCKET, or else on the TCP address
+// LISTEN_ADDR, terminating TLS with tlsConfig if it is not nil. A socket left
+// behind by a previous run is replaced.
+// @param cfg Config configuration
+// @param tlsConfig *tls.Config TLS configuration, see TLSConfig
+// @return net.Listener listener
+// @return error error
+func Listen(cfg Config, tlsConfig *tls.Config) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if cfg.ListenSocket != "" {
+		if err := os.Remove(cfg.ListenSocket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if ln, err = net.Listen("unix", cfg.ListenSocket); err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(cfg.ListenSocket, cfg.ListenSocketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	} else if ln, err = net.Listen("tcp", cfg.ListenAddr); err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
@@ -0,0 +1,404 @@
+package gofs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP handlers over the same file system as the WebDAV server, so the image
+// bucket and its virtual folders look like a directory tree
+type sftpHandlers struct {
+	fsys *gridfsFileSystem
+	// User and address of the session, recorded in the audit trail
+	source auditSource
+}
+
+// Entries returned by list and stat requests
+type sftpListing []os.FileInfo
+
+// Copy entries starting at offset
+// @param entries []os.FileInfo destination
+// @param offset int64
+// @return int entries copied
+// @return error io.EOF at the end of the listing
+func (l sftpListing) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(entries, l[offset:])
+	if n < len(entries) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Check that SFTP_ROLE has at least the role of a request, following the
+// policy of the REST routes: readers may download and stat files, uploaders
+// may also change them, only admins may delete files and list folders
+// @param role string role of the request
+// @return error permission error if it has not
+func sftpAuthorize(role string) error {
+	if !hasRole(config.SFTPRole, role) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// Open image for reading
+// @param r *sftp.Request request
+// @return io.ReaderAt reader
+// @return error error
+func (h *sftpHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if err := sftpAuthorize(roleReader); err != nil {
+		return nil, err
+	}
+	ctx := withAuditSource(r.Context(), h.source)
+	file, err := h.fsys.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	readFile, ok := file.(*gridfsReadFile)
+	if !ok {
+		file.Close()
+		return nil, os.ErrInvalid
+	}
+	return &sftpReadFile{file: readFile}, nil
+}
+
+// Open image for writing, it is stored once the client closes the handle
+// @param r *sftp.Request request
+// @return io.WriterAt writer
+// @return error error
+func (h *sftpHandlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if err := sftpAuthorize(roleUploader); err != nil {
+		return nil, err
+	}
+	// The upload outlives the open request, it is finished by Close
+	ctx := withAuditSource(context.Background(), h.source)
+	file, err := h.fsys.OpenFile(ctx, r.Filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriteFile{file: file.(*gridfsWriteFile), pending: map[int64][]byte{}}, nil
+}
+
+// Run file command
+// @param r *sftp.Request request
+// @return error error
+func (h *sftpHandlers) Filecmd(r *sftp.Request) error {
+	role := roleUploader
+	if r.Method == "Rmdir" || r.Method == "Remove" {
+		role = roleAdmin
+	}
+	if err := sftpAuthorize(role); err != nil {
+		return err
+	}
+	ctx := withAuditSource(r.Context(), h.source)
+	switch r.Method {
+	case "Setstat":
+		// Permissions and times are not stored, accept them so uploads don't fail
+		return nil
+	case "Rename":
+		return h.fsys.Rename(ctx, r.Filepath, r.Target)
+	case "Rmdir", "Remove":
+		if _, err := h.fsys.Stat(ctx, r.Filepath); err != nil {
+			return err
+		}
+		return h.fsys.RemoveAll(ctx, r.Filepath)
+	case "Mkdir":
+		return h.fsys.Mkdir(ctx, r.Filepath, 0)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// List folder or stat file
+// @param r *sftp.Request request
+// @return sftp.ListerAt entries
+// @return error error
+func (h *sftpHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	role := roleReader
+	if r.Method == "List" {
+		role = roleAdmin
+	}
+	if err := sftpAuthorize(role); err != nil {
+		return nil, err
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case "List":
+		file, err := h.fsys.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		entries, err := file.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing(entries), nil
+	case "Stat":
+		info, err := h.fsys.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Image opened for reading at arbitrary offsets
+type sftpReadFile struct {
+	mu   sync.Mutex
+	file *gridfsReadFile
+}
+
+// Read content at offset, reads are serialized since the download stream is
+// shared
+// @param p []byte
+// @param offset int64
+// @return int bytes read
+// @return error error
+func (f *sftpReadFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.file, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close download stream
+// @return error error
+func (f *sftpReadFile) Close() error {
+	return f.file.Close()
+}
+
+// Bytes past the written content which chunks arriving ahead of it may
+// reach, enough for the concurrent writes of common clients
+const sftpWriteAhead = 4 << 20
+
+// Image opened for writing. Clients send several writes at once, chunks
+// arriving ahead of the written content are held until the gap is filled.
+type sftpWriteFile struct {
+	mu      sync.Mutex
+	file    *gridfsWriteFile
+	offset  int64
+	pending map[int64][]byte
+	// Bytes held in pending
+	pendingBytes int
+	err          error
+}
+
+// Write content at offset
+// @param p []byte
+// @param offset int64
+// @return int bytes written
+// @return error error
+func (f *sftpWriteFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return 0, f.err
+	}
+	if offset != f.offset {
+		if offset < f.offset {
+			return 0, fmt.Errorf("write at offset %d: %w", offset, os.ErrInvalid)
+		}
+		// Chunks are held in memory, so they may not run far ahead
+		held := f.pendingBytes - len(f.pending[offset]) + len(p)
+		if offset+int64(len(p)) > f.offset+sftpWriteAhead || held > sftpWriteAhead {
+			return 0, fmt.Errorf("write at offset %d more than %d bytes ahead of offset %d: %w", offset, sftpWriteAhead, f.offset, os.ErrInvalid)
+		}
+		f.pending[offset] = bytes.Clone(p)
+		f.pendingBytes = held
+		return len(p), nil
+	}
+
+	for chunk := p; chunk != nil; chunk = f.pending[f.offset] {
+		f.pendingBytes -= len(f.pending[f.offset])
+		delete(f.pending, f.offset)
+		if _, err := f.file.Write(chunk); err != nil {
+			f.err = err
+			return 0, err
+		}
+		f.offset += int64(len(chunk))
+	}
+	return len(p), nil
+}
+
+// Finish upload, failing if chunks are still missing
+// @return error error
+func (f *sftpWriteFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err == nil && len(f.pending) > 0 {
+		f.err = fmt.Errorf("missing content at offset %d", f.offset)
+	}
+	if f.err != nil {
+		f.file.pipe.CloseWithError(f.err)
+		<-f.file.done
+		return f.err
+	}
+	return f.file.Close()
+}
+
+// Load public keys allowed to log in
+// @param path string authorized_keys file
+// @return map[string]bool marshaled keys
+// @return error error
+func loadAuthorizedKeys(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	return keys, nil
+}
+
+// Build SSH server configuration with public key authentication
+// @return *ssh.ServerConfig config
+// @return error error
+func sftpServerConfig() (*ssh.ServerConfig, error) {
+	authorizedKeys, err := loadAuthorizedKeys(config.SFTPAuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("authorized keys: %w", err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorizedKeys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", conn.User())
+		},
+	}
+
+	pem, err := os.ReadFile(config.SFTPHostKey)
+	if err != nil {
+		return nil, fmt.Errorf("host key: %w", err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("host key: %w", err)
+	}
+	serverConfig.AddHostKey(hostKey)
+	return serverConfig, nil
+}
+
+// Serve SFTP sessions of an SSH connection
+// @param conn net.Conn
+// @param serverConfig *ssh.ServerConfig
+// @param db *mongo.Database database
+func serveSFTPConn(conn net.Conn, serverConfig *ssh.ServerConfig, db *mongo.Database) {
+	defer conn.Close()
+
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		// Only the sftp subsystem is available, there is no shell
+		go func(requests <-chan *ssh.Request) {
+			for request := range requests {
+				var subsystem struct{ Name string }
+				ok := request.Type == "subsystem" && ssh.Unmarshal(request.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+				request.Reply(ok, nil)
+			}
+		}(requests)
+
+		go func(channel ssh.Channel) {
+			defer channel.Close()
+			ip, _, _ := net.SplitHostPort(sshConn.RemoteAddr().String())
+			handlers := &sftpHandlers{
+				fsys:   &gridfsFileSystem{db: db},
+				source: auditSource{Actor: sshConn.User(), IP: ip, Protocol: "sftp"},
+			}
+			server := sftp.NewRequestServer(channel, sftp.Handlers{
+				FileGet:  handlers,
+				FilePut:  handlers,
+				FileCmd:  handlers,
+				FileList: handlers,
+			})
+			if err := server.Serve(); err != nil && err != io.EOF {
+				logger.Error("sftp session failed", "user", sshConn.User(), "ip", sshConn.RemoteAddr().String(), "error", err)
+			}
+		}(channel)
+	}
+}
+
+// Serve the image bucket over SFTP in the background if a listen address
+// is configured
+// @return error error loading the keys or listening
+func startSFTPServer() error {
+	if config.SFTPListenAddr == "" {
+		return nil
+	}
+
+	serverConfig, err := sftpServerConfig()
+	if err != nil {
+		return fmt.Errorf("sftp server: %w", err)
+	}
+	listener, err := net.Listen("tcp", config.SFTPListenAddr)
+	if err != nil {
+		return fmt.Errorf("sftp server: %w", err)
+	}
+
+	db := database()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Error("sftp server stopped", "error", err)
+				}
+				return
+			}
+			go serveSFTPConn(conn, serverConfig, db)
+		}
+	}()
+
+	// Sessions already open keep running until the process exits, their
+	// uploads are waited for like all others
+	onShutdown(func(ctx context.Context) {
+		listener.Close()
+	})
+	return nil
+}
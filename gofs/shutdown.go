@@ -0,0 +1,123 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time aborted transfers get to remove their partial content once the drain
+// timeout passed
+const transferAbortGrace = 5 * time.Second
+
+// Error of transfers aborted because the service shuts down
+var errShuttingDown = errors.New("service is shutting down")
+
+var (
+	// Functions stopping background services, run by Shutdown
+	shutdownMu    sync.Mutex
+	shutdownHooks []func(ctx context.Context)
+
+	// Uploads and downloads in flight, aborted when the drain timeout passed
+	transfers        sync.WaitGroup
+	activeTransfers  atomic.Int64
+	transfersAborted = make(chan struct{})
+	abortOnce        sync.Once
+)
+
+// Register function stopping a background service on shutdown
+// @param stop func(ctx context.Context) stops the service, giving up when ctx is done
+func onShutdown(stop func(ctx context.Context)) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, stop)
+}
+
+// Reader of a transfer which fails once transfers are aborted, so uploads
+// abort their GridFS upload stream and leave no partial chunks behind
+type transferReader struct {
+	reader io.Reader
+}
+
+// Read from the underlying reader unless transfers were aborted
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (r transferReader) Read(p []byte) (int, error) {
+	select {
+	case <-transfersAborted:
+		return 0, errShuttingDown
+	default:
+	}
+	return r.reader.Read(p)
+}
+
+// Get time left until the drain deadline of ctx
+// @param ctx context.Context
+// @return time.Duration timeout, 0 if ctx has no deadline
+func drainTimeout(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if timeout := time.Until(deadline); timeout > 0 {
+		return timeout
+	}
+	return time.Nanosecond
+}
+
+// Track transfer reading from reader until done is called, so shutdown
+// waits for it
+// @param reader io.Reader content
+// @return io.Reader reader to transfer from
+// @return func() done
+func startTransfer(reader io.Reader) (io.Reader, func()) {
+	transfers.Add(1)
+	activeTransfers.Add(1)
+	return transferReader{reader: reader}, func() {
+		activeTransfers.Add(-1)
+		transfers.Done()
+	}
+}
+
+// Stop the background services and protocol servers started by
+// StartServices, wait for uploads and downloads in flight and disconnect from
+// MongoDB. Transfers still running when ctx is done are aborted. Stop the
+// HTTP app first, e.g. with app.ShutdownWithTimeout, so no new requests come
+// in.
+// @param ctx context.Context drain deadline
+// @return error error
+func Shutdown(ctx context.Context) error {
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownMu.Unlock()
+
+	// Stop the services in reverse start order
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](ctx)
+	}
+
+	// Wait for transfers to finish, aborting them at the deadline
+	done := make(chan struct{})
+	go func() {
+		transfers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("drain timeout passed, aborting transfers")
+		abortOnce.Do(func() { close(transfersAborted) })
+		select {
+		case <-done:
+		case <-time.After(transferAbortGrace):
+			logger.Error("transfers did not stop in time")
+		}
+	}
+
+	return disconnectMongo()
+}
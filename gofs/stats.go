@@ -0,0 +1,188 @@
+package gofs
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Number of largest files reported by the storage statistics
+const (
+	defaultLargestFiles = 10
+	maxLargestFiles     = 100
+)
+
+// File count and size of a group of files
+type storageUsage struct {
+	Files int64
+	Bytes int64
+}
+
+// Result of the storage statistics pipeline
+type storageFacets struct {
+	Totals []struct {
+		Files int64 `bson:"files"`
+		Bytes int64 `bson:"bytes"`
+	} `bson:"totals"`
+	ByExt []struct {
+		Ext   *string `bson:"_id"`
+		Files int64   `bson:"files"`
+		Bytes int64   `bson:"bytes"`
+	} `bson:"byExt"`
+	ByOwner []struct {
+		Owner *string `bson:"_id"`
+		Files int64   `bson:"files"`
+		Bytes int64   `bson:"bytes"`
+	} `bson:"byOwner"`
+	Largest []bson.M `bson:"largest"`
+}
+
+// Compute file count and total size of a GridFS bucket, grouped by content
+// type and by owner, and its largest files, in one aggregation over the files
+// collection. All revisions count, as they all take up storage.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param largest int number of largest files
+// @return fiber.Map statistics
+// @return error error
+func storageStats(ctx context.Context, db *mongo.Database, bucket string, largest int) (fiber.Map, error) {
+	group := func(key interface{}) bson.M {
+		return bson.M{"$group": bson.M{"_id": key, "files": bson.M{"$sum": 1}, "bytes": bson.M{"$sum": "$length"}}}
+	}
+
+	cursor, err := namedFilesCollection(db, bucket).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$facet", Value: bson.M{
+			"totals":  bson.A{group(nil)},
+			"byExt":   bson.A{group("$metadata.ext")},
+			"byOwner": bson.A{group("$metadata.owner"), bson.M{"$sort": bson.D{{Key: "bytes", Value: -1}, {Key: "_id", Value: 1}}}},
+			"largest": bson.A{
+				bson.M{"$sort": bson.D{{Key: "length", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": largest},
+			},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var facets []storageFacets
+	if err := cursor.All(ctx, &facets); err != nil {
+		return nil, err
+	}
+	result := facets[0]
+
+	total := storageUsage{}
+	if len(result.Totals) > 0 {
+		total = storageUsage{Files: result.Totals[0].Files, Bytes: result.Totals[0].Bytes}
+	}
+
+	// Extensions sharing a content type, like .jpg and .jpeg, are merged
+	usageByType := map[string]*storageUsage{}
+	for _, group := range result.ByExt {
+		contentType := "application/octet-stream"
+		if group.Ext != nil {
+			if value, ok := contentTypes[*group.Ext]; ok {
+				contentType = value
+			}
+		}
+		if usageByType[contentType] == nil {
+			usageByType[contentType] = &storageUsage{}
+		}
+		usageByType[contentType].Files += group.Files
+		usageByType[contentType].Bytes += group.Bytes
+	}
+	byContentType := make([]fiber.Map, 0, len(usageByType))
+	for contentType, usage := range usageByType {
+		byContentType = append(byContentType, fiber.Map{"contentType": contentType, "files": usage.Files, "bytes": usage.Bytes})
+	}
+	sort.Slice(byContentType, func(i, j int) bool {
+		return byContentType[i]["bytes"].(int64) > byContentType[j]["bytes"].(int64)
+	})
+
+	// Files uploaded before owners were recorded have none
+	byOwner := make([]fiber.Map, 0, len(result.ByOwner))
+	for _, group := range result.ByOwner {
+		owner := "unknown"
+		if group.Owner != nil {
+			owner = *group.Owner
+		}
+		byOwner = append(byOwner, fiber.Map{"owner": owner, "files": group.Files, "bytes": group.Bytes})
+	}
+
+	largestFiles := make([]fiber.Map, 0, len(result.Largest))
+	for _, fileDoc := range result.Largest {
+		largestFiles = append(largestFiles, fileInfo(fileDoc))
+	}
+
+	return fiber.Map{
+		"bucket":        bucket,
+		"files":         total.Files,
+		"bytes":         total.Bytes,
+		"byContentType": byContentType,
+		"byOwner":       byOwner,
+		"largest":       largestFiles,
+	}, nil
+}
+
+// Register storage statistics and usage routes, available to admins only,
+// see requireAdmin
+// @param app *fiber.App app
+func registerStatsRoutes(app *fiber.App) {
+	// Get file count and total size of a bucket, by content type and by
+	// owner, and its largest files
+	// @param bucket string default bucket if empty
+	// @param largest int number of largest files
+	// @return storage statistics
+	app.Get("/api/admin/stats", requireAdmin, func(c *fiber.Ctx) error {
+		bucket := c.Query("bucket", config.BucketName)
+		if !managedBucket(bucket) {
+			return newError(fiber.StatusNotFound, CodeBucketNotFound, "Unknown bucket "+bucket)
+		}
+		largest, err := strconv.Atoi(c.Query("largest", strconv.Itoa(defaultLargestFiles)))
+		if err != nil || largest <= 0 || largest > maxLargestFiles {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid largest")
+		}
+
+		stats, err := storageStats(c.Context(), requestDatabase(c.Context()), bucket, largest)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Storage stats fetched successfully", "stats", stats)
+	})
+
+	// Get file count and total size of a bucket grouped by owner, tag,
+	// content type and upload month, for billing and capacity planning
+	// @param bucket string default bucket if empty
+	// @param groupBy string comma separated owner|tag|contentType|month
+	// @param uploadedAfter string RFC 3339 timestamp
+	// @param uploadedBefore string RFC 3339 timestamp
+	// @return usage groups, largest first
+	app.Get("/api/admin/usage", requireAdmin, func(c *fiber.Ctx) error {
+		bucket := c.Query("bucket", config.BucketName)
+		if !managedBucket(bucket) {
+			return newError(fiber.StatusNotFound, CodeBucketNotFound, "Unknown bucket "+bucket)
+		}
+		v := &validation.Validator{}
+		dimensions := usageGroupBy(c, v)
+		after := v.Time(validation.Query, "uploadedAfter", c.Query("uploadedAfter"))
+		before := v.Time(validation.Query, "uploadedBefore", c.Query("uploadedBefore"))
+		if err := v.Err(); err != nil {
+			return err
+		}
+
+		groups, err := storageUsageGroups(c.Context(), requestDatabase(c.Context()), bucket, dimensions, after, before)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Storage usage fetched successfully", "usage", fiber.Map{
+			"bucket":  bucket,
+			"groupBy": dimensions,
+			"groups":  groups,
+		})
+	})
+}
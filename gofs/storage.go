@@ -0,0 +1,429 @@
+package gofs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Error returned when uploaded file is not a supported image
+var errInvalidFileType = newError(fiber.StatusBadRequest, CodeInvalidFileType, "Invalid file type")
+
+// Content types of supported file extensions
+var contentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".pdf":  "application/pdf",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".svg":  "image/svg+xml",
+	".txt":  "text/plain",
+	".log":  "text/plain",
+	".csv":  "text/csv",
+	".md":   "text/markdown",
+	".json": "application/json",
+}
+
+// Get file extensions stored with given content type
+// @param contentType string
+// @return []string file extensions
+func contentTypeExtensions(contentType string) []string {
+	var extensions []string
+	for ext, extContentType := range contentTypes {
+		if extContentType == contentType {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// Regular expression matching the file extension
+var fileExtensionRegexp = regexp.MustCompile(`\.[a-zA-Z0-9]+$`)
+
+// Get database handle
+// @return *mongo.Database database
+func database() *mongo.Database {
+	return mongoClient().Database(config.DatabaseName)
+}
+
+// Context key marking requests which may read from secondaries
+type secondaryReadsContextKey struct{}
+
+// Get read preference of downloads and metadata reads
+// @param mode string e.g. secondaryPreferred
+// @param maxStaleness time.Duration how far secondaries may lag behind, 0 for no limit
+// @return *readpref.ReadPref read preference
+// @return error error
+func readPreference(mode string, maxStaleness time.Duration) (*readpref.ReadPref, error) {
+	readMode, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, err
+	}
+	if maxStaleness > 0 {
+		return readpref.New(readMode, readpref.WithMaxStaleness(maxStaleness))
+	}
+	return readpref.New(readMode)
+}
+
+// Get database handle for reads. GET and HEAD requests read with the
+// configured READ_PREFERENCE, everything else reads from the primary, so
+// writes and the reads they depend on always see the latest data.
+// @param ctx context.Context
+// @return *mongo.Database database
+func readDatabase(ctx context.Context) *mongo.Database {
+	if allowed, _ := ctx.Value(secondaryReadsContextKey{}).(bool); !allowed || strings.EqualFold(config.ReadPreference, "primary") {
+		return requestDatabase(ctx)
+	}
+	// Validated when the configuration is loaded
+	preference, _ := readPreference(config.ReadPreference, config.ReadMaxStaleness)
+	return mongoClient().Database(databaseName(ctx), options.Database().SetReadPreference(preference))
+}
+
+// Middleware letting GET and HEAD requests read with the configured read
+// preference, see readDatabase
+// @param c *fiber.Ctx context
+// @return error error
+func allowSecondaryReads(c *fiber.Ctx) error {
+	if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+		c.Locals(secondaryReadsContextKey{}, true)
+	}
+	return c.Next()
+}
+
+// Open default GridFS bucket
+// @param db *mongo.Database database
+// @return *gridfs.Bucket bucket
+// @return error error
+func imageBucket(db *mongo.Database) (*gridfs.Bucket, error) {
+	return namedBucket(db, config.BucketName)
+}
+
+// Bounds of GridFS chunk sizes. Chunks are stored as documents, which are
+// limited to 16 MiB.
+const (
+	minChunkSize = 1024
+	maxChunkSize = 15 * 1024 * 1024
+)
+
+// Context key of the chunk size requested for an upload
+type chunkSizeContextKey struct{}
+
+// Check if chunk size is within the GridFS bounds
+// @param size int chunk size in bytes
+// @return bool valid
+func validChunkSize(size int) bool {
+	return size >= minChunkSize && size <= maxChunkSize
+}
+
+// Get context storing uploads in chunks of the given size
+// @param ctx context.Context
+// @param size int32 chunk size in bytes
+// @return context.Context context
+func withChunkSize(ctx context.Context, size int32) context.Context {
+	return context.WithValue(ctx, chunkSizeContextKey{}, size)
+}
+
+// Get chunk size of uploads made with ctx, see withChunkSize
+// @param ctx context.Context
+// @return int32 chunk size in bytes, the configured one by default
+func chunkSizeFromContext(ctx context.Context) int32 {
+	if size, ok := ctx.Value(chunkSizeContextKey{}).(int32); ok {
+		return size
+	}
+	return int32(config.ChunkSizeBytes)
+}
+
+// Get options of a GridFS bucket
+// @param name string bucket name
+// @param chunkSize int32 chunk size of uploads, 0 for the driver default
+// @return *options.BucketOptions options
+func bucketOptions(name string, chunkSize int32) *options.BucketOptions {
+	opts := options.GridFSBucket().SetName(name)
+	if chunkSize > 0 {
+		opts.SetChunkSizeBytes(chunkSize)
+	}
+	return opts
+}
+
+// Open GridFS bucket by name, uploading in chunks of the configured size
+// @param db *mongo.Database database
+// @param name string
+// @return *gridfs.Bucket bucket
+// @return error error
+func namedBucket(db *mongo.Database, name string) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(db, bucketOptions(name, int32(config.ChunkSizeBytes)))
+}
+
+// Get files collection of the default GridFS bucket
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func filesCollection(db *mongo.Database) *mongo.Collection {
+	return namedFilesCollection(db, config.BucketName)
+}
+
+// Open GridFS bucket the request works on, see BucketFromContext, uploading
+// in chunks of the size requested for the upload, see withChunkSize
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @return *gridfs.Bucket bucket
+// @return error error
+func requestBucket(ctx context.Context, db *mongo.Database) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(db, bucketOptions(BucketFromContext(ctx), chunkSizeFromContext(ctx)))
+}
+
+// Get files collection of the GridFS bucket the request works on
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func requestFilesCollection(ctx context.Context, db *mongo.Database) *mongo.Collection {
+	return namedFilesCollection(db, BucketFromContext(ctx))
+}
+
+// Get files collection of GridFS bucket by name
+// @param db *mongo.Database database
+// @param name string
+// @return *mongo.Collection collection
+func namedFilesCollection(db *mongo.Database, name string) *mongo.Collection {
+	return db.Collection(name + ".files")
+}
+
+// Get chunks collection of GridFS bucket by name
+// @param db *mongo.Database database
+// @param name string
+// @return *mongo.Collection collection
+func namedChunksCollection(db *mongo.Database, name string) *mongo.Collection {
+	return db.Collection(name + ".chunks")
+}
+
+// Get file extension of filename, checking it is a supported image type
+// @param filename string
+// @return string file extension
+// @return error error
+func imageExtension(filename string) (string, error) {
+	fileExtension := fileExtensionRegexp.FindString(filename)
+	if _, ok := contentTypes[fileExtension]; !ok {
+		return "", errInvalidFileType
+	}
+	return fileExtension, nil
+}
+
+// Stream content from reader into GridFS bucket. The SHA-256 hash of the
+// content is stored in metadata.sha256 once the files document is written,
+// the duplicates report groups files by it.
+// @param bucket *gridfs.Bucket bucket
+// @param filename string
+// @param reader io.Reader content
+// @param metadata bson.M
+// @return primitive.ObjectID file id
+// @return int64 file size
+// @return error error
+func storeReader(bucket *gridfs.Bucket, filename string, reader io.Reader, metadata bson.M) (primitive.ObjectID, int64, error) {
+	// A hash can't be set in a null metadata field
+	if metadata == nil {
+		metadata = bson.M{}
+	}
+	uploadStream, err := bucket.OpenUploadStream(filename, options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+
+	// Shutdown waits for the upload, or aborts it at the drain deadline
+	reader, done := startTransfer(reader)
+	defer done()
+
+	fileId := uploadStream.FileID.(primitive.ObjectID)
+	hash := sha256.New()
+	fileSize, err := io.Copy(uploadStream, io.TeeReader(reader, hash))
+	if err != nil {
+		uploadStream.Abort()
+		return primitive.NilObjectID, 0, err
+	}
+
+	// Close upload stream to flush remaining chunks and write files document
+	if err := uploadStream.Close(); err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+
+	// The file is stored, a missing hash only keeps it out of the duplicates
+	// report
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if _, err := bucket.GetFilesCollection().UpdateByID(context.Background(), fileId, bson.M{"$set": bson.M{"metadata.sha256": sum}}); err != nil {
+		logger.Error("store content hash", "file_id", fileId, "error", err)
+	}
+
+	return fileId, fileSize, nil
+}
+
+// Delete file and its content from the storage backend
+// @param ctx context.Context
+// @param id primitive.ObjectID file id
+// @return error error
+func deleteFile(ctx context.Context, id primitive.ObjectID) error {
+	// The CDN caches the file under its name too, look it up while it exists
+	var filenames []string
+	if config.CDNProvider != "" || len(hooks) > 0 {
+		fileDoc, err := fileStorage().Stat(ctx, id)
+		switch {
+		case err == nil:
+			filenames = append(filenames, fileDoc["filename"].(string))
+			// Let the registered hooks veto the delete
+			if err := beforeDelete(ctx, fileDoc); err != nil {
+				recordAudit(ctx, auditDelete, id, fileDoc["filename"].(string), err)
+				return err
+			}
+		case len(hooks) > 0 && !errors.Is(err, ErrFileNotFound):
+			// Files are not deleted without asking the hooks
+			return err
+		}
+	}
+
+	err := fileStorage().Delete(ctx, id)
+	recordAudit(ctx, auditDelete, id, "", err)
+	if err != nil {
+		if errors.Is(err, ErrFileNotFound) {
+			return newError(fiber.StatusNotFound, CodeFileNotFound, "Image not found")
+		}
+		return err
+	}
+	forgetDownloads(ctx, requestDatabase(ctx), id)
+	uncacheFiles(ctx, BucketFromContext(ctx), id)
+	purgeFile(BucketFromContext(ctx), id, filenames...)
+	replicateFile(ctx, BucketFromContext(ctx), id)
+	transcodeVideo(ctx, BucketFromContext(ctx), id)
+	previewDocument(ctx, BucketFromContext(ctx), id)
+	publishEvent(eventFileDeleted, fiber.Map{"id": id})
+	return nil
+}
+
+// Get file extension stored in files document metadata
+// @param fileDoc bson.M files document
+// @return string file extension
+func fileExtension(fileDoc bson.M) string {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	ext, _ := metadata["ext"].(string)
+	return ext
+}
+
+// Get file size stored in files document
+// @param fileDoc bson.M files document
+// @return int64 size
+func fileLength(fileDoc bson.M) int64 {
+	switch length := fileDoc["length"].(type) {
+	case int32:
+		return int64(length)
+	case int64:
+		return length
+	}
+	return 0
+}
+
+// Get chunk size of a GridFS file from its files document
+// @param fileDoc bson.M files document
+// @return int64 chunk size in bytes
+func fileChunkSize(fileDoc bson.M) int64 {
+	switch size := fileDoc["chunkSize"].(type) {
+	case int32:
+		return int64(size)
+	case int64:
+		return size
+	}
+	return int64(gridfs.DefaultChunkSize)
+}
+
+// Download image described by files document from the storage backend and
+// send it. HEAD requests only get the headers, the content is not downloaded.
+// HEIF images may be sent as JPEG rendition, see wantsJPEG, single byte
+// ranges as partial content, see sendRange. Conditional requests for a
+// current copy get 304 Not Modified, see notModified.
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+// @return error error
+func sendImage(c *fiber.Ctx, fileDoc bson.M) error {
+	// Set required headers
+	setResponseHeaders(c, fileDoc)
+	if c.QueryBool("download") {
+		c.Set(fiber.HeaderContentDisposition, attachmentDisposition(fileDoc["filename"].(string)))
+	}
+
+	// HEIF images are converted for clients which can't display them
+	if isHEIF(fileDoc) {
+		convert, err := wantsJPEG(c)
+		if err != nil {
+			return err
+		}
+		if convert {
+			return heicRendition().send(c, fileDoc)
+		}
+	}
+	if notModified(c) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	if header := c.Get(fiber.HeaderRange); header != "" && ifRangeMatches(c) {
+		return sendRange(c, fileDoc, header)
+	}
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	// Content too large for the caches is streamed to the client as read
+	if !contentCacheable(fileDoc) {
+		return streamImage(c, fileDoc)
+	}
+
+	// Download image to buffer, or take it from the cache
+	content, cached, err := readFileContent(c.Context(), fileDoc)
+	trackDownload(c.Context(), fileDoc, err)
+	if err != nil {
+		return err
+	}
+	if cached {
+		c.Set("X-Cache", "HIT")
+	} else if contentCache() != nil {
+		c.Set("X-Cache", "MISS")
+	}
+
+	// Return image
+	return c.Send(content)
+}
+
+// Stream image described by files document from the storage backend to the
+// client without holding it in memory
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+// @return error error
+func streamImage(c *fiber.Ctx, fileDoc bson.M) error {
+	stream, err := fileStorage().Get(c.Context(), fileDoc["_id"].(primitive.ObjectID))
+	trackDownload(c.Context(), fileDoc, err)
+	if err != nil {
+		return err
+	}
+	if contentCache() != nil {
+		c.Set("X-Cache", "MISS")
+	}
+	reader, done := startTransfer(stream)
+	return c.SendStream(rangeStream{reader, transferCloser{stream, done}}, int(fileLength(fileDoc)))
+}
@@ -0,0 +1,234 @@
+package gofs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Content Security Policy of SVG downloads when SECURITY_DOWNLOAD_CSP is
+// empty: no scripts, no external resources, inline styles and embedded
+// raster images only
+const svgCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+// Elements removed from SVG uploads with their content, as they run
+// scripts or embed other documents
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"frame":         true,
+	"embed":         true,
+	"object":        true,
+	"applet":        true,
+	"handler":       true,
+	"listener":      true,
+	"link":          true,
+	"meta":          true,
+	"base":          true,
+}
+
+// Animation elements, removed when they animate links or event handlers
+var svgAnimationElements = map[string]bool{
+	"animate":          true,
+	"animatecolor":     true,
+	"animatemotion":    true,
+	"animatetransform": true,
+	"set":              true,
+}
+
+// Attributes holding URLs, kept only for references within the document and
+// embedded raster images
+var svgURLAttributes = map[string]bool{
+	"href":   true,
+	"src":    true,
+	"action": true,
+	"data":   true,
+}
+
+// Local references and embedded raster images, the only URLs kept
+var svgLocalURLRegexp = regexp.MustCompile(`^(#|data:image/(png|jpeg|gif|webp)[;,])`)
+
+// CSS imports and url() references
+var (
+	cssImportRegexp = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	cssURLRegexp    = regexp.MustCompile(`(?i)url\(\s*(['"]?)(.*?)(['"]?)\s*\)`)
+)
+
+// Check if a URL is kept in sanitized SVG documents
+// @param value string URL
+// @return bool local
+func svgLocalURL(value string) bool {
+	return svgLocalURLRegexp.MatchString(strings.ToLower(strings.TrimSpace(value)))
+}
+
+// Remove imports and external url() references from CSS. Escapes are
+// removed first, as they could spell out either.
+// @param css string
+// @return string sanitized CSS
+func sanitizeCSS(css string) string {
+	css = strings.ReplaceAll(css, `\`, "")
+	css = cssImportRegexp.ReplaceAllString(css, "")
+	return cssURLRegexp.ReplaceAllStringFunc(css, func(ref string) string {
+		if svgLocalURL(cssURLRegexp.FindStringSubmatch(ref)[2]) {
+			return ref
+		}
+		return "none"
+	})
+}
+
+// Sanitize attributes of an SVG element: event handlers, external URLs and
+// javascript: values are removed, external CSS references stripped
+// @param attrs []xml.Attr
+// @return []xml.Attr sanitized attributes
+func sanitizeSVGAttrs(attrs []xml.Attr) []xml.Attr {
+	var kept []xml.Attr
+	for _, attr := range attrs {
+		local := strings.ToLower(attr.Name.Local)
+		// Values may hide the scheme behind whitespace and control characters
+		compact := strings.ToLower(strings.Map(func(r rune) rune {
+			if r <= ' ' {
+				return -1
+			}
+			return r
+		}, attr.Value))
+		switch {
+		case strings.HasPrefix(local, "on"),
+			local == "base" && attr.Name.Space == "xml",
+			svgURLAttributes[local] && !svgLocalURL(attr.Value),
+			strings.Contains(compact, "javascript:"),
+			strings.Contains(compact, "vbscript:"):
+			continue
+		}
+		if strings.Contains(compact, "url(") || local == "style" {
+			attr.Value = sanitizeCSS(attr.Value)
+		}
+		kept = append(kept, attr)
+	}
+	return kept
+}
+
+// Check if an animation element animates a link or an event handler
+// @param attrs []xml.Attr attributes of the element
+// @return bool unsafe
+func svgUnsafeAnimation(attrs []xml.Attr) bool {
+	for _, attr := range attrs {
+		if strings.ToLower(attr.Name.Local) != "attributename" {
+			continue
+		}
+		value := strings.ToLower(strings.TrimSpace(attr.Value))
+		target := value[strings.LastIndex(value, ":")+1:]
+		return svgURLAttributes[target] || strings.HasPrefix(target, "on")
+	}
+	return false
+}
+
+// Get qualified name of a raw XML name
+// @param name xml.Name name with its prefix as space
+// @return string name
+func svgName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// Sanitize SVG document before it is stored. Scripts, embedded documents,
+// event handlers and references to external resources are removed, as are
+// comments, processing instructions and DOCTYPE declarations.
+// @param content []byte SVG document
+// @return []byte sanitized document
+// @return error error if the content is not a well-formed SVG document
+func sanitizeSVG(content []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	var out bytes.Buffer
+	var open []string
+	// Depth within a removed element, 0 outside of one
+	skip := 0
+	root := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(open) == 0 {
+				if root {
+					return nil, errors.New("multiple root elements")
+				}
+				if strings.ToLower(t.Name.Local) != "svg" {
+					return nil, errors.New("root element is not svg")
+				}
+				root = true
+			}
+			open = append(open, svgName(t.Name))
+			local := strings.ToLower(t.Name.Local)
+			if skip > 0 || svgForbiddenElements[local] || (svgAnimationElements[local] && svgUnsafeAnimation(t.Attr)) {
+				skip++
+				continue
+			}
+			out.WriteString("<" + svgName(t.Name))
+			for _, attr := range sanitizeSVGAttrs(t.Attr) {
+				out.WriteString(" " + svgName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != svgName(t.Name) {
+				return nil, errors.New("unexpected end element " + svgName(t.Name))
+			}
+			open = open[:len(open)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out.WriteString("</" + svgName(t.Name) + ">")
+		case xml.CharData:
+			if skip > 0 || len(open) == 0 {
+				continue
+			}
+			text := []byte(t)
+			if name := open[len(open)-1]; strings.EqualFold(name[strings.LastIndex(name, ":")+1:], "style") {
+				text = []byte(sanitizeCSS(string(text)))
+			}
+			xml.EscapeText(&out, text)
+		}
+	}
+
+	if !root {
+		return nil, errors.New("no svg element")
+	}
+	if len(open) > 0 {
+		return nil, errors.New("unclosed element " + open[len(open)-1])
+	}
+	return out.Bytes(), nil
+}
+
+// Read and sanitize uploaded SVG document, see sanitizeSVG
+// @param content io.Reader upload content
+// @return io.Reader sanitized content
+// @return error unprocessable entity error if the content is not an SVG
+// document
+func inspectSVG(content io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	sanitized, err := sanitizeSVG(data)
+	if err != nil {
+		return nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid SVG image: "+err.Error())
+	}
+	return bytes.NewReader(sanitized), nil
+}
@@ -0,0 +1,118 @@
+package gofs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// Substrings the sanitized document must not and must contain
+		removed, kept []string
+	}{
+		{
+			name:    "script element",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><rect width="1"/></svg>`,
+			removed: []string{"script", "alert"},
+			kept:    []string{`<rect width="1">`},
+		},
+		{
+			name:    "prefixed script element",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg" xmlns:s="http://www.w3.org/2000/svg"><s:script>alert(1)</s:script></svg>`,
+			removed: []string{"script", "alert"},
+		},
+		{
+			name:    "foreignObject",
+			in:      `<svg><foreignObject><iframe src="https://evil.example"/></foreignObject></svg>`,
+			removed: []string{"foreignObject", "iframe", "evil"},
+		},
+		{
+			name:    "event handler",
+			in:      `<svg onload="alert(1)"><rect onclick="alert(2)" width="1"/></svg>`,
+			removed: []string{"onload", "onclick", "alert"},
+			kept:    []string{`width="1"`},
+		},
+		{
+			name:    "external xlink:href",
+			in:      `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="https://evil.example/a.svg#x"/></svg>`,
+			removed: []string{"evil"},
+			kept:    []string{"<use>"},
+		},
+		{
+			name:    "javascript xlink:href",
+			in:      `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><a xlink:href=" java&#x09;script:alert(1)"><text>x</text></a></svg>`,
+			removed: []string{"script", "alert"},
+		},
+		{
+			name: "local xlink:href",
+			in:   `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#shape"/></svg>`,
+			kept: []string{`xlink:href="#shape"`},
+		},
+		{
+			name:    "animated href",
+			in:      `<svg><a><set attributeName="xlink:href" to="javascript:alert(1)"/></a></svg>`,
+			removed: []string{"set", "alert"},
+		},
+		{
+			name:    "CSS url() in style attribute",
+			in:      `<svg><rect style="fill: url('https://evil.example/x')"/></svg>`,
+			removed: []string{"evil"},
+			kept:    []string{"fill: none"},
+		},
+		{
+			name:    "CSS url() in style element",
+			in:      `<svg><style>rect { background: url(https://evil.example/x) } @import "https://evil.example/y.css";</style></svg>`,
+			removed: []string{"evil", "@import"},
+			kept:    []string{"background: none"},
+		},
+		{
+			name:    "escaped CSS url()",
+			in:      `<svg><style>rect { background: u\rl(https://evil.example/x) }</style></svg>`,
+			removed: []string{"evil"},
+		},
+		{
+			name: "local CSS url()",
+			in:   `<svg><rect style="fill: url(#gradient)"/></svg>`,
+			kept: []string{"url(#gradient)"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := sanitizeSVG([]byte(test.in))
+			if err != nil {
+				t.Fatalf("sanitizeSVG() error = %v", err)
+			}
+			for _, s := range test.removed {
+				if strings.Contains(string(out), s) {
+					t.Errorf("sanitizeSVG() = %s, contains %q", out, s)
+				}
+			}
+			for _, s := range test.kept {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("sanitizeSVG() = %s, missing %q", out, s)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeSVGRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"not svg", `<html><body/></html>`},
+		{"multiple roots", `<svg></svg><svg></svg>`},
+		{"unclosed element", `<svg><g></svg>`},
+		{"empty", ``},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := sanitizeSVG([]byte(test.in)); err == nil {
+				t.Fatal("sanitizeSVG() accepted the document")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package gofs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Header carrying a tenant API key, besides the Authorization bearer token
+const apiKeyHeader = "X-API-Key"
+
+// Prefix of tenant API keys, making leaked keys easy to find by scanners
+const apiKeyPrefix = "gofs_"
+
+// API key of a tenant. Only the SHA-256 hash of the key is stored, the key
+// itself is shown once when it is issued.
+type tenantKey struct {
+	Id        string    `bson:"id" json:"id"`
+	Hash      string    `bson:"hash" json:"-"`
+	Role      string    `bson:"role,omitempty" json:"role"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// Get role of the key, keys issued before roles existed are uploaders
+// @return string role
+func (k tenantKey) role() string {
+	if k.Role == "" {
+		return roleUploader
+	}
+	return k.Role
+}
+
+// Tenants recently looked up by API key, by key hash
+var tenantKeyCache sync.Map
+
+// Forget tenants looked up by API key, after keys were revoked or tenants
+// disabled
+func forgetTenantKeys() {
+	tenantKeyCache.Range(func(hash, _ interface{}) bool {
+		tenantKeyCache.Delete(hash)
+		return true
+	})
+}
+
+// Get hash of an API key as stored in the tenant registry
+// @param key string API key
+// @return string hex encoded SHA-256 hash
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate new API key
+// @param role string role of the key
+// @return tenantKey stored key
+// @return string API key, given to the tenant
+func newAPIKey(role string) (tenantKey, string) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return tenantKey{Id: hex.EncodeToString(id), Hash: hashAPIKey(key), Role: role, CreatedAt: time.Now().UTC()}, key
+}
+
+// Get API key of a request from the X-API-Key header or the bearer token.
+// Other bearer tokens, like JWTs, are not API keys.
+// @param c *fiber.Ctx context
+// @return string API key, empty if the request carries none
+func requestAPIKey(c *fiber.Ctx) string {
+	return credentialAPIKey(c.Get(fiber.HeaderAuthorization), c.Get(apiKeyHeader))
+}
+
+// Get tenant API key of the credentials of a request or call
+// @param authorization string Authorization value
+// @param apiKey string X-API-Key value
+// @return string key, empty if there is none
+func credentialAPIKey(authorization string, apiKey string) string {
+	if apiKey != "" {
+		return apiKey
+	}
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found && strings.HasPrefix(token, apiKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// Find enabled tenant owning an API key, through the in-memory cache.
+// Revoked keys are rejected by other instances after at most tenantCacheTTL.
+// @param ctx context.Context
+// @param key string API key
+// @return *tenant tenant, nil if the key is unknown or its tenant disabled
+// @return tenantKey stored key
+// @return error error
+func findTenantByKey(ctx context.Context, key string) (*tenant, tenantKey, error) {
+	hash := hashAPIKey(key)
+	var t *tenant
+	if cached, ok := tenantKeyCache.Load(hash); ok && time.Now().Before(cached.(cachedTenant).expires) {
+		t = cached.(cachedTenant).tenant
+	} else {
+		err := withRetry(ctx, func() error {
+			var found tenant
+			err := tenantCollection(database()).FindOne(ctx, bson.M{"keys.hash": hash, "disabled": bson.M{"$ne": true}}).Decode(&found)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				t = nil
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			t = &found
+			return nil
+		})
+		if err != nil {
+			return nil, tenantKey{}, err
+		}
+		tenantKeyCache.Store(hash, cachedTenant{tenant: t, expires: time.Now().Add(tenantCacheTTL)})
+	}
+
+	if t == nil {
+		return nil, tenantKey{}, nil
+	}
+	for _, k := range t.Keys {
+		if k.Hash == hash {
+			return t, k, nil
+		}
+	}
+	return t, tenantKey{}, nil
+}
+
+// Request body of the API key endpoint
+type tenantKeyRequest struct {
+	Role           string `json:"role"`
+	RevokeExisting bool   `json:"revokeExisting"`
+}
+
+// Register tenant API key routes on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerTenantKeyRoutes(admin fiber.Router) {
+	// Issue API key of a tenant. Rotate keys by issuing a new one, moving
+	// clients over and revoking the old one, or at once with revokeExisting.
+	// @param id string
+	// @param role string reader, uploader or admin of the tenant, uploader by
+	// default
+	// @param revokeExisting bool
+	// @return key, shown only once
+	admin.Post("/tenants/:id/keys", func(c *fiber.Ctx) error {
+		var body tenantKeyRequest
+		if c.Request().Header.ContentLength() != 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		if body.Role == "" {
+			body.Role = roleUploader
+		}
+		if !validRole(body.Role) {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid role "+body.Role)
+		}
+
+		stored, key := newAPIKey(body.Role)
+		update := bson.M{"$push": bson.M{"keys": stored}}
+		if body.RevokeExisting {
+			update = bson.M{"$set": bson.M{"keys": []tenantKey{stored}}}
+		}
+		result, err := tenantCollection(database()).UpdateOne(c.Context(), bson.M{"_id": c.Params("id")}, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return newError(fiber.StatusNotFound, CodeTenantNotFound, "Unknown tenant "+c.Params("id"))
+		}
+		if body.RevokeExisting {
+			forgetTenantKeys()
+		}
+
+		return respond(c, fiber.StatusCreated, "API key issued successfully", "key", fiber.Map{
+			"id":        stored.Id,
+			"key":       key,
+			"role":      stored.Role,
+			"createdAt": stored.CreatedAt,
+		})
+	})
+
+	// Revoke API key of a tenant
+	// @param id string
+	// @param keyId string
+	// @return success message
+	admin.Delete("/tenants/:id/keys/:keyId", func(c *fiber.Ctx) error {
+		result, err := tenantCollection(database()).UpdateOne(c.Context(),
+			bson.M{"_id": c.Params("id"), "keys.id": c.Params("keyId")},
+			bson.M{"$pull": bson.M{"keys": bson.M{"id": c.Params("keyId")}}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Unknown API key "+c.Params("keyId"))
+		}
+		forgetTenantKeys()
+		return respond(c, fiber.StatusOK, "API key revoked successfully", "", nil)
+	})
+}
@@ -0,0 +1,306 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long tenants read from the registry are kept in memory. Disabling a
+// tenant takes effect on other instances after at most this long.
+const tenantCacheTTL = 30 * time.Second
+
+// Tenant of a multi-tenant deployment, stored in the tenant registry
+type tenant struct {
+	Id        string      `bson:"_id" json:"id"`
+	Database  string      `bson:"database" json:"database"`
+	Disabled  bool        `bson:"disabled" json:"disabled"`
+	Keys      []tenantKey `bson:"keys,omitempty" json:"keys"`
+	CreatedAt time.Time   `bson:"createdAt" json:"createdAt"`
+}
+
+// Context key of the tenant of a request. Like the bucket it is kept in the
+// locals of REST requests, see bucketContextKey.
+type tenantContextKey struct{}
+
+// Tenant read from the registry with its expiry time
+type cachedTenant struct {
+	tenant  *tenant
+	expires time.Time
+}
+
+// Tenants recently read from the registry, by id
+var tenantCache sync.Map
+
+// Open tenant registry collection, kept in the default database
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func tenantCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(config.TenantCollection)
+}
+
+// Get tenant a request or background job works on
+// @param ctx context.Context
+// @return *tenant tenant, nil for the default database
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// Get context working on the database of a tenant
+// @param ctx context.Context
+// @param t *tenant tenant, nil for the default database
+// @return context.Context context
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, t)
+}
+
+// Get name of the database a request works on
+// @param ctx context.Context
+// @return string database name
+func databaseName(ctx context.Context) string {
+	if t := tenantFromContext(ctx); t != nil {
+		return t.Database
+	}
+	return config.DatabaseName
+}
+
+// Get database handle of the tenant a request works on, see tenantFromContext
+// @param ctx context.Context
+// @return *mongo.Database database
+func requestDatabase(ctx context.Context) *mongo.Database {
+	return mongoClient().Database(databaseName(ctx))
+}
+
+// Get default database of a new tenant
+// @param id string tenant id
+// @return string database name
+func tenantDatabaseName(id string) string {
+	return config.DatabaseName + "-" + id
+}
+
+// Find enabled tenant in the registry, through the in-memory cache
+// @param ctx context.Context
+// @param id string tenant id
+// @return *tenant tenant, nil if unknown or disabled
+// @return error error
+func findTenant(ctx context.Context, id string) (*tenant, error) {
+	if cached, ok := tenantCache.Load(id); ok && time.Now().Before(cached.(cachedTenant).expires) {
+		return cached.(cachedTenant).tenant, nil
+	}
+
+	var t *tenant
+	err := withRetry(ctx, func() error {
+		var found tenant
+		err := tenantCollection(database()).FindOne(ctx, bson.M{"_id": id, "disabled": bson.M{"$ne": true}}).Decode(&found)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			t = nil
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t = &found
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tenantCache.Store(id, cachedTenant{tenant: t, expires: time.Now().Add(tenantCacheTTL)})
+	return t, nil
+}
+
+// Get enabled tenants, for the background services working on all databases
+// @param ctx context.Context
+// @return []*tenant tenants, starting with nil for the default database
+// @return error error
+func managedTenants(ctx context.Context) ([]*tenant, error) {
+	tenants := []*tenant{nil}
+	if config.TenantMode == "" {
+		return tenants, nil
+	}
+	cursor, err := tenantCollection(database()).Find(ctx, bson.M{"disabled": bson.M{"$ne": true}}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return tenants, err
+	}
+	var registered []*tenant
+	if err := cursor.All(ctx, &registered); err != nil {
+		return tenants, err
+	}
+	return append(tenants, registered...), nil
+}
+
+// Get tenant id of a request from the tenant header or the subdomain of
+// TENANT_DOMAIN, e.g. acme for acme.files.example.com
+// @param c *fiber.Ctx context
+// @return string tenant id, empty if the request names none
+func requestTenantId(c *fiber.Ctx) string {
+	switch config.TenantMode {
+	case "header":
+		return c.Get(config.TenantHeader)
+	case "subdomain":
+		subdomain, found := strings.CutSuffix(strings.ToLower(c.Hostname()), "."+config.TenantDomain)
+		if found && !strings.Contains(subdomain, ".") {
+			return subdomain
+		}
+	}
+	return ""
+}
+
+// Select the tenant named by the request, or the tenant its credentials are
+// bound to, for the following handlers. Requests of unknown or disabled
+// tenants, requests naming none and credentials of other tenants are
+// rejected.
+// @param c *fiber.Ctx context
+// @return error error
+func selectTenant(c *fiber.Ctx) error {
+	if config.TenantMode == "header" {
+		// Responses differ by tenant, shared caches must keep them apart
+		c.Vary(config.TenantHeader)
+	}
+	t, err := resolveTenant(c.Context(), requestTenantId(c), principalFromContext(c.Context()))
+	if err != nil {
+		return unauthorized(c, err)
+	}
+	c.Locals(tenantContextKey{}, t)
+	return c.Next()
+}
+
+// Get tenant a request or call works on: the one it names, or the one its
+// credentials are bound to
+// @param ctx context.Context
+// @param id string tenant named by the request, empty if it names none
+// @param p *principal principal of the request
+// @return *tenant tenant
+// @return error error if the tenant is unknown or disabled, missing, or the
+// credentials belong to another one
+func resolveTenant(ctx context.Context, id string, p *principal) (*tenant, error) {
+	switch {
+	case p != nil && p.Tenant != "":
+		if id == "" {
+			id = p.Tenant
+		} else if id != p.Tenant {
+			return nil, fiber.NewError(fiber.StatusForbidden, "Credentials belong to another tenant")
+		}
+	case config.RequireTenantKey && (p == nil || !p.globalAdmin()):
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "API key required")
+	}
+	if id == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Missing tenant")
+	}
+	if !validBucketName(id) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid tenant "+id)
+	}
+	t, err := findTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, newError(fiber.StatusNotFound, CodeTenantNotFound, "Unknown tenant "+id)
+	}
+	return t, nil
+}
+
+// Register middleware selecting the tenant of file service requests, if
+// multi-tenancy is enabled
+// @param app *fiber.App app
+func registerTenantMiddleware(app *fiber.App) {
+	if config.TenantMode == "" {
+		return
+	}
+	app.Use("/api", selectTenant)
+	app.Use("/graphql", selectTenant)
+}
+
+// Request body of the tenant registration endpoint
+type tenantRequest struct {
+	Database string `json:"database"`
+}
+
+// Register tenant registry routes on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerTenantRoutes(admin fiber.Router) {
+	// List registered tenants, disabled ones included
+	// @return tenants
+	admin.Get("/tenants", func(c *fiber.Ctx) error {
+		cursor, err := tenantCollection(database()).Find(c.Context(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		tenants := []tenant{}
+		if err := cursor.All(c.Context(), &tenants); err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Tenants fetched successfully", "tenants", tenants)
+	})
+
+	// Register tenant, or enable it again, and create the indexes of its
+	// database. The database defaults to <DATABASE_NAME>-<id>.
+	// @param id string
+	// @param database string
+	// @return tenant
+	admin.Put("/tenants/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		if !validBucketName(id) {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid tenant id")
+		}
+		var body tenantRequest
+		if c.Request().Header.ContentLength() != 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+		if body.Database == "" {
+			body.Database = tenantDatabaseName(id)
+		}
+		if !validDatabaseName(body.Database) || body.Database == config.DatabaseName {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid database "+body.Database)
+		}
+
+		// Each database belongs to one tenant only
+		count, err := tenantCollection(database()).CountDocuments(c.Context(), bson.M{"database": body.Database, "_id": bson.M{"$ne": id}})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fiber.NewError(fiber.StatusConflict, "Database already belongs to another tenant")
+		}
+
+		var t tenant
+		err = tenantCollection(database()).FindOneAndUpdate(c.Context(), bson.M{"_id": id}, bson.M{
+			"$set":         bson.M{"database": body.Database, "disabled": false},
+			"$setOnInsert": bson.M{"createdAt": time.Now().UTC()},
+		}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&t)
+		if err != nil {
+			return err
+		}
+		tenantCache.Delete(id)
+		ensureIndexes(mongoClient().Database(t.Database))
+
+		return respond(c, fiber.StatusOK, "Tenant registered successfully", "tenant", t)
+	})
+
+	// Disable tenant. Its database is kept, registering the tenant again
+	// enables it.
+	// @param id string
+	// @return success message
+	admin.Delete("/tenants/:id", func(c *fiber.Ctx) error {
+		result, err := tenantCollection(database()).UpdateOne(c.Context(), bson.M{"_id": c.Params("id")}, bson.M{"$set": bson.M{"disabled": true}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return newError(fiber.StatusNotFound, CodeTenantNotFound, "Unknown tenant "+c.Params("id"))
+		}
+		tenantCache.Delete(c.Params("id"))
+		forgetTenantKeys()
+		return respond(c, fiber.StatusOK, "Tenant disabled successfully", "", nil)
+	})
+}
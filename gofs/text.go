@@ -0,0 +1,150 @@
+package gofs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Bytes of a text file read at most for its upload check with
+// IMAGE_VERIFICATION header, and for previews
+const maxTextPreviewBytes = 64 * 1024
+
+// Lines of text previews
+const (
+	defaultPreviewLines = 20
+	maxPreviewLines     = 1000
+)
+
+// Check if a file is a text file
+// @param fileDoc bson.M files document
+// @return bool text
+func isTextFile(fileDoc bson.M) bool {
+	contentType := contentTypes[fileExtension(fileDoc)]
+	return strings.HasPrefix(contentType, "text/") || contentType == "application/json"
+}
+
+// Cut a rune split at the end of text read up to a size limit
+// @param data []byte
+// @return []byte data ending with a complete rune
+func trimPartialRune(data []byte) []byte {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// Check if data is UTF-8 text without NUL bytes, which only binary files
+// have
+// @param data []byte
+// @return bool text
+func validText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// Inspect uploaded text file. With IMAGE_VERIFICATION header its first
+// 64 KiB have to be UTF-8 text, with decode all of it, and JSON files have
+// to be valid JSON.
+// @param content io.Reader upload content
+// @param ext string file extension
+// @return io.Reader content
+// @return error unprocessable entity error if the content is not text
+func inspectText(content io.Reader, ext string) (io.Reader, error) {
+	invalid := newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not valid UTF-8 text")
+	switch config.ImageVerification {
+	case verifyNone:
+		return content, nil
+	case verifyHeader:
+		head := make([]byte, maxTextPreviewBytes)
+		n, err := io.ReadFull(content, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		head = head[:n]
+		if !validText(trimPartialRune(head)) {
+			return nil, invalid
+		}
+		return io.MultiReader(bytes.NewReader(head), content), nil
+	}
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	if !validText(data) {
+		return nil, invalid
+	}
+	if ext == ".json" && !json.Valid(data) {
+		return nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not valid JSON")
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Send the first lines of a text file, read up to 64 KiB, as text or as
+// JSON. Invalid UTF-8 is replaced, the Truncated field or the
+// X-Preview-Truncated header tells if the file goes on.
+// @param c *fiber.Ctx context
+// @param fileDoc bson.M files document
+// @return error error
+func sendTextPreview(c *fiber.Ctx, fileDoc bson.M) error {
+	v := &validation.Validator{}
+	lines := v.Int(validation.Query, "lines", c.Query("lines"), defaultPreviewLines, 1, maxPreviewLines)
+	format := c.Query("format", "text")
+	v.OneOf(validation.Query, "format", format, "text", "json")
+	if err := v.Err(); err != nil {
+		return err
+	}
+
+	reader, err := fileStorage().Get(c.Context(), fileDoc["_id"].(primitive.ObjectID))
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxTextPreviewBytes+1))
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	capped := len(data) > maxTextPreviewBytes
+	if capped {
+		data = trimPartialRune(data[:maxTextPreviewBytes])
+	}
+
+	text := strings.ToValidUTF8(string(data), "�")
+	parts := strings.Split(text, "\n")
+	if parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	truncated := capped || len(parts) > lines
+	parts = parts[:min(lines, len(parts))]
+	for i, part := range parts {
+		parts[i] = strings.TrimSuffix(part, "\r")
+	}
+
+	c.Set(fiber.HeaderCacheControl, cacheControl(BucketFromContext(c.Context()), fileDoc))
+	if format == "json" {
+		return respond(c, fiber.StatusOK, "Preview fetched successfully", "preview", fiber.Map{
+			"lines":     parts,
+			"truncated": truncated,
+		})
+	}
+	c.Set(fiber.HeaderContentType, "text/plain; charset=utf-8")
+	c.Set("X-Preview-Truncated", strconv.FormatBool(truncated))
+	setSecurityHeaders(c)
+	if len(parts) == 0 {
+		return c.SendString("")
+	}
+	return c.SendString(strings.Join(parts, "\n") + "\n")
+}
@@ -0,0 +1,153 @@
+package gofs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// TLS versions of the TLS_MIN_VERSION setting
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Certificate loaded from files, reloaded when they change so renewed
+// certificates are served without restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// Get latest modification time of the certificate and key files
+// @return time.Time modification time
+// @return error error
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Load certificate and key files
+// @return error error
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// Get certificate for a TLS handshake, reloading the files if they changed
+// since the last check. A certificate failing to load is logged and the
+// previous one kept, the files may be half written.
+// @param hello *tls.ClientHelloInfo
+// @return *tls.Certificate certificate
+// @return error error
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	if modTime, err := r.filesModTime(); err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	if err := r.load(); err != nil {
+		logger.Error("reload TLS certificate", "cert_file", r.certFile, "error", err)
+		return r.cert, nil
+	}
+	logger.Info("reloaded TLS certificate", "cert_file", r.certFile)
+	return r.cert, nil
+}
+
+// Get TLS configuration of the HTTP server from TLS_CERT_FILE and
+// TLS_KEY_FILE, or from ACME if ACME_DOMAINS is set. The files are reloaded
+// when they change.
+// @param cfg Config configuration
+// @return *tls.Config TLS configuration, nil if TLS is not configured
+// @return error error loading the certificate
+func TLSConfig(cfg Config) (*tls.Config, error) {
+	if len(cfg.ACMEDomains) > 0 {
+		return acmeTLSConfig(cfg), nil
+	}
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	reloader := &certReloader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile, checked: time.Now()}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tlsVersions[cfg.TLSMinVersion],
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}, nil
+}
+
+// Get TLS configuration obtaining and renewing certificates of ACME_DOMAINS
+// from the ACME CA, Let's Encrypt by default. Certificates are requested on
+// the first handshake for a domain and cached in ACME_CACHE_DIR. Serves the
+// HTTP-01 challenges on ACME_HTTP_ADDR, redirecting all other HTTP requests
+// to HTTPS.
+// @param cfg Config configuration
+// @return *tls.Config TLS configuration
+func acmeTLSConfig(cfg Config) *tls.Config {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+
+	server := &http.Server{Addr: cfg.ACMEHTTPAddr, Handler: manager.HTTPHandler(nil)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("acme http server stopped", "error", err)
+		}
+	}()
+	onShutdown(func(ctx context.Context) {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	})
+
+	return &tls.Config{
+		MinVersion:     tlsVersions[cfg.TLSMinVersion],
+		GetCertificate: manager.GetCertificate,
+		// fasthttp does not speak HTTP/2, unlike the defaults of autocert
+		NextProtos: []string{"http/1.1", acme.ALPNProto},
+	}
+}
@@ -0,0 +1,443 @@
+package gofs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Limits of image transforms
+const (
+	// Operations of one pipeline
+	maxTransformOps = 10
+	// Width and height of resized and cropped images
+	maxTransformDimension = 8192
+	// Pixels of images which are decoded, larger ones are rejected
+	maxTransformPixels = 50 * 1000 * 1000
+	// JPEG quality without quality operation
+	defaultTransformQuality = 85
+)
+
+// Image formats transforms read and write, by file extension
+var transformFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+}
+
+// Transforms running at once, decoded images take a lot of memory
+var transformSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+var (
+	// In-memory cache of transformed images
+	transformResults     *lruCache
+	transformResultsOnce sync.Once
+)
+
+// Get cache of transformed images, created on first use. Transforms are
+// too costly to repeat on every request, so they are cached even without
+// MEMORY_CACHE_BYTES.
+// @return *lruCache cache
+func transformCache() *lruCache {
+	transformResultsOnce.Do(func() {
+		transformResults = newLRUCache(config.TransformCacheBytes, config.TransformCacheBytes/8)
+	})
+	return transformResults
+}
+
+// Image operation of a transform pipeline
+type transformOp func(img *image.NRGBA) *image.NRGBA
+
+// Parsed transform pipeline, e.g. resize:800x0,grayscale,quality:80
+type transformPipeline struct {
+	ops []transformOp
+	// Output format, as named by image.DecodeConfig
+	format string
+	// JPEG quality
+	quality int
+	// Normalized pipeline, the same for all spellings of the same operations
+	key string
+}
+
+// Parse transform pipeline: comma separated operations applied in order.
+// Operations are resize:WxH (0 keeps the aspect ratio), crop:WxH (centered),
+// rotate:90|180|270 (clockwise), flip:h|v, grayscale, format:jpeg|png and
+// quality:1-100 (JPEG output).
+// @param spec string
+// @param sourceFormat string format of the file, see transformFormats
+// @return *transformPipeline pipeline
+// @return error bad request error if an operation is unknown or invalid
+func parseTransforms(spec, sourceFormat string) (*transformPipeline, error) {
+	pipeline := &transformPipeline{format: sourceFormat}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxTransformOps {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("At most %d transform operations are allowed", maxTransformOps))
+	}
+	var keys []string
+	quality := 0
+	for _, part := range parts {
+		name, arg, _ := strings.Cut(strings.ToLower(strings.TrimSpace(part)), ":")
+		invalid := fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid transform operation %q", part))
+		switch name {
+		case "resize", "crop":
+			width, height, ok := parseTransformSize(arg)
+			if !ok || (name == "crop" && (width == 0 || height == 0)) {
+				return nil, invalid
+			}
+			if name == "resize" {
+				pipeline.ops = append(pipeline.ops, func(img *image.NRGBA) *image.NRGBA { return resizeImage(img, width, height) })
+			} else {
+				pipeline.ops = append(pipeline.ops, func(img *image.NRGBA) *image.NRGBA { return cropImage(img, width, height) })
+			}
+			arg = strconv.Itoa(width) + "x" + strconv.Itoa(height)
+		case "rotate":
+			if arg != "90" && arg != "180" && arg != "270" {
+				return nil, invalid
+			}
+			turns, _ := strconv.Atoi(arg)
+			pipeline.ops = append(pipeline.ops, func(img *image.NRGBA) *image.NRGBA { return rotateImage(img, turns/90) })
+		case "flip":
+			if arg != "h" && arg != "v" {
+				return nil, invalid
+			}
+			horizontal := arg == "h"
+			pipeline.ops = append(pipeline.ops, func(img *image.NRGBA) *image.NRGBA { return flipImage(img, horizontal) })
+		case "grayscale":
+			if arg != "" {
+				return nil, invalid
+			}
+			pipeline.ops = append(pipeline.ops, grayscaleImage)
+		case "format":
+			if arg != "jpeg" && arg != "png" {
+				return nil, invalid
+			}
+			pipeline.format = arg
+		case "quality":
+			value, err := strconv.Atoi(arg)
+			if err != nil || value < 1 || value > 100 {
+				return nil, invalid
+			}
+			quality = value
+			arg = strconv.Itoa(value)
+		default:
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown transform operation %q, expected resize, crop, rotate, flip, grayscale, format or quality", name))
+		}
+		if arg != "" {
+			name += ":" + arg
+		}
+		keys = append(keys, name)
+	}
+	if quality > 0 && pipeline.format != "jpeg" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Transform operation quality needs JPEG output")
+	}
+	pipeline.quality = quality
+	if pipeline.quality == 0 {
+		pipeline.quality = defaultTransformQuality
+	}
+	pipeline.key = strings.Join(keys, ",")
+	return pipeline, nil
+}
+
+// Parse WxH size of a transform operation
+// @param arg string
+// @return int width, 0 to keep the aspect ratio
+// @return int height, 0 to keep the aspect ratio
+// @return bool valid
+func parseTransformSize(arg string) (int, int, bool) {
+	w, h, found := strings.Cut(arg, "x")
+	width, err := strconv.Atoi(w)
+	if !found || err != nil {
+		return 0, 0, false
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, 0, false
+	}
+	valid := width >= 0 && height >= 0 && width <= maxTransformDimension && height <= maxTransformDimension && width+height > 0
+	return width, height, valid
+}
+
+// Get rendition of an image made by a transform pipeline, cached under the
+// normalized pipeline
+// @param fileDoc bson.M files document
+// @param spec string pipeline
+// @return rendition rendition
+// @return error bad request error if the pipeline is invalid, unsupported
+// media type error if the file can't be transformed
+func transformRendition(fileDoc bson.M, spec string) (rendition, error) {
+	sourceFormat, ok := transformFormats[fileExtension(fileDoc)]
+	if !ok {
+		return rendition{}, fiber.NewError(fiber.StatusUnsupportedMediaType, "Only JPEG, PNG and GIF images can be transformed")
+	}
+	pipeline, err := parseTransforms(spec, sourceFormat)
+	if err != nil {
+		return rendition{}, err
+	}
+	ext := "." + pipeline.format
+	if pipeline.format == "jpeg" {
+		ext = ".jpg"
+	}
+	return rendition{name: "t:" + pipeline.key, transform: pipeline.apply, cache: transformCache(), format: pipeline.format, ext: ext}, nil
+}
+
+// Decode image, apply the operations and encode the result
+// @param content []byte
+// @return []byte transformed image
+// @return error unprocessable entity error if the image is corrupt or too
+// large, or other errors
+func (p *transformPipeline) apply(content []byte) ([]byte, error) {
+	transformSlots <- struct{}{}
+	defer func() { <-transformSlots }()
+
+	header, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Image can't be decoded: "+err.Error())
+	}
+	if header.Width*header.Height > maxTransformPixels {
+		return nil, newError(fiber.StatusUnprocessableEntity, CodeImageTooLarge, fmt.Sprintf("Image of %dx%d pixels is too large to transform", header.Width, header.Height))
+	}
+	// Decoding keeps the first frame only, the animation would be lost
+	if animatedGIF(content) {
+		return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "Animated GIFs can't be transformed")
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Image can't be decoded: "+err.Error())
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	for _, op := range p.ops {
+		img = op(img)
+	}
+
+	var out bytes.Buffer
+	switch p.format {
+	case "jpeg":
+		// JPEG has no transparency, transparent pixels turn white
+		flat := image.NewNRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, image.Point{}, draw.Over)
+		err = jpeg.Encode(&out, flat, &jpeg.Options{Quality: p.quality})
+	case "png":
+		err = png.Encode(&out, img)
+	case "gif":
+		err = gif.Encode(&out, img, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Check if content is a GIF with more than one frame, by walking its blocks
+// without decoding them
+// @param content []byte
+// @return bool animated
+func animatedGIF(content []byte) bool {
+	// Header and logical screen descriptor, followed by the global color table
+	if len(content) < 13 || !bytes.HasPrefix(content, []byte("GIF")) {
+		return false
+	}
+	offset := 13
+	if content[10]&0x80 != 0 {
+		offset += 3 << (content[10]&0x07 + 1)
+	}
+	// Skip sub-blocks up to their terminator
+	skipSubBlocks := func() {
+		for offset < len(content) && content[offset] != 0 {
+			offset += int(content[offset]) + 1
+		}
+		offset++
+	}
+
+	frames := 0
+	for offset < len(content) {
+		switch content[offset] {
+		case 0x21:
+			// Extension: introducer, label and sub-blocks
+			offset += 2
+			skipSubBlocks()
+		case 0x2c:
+			// Image descriptor, local color table, LZW code size and data
+			if frames++; frames > 1 {
+				return true
+			}
+			if offset+10 > len(content) {
+				return false
+			}
+			if content[offset+9]&0x80 != 0 {
+				offset += 3 << (content[offset+9]&0x07 + 1)
+			}
+			offset += 11
+			skipSubBlocks()
+		default:
+			// Trailer or corrupt data
+			return false
+		}
+	}
+	return false
+}
+
+// Resize image with a triangle filter widened when shrinking, so all source
+// pixels contribute
+// @param img *image.NRGBA
+// @param width int 0 keeps the aspect ratio
+// @param height int 0 keeps the aspect ratio
+// @return *image.NRGBA resized image
+func resizeImage(img *image.NRGBA, width, height int) *image.NRGBA {
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	if width == 0 {
+		width = max(1, int(math.Round(float64(srcWidth)*float64(height)/float64(srcHeight))))
+	}
+	if height == 0 {
+		height = max(1, int(math.Round(float64(srcHeight)*float64(width)/float64(srcWidth))))
+	}
+	width, height = min(width, maxTransformDimension), min(height, maxTransformDimension)
+	if width == srcWidth && height == srcHeight {
+		return img
+	}
+	return resampleAxis(resampleAxis(img, width, true), height, false)
+}
+
+// Resample image along one axis
+// @param img *image.NRGBA
+// @param size int new width or height
+// @param horizontal bool resample the width
+// @return *image.NRGBA resampled image
+func resampleAxis(img *image.NRGBA, size int, horizontal bool) *image.NRGBA {
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	srcSize, lines := srcWidth, srcHeight
+	dst := image.NewNRGBA(image.Rect(0, 0, size, srcHeight))
+	if !horizontal {
+		srcSize, lines = srcHeight, srcWidth
+		dst = image.NewNRGBA(image.Rect(0, 0, srcWidth, size))
+	}
+	// Offset of pixel i of line j in the pixel slices
+	srcOffset := func(i, j int) int { return j*img.Stride + i*4 }
+	dstOffset := func(i, j int) int { return j*dst.Stride + i*4 }
+	if !horizontal {
+		srcOffset = func(i, j int) int { return i*img.Stride + j*4 }
+		dstOffset = func(i, j int) int { return i*dst.Stride + j*4 }
+	}
+
+	scale := float64(srcSize) / float64(size)
+	radius := max(scale, 1)
+	for i := 0; i < size; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		from := max(int(math.Ceil(center-radius)), 0)
+		to := min(int(math.Floor(center+radius)), srcSize-1)
+		for j := 0; j < lines; j++ {
+			var r, g, b, a, total float64
+			for k := from; k <= to; k++ {
+				weight := 1 - math.Abs(float64(k)-center)/radius
+				if weight <= 0 {
+					continue
+				}
+				pixel := img.Pix[srcOffset(k, j):]
+				// Colors are weighted by alpha, transparent pixels don't bleed
+				alpha := float64(pixel[3]) * weight
+				r += float64(pixel[0]) * alpha
+				g += float64(pixel[1]) * alpha
+				b += float64(pixel[2]) * alpha
+				a += alpha
+				total += weight
+			}
+			pixel := dst.Pix[dstOffset(i, j):]
+			if a > 0 {
+				pixel[0] = uint8(math.Round(r / a))
+				pixel[1] = uint8(math.Round(g / a))
+				pixel[2] = uint8(math.Round(b / a))
+			}
+			if total > 0 {
+				pixel[3] = uint8(math.Round(a / total))
+			}
+		}
+	}
+	return dst
+}
+
+// Crop the center of an image, at most the whole image
+// @param img *image.NRGBA
+// @param width int
+// @param height int
+// @return *image.NRGBA cropped image
+func cropImage(img *image.NRGBA, width, height int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height = min(width, bounds.Dx()), min(height, bounds.Dy())
+	left := bounds.Min.X + (bounds.Dx()-width)/2
+	top := bounds.Min.Y + (bounds.Dy()-height)/2
+	cropped := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Bounds(), img, image.Pt(left, top), draw.Src)
+	return cropped
+}
+
+// Rotate image clockwise by quarter turns
+// @param img *image.NRGBA
+// @param turns int 1 to 3
+// @return *image.NRGBA rotated image
+func rotateImage(img *image.NRGBA, turns int) *image.NRGBA {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	rotated := image.NewNRGBA(image.Rect(0, 0, height, width))
+	if turns == 2 {
+		rotated = image.NewNRGBA(image.Rect(0, 0, width, height))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch turns {
+			case 1:
+				dx, dy = height-1-y, x
+			case 2:
+				dx, dy = width-1-x, height-1-y
+			default:
+				dx, dy = y, width-1-x
+			}
+			copy(rotated.Pix[dy*rotated.Stride+dx*4:][:4], img.Pix[y*img.Stride+x*4:][:4])
+		}
+	}
+	return rotated
+}
+
+// Mirror image
+// @param img *image.NRGBA
+// @param horizontal bool mirror left and right, top and bottom otherwise
+// @return *image.NRGBA flipped image
+func flipImage(img *image.NRGBA, horizontal bool) *image.NRGBA {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	flipped := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := width-1-x, y
+			if !horizontal {
+				dx, dy = x, height-1-y
+			}
+			copy(flipped.Pix[dy*flipped.Stride+dx*4:][:4], img.Pix[y*img.Stride+x*4:][:4])
+		}
+	}
+	return flipped
+}
+
+// Convert image to shades of gray, keeping its transparency
+// @param img *image.NRGBA
+// @return *image.NRGBA gray image
+func grayscaleImage(img *image.NRGBA) *image.NRGBA {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		// Luma weights of ITU-R BT.601, like color.GrayModel
+		y := (19595*uint32(img.Pix[i]) + 38470*uint32(img.Pix[i+1]) + 7471*uint32(img.Pix[i+2]) + 1<<15) >> 16
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = uint8(y), uint8(y), uint8(y)
+	}
+	return img
+}
@@ -0,0 +1,538 @@
+package gofs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Options of a new upload read from the request
+type uploadOptions struct {
+	// Virtual folder the file is placed in
+	Folder string
+	// Filename collision policy
+	Collision string
+	// Custom metadata fields
+	Custom map[string]interface{}
+	// Expiry time, nil if the file never expires
+	ExpiresAt *time.Time
+	// Actor uploading the file, see auditSource
+	Owner string
+	// Persistence progress reported to subscribers, nil if not tracked
+	Progress *uploadProgress
+	// GridFS chunk size, 0 for the configured one
+	ChunkSize int32
+	// Digests the content must have, nil if the client sent none
+	Checksum *uploadChecksum
+	// Upload is a new version of an existing file, hooks can't rename it
+	Revision bool
+}
+
+// Largest total size of the form fields of a streamed upload
+const maxStreamedFormBytes = 1024 * 1024
+
+// Fields shared by uploads sent as JSON instead of a multipart form
+type jsonUpload struct {
+	Filename  string                 `json:"filename"`
+	Folder    string                 `json:"folder"`
+	Collision string                 `json:"collision"`
+	ExpiresAt string                 `json:"expiresAt"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	ChunkSize int                    `json:"chunkSize"`
+}
+
+// Parse GridFS chunk size requested for an upload
+// @param size int chunk size in bytes, 0 for the configured one
+// @return int32 chunk size
+// @return error error
+func parseChunkSize(size int) (int32, error) {
+	if size != 0 && !validChunkSize(size) {
+		return 0, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("chunkSize must be between %d and %d bytes", minChunkSize, maxChunkSize))
+	}
+	return int32(size), nil
+}
+
+// Read upload options from multipart form fields
+// @param c *fiber.Ctx context
+// @return uploadOptions options
+// @return error error
+func formUploadOptions(c *fiber.Ctx) (uploadOptions, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return uploadOptions{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	opts, err := fieldUploadOptions(c, form.Value)
+	if err != nil {
+		return uploadOptions{}, err
+	}
+
+	// Progress covers all files of the form
+	if opts.Progress != nil {
+		var total int64
+		for _, fileHeaders := range form.File {
+			for _, fileHeader := range fileHeaders {
+				total += fileHeader.Size
+			}
+		}
+		opts.Progress.total.Store(total)
+	}
+	return opts, nil
+}
+
+// Read upload options from form field values. Query parameters take
+// precedence, like with FormValue.
+// @param c *fiber.Ctx context
+// @param form map[string][]string form field values
+// @return uploadOptions options
+// @return error error
+func fieldUploadOptions(c *fiber.Ctx, form map[string][]string) (uploadOptions, error) {
+	value := func(key string) string {
+		if query := c.Query(key); query != "" {
+			return query
+		}
+		if values := form[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	// Report all invalid fields at once
+	v := &validation.Validator{}
+	custom, err := uploadMetadata(form)
+	v.Merge(validation.Form, "metadata", err)
+	expiresAt, err := parseExpiry(value("expiresAt"))
+	v.Merge(validation.Form, "expiresAt", err)
+	collision, err := collisionPolicy(value("collision"))
+	v.Merge(validation.Form, "collision", err)
+	requestedChunkSize := v.Int(validation.Form, "chunkSize", value("chunkSize"), 0, minChunkSize, maxChunkSize)
+	chunkSize, err := parseChunkSize(requestedChunkSize)
+	v.Merge(validation.Form, "chunkSize", err)
+	if _, err := cleanFolder(value("folder")); err != nil {
+		v.Merge(validation.Form, "folder", err)
+	}
+	checksum := requestChecksum(c, v)
+	if err := v.Err(); err != nil {
+		return uploadOptions{}, err
+	}
+
+	return uploadOptions{
+		Folder:    value("folder"),
+		Collision: collision,
+		Custom:    custom,
+		ExpiresAt: expiresAt,
+		Progress:  requestProgress(c),
+		ChunkSize: chunkSize,
+		Checksum:  checksum,
+	}, nil
+}
+
+// Read upload options from JSON request fields
+// @return uploadOptions options
+// @return error error
+func (body jsonUpload) options() (uploadOptions, error) {
+	custom := body.Metadata
+	if custom == nil {
+		custom = map[string]interface{}{}
+	}
+
+	// Report all invalid fields at once
+	v := &validation.Validator{}
+	v.Merge(validation.Body, "metadata", validateCustomMetadata(custom))
+	expiresAt, err := parseExpiry(body.ExpiresAt)
+	v.Merge(validation.Body, "expiresAt", err)
+	collision, err := collisionPolicy(body.Collision)
+	v.Merge(validation.Body, "collision", err)
+	chunkSize, err := parseChunkSize(body.ChunkSize)
+	v.Merge(validation.Body, "chunkSize", err)
+	if _, err := cleanFolder(body.Folder); err != nil {
+		v.Merge(validation.Body, "folder", err)
+	}
+	if err := v.Err(); err != nil {
+		return uploadOptions{}, err
+	}
+
+	return uploadOptions{
+		Folder:    body.Folder,
+		Collision: collision,
+		Custom:    custom,
+		ExpiresAt: expiresAt,
+		ChunkSize: chunkSize,
+	}, nil
+}
+
+// Store uploaded content, placing it in the requested folder and resolving
+// filename collisions with existing images according to the collision policy.
+// Uploads are recorded in the audit trail, failed ones too.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @param content io.Reader
+// @param opts uploadOptions
+// @return fiber.Map image metadata
+// @return error error
+func storeUpload(ctx context.Context, db *mongo.Database, filename string, content io.Reader, opts uploadOptions) (fiber.Map, error) {
+	opts.Owner = auditSourceFrom(ctx).Actor
+	image, err := storeUploadContent(ctx, db, filename, content, opts)
+	if err != nil {
+		recordAudit(ctx, auditUpload, primitive.NilObjectID, filename, err)
+		return nil, err
+	}
+	recordAudit(ctx, auditUpload, image["id"].(primitive.ObjectID), image["name"].(string), nil)
+	forgetFileDocs(BucketFromContext(ctx))
+	purgeCDN(nameSurrogateKey(BucketFromContext(ctx), image["name"].(string)))
+	replicateFile(ctx, BucketFromContext(ctx), image["id"].(primitive.ObjectID))
+	if isVideoFilename(image["name"].(string)) {
+		transcodeVideo(ctx, BucketFromContext(ctx), image["id"].(primitive.ObjectID))
+	}
+	if isOfficeFilename(image["name"].(string)) {
+		previewDocument(ctx, BucketFromContext(ctx), image["id"].(primitive.ObjectID))
+	}
+	return image, nil
+}
+
+// Store uploaded content, see storeUpload
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @param content io.Reader
+// @param opts uploadOptions
+// @return fiber.Map image metadata
+// @return error error
+func storeUploadContent(ctx context.Context, db *mongo.Database, filename string, content io.Reader, opts uploadOptions) (fiber.Map, error) {
+	// Place file in the requested virtual folder
+	folder, err := cleanFolder(opts.Folder)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	filename = folderPath(folder) + filename
+
+	// Let the registered hooks check, rename or annotate the upload
+	upload := &Upload{Filename: filename, Metadata: opts.Custom, ExpiresAt: opts.ExpiresAt, Owner: opts.Owner}
+	if err := beforeStore(ctx, upload); err != nil {
+		return nil, err
+	}
+	if !opts.Revision {
+		filename = upload.Filename
+	}
+	opts.Custom, opts.ExpiresAt = upload.Metadata, upload.ExpiresAt
+
+	// Check if file is of type image or not
+	fileExtension, err := imageExtension(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateFilename(filename); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	// Digests are of the content as received, stored content may be sanitized
+	content, verified := opts.Checksum.hash(content)
+	content, extracted, err := inspectImage(content, fileExtension)
+	if err != nil {
+		return nil, err
+	}
+	content = verified(content)
+	opts = withExtractedMetadata(opts, extracted)
+
+	// Apply the filename collision policy
+	filename, version, err := resolveCollision(ctx, db, opts.Collision, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := buildFileMetadata(opts, fileExtension, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upload file to the storage backend
+	if opts.ChunkSize > 0 {
+		ctx = withChunkSize(ctx, opts.ChunkSize)
+	}
+	if opts.Progress != nil {
+		content = &progressReader{reader: content, progress: opts.Progress}
+	}
+	fileId, fileSize, err := fileStorage().Put(ctx, filename, content, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Collision {
+	case collisionVersion:
+		err = setCurrentRevision(ctx, db, filename, fileId)
+	case collisionOverwrite:
+		err = deleteOtherRevisions(ctx, db, filename, fileId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	image := fiber.Map{
+		"id":        fileId,
+		"name":      filename,
+		"size":      fileSize,
+		"version":   version,
+		"expiresAt": opts.ExpiresAt,
+		"metadata":  opts.Custom,
+	}
+	afterStore(ctx, FileInfo{Id: fileId, Bucket: BucketFromContext(ctx), Filename: filename, Size: fileSize, Metadata: metadata})
+	publishEvent(eventFileUploaded, image)
+	return image, nil
+}
+
+// Add metadata extracted from the content of an upload to its options.
+// Extracted fields use reserved keys, like document or video.
+// @param opts uploadOptions
+// @param extracted bson.M metadata, see inspectImage
+// @return uploadOptions options
+func withExtractedMetadata(opts uploadOptions, extracted bson.M) uploadOptions {
+	if len(extracted) == 0 {
+		return opts
+	}
+	custom := map[string]interface{}{}
+	for key, value := range opts.Custom {
+		custom[key] = value
+	}
+	for key, value := range extracted {
+		custom[key] = value
+	}
+	opts.Custom = custom
+	return opts
+}
+
+// Validate image uploaded as multipart form file and store it
+// @param c *fiber.Ctx context
+// @param db *mongo.Database database
+// @param fileHeader *multipart.FileHeader
+// @return fiber.Map image metadata
+// @return error error
+func uploadImage(c *fiber.Ctx, db *mongo.Database, fileHeader *multipart.FileHeader) (fiber.Map, error) {
+	opts, err := formUploadOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	defer file.Close()
+
+	return storeUpload(c.Context(), db, fileHeader.Filename, file, opts)
+}
+
+// Register middleware holding streamed request bodies to BODY_LIMIT. With
+// STREAM_REQUEST_BODY fasthttp hands bodies of any size to the handlers,
+// only multipart forms are read as streams, other bodies are read into
+// memory and rejected with 413 past the limit.
+// @param app *fiber.App app
+func registerBodyLimitMiddleware(app *fiber.App) {
+	app.Use(func(c *fiber.Ctx) error {
+		body := c.Context().RequestBodyStream()
+		if body == nil || len(c.Request().Header.MultipartFormBoundary()) > 0 {
+			return c.Next()
+		}
+		// The rest of a rejected body is left unread, so the connection
+		// can't serve further requests
+		if c.Request().Header.ContentLength() > config.BodyLimit {
+			c.Context().SetConnectionClose()
+			return fiber.ErrRequestEntityTooLarge
+		}
+		content, err := io.ReadAll(io.LimitReader(body, int64(config.BodyLimit)+1))
+		if err != nil {
+			c.Context().SetConnectionClose()
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if len(content) > config.BodyLimit {
+			c.Context().SetConnectionClose()
+			return fiber.ErrRequestEntityTooLarge
+		}
+		c.Request().SetBody(content)
+		return c.Next()
+	})
+}
+
+// Check if the upload form of a request can be streamed into the storage
+// backend: with STREAM_REQUEST_BODY fasthttp leaves multipart bodies unread
+// and hands them to handlers as streams
+// @param c *fiber.Ctx context
+// @return io.Reader request body, nil if it is not streamed
+func streamedForm(c *fiber.Ctx) io.Reader {
+	header := &c.Request().Header
+	if len(header.MultipartFormBoundary()) == 0 || len(header.Peek(fiber.HeaderContentEncoding)) > 0 {
+		return nil
+	}
+	return c.Context().RequestBodyStream()
+}
+
+// Store image of a streamed multipart form, copying the "image" part into
+// the storage backend as it is received, so memory use doesn't grow with
+// the file size and nothing is spooled to disk. Form fields are only read
+// before the image part, parts after it are ignored.
+// @param c *fiber.Ctx context
+// @param db *mongo.Database database
+// @param body io.Reader request body
+// @return fiber.Map image metadata
+// @return error error
+func uploadStreamedImage(c *fiber.Ctx, db *mongo.Database, body io.Reader) (fiber.Map, error) {
+	reader := multipart.NewReader(body, string(c.Request().Header.MultipartFormBoundary()))
+	form := map[string][]string{}
+	var formBytes int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "there is no uploaded file associated with the given key")
+		}
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if part.FileName() == "" {
+			// Fields are small, their total is bounded like in ReadForm
+			value, err := io.ReadAll(io.LimitReader(part, maxStreamedFormBytes-formBytes+1))
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+			formBytes += int64(len(value))
+			if formBytes > maxStreamedFormBytes {
+				return nil, fiber.NewError(fiber.StatusRequestEntityTooLarge, "Form fields exceed "+strconv.Itoa(maxStreamedFormBytes)+" bytes")
+			}
+			form[part.FormName()] = append(form[part.FormName()], string(value))
+			continue
+		}
+		if part.FormName() != "image" {
+			continue
+		}
+
+		opts, err := fieldUploadOptions(c, form)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Progress != nil {
+			opts.Progress.total.Store(int64(c.Request().Header.ContentLength()))
+		}
+		image, err := storeUpload(c.Context(), db, part.FileName(), part, opts)
+		// Read the rest of the form, leaving the connection ready for the
+		// next request
+		io.Copy(io.Discard, body)
+		return image, err
+	}
+}
+
+// Request body of uploads sent as base64 encoded JSON
+type base64UploadRequest struct {
+	jsonUpload
+	// Base64 encoded content, optionally as data URL
+	Data string `json:"data"`
+}
+
+// Decode base64 JSON upload while streaming it into GridFS
+// @param c *fiber.Ctx context
+// @param db *mongo.Database database
+// @return fiber.Map image metadata
+// @return error error
+func uploadBase64(c *fiber.Ctx, db *mongo.Database) (fiber.Map, error) {
+	var body base64UploadRequest
+	if err := c.BodyParser(&body); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if body.Filename == "" || body.Data == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "filename and data are required")
+	}
+	opts, err := body.options()
+	if err != nil {
+		return nil, err
+	}
+	v := &validation.Validator{}
+	opts.Checksum = requestChecksum(c, v)
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+
+	// Accept data URLs like data:image/png;base64,iVBORw0...
+	data := body.Data
+	if strings.HasPrefix(data, "data:") {
+		if _, payload, found := strings.Cut(data, ";base64,"); found {
+			data = payload
+		}
+	}
+
+	opts.Progress = requestProgress(c)
+	if opts.Progress != nil {
+		opts.Progress.total.Store(int64(base64.StdEncoding.DecodedLen(len(data))))
+	}
+
+	content := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
+	image, err := storeUpload(c.Context(), db, body.Filename, content, opts)
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid base64 data")
+	}
+	return image, err
+}
+
+// Register multi-file upload route
+// @param app *fiber.App app
+func registerBatchUploadRoutes(app *fiber.App) {
+	// Upload several images sent as "images" parts of one multipart request.
+	// Every file is stored independently, the response lists the result of
+	// each file in request order including why rejected files failed.
+	// @param images files
+	// @return images metadata
+	app.Post("/api/images", trackUploadProgress, func(c *fiber.Ctx) error {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		fileHeaders := form.File["images"]
+		if len(fileHeaders) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "No images in request")
+		}
+		// Digests in headers can only describe a single file
+		if len(fileHeaders) > 1 && hasChecksumHeaders(c) {
+			return fiber.NewError(fiber.StatusBadRequest, "Content-MD5 and "+checksumSHA256Header+" only apply to uploads of one image")
+		}
+
+		db := requestDatabase(c.Context())
+		results := make([]fiber.Map, 0, len(fileHeaders))
+		uploaded := 0
+		for _, fileHeader := range fileHeaders {
+			image, err := uploadImage(c, db, fileHeader)
+			if err != nil {
+				results = append(results, fiber.Map{
+					"name":     fileHeader.Filename,
+					"uploaded": false,
+					"status":   errorStatus(err),
+					"code":     errorCode(err),
+					"error":    err.Error(),
+				})
+				continue
+			}
+
+			image["uploaded"] = true
+			results = append(results, image)
+			uploaded++
+		}
+
+		// 207 signals a partial success, the per-file results tell which ones failed
+		switch uploaded {
+		case len(fileHeaders):
+			return respond(c, fiber.StatusCreated, "Images uploaded successfully", "images", results)
+		case 0:
+			return respond(c, fiber.StatusBadRequest, "No images uploaded", "images", results)
+		default:
+			return respond(c, fiber.StatusMultiStatus, "Some images could not be uploaded", "images", results)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package gofs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Dimensions storage usage can be grouped by, with the expression of the
+// files document they are read from
+var usageDimensions = map[string]interface{}{
+	"owner":       "$metadata.owner",
+	"tag":         "$metadata.tags",
+	"contentType": "$metadata.ext",
+	"month":       bson.M{"$dateToString": bson.M{"format": "%Y-%m", "date": "$uploadDate", "timezone": "UTC"}},
+}
+
+// Names of the usage dimensions, in the order they are documented
+var usageDimensionNames = []string{"owner", "tag", "contentType", "month"}
+
+// Compute file count and total size of a GridFS bucket grouped by any
+// combination of owner, tag, content type and upload month, largest groups
+// first. Files with several tags count for each of them, so the groups of
+// tag don't add up to the bucket total. All revisions count.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param bucket string bucket name
+// @param dimensions []string names of usageDimensions
+// @param after time.Time uploaded at or after, zero for no limit
+// @param before time.Time uploaded before, zero for no limit
+// @return []fiber.Map groups with their dimension values, files and bytes
+// @return error error
+func storageUsageGroups(ctx context.Context, db *mongo.Database, bucket string, dimensions []string, after, before time.Time) ([]fiber.Map, error) {
+	match := bson.M{}
+	uploadDate := bson.M{}
+	if !after.IsZero() {
+		uploadDate["$gte"] = after
+	}
+	if !before.IsZero() {
+		uploadDate["$lt"] = before
+	}
+	if len(uploadDate) > 0 {
+		match["uploadDate"] = uploadDate
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+	key := bson.M{}
+	for _, dimension := range dimensions {
+		if dimension == "tag" {
+			pipeline = append(pipeline, bson.D{{Key: "$unwind", Value: bson.M{"path": "$metadata.tags", "preserveNullAndEmptyArrays": true}}})
+		}
+		key[dimension] = usageDimensions[dimension]
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$group", Value: bson.M{"_id": key, "files": bson.M{"$sum": 1}, "bytes": bson.M{"$sum": "$length"}}}})
+
+	cursor, err := namedFilesCollection(db, bucket).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Key   bson.M `bson:"_id"`
+		Files int64  `bson:"files"`
+		Bytes int64  `bson:"bytes"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	// Extensions sharing a content type, like .jpg and .jpeg, are merged, so
+	// groups are merged by their values
+	groups := map[string]fiber.Map{}
+	for _, result := range results {
+		group := fiber.Map{}
+		values := make([]string, 0, len(dimensions))
+		for _, dimension := range dimensions {
+			value, _ := result.Key[dimension].(string)
+			switch {
+			case dimension == "contentType":
+				contentType := "application/octet-stream"
+				if known, ok := contentTypes[value]; ok {
+					contentType = known
+				}
+				group[dimension] = contentType
+				value = contentType
+			case dimension == "owner" && value == "":
+				// Files uploaded before owners were recorded have none
+				group[dimension] = "unknown"
+			case value == "":
+				// Untagged files
+				group[dimension] = nil
+			default:
+				group[dimension] = value
+			}
+			values = append(values, value)
+		}
+		id := strings.Join(values, "\x00")
+		if merged, ok := groups[id]; ok {
+			merged["files"] = merged["files"].(int64) + result.Files
+			merged["bytes"] = merged["bytes"].(int64) + result.Bytes
+			continue
+		}
+		group["files"] = result.Files
+		group["bytes"] = result.Bytes
+		groups[id] = group
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := groups[ids[i]]["bytes"].(int64), groups[ids[j]]["bytes"].(int64)
+		if a != b {
+			return a > b
+		}
+		return ids[i] < ids[j]
+	})
+	usage := make([]fiber.Map, 0, len(ids))
+	for _, id := range ids {
+		usage = append(usage, groups[id])
+	}
+	return usage, nil
+}
+
+// Read usage dimensions from the comma separated groupBy query parameter,
+// recording unknown ones in v
+// @param c *fiber.Ctx context
+// @param v *validation.Validator
+// @return []string dimensions, owner if empty
+func usageGroupBy(c *fiber.Ctx, v *validation.Validator) []string {
+	dimensions := splitList(c.Query("groupBy", "owner"))
+	seen := map[string]bool{}
+	for _, dimension := range dimensions {
+		_, ok := usageDimensions[dimension]
+		v.Check(ok && !seen[dimension], validation.Query, "groupBy", "groupBy must list distinct values of "+strings.Join(usageDimensionNames, ", "))
+		seen[dimension] = true
+	}
+	v.Check(len(dimensions) > 0, validation.Query, "groupBy", "groupBy must not be empty")
+	return dimensions
+}
@@ -0,0 +1,305 @@
+package gofs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Read version number stored in files document metadata.
+// Files uploaded before versioning fall back to their upload order.
+// @param fileDoc bson.M files document
+// @param index int position in upload order
+// @return int version
+func fileVersion(fileDoc bson.M, index int) int {
+	metadata, _ := fileDoc["metadata"].(bson.M)
+	switch version := metadata["version"].(type) {
+	case int32:
+		return int(version)
+	case int64:
+		return int(version)
+	case float64:
+		return int(version)
+	}
+	return index + 1
+}
+
+// List all revisions stored under filename, oldest first
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @return []bson.M files documents
+// @return error error
+func listRevisions(ctx context.Context, db *mongo.Database, filename string) ([]bson.M, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "uploadDate", Value: 1}})
+	var revisions []bson.M
+	err := withRetry(ctx, func() error {
+		cursor, err := requestFilesCollection(ctx, db).Find(ctx, activeFilter(bson.M{"filename": filename}), findOptions)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &revisions)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Collection of the version counters of versioned filenames
+const versionCountersCollection = "version_counters"
+
+// Get version number for the next revision of filename from its counter
+// document, so concurrent uploads never get the same number. The counter is
+// raised to the latest stored version first, files versioned before counters
+// existed keep their numbers.
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @return int version
+// @return error error
+func nextVersion(ctx context.Context, db *mongo.Database, filename string) (int, error) {
+	revisions, err := listRevisions(ctx, db, filename)
+	if err != nil {
+		return 0, err
+	}
+	latest := 0
+	for index, revision := range revisions {
+		latest = max(latest, fileVersion(revision, index))
+	}
+
+	counters := db.Collection(versionCountersCollection)
+	key := bson.M{"_id": bson.D{{Key: "bucket", Value: BucketFromContext(ctx)}, {Key: "filename", Value: filename}}}
+	err = withRetry(ctx, func() error {
+		_, err := counters.UpdateOne(ctx, key, bson.M{"$max": bson.M{"version": latest}}, options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			// A concurrent upload created the counter meanwhile
+			_, err = counters.UpdateOne(ctx, key, bson.M{"$max": bson.M{"version": latest}})
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var counter struct {
+		Version int `bson:"version"`
+	}
+	err = counters.FindOneAndUpdate(ctx, key, bson.M{"$inc": bson.M{"version": 1}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Version, nil
+}
+
+// Mark revision as current version and clear the flag on all others
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @param id interface{} files document id
+// @return error error
+func setCurrentRevision(ctx context.Context, db *mongo.Database, filename string, id interface{}) error {
+	collection := requestFilesCollection(ctx, db)
+	return withRetry(ctx, func() error {
+		if _, err := collection.UpdateMany(ctx, bson.M{"filename": filename, "_id": bson.M{"$ne": id}}, bson.M{"$set": bson.M{"metadata.current": false}}); err != nil {
+			return err
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"metadata.current": true}})
+		return err
+	})
+}
+
+// Find current version of file by name, falling back to the latest upload
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param name string
+// @return bson.M files document
+// @return error error
+func findCurrentByName(ctx context.Context, db *mongo.Database, name string) (bson.M, error) {
+	var fileDoc bson.M
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "metadata.current", Value: -1}, {Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}})
+	err := withRetry(ctx, func() error {
+		return requestFilesCollection(ctx, db).FindOne(ctx, activeFilter(bson.M{"filename": name}), findOptions).Decode(&fileDoc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fileDoc, nil
+}
+
+// Find files document by id given in request params
+// @param c *fiber.Ctx context
+// @return bson.M files document
+// @return error error
+func findFileByParam(c *fiber.Ctx) (bson.M, error) {
+	// Get image id from request params and convert it to ObjectID
+	id, err := objectIdParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	fileDoc, err := fileStorage().Stat(c.Context(), id)
+	if errors.Is(err, ErrFileNotFound) {
+		return nil, newError(fiber.StatusNotFound, CodeFileNotFound, "Image not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fileDoc, nil
+}
+
+// Find revision with given version number in request params
+// @param c *fiber.Ctx context
+// @param db *mongo.Database database
+// @return bson.M files document
+// @return error error
+func findRevisionByParam(c *fiber.Ctx, db *mongo.Database) (bson.M, error) {
+	fileDoc, err := findFileByParam(c)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := strconv.Atoi(c.Params("version"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid version")
+	}
+
+	revisions, err := listRevisions(c.Context(), db, fileDoc["filename"].(string))
+	if err != nil {
+		return nil, err
+	}
+	for index, revision := range revisions {
+		if fileVersion(revision, index) == version {
+			return revision, nil
+		}
+	}
+	return nil, newError(fiber.StatusNotFound, CodeVersionNotFound, "Version not found")
+}
+
+// Register file versioning routes
+// @param app *fiber.App app
+func registerVersionRoutes(app *fiber.App) {
+	// Upload new version of an existing image, keeping prior revisions
+	// @param id string
+	// @param file file
+	// @return image metadata
+	app.Post("/api/image/id/:id/versions", func(c *fiber.Ctx) error {
+		db := requestDatabase(c.Context())
+
+		// Find the image this upload is a new version of
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+
+		// Check if file is present in request body or not
+		fileHeader, err := c.FormFile("image")
+		if err != nil {
+			return respondError(c, fiber.StatusBadRequest, CodeBadRequest, err.Error())
+		}
+
+		// Read custom metadata and expiry time from the form
+		opts, err := formUploadOptions(c)
+		if err != nil {
+			return err
+		}
+		// The new version keeps the filename and folder of the image, and
+		// follows its highest version
+		opts.Folder, opts.Collision, opts.Revision = "", collisionVersion, true
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			return respondError(c, fiber.StatusBadRequest, CodeBadRequest, err.Error())
+		}
+		defer file.Close()
+
+		image, err := storeUpload(c.Context(), db, fileDoc["filename"].(string), file, opts)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusCreated, "Image version uploaded successfully", "image", image)
+	})
+
+	// List all versions of an image
+	// @param id string
+	// @return versions metadata
+	app.Get("/api/image/id/:id/versions", func(c *fiber.Ctx) error {
+		db := readDatabase(c.Context())
+
+		fileDoc, err := findFileByParam(c)
+		if err != nil {
+			return err
+		}
+
+		revisions, err := listRevisions(c.Context(), db, fileDoc["filename"].(string))
+		if err != nil {
+			return err
+		}
+
+		// Without an explicit current flag the latest revision is current
+		hasCurrent := false
+		for _, revision := range revisions {
+			if metadata, ok := revision["metadata"].(bson.M); ok && metadata["current"] == true {
+				hasCurrent = true
+			}
+		}
+
+		versions := make([]fiber.Map, 0, len(revisions))
+		for index, revision := range revisions {
+			metadata, _ := revision["metadata"].(bson.M)
+			versions = append(versions, fiber.Map{
+				"id":         revision["_id"],
+				"version":    fileVersion(revision, index),
+				"size":       revision["length"],
+				"uploadDate": revision["uploadDate"],
+				"current":    metadata["current"] == true || (!hasCurrent && index == len(revisions)-1),
+			})
+		}
+
+		return respond(c, fiber.StatusOK, "Image versions fetched successfully", "versions", versions)
+	})
+
+	// Get specific version of an image
+	// @param id string
+	// @param version int
+	// @param download bool save as attachment instead of rendering
+	// @return image content
+	app.Get("/api/image/id/:id/versions/:version", func(c *fiber.Ctx) error {
+		db := readDatabase(c.Context())
+
+		revision, err := findRevisionByParam(c, db)
+		if err != nil {
+			return err
+		}
+
+		return sendImage(c, revision)
+	})
+
+	// Promote a version to be the current one, e.g. to roll back a bad upload
+	// @param id string
+	// @param version int
+	// @return success message
+	app.Post("/api/image/id/:id/versions/:version/promote", func(c *fiber.Ctx) error {
+		db := requestDatabase(c.Context())
+
+		revision, err := findRevisionByParam(c, db)
+		if err != nil {
+			return err
+		}
+
+		if err := setCurrentRevision(c.Context(), db, revision["filename"].(string), revision["_id"]); err != nil {
+			return err
+		}
+		forgetFileDocs(config.BucketName)
+		purgeCDN(nameSurrogateKey(config.BucketName, revision["filename"].(string)))
+		replicateFile(c.Context(), config.BucketName, revision["_id"].(primitive.ObjectID))
+
+		return respond(c, fiber.StatusOK, "Image version promoted successfully", "", nil)
+	})
+}
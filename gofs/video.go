@@ -0,0 +1,287 @@
+package gofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// EBML element ids of the WebM elements read for the video metadata
+const (
+	ebmlHeader        = 0x1a45dfa3
+	ebmlDocType       = 0x4282
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549a966
+	ebmlTimecodeScale = 0x2ad7b1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654ae6b
+	ebmlTrackEntry    = 0xae
+	ebmlVideo         = 0xe0
+	ebmlPixelWidth    = 0xb0
+	ebmlPixelHeight   = 0xba
+)
+
+// Video metadata stored with uploads
+type videoInfo struct {
+	// Duration in seconds
+	Duration float64
+	Width    int
+	Height   int
+}
+
+// Get video metadata as stored in the video metadata field
+// @return bson.M metadata
+func (v videoInfo) metadata() bson.M {
+	return bson.M{
+		"duration": math.Round(v.Duration*1000) / 1000,
+		"width":    v.Width,
+		"height":   v.Height,
+	}
+}
+
+// Inspect uploaded MP4 or WebM video and extract its duration and
+// resolution. Uploads larger than VIDEO_MAX_BYTES are rejected. Unless
+// IMAGE_VERIFICATION is none the container has to match the file extension
+// and carry the video metadata, rejecting truncated files whose metadata
+// would follow the media data.
+// @param content io.Reader upload content
+// @param ext string file extension
+// @return io.Reader content
+// @return bson.M video metadata
+// @return error error
+func inspectVideo(content io.Reader, ext string) (io.Reader, bson.M, error) {
+	if config.MaxVideoBytes > 0 {
+		content = &limitReader{reader: content, remaining: config.MaxVideoBytes}
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var info videoInfo
+	if ext == ".webm" {
+		info, err = webmInfo(data)
+	} else {
+		info, err = mp4Info(data)
+	}
+	if err != nil {
+		if config.ImageVerification != verifyNone {
+			return nil, nil, newError(fiber.StatusUnprocessableEntity, CodeInvalidImage, "Content is not a valid "+imageFormatName(ext)+" video: "+err.Error())
+		}
+		return bytes.NewReader(data), nil, nil
+	}
+	return bytes.NewReader(data), bson.M{"video": info.metadata()}, nil
+}
+
+// Get duration and resolution of an MP4 video from its movie header and the
+// track headers of its video tracks
+// @param data []byte MP4 video
+// @return videoInfo info
+// @return error error if the content is no MP4 video or has no movie box
+func mp4Info(data []byte) (videoInfo, error) {
+	var info videoInfo
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return info, errors.New("missing ftyp box")
+	}
+
+	movie := false
+	err := eachBox(data, func(typ string, payload []byte) error {
+		if typ != "moov" {
+			return nil
+		}
+		movie = true
+		return eachBox(payload, func(typ string, payload []byte) error {
+			switch typ {
+			case "mvhd":
+				// Version 1 headers have 64 bit times and duration
+				if len(payload) >= 32 && payload[0] == 1 {
+					info.Duration = float64(binary.BigEndian.Uint64(payload[24:32])) / float64(max(binary.BigEndian.Uint32(payload[20:24]), 1))
+				} else if len(payload) >= 20 {
+					info.Duration = float64(binary.BigEndian.Uint32(payload[16:20])) / float64(max(binary.BigEndian.Uint32(payload[12:16]), 1))
+				}
+			case "trak":
+				return eachBox(payload, func(typ string, payload []byte) error {
+					if typ != "tkhd" {
+						return nil
+					}
+					// Width and height are 16.16 fixed point, zero for audio
+					offset := 76
+					if len(payload) > 0 && payload[0] == 1 {
+						offset = 88
+					}
+					if len(payload) < offset+8 {
+						return nil
+					}
+					width := int(binary.BigEndian.Uint32(payload[offset:offset+4]) >> 16)
+					height := int(binary.BigEndian.Uint32(payload[offset+4:offset+8]) >> 16)
+					if width*height > info.Width*info.Height {
+						info.Width, info.Height = width, height
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return info, err
+	}
+	if !movie {
+		return info, errors.New("missing moov box")
+	}
+	return info, nil
+}
+
+// Read EBML variable length integer
+// @param data []byte
+// @param marker bool keep the length marker, as element ids do
+// @return uint64 value
+// @return int length in bytes, 0 if data holds no valid integer
+func readVint(data []byte, marker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0])
+	if !marker {
+		value &= uint64(0xff >> length)
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// Call fn with the id and payload of each EBML element in data. Elements of
+// unknown size extend to the end of data.
+// @param data []byte elements
+// @param fn func(uint64, []byte) error
+// @return error error
+func eachElement(data []byte, fn func(id uint64, payload []byte) error) error {
+	for len(data) > 0 {
+		id, idLength := readVint(data, true)
+		if idLength == 0 {
+			return errors.New("invalid element id")
+		}
+		size, sizeLength := readVint(data[idLength:], false)
+		if sizeLength == 0 {
+			return errors.New("invalid element size")
+		}
+		data = data[idLength+sizeLength:]
+		// All ones is the reserved unknown size
+		if size == uint64(1)<<(7*sizeLength)-1 || size > uint64(len(data)) {
+			size = uint64(len(data))
+		}
+		if err := fn(id, data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// Read EBML unsigned integer element
+// @param payload []byte
+// @return uint64 value
+func ebmlUint(payload []byte) uint64 {
+	var value uint64
+	for _, b := range payload {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// Get duration and resolution of a WebM video from its segment information
+// and the video settings of its tracks
+// @param data []byte WebM video
+// @return videoInfo info
+// @return error error if the content is no WebM video or has no segment
+// information
+func webmInfo(data []byte) (videoInfo, error) {
+	var info videoInfo
+	if len(data) < 4 || binary.BigEndian.Uint32(data[0:4]) != ebmlHeader {
+		return info, errors.New("missing EBML header")
+	}
+
+	webm, segment := false, false
+	// Durations are counted in timecode scale units, 1ms by default
+	scale, duration := uint64(1000000), 0.0
+	err := eachElement(data, func(id uint64, payload []byte) error {
+		switch id {
+		case ebmlHeader:
+			return eachElement(payload, func(id uint64, payload []byte) error {
+				if id == ebmlDocType {
+					webm = string(payload) == "webm"
+				}
+				return nil
+			})
+		case ebmlSegment:
+			return eachElement(payload, func(id uint64, payload []byte) error {
+				switch id {
+				case ebmlInfo:
+					segment = true
+					return eachElement(payload, func(id uint64, payload []byte) error {
+						switch {
+						case id == ebmlTimecodeScale:
+							scale = ebmlUint(payload)
+						case id == ebmlDuration && len(payload) == 4:
+							duration = float64(math.Float32frombits(binary.BigEndian.Uint32(payload)))
+						case id == ebmlDuration && len(payload) == 8:
+							duration = math.Float64frombits(binary.BigEndian.Uint64(payload))
+						}
+						return nil
+					})
+				case ebmlTracks:
+					return eachElement(payload, func(id uint64, payload []byte) error {
+						if id != ebmlTrackEntry {
+							return nil
+						}
+						return eachElement(payload, func(id uint64, payload []byte) error {
+							if id != ebmlVideo {
+								return nil
+							}
+							var width, height int
+							eachElement(payload, func(id uint64, payload []byte) error {
+								switch id {
+								case ebmlPixelWidth:
+									width = int(ebmlUint(payload))
+								case ebmlPixelHeight:
+									height = int(ebmlUint(payload))
+								}
+								return nil
+							})
+							if width*height > info.Width*info.Height {
+								info.Width, info.Height = width, height
+							}
+							return nil
+						})
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return info, err
+	}
+	if !webm {
+		return info, errors.New("document type is not webm")
+	}
+	if !segment {
+		return info, errors.New("missing segment information")
+	}
+	info.Duration = duration * float64(scale) / 1e9
+	return info, nil
+}
@@ -0,0 +1,500 @@
+package gofs
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV file system over the image bucket. Folders are the virtual folders
+// of the filenames, only the current version of each image is visible.
+type gridfsFileSystem struct {
+	db *mongo.Database
+}
+
+// Convert storage errors to the file system errors WebDAV expects
+// @param err error
+// @return error error
+func webdavError(err error) error {
+	switch errorStatus(err) {
+	case fiber.StatusNotFound:
+		return os.ErrNotExist
+	case fiber.StatusConflict:
+		return os.ErrExist
+	case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity:
+		return os.ErrInvalid
+	}
+	return err
+}
+
+// Convert WebDAV path to stored filename or folder, "/a/b.png" becomes "a/b.png"
+// @param name string
+// @return string filename
+func webdavName(name string) string {
+	return strings.Trim(name, "/")
+}
+
+// Information about a file or folder
+type gridfsFileInfo struct {
+	name        string
+	size        int64
+	modTime     time.Time
+	dir         bool
+	contentType string
+}
+
+// File info accessors
+func (fi *gridfsFileInfo) Name() string       { return fi.name }
+func (fi *gridfsFileInfo) Size() int64        { return fi.size }
+func (fi *gridfsFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *gridfsFileInfo) IsDir() bool        { return fi.dir }
+func (fi *gridfsFileInfo) Sys() interface{}   { return nil }
+
+// Get file mode, files are read-write for everyone using the share
+// @return fs.FileMode mode
+func (fi *gridfsFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// Get content type from the stored extension instead of sniffing the content
+// @param ctx context.Context
+// @return string content type
+// @return error error
+func (fi *gridfsFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.contentType, nil
+}
+
+// Build file info of files document
+// @param fileDoc bson.M files document
+// @return *gridfsFileInfo file info
+func fileDocInfo(fileDoc bson.M) *gridfsFileInfo {
+	uploadDate, _ := fileDoc["uploadDate"].(primitive.DateTime)
+	return &gridfsFileInfo{
+		name:        path.Base(fileDoc["filename"].(string)),
+		size:        fileLength(fileDoc),
+		modTime:     uploadDate.Time(),
+		contentType: contentTypes[fileExtension(fileDoc)],
+	}
+}
+
+// Build file info of folder
+// @param folder string cleaned folder
+// @return *gridfsFileInfo file info
+func folderInfo(folder string) *gridfsFileInfo {
+	return &gridfsFileInfo{name: path.Base("/" + folder), dir: true}
+}
+
+// Create folder
+// @param ctx context.Context
+// @param name string
+// @param perm os.FileMode ignored
+// @return error error
+func (fsys *gridfsFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	folder, err := cleanFolder(webdavName(name))
+	if err != nil {
+		return os.ErrInvalid
+	}
+	if _, err := fsys.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	return createFolder(ctx, fsys.db, folder)
+}
+
+// Open file or folder. Opening for writing stores a new image once the file
+// is closed, replacing all versions stored under the name.
+// @param ctx context.Context
+// @param name string
+// @param flag int
+// @param perm os.FileMode ignored
+// @return webdav.File file
+// @return error error
+func (fsys *gridfsFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	filename := webdavName(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := validateFilename(filename); err != nil {
+			return nil, os.ErrPermission
+		}
+		return newGridfsWriteFile(ctx, fsys.db, filename), nil
+	}
+
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &gridfsDir{ctx: ctx, db: fsys.db, folder: filename, info: info.(*gridfsFileInfo)}, nil
+	}
+
+	fileDoc, err := findCurrentByName(ctx, fsys.db, filename)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	bucket, err := imageBucket(fsys.db)
+	trackDownload(ctx, fileDoc, err)
+	if err != nil {
+		return nil, err
+	}
+	return &gridfsReadFile{bucket: bucket, fileDoc: fileDoc, info: fileDocInfo(fileDoc)}, nil
+}
+
+// Delete image with all its versions, or folder recursively
+// @param ctx context.Context
+// @param name string
+// @return error error
+func (fsys *gridfsFileSystem) RemoveAll(ctx context.Context, name string) error {
+	filename := webdavName(name)
+	if filename == "" {
+		return os.ErrPermission
+	}
+
+	revisions, err := listRevisions(ctx, fsys.db, filename)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		folder, err := cleanFolder(filename)
+		if err != nil {
+			return os.ErrInvalid
+		}
+		_, err = deleteFolder(ctx, fsys.db, folder)
+		return webdavError(err)
+	}
+	for _, revision := range revisions {
+		if err := deleteFile(ctx, revision["_id"].(primitive.ObjectID)); err != nil {
+			return webdavError(err)
+		}
+	}
+	return nil
+}
+
+// Rename image or move folder
+// @param ctx context.Context
+// @param oldName string
+// @param newName string
+// @return error error
+func (fsys *gridfsFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := webdavName(oldName), webdavName(newName)
+	if fileDoc, err := findCurrentByName(ctx, fsys.db, from); err == nil {
+		return webdavError(renameFile(ctx, fsys.db, fileDoc, to))
+	}
+
+	from, err := cleanFolder(from)
+	if err != nil {
+		return os.ErrInvalid
+	}
+	to, err = cleanFolder(to)
+	if err != nil {
+		return os.ErrInvalid
+	}
+	_, err = moveFolder(ctx, fsys.db, from, to)
+	return webdavError(err)
+}
+
+// Get information about image or folder
+// @param ctx context.Context
+// @param name string
+// @return os.FileInfo file info
+// @return error error
+func (fsys *gridfsFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	filename := webdavName(name)
+	if filename != "" {
+		if fileDoc, err := findCurrentByName(ctx, fsys.db, filename); err == nil {
+			return fileDocInfo(fileDoc), nil
+		}
+	}
+
+	folder, err := cleanFolder(filename)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	exists, err := folderExists(ctx, fsys.db, folder)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return folderInfo(folder), nil
+}
+
+// Folder opened for listing
+type gridfsDir struct {
+	ctx     context.Context
+	db      *mongo.Database
+	folder  string
+	info    *gridfsFileInfo
+	entries []fs.FileInfo
+	listed  bool
+}
+
+// Folders can't be read or written like files
+func (d *gridfsDir) Close() error                                 { return nil }
+func (d *gridfsDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *gridfsDir) Write(p []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (d *gridfsDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *gridfsDir) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+
+// List folder entries, count > 0 returns at most count entries per call
+// @param count int
+// @return []fs.FileInfo entries
+// @return error error
+func (d *gridfsDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		folders, fileDocs, err := listFolder(d.ctx, d.db, d.folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, folder := range folders {
+			d.entries = append(d.entries, folderInfo(folder))
+		}
+		for _, fileDoc := range fileDocs {
+			d.entries = append(d.entries, fileDocInfo(fileDoc))
+		}
+		d.listed = true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// Image opened for reading. Seeking reopens the download stream at the new
+// offset, which lets clients request byte ranges.
+type gridfsReadFile struct {
+	bucket       *gridfs.Bucket
+	fileDoc      bson.M
+	info         *gridfsFileInfo
+	stream       *gridfs.DownloadStream
+	offset       int64
+	streamOffset int64
+}
+
+// Read-only file, it has no entries
+func (f *gridfsReadFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *gridfsReadFile) Readdir(count int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *gridfsReadFile) Stat() (fs.FileInfo, error)               { return f.info, nil }
+
+// Read content at the current offset
+// @param p []byte
+// @return int bytes read
+// @return error error
+func (f *gridfsReadFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.stream == nil || f.streamOffset != f.offset {
+		if f.stream != nil {
+			f.stream.Close()
+		}
+		stream, err := f.bucket.OpenDownloadStream(f.fileDoc["_id"])
+		if err != nil {
+			return 0, err
+		}
+		if _, err := stream.Skip(f.offset); err != nil {
+			stream.Close()
+			return 0, err
+		}
+		f.stream, f.streamOffset = stream, f.offset
+	}
+
+	n, err := f.stream.Read(p)
+	f.offset += int64(n)
+	f.streamOffset += int64(n)
+	return n, err
+}
+
+// Set offset of the next read
+// @param offset int64
+// @param whence int
+// @return int64 new offset
+// @return error error
+func (f *gridfsReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close download stream
+// @return error error
+func (f *gridfsReadFile) Close() error {
+	if f.stream != nil {
+		return f.stream.Close()
+	}
+	return nil
+}
+
+// Image opened for writing. Content is streamed to the upload in the
+// background, closing the file waits for the upload to finish.
+type gridfsWriteFile struct {
+	info *gridfsFileInfo
+	pipe *io.PipeWriter
+	done chan error
+}
+
+// Start upload of an image written through WebDAV
+// @param ctx context.Context
+// @param db *mongo.Database database
+// @param filename string
+// @return *gridfsWriteFile file
+func newGridfsWriteFile(ctx context.Context, db *mongo.Database, filename string) *gridfsWriteFile {
+	reader, writer := io.Pipe()
+	f := &gridfsWriteFile{
+		info: &gridfsFileInfo{name: path.Base(filename), modTime: time.Now()},
+		pipe: writer,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		expiresAt, err := parseExpiry("")
+		if err == nil {
+			_, err = storeUpload(ctx, db, filename, reader, uploadOptions{
+				Collision: collisionOverwrite,
+				ExpiresAt: expiresAt,
+			})
+		}
+		reader.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+// Write-only file, seeking keeps the offset at the end of the written content
+func (f *gridfsWriteFile) Read(p []byte) (int, error)                   { return 0, os.ErrPermission }
+func (f *gridfsWriteFile) Seek(offset int64, whence int) (int64, error) { return f.info.size, nil }
+func (f *gridfsWriteFile) Readdir(count int) ([]fs.FileInfo, error)     { return nil, os.ErrInvalid }
+func (f *gridfsWriteFile) Stat() (fs.FileInfo, error)                   { return f.info, nil }
+
+// Write content to the upload
+// @param p []byte
+// @return int bytes written
+// @return error error
+func (f *gridfsWriteFile) Write(p []byte) (int, error) {
+	n, err := f.pipe.Write(p)
+	f.info.size += int64(n)
+	return n, err
+}
+
+// Finish upload
+// @return error error
+func (f *gridfsWriteFile) Close() error {
+	f.pipe.Close()
+	return webdavError(<-f.done)
+}
+
+// Get role a WebDAV request needs, following the policy of the REST routes:
+// readers may download and stat files, uploaders may also change them, only
+// admins may delete files and list folders
+// @param r *http.Request request
+// @return string role
+func webdavRole(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return roleReader
+	case "PROPFIND":
+		if r.Header.Get("Depth") == "0" {
+			return roleReader
+		}
+		return roleAdmin
+	case http.MethodDelete:
+		return roleAdmin
+	}
+	return roleUploader
+}
+
+// Require HTTP basic authentication with the WebDAV credentials, and
+// WEBDAV_ROLE to have the role of the request
+// @param next http.Handler
+// @return http.Handler handler
+func webdavBasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(config.WebDAVUsername)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.WebDAVPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-mongo-fs"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !hasRole(config.WebDAVRole, webdavRole(r)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ctx := context.WithValue(r.Context(), principalKey{}, &principal{Actor: config.WebDAVUsername, Role: config.WebDAVRole, Authenticated: true})
+		ctx = withAuditSource(ctx, auditSource{Actor: config.WebDAVUsername, IP: ip, Protocol: "webdav"})
+		// Browsers may open SVG files of the share, keep their scripts inert
+		w.Header().Set("Content-Security-Policy", svgCSP)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Serve the image bucket over WebDAV in the background if a listen address
+// is configured
+func startWebDAVServer() {
+	if config.WebDAVListenAddr == "" {
+		return
+	}
+
+	handler := &webdav.Handler{
+		FileSystem: &gridfsFileSystem{db: database()},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Error("webdav request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+		},
+	}
+
+	server := &http.Server{Addr: config.WebDAVListenAddr, Handler: webdavBasicAuth(handler)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("webdav server stopped", "error", err)
+		}
+	}()
+
+	onShutdown(func(ctx context.Context) {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	})
+}
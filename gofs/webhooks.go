@@ -0,0 +1,266 @@
+package gofs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/roshanpaturkar/go-mongo-fs/jobs"
+	"github.com/roshanpaturkar/go-mongo-fs/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// File lifecycle event types
+const (
+	eventFileUploaded        = "file.uploaded"
+	eventFileDeleted         = "file.deleted"
+	eventFileRenamed         = "file.renamed"
+	eventFileMetadataUpdated = "file.metadata_updated"
+)
+
+// Collection of the webhook deliveries which failed on all retries, in the
+// default database
+const webhookDeadLettersCollection = "webhook_dead_letters"
+
+// Header carrying the HMAC-SHA256 signature of the webhook payload
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// Delays of webhook deliveries
+const (
+	// Time a worker has to deliver an event before another one may take the
+	// job over
+	webhookLease = time.Minute
+	// Delay before the first retry, doubled on every further attempt
+	webhookRetryDelay = time.Second
+)
+
+// Lifecycle event sent to webhooks
+type fileEvent struct {
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// HTTP client used for webhook deliveries
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Generate random event id
+// @return string id
+func newEventId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Sign payload with the webhook secret
+// @param payload []byte
+// @return string signature, "sha256=<hex>"
+func signPayload(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send payload to webhook once
+// @param ctx context.Context
+// @param url string
+// @param eventType string
+// @param payload []byte
+// @return error error
+func deliverWebhook(ctx context.Context, url string, eventType string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set("X-Webhook-Event", eventType)
+	if config.WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, signPayload(payload))
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Open collection of the webhook deliveries which failed on all retries
+// @param db *mongo.Database database
+// @return *mongo.Collection collection
+func webhookDeadLetterCollection(db *mongo.Database) *mongo.Collection {
+	return db.Collection(webhookDeadLettersCollection)
+}
+
+// Get webhook deliveries which failed on all retries
+// @return *jobs.DeadLetters dead letters
+func webhookDeadLetters() *jobs.DeadLetters {
+	return jobs.NewDeadLetters(webhookDeadLetterCollection(database()))
+}
+
+// Register the handler of webhook jobs, which deliver events to a webhook.
+// Failed deliveries are retried WEBHOOK_RETRIES times with exponentially
+// growing delays, then moved to the dead letters to be replayed by hand.
+func registerWebhookJobs() {
+	if len(config.WebhookURLs) == 0 {
+		return
+	}
+	backgroundJobs().Register(jobWebhook, jobs.Handler{
+		Run: func(ctx context.Context, job *jobs.Job) error {
+			url, _ := job.Payload["url"].(string)
+			eventType, _ := job.Payload["event"].(string)
+			payload, _ := job.Payload["payload"].(string)
+			return deliverWebhook(ctx, url, eventType, []byte(payload))
+		},
+		Workers:     config.JobWorkers,
+		Lease:       webhookLease,
+		RetryDelay:  webhookRetryDelay,
+		MaxAttempts: config.WebhookRetries + 1,
+		DeadLetters: webhookDeadLetters(),
+	})
+}
+
+// Publish file lifecycle event to all configured webhooks, queueing a
+// delivery job for each
+// @param eventType string
+// @param data interface{} event data
+func publishEvent(eventType string, data interface{}) {
+	if len(config.WebhookURLs) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(fileEvent{
+		Id:        newEventId(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		logger.Error("encode event", "event", eventType, "error", err)
+		return
+	}
+
+	for _, url := range config.WebhookURLs {
+		enqueueJob(context.Background(), jobWebhook, bson.M{"url": url, "event": eventType, "payload": string(payload)})
+	}
+}
+
+// Read dead letter id from request params
+// @param c *fiber.Ctx context
+// @return primitive.ObjectID id
+// @return error error
+func deadLetterIdParam(c *fiber.Ctx) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return primitive.NilObjectID, newError(fiber.StatusBadRequest, CodeInvalidId, "Invalid dead letter id")
+	}
+	return id, nil
+}
+
+// Translate errors of the dead letters to responses
+// @param err error
+// @return error error
+func deadLetterError(err error) error {
+	if errors.Is(err, jobs.ErrNotFound) {
+		return newError(fiber.StatusNotFound, CodeNotFound, "Dead letter not found, it was replayed or deleted")
+	}
+	return err
+}
+
+// Register webhook dead letter routes on the admin routes
+// @param admin fiber.Router router of the admin routes
+func registerWebhookRoutes(admin fiber.Router) {
+	// List webhook deliveries which failed on all retries, oldest first
+	// @param url string
+	// @param event string
+	// @param skip int
+	// @param limit int
+	// @return deadLetters
+	admin.Get("/webhooks/dead-letters", func(c *fiber.Ctx) error {
+		v := &validation.Validator{}
+		skip, limit := pageParams(c, v)
+		if err := v.Err(); err != nil {
+			return err
+		}
+		filter := jobs.Filter{Payload: bson.M{}}
+		if url := c.Query("url"); url != "" {
+			filter.Payload["url"] = url
+		}
+		if event := c.Query("event"); event != "" {
+			filter.Payload["event"] = event
+		}
+
+		list, err := webhookDeadLetters().Find(c.Context(), filter, skip, limit)
+		if err != nil {
+			return err
+		}
+		return respond(c, fiber.StatusOK, "Dead letters fetched successfully", "deadLetters", list)
+	})
+
+	// Get webhook delivery which failed on all retries
+	// @param id string
+	// @return deadLetter
+	admin.Get("/webhooks/dead-letters/:id", func(c *fiber.Ctx) error {
+		id, err := deadLetterIdParam(c)
+		if err != nil {
+			return err
+		}
+		deadLetter, err := webhookDeadLetters().Get(c.Context(), id)
+		if err != nil {
+			return deadLetterError(err)
+		}
+		return respond(c, fiber.StatusOK, "Dead letter fetched successfully", "deadLetter", deadLetter)
+	})
+
+	// Queue delivery again, to the URL it failed on, with a fresh count of
+	// attempts
+	// @param id string
+	// @return job
+	admin.Post("/webhooks/dead-letters/:id/replay", func(c *fiber.Ctx) error {
+		// Without webhooks no worker delivers the replayed job
+		if len(config.WebhookURLs) == 0 {
+			return fiber.NewError(fiber.StatusConflict, "Webhooks are not configured")
+		}
+		id, err := deadLetterIdParam(c)
+		if err != nil {
+			return err
+		}
+		job, err := backgroundJobs().Replay(c.Context(), webhookDeadLetters(), id)
+		if err != nil {
+			return deadLetterError(err)
+		}
+		return respond(c, fiber.StatusOK, "Delivery queued successfully", "job", job)
+	})
+
+	// Delete webhook delivery which failed on all retries without replaying
+	// it
+	// @param id string
+	// @return success message
+	admin.Delete("/webhooks/dead-letters/:id", func(c *fiber.Ctx) error {
+		id, err := deadLetterIdParam(c)
+		if err != nil {
+			return err
+		}
+		if err := webhookDeadLetters().Delete(c.Context(), id); err != nil {
+			return deadLetterError(err)
+		}
+		return respond(c, fiber.StatusOK, "Dead letter deleted successfully", "", nil)
+	})
+}
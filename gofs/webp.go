@@ -0,0 +1,140 @@
+package gofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Error returned for content which is not a WebP image
+var errInvalidWebP = errors.New("webp: invalid format")
+
+// VP8X flag of animated WebP images
+const webpAnimationFlag = 0x02
+
+// Register WebP with the image package for its header. Only the header is
+// parsed, image data is checked by checkWebP.
+func init() {
+	image.RegisterFormat("webp", "RIFF????WEBPVP8", decodeWebP, decodeWebPConfig)
+}
+
+// Decode WebP image, not supported as pixel data is never needed
+// @param r io.Reader
+// @return image.Image image
+// @return error error
+func decodeWebP(r io.Reader) (image.Image, error) {
+	return nil, errors.New("webp: decoding is not supported")
+}
+
+// Decode dimensions of a WebP image from its first chunk: lossy VP8,
+// lossless VP8L, or VP8X for extended and animated images
+// @param r io.Reader
+// @return image.Config config
+// @return error error
+func decodeWebPConfig(r io.Reader) (image.Config, error) {
+	// RIFF header, chunk header and the first 10 bytes of its payload
+	var b [30]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return image.Config{}, errInvalidWebP
+	}
+	if string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return image.Config{}, errInvalidWebP
+	}
+
+	payload := b[20:]
+	switch string(b[12:16]) {
+	case "VP8 ":
+		if payload[3] != 0x9d || payload[4] != 0x01 || payload[5] != 0x2a {
+			return image.Config{}, errInvalidWebP
+		}
+		return image.Config{
+			ColorModel: color.YCbCrModel,
+			Width:      int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff),
+			Height:     int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff),
+		}, nil
+	case "VP8L":
+		if payload[0] != 0x2f {
+			return image.Config{}, errInvalidWebP
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		return image.Config{
+			ColorModel: color.NRGBAModel,
+			Width:      int(bits&0x3fff) + 1,
+			Height:     int(bits>>14&0x3fff) + 1,
+		}, nil
+	case "VP8X":
+		return image.Config{
+			ColorModel: color.NRGBAModel,
+			Width:      int(uint24(payload[4:7])) + 1,
+			Height:     int(uint24(payload[7:10])) + 1,
+		}, nil
+	}
+	return image.Config{}, errInvalidWebP
+}
+
+// Get little endian 24 bit integer
+// @param b []byte 3 bytes
+// @return uint32 value
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// Check the chunks of a WebP image: their sizes have to add up to the RIFF
+// size, still images need a VP8 or VP8L bitstream and animated ones an ANIM
+// chunk and at least one frame
+// @param data []byte WebP image
+// @return error error if the image is invalid or truncated
+func checkWebP(data []byte) error {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errInvalidWebP
+	}
+	size := int64(binary.LittleEndian.Uint32(data[4:8])) + 8
+	if size > int64(len(data)) {
+		return errors.New("webp: truncated file")
+	}
+	data = data[:size]
+
+	var animated, anim, bitstream bool
+	frames := 0
+	for offset := 12; offset < len(data); {
+		if len(data)-offset < 8 {
+			return errors.New("webp: truncated chunk")
+		}
+		fourCC := string(data[offset : offset+4])
+		length := int64(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		end := int64(offset) + 8 + length + length&1
+		if int64(offset)+8+length > int64(len(data)) {
+			return errors.New("webp: truncated chunk " + fourCC)
+		}
+		switch fourCC {
+		case "VP8X":
+			if length < 10 {
+				return errInvalidWebP
+			}
+			animated = data[offset+8]&webpAnimationFlag != 0
+		case "ANIM":
+			anim = true
+		case "ANMF":
+			frames++
+		case "VP8 ", "VP8L":
+			bitstream = true
+		}
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		offset = int(end)
+	}
+
+	if animated {
+		if !anim || frames == 0 {
+			return errors.New("webp: animation without frames")
+		}
+		return nil
+	}
+	if !bitstream {
+		return errors.New("webp: missing image data")
+	}
+	return nil
+}
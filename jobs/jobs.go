@@ -0,0 +1,638 @@
+// Package jobs runs background work queued in a MongoDB collection, so jobs
+// survive restarts and are shared by all instances of a service:
+//
+//	queue := jobs.New(db.Collection("jobs"), logger)
+//	queue.Register("preview", jobs.Handler{Run: convert, Workers: 2, MaxAttempts: 5})
+//	queue.Start(ctx)
+//	queue.Enqueue(ctx, "preview", bson.M{"fileId": id})
+//
+// Workers lease the jobs they claim, jobs of workers which crashed or were
+// stopped are claimed again once their lease ends. Failed jobs are retried
+// with growing delays and, after their last attempt, kept as dead jobs to be
+// inspected and retried by hand, in the queue or in a dead-letter collection
+// of their handler. Jobs can run more than once, handlers have
+// to be idempotent.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Job states. Finished jobs are removed from the queue.
+const (
+	// Waiting until RunAt, for the first attempt or a retry
+	StatusQueued = "queued"
+	// Leased to a worker until RunAt
+	StatusRunning = "running"
+	// Failed on its last attempt
+	StatusDead = "dead"
+)
+
+// Defaults of handlers leaving limits unset
+const (
+	defaultLease        = 5 * time.Minute
+	defaultRetryDelay   = time.Second
+	defaultMaxDelay     = time.Hour
+	defaultPollInterval = 5 * time.Second
+)
+
+var (
+	// Error of jobs which are not in the queue
+	ErrNotFound = errors.New("job not found")
+	// Error of retrying a job a worker holds
+	ErrRunning = errors.New("job is running")
+)
+
+// Indexes on the queue collection backing the claims of the workers and the
+// listing of jobs
+var Indexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "status", Value: 1}, {Key: "runAt", Value: 1}},
+		Options: options.Index().SetName("kind_status_runAt"),
+	},
+	{
+		Keys:    bson.D{{Key: "enqueuedAt", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("enqueuedAt_id"),
+	},
+}
+
+// Indexes on dead-letter collections backing the listing of dead jobs
+var DeadLetterIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "diedAt", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("diedAt_id"),
+	},
+}
+
+// Queued job
+type Job struct {
+	Id   primitive.ObjectID `bson:"_id" json:"id"`
+	Kind string             `bson:"kind" json:"kind"`
+	// Key of jobs enqueued with EnqueueUnique
+	Key     string `bson:"key,omitempty" json:"key,omitempty"`
+	Payload bson.M `bson:"payload" json:"payload"`
+	Status  string `bson:"status" json:"status"`
+	// Time the job is due, or its lease ends while it runs
+	RunAt      time.Time `bson:"runAt" json:"runAt"`
+	EnqueuedAt time.Time `bson:"enqueuedAt" json:"enqueuedAt"`
+	Attempts   int       `bson:"attempts" json:"attempts"`
+	LastError  string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	// Time the job failed on its last attempt
+	DiedAt *time.Time `bson:"diedAt,omitempty" json:"diedAt,omitempty"`
+}
+
+// Handler of a kind of jobs
+type Handler struct {
+	// Run job, an error schedules a retry
+	Run func(ctx context.Context, job *Job) error
+	// Jobs run concurrently by each instance, at least 1
+	Workers int
+	// Time a worker has to finish a job before another one may take it over,
+	// 5 minutes if 0
+	Lease time.Duration
+	// Delay before the first retry, doubled on every further attempt, 1
+	// second if 0
+	RetryDelay time.Duration
+	// Longest delay between retries, 1 hour if 0
+	MaxDelay time.Duration
+	// Attempts after which a failing job is dead, 0 retries forever
+	MaxAttempts int
+	// Collection dead jobs are moved to, nil keeps them in the queue
+	DeadLetters *DeadLetters
+}
+
+// Delay before the next attempt of a job which failed attempts times
+// @param attempts int
+// @return time.Duration delay
+func (h *Handler) retryDelay(attempts int) time.Duration {
+	if attempts >= 32 {
+		return h.MaxDelay
+	}
+	return min(h.RetryDelay<<(attempts-1), h.MaxDelay)
+}
+
+// Criteria of listed and counted jobs, empty fields match all jobs
+type Filter struct {
+	Kind   string
+	Status string
+	// Only jobs which failed at least once
+	Failed bool
+	// Payload fields the jobs must have
+	Payload bson.M
+}
+
+// Build query of the jobs matching the filter
+// @return bson.M query
+func (f Filter) bson() bson.M {
+	query := bson.M{}
+	if f.Kind != "" {
+		query["kind"] = f.Kind
+	}
+	if f.Status != "" {
+		query["status"] = f.Status
+	}
+	if f.Failed {
+		query["lastError"] = bson.M{"$exists": true}
+	}
+	for key, value := range f.Payload {
+		query["payload."+key] = value
+	}
+	return query
+}
+
+// Collection of dead jobs moved out of a queue, to be listed and replayed
+type DeadLetters struct {
+	collection *mongo.Collection
+}
+
+// Create dead-letter collection
+// @param collection *mongo.Collection
+// @return *DeadLetters dead letters
+func NewDeadLetters(collection *mongo.Collection) *DeadLetters {
+	return &DeadLetters{collection: collection}
+}
+
+// Queue of jobs in a collection, with the workers of this instance
+type Queue struct {
+	collection *mongo.Collection
+	logger     *slog.Logger
+	handlers   map[string]*Handler
+	// Wake an idle worker of a kind when a job is enqueued
+	wake    map[string]chan struct{}
+	workers sync.WaitGroup
+	// How often idle workers look for jobs enqueued by other instances
+	PollInterval time.Duration
+}
+
+// Create queue of jobs in collection
+// @param collection *mongo.Collection
+// @param logger *slog.Logger logger of failed jobs
+// @return *Queue queue
+func New(collection *mongo.Collection, logger *slog.Logger) *Queue {
+	return &Queue{
+		collection:   collection,
+		logger:       logger,
+		handlers:     map[string]*Handler{},
+		wake:         map[string]chan struct{}{},
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// Get collection of the queue
+// @return *mongo.Collection collection
+func (q *Queue) Collection() *mongo.Collection {
+	return q.collection
+}
+
+// Register handler of a kind of jobs, run by the workers started by Start.
+// Must be called before Start. Jobs of kinds without handler stay queued.
+// @param kind string
+// @param handler Handler
+func (q *Queue) Register(kind string, handler Handler) {
+	handler.Workers = max(handler.Workers, 1)
+	if handler.Lease == 0 {
+		handler.Lease = defaultLease
+	}
+	if handler.RetryDelay == 0 {
+		handler.RetryDelay = defaultRetryDelay
+	}
+	if handler.MaxDelay == 0 {
+		handler.MaxDelay = defaultMaxDelay
+	}
+	q.handlers[kind] = &handler
+	q.wake[kind] = make(chan struct{}, 1)
+}
+
+// Enqueue job, due now
+// @param ctx context.Context
+// @param kind string
+// @param payload bson.M
+// @return *Job job
+// @return error error
+func (q *Queue) Enqueue(ctx context.Context, kind string, payload bson.M) (*Job, error) {
+	job := newJob(kind, "", payload)
+	if _, err := q.collection.InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+	q.notify(kind)
+	return job, nil
+}
+
+// Enqueue job unless a job of the same kind and key is queued or running,
+// e.g. for periodic work triggered by every instance. Instances enqueueing
+// at the same moment may both succeed.
+// @param ctx context.Context
+// @param kind string
+// @param key string
+// @param payload bson.M
+// @return *Job job, nil if one is queued already
+// @return error error
+func (q *Queue) EnqueueUnique(ctx context.Context, kind, key string, payload bson.M) (*Job, error) {
+	job := newJob(kind, key, payload)
+	filter := bson.M{"kind": kind, "key": key, "status": bson.M{"$in": bson.A{StatusQueued, StatusRunning}}}
+	result, err := q.collection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": job}, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	if result.UpsertedCount == 0 {
+		return nil, nil
+	}
+	q.notify(kind)
+	return job, nil
+}
+
+// Create job due now
+// @param kind string
+// @param key string
+// @param payload bson.M
+// @return *Job job
+func newJob(kind, key string, payload bson.M) *Job {
+	if payload == nil {
+		payload = bson.M{}
+	}
+	now := time.Now().UTC()
+	return &Job{
+		Id:         primitive.NewObjectID(),
+		Kind:       kind,
+		Key:        key,
+		Payload:    payload,
+		Status:     StatusQueued,
+		RunAt:      now,
+		EnqueuedAt: now,
+	}
+}
+
+// Wake an idle worker of a kind
+// @param kind string
+func (q *Queue) notify(kind string) {
+	select {
+	case q.wake[kind] <- struct{}{}:
+	default:
+	}
+}
+
+// Start the workers of the registered kinds, running jobs until ctx is
+// done. Jobs interrupted by ctx are retried once their lease ends.
+// @param ctx context.Context
+func (q *Queue) Start(ctx context.Context) {
+	for kind, handler := range q.handlers {
+		for i := 0; i < handler.Workers; i++ {
+			q.workers.Add(1)
+			go func(kind string, handler *Handler) {
+				defer q.workers.Done()
+				q.work(ctx, kind, handler)
+			}(kind, handler)
+		}
+	}
+}
+
+// Wait for the workers to stop after the context passed to Start is done
+func (q *Queue) Wait() {
+	q.workers.Wait()
+}
+
+// Run jobs of a kind until ctx is done, waiting for new ones when none is
+// due
+// @param ctx context.Context
+// @param kind string
+// @param handler *Handler
+func (q *Queue) work(ctx context.Context, kind string, handler *Handler) {
+	for ctx.Err() == nil {
+		job, err := q.claim(ctx, kind, handler)
+		if err != nil && ctx.Err() == nil {
+			q.logger.Error("claim job", "kind", kind, "error", err)
+		}
+		if job != nil {
+			q.run(ctx, handler, job)
+			continue
+		}
+		select {
+		case <-q.wake[kind]:
+		case <-time.After(q.PollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Claim the next due job of a kind, or one whose lease ended, leasing it to
+// the calling worker
+// @param ctx context.Context
+// @param kind string
+// @param handler *Handler
+// @return *Job job, nil if none is due
+// @return error error
+func (q *Queue) claim(ctx context.Context, kind string, handler *Handler) (*Job, error) {
+	now := time.Now().UTC()
+	findOptions := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "runAt", Value: 1}}).
+		SetReturnDocument(options.After)
+	var job Job
+	err := q.collection.FindOneAndUpdate(ctx,
+		bson.M{"kind": kind, "status": bson.M{"$in": bson.A{StatusQueued, StatusRunning}}, "runAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"status": StatusRunning, "runAt": now.Add(handler.Lease)}, "$inc": bson.M{"attempts": 1}},
+		findOptions,
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Run a claimed job, removing it from the queue on success. Failed jobs are
+// scheduled for a retry with a growing delay, or marked dead after their last
+// attempt.
+// @param ctx context.Context
+// @param handler *Handler
+// @param job *Job
+func (q *Queue) run(ctx context.Context, handler *Handler, job *Job) {
+	err := handler.Run(ctx, job)
+	if err == nil {
+		result, err := q.collection.DeleteOne(ctx, leased(job))
+		if err != nil {
+			q.logger.Error("remove job", "kind", job.Kind, "job_id", job.Id, "error", err)
+		} else if result.DeletedCount == 0 {
+			q.logger.Warn("job finished after its lease ended", "kind", job.Kind, "job_id", job.Id, "attempts", job.Attempts)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	set := bson.M{"status": StatusQueued, "lastError": err.Error()}
+	dead := handler.MaxAttempts > 0 && job.Attempts >= handler.MaxAttempts
+	if dead {
+		q.logger.Error("job failed", "kind", job.Kind, "job_id", job.Id, "payload", job.Payload, "attempts", job.Attempts, "error", err)
+		set["status"] = StatusDead
+		set["diedAt"] = now
+	} else {
+		delay := handler.retryDelay(job.Attempts)
+		q.logger.Warn("job failed, retrying", "kind", job.Kind, "job_id", job.Id, "payload", job.Payload, "attempts", job.Attempts, "retry_in", delay, "error", err)
+		set["runAt"] = now.Add(delay)
+	}
+	result, err := q.collection.UpdateOne(ctx, leased(job), bson.M{"$set": set})
+	if err != nil {
+		q.logger.Error("reschedule job", "kind", job.Kind, "job_id", job.Id, "error", err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		q.logger.Warn("job failed after its lease ended", "kind", job.Kind, "job_id", job.Id, "attempts", job.Attempts)
+		return
+	}
+	if dead && handler.DeadLetters != nil {
+		job.Status, job.LastError, job.DiedAt = StatusDead, err.Error(), &now
+		q.bury(ctx, handler.DeadLetters, job)
+	}
+}
+
+// Get filter matching a claimed job only while the claim holds, so a worker
+// whose lease ended doesn't remove or reschedule the job another worker
+// claimed since
+// @param job *Job claimed job
+// @return bson.M filter
+func leased(job *Job) bson.M {
+	return bson.M{"_id": job.Id, "status": StatusRunning, "attempts": job.Attempts}
+}
+
+// Move job marked dead in the queue into a dead-letter collection. The job
+// is inserted before it is removed from the queue, so it is never lost, and
+// stays dead in the queue if the insert fails.
+// @param ctx context.Context
+// @param deadLetters *DeadLetters
+// @param job *Job dead job
+func (q *Queue) bury(ctx context.Context, deadLetters *DeadLetters, job *Job) {
+	// A job buried before may have stayed in the queue
+	if _, err := deadLetters.collection.InsertOne(ctx, job); err != nil && !mongo.IsDuplicateKeyError(err) {
+		q.logger.Error("move job to dead letters", "kind", job.Kind, "job_id", job.Id, "error", err)
+		return
+	}
+	if _, err := q.collection.DeleteOne(ctx, bson.M{"_id": job.Id, "status": StatusDead}); err != nil {
+		q.logger.Error("remove job", "kind", job.Kind, "job_id", job.Id, "error", err)
+	}
+}
+
+// Move job from a dead-letter collection back into the queue, due now with
+// a fresh count of attempts
+// @param ctx context.Context
+// @param deadLetters *DeadLetters
+// @param id primitive.ObjectID
+// @return *Job job
+// @return error error, ErrNotFound if it is not in the dead-letter collection
+func (q *Queue) Replay(ctx context.Context, deadLetters *DeadLetters, id primitive.ObjectID) (*Job, error) {
+	job, err := deadLetters.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	job.Status = StatusQueued
+	job.RunAt = time.Now().UTC()
+	job.Attempts = 0
+	job.DiedAt = nil
+	// The job is inserted before it is removed from the dead letters, a
+	// replay interrupted in between is completed by the next one
+	if _, err := q.collection.InsertOne(ctx, job); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+	if _, err := deadLetters.collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return nil, err
+	}
+	q.notify(job.Kind)
+	return job, nil
+}
+
+// List jobs matching filter, oldest first
+// @param ctx context.Context
+// @param filter Filter
+// @param skip int64
+// @param limit int64
+// @return []Job jobs
+// @return error error
+func (q *Queue) Find(ctx context.Context, filter Filter, skip, limit int64) ([]Job, error) {
+	return findJobs(ctx, q.collection, filter, "enqueuedAt", skip, limit)
+}
+
+// List jobs of a collection matching filter, sorted by a time field
+// @param ctx context.Context
+// @param collection *mongo.Collection
+// @param filter Filter
+// @param sortField string
+// @param skip int64
+// @param limit int64
+// @return []Job jobs
+// @return error error
+func findJobs(ctx context.Context, collection *mongo.Collection, filter Filter, sortField string, skip, limit int64) ([]Job, error) {
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: sortField, Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(skip).
+		SetLimit(limit)
+	cursor, err := collection.Find(ctx, filter.bson(), findOptions)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Get job by id from a collection
+// @param ctx context.Context
+// @param collection *mongo.Collection
+// @param id primitive.ObjectID
+// @return *Job job
+// @return error error, ErrNotFound if it is not in the collection
+func getJob(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID) (*Job, error) {
+	var job Job
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Count jobs matching filter
+// @param ctx context.Context
+// @param filter Filter
+// @return int64 count
+// @return error error
+func (q *Queue) Count(ctx context.Context, filter Filter) (int64, error) {
+	return q.collection.CountDocuments(ctx, filter.bson())
+}
+
+// Get job by id
+// @param ctx context.Context
+// @param id primitive.ObjectID
+// @return *Job job
+// @return error error, ErrNotFound if it finished or was deleted
+func (q *Queue) Get(ctx context.Context, id primitive.ObjectID) (*Job, error) {
+	return getJob(ctx, q.collection, id)
+}
+
+// Find queued or running job of a kind
+// @param ctx context.Context
+// @param kind string
+// @param payload bson.M payload fields the job must have
+// @return *Job job, nil if there is none
+// @return error error
+func (q *Queue) Pending(ctx context.Context, kind string, payload bson.M) (*Job, error) {
+	query := Filter{Kind: kind, Payload: payload}.bson()
+	query["status"] = bson.M{"$in": bson.A{StatusQueued, StatusRunning}}
+	var job Job
+	err := q.collection.FindOne(ctx, query).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Run dead or waiting job again now, with a fresh count of attempts
+// @param ctx context.Context
+// @param id primitive.ObjectID
+// @return *Job job
+// @return error error, ErrNotFound if it finished or was deleted, ErrRunning
+// if a worker holds it
+func (q *Queue) Retry(ctx context.Context, id primitive.ObjectID) (*Job, error) {
+	update := bson.M{
+		"$set":   bson.M{"status": StatusQueued, "runAt": time.Now().UTC(), "attempts": 0},
+		"$unset": bson.M{"diedAt": ""},
+	}
+	var job Job
+	err := q.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{StatusQueued, StatusDead}}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := q.Get(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrRunning
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.notify(job.Kind)
+	return &job, nil
+}
+
+// Delete job which is not running
+// @param ctx context.Context
+// @param id primitive.ObjectID
+// @return error error, ErrNotFound if it finished or was deleted, ErrRunning
+// if a worker holds it
+func (q *Queue) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := q.collection.DeleteOne(ctx, bson.M{"_id": id, "status": bson.M{"$ne": StatusRunning}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		if _, err := q.Get(ctx, id); err != nil {
+			return err
+		}
+		return ErrRunning
+	}
+	return nil
+}
+
+// List dead jobs matching filter, oldest first
+// @param ctx context.Context
+// @param filter Filter
+// @param skip int64
+// @param limit int64
+// @return []Job jobs
+// @return error error
+func (d *DeadLetters) Find(ctx context.Context, filter Filter, skip, limit int64) ([]Job, error) {
+	return findJobs(ctx, d.collection, filter, "diedAt", skip, limit)
+}
+
+// Count dead jobs matching filter
+// @param ctx context.Context
+// @param filter Filter
+// @return int64 count
+// @return error error
+func (d *DeadLetters) Count(ctx context.Context, filter Filter) (int64, error) {
+	return d.collection.CountDocuments(ctx, filter.bson())
+}
+
+// Get dead job by id
+// @param ctx context.Context
+// @param id primitive.ObjectID
+// @return *Job job
+// @return error error, ErrNotFound if it was replayed or deleted
+func (d *DeadLetters) Get(ctx context.Context, id primitive.ObjectID) (*Job, error) {
+	return getJob(ctx, d.collection, id)
+}
+
+// Delete dead job
+// @param ctx context.Context
+// @param id primitive.ObjectID
+// @return error error, ErrNotFound if it was replayed or deleted
+func (d *DeadLetters) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := d.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package validation checks request fields, collecting all violations so a
+// request is rejected with every problem at once instead of the first one:
+//
+//	v := &validation.Validator{}
+//	limit := v.Int(validation.Query, "limit", c.Query("limit"), 50, 1, 1000)
+//	after := v.Time(validation.Query, "uploadedAfter", c.Query("uploadedAfter"))
+//	if err := v.Err(); err != nil {
+//		return err
+//	}
+//
+// The violations are returned as Errors, which the file service reports in
+// the errors array of the error response.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where request fields are sent
+const (
+	Path   = "path"
+	Query  = "query"
+	Header = "header"
+	Form   = "form"
+	Body   = "body"
+)
+
+// Violation of a rule by a request field
+type Violation struct {
+	// Where the field was sent, e.g. query
+	In string `json:"in,omitempty"`
+	// Field name, nested fields are named by path, e.g. metadata.tags
+	Field string `json:"field"`
+	// Error code of the violation, empty for malformed values
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// Violations of a request
+type Errors []Violation
+
+// Get messages of all violations
+// @return string message
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, violation := range e {
+		messages = append(messages, violation.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Collector of the violations of a request. The zero value is ready to use.
+type Validator struct {
+	violations Errors
+}
+
+// Record violation
+// @param in string where the field was sent
+// @param field string field name
+// @param code string error code, may be empty
+// @param message string
+func (v *Validator) Add(in, field, code, message string) {
+	v.violations = append(v.violations, Violation{In: in, Field: field, Code: code, Message: message})
+}
+
+// Record violation unless ok
+// @param ok bool rule holds
+// @param in string where the field was sent
+// @param field string field name
+// @param message string
+// @return bool ok
+func (v *Validator) Check(ok bool, in, field, message string) bool {
+	if !ok {
+		v.Add(in, field, "", message)
+	}
+	return ok
+}
+
+// Record error of checking a field. Errors are taken over with their
+// violations, sent in in unless they name another place, other errors
+// become a violation of field.
+// @param in string where the field was sent
+// @param field string field name
+// @param err error error, nil if the field is valid
+// @return bool valid
+func (v *Validator) Merge(in, field string, err error) bool {
+	if err == nil {
+		return true
+	}
+	var violations Errors
+	if !errors.As(err, &violations) {
+		v.Add(in, field, "", err.Error())
+		return false
+	}
+	for _, violation := range violations {
+		if violation.In == "" {
+			violation.In = in
+		}
+		v.violations = append(v.violations, violation)
+	}
+	return false
+}
+
+// Parse integer field between min and max
+// @param in string where the field was sent
+// @param field string field name
+// @param value string raw value
+// @param fallback int value if empty
+// @param min int
+// @param max int
+// @return int value, fallback if invalid
+func (v *Validator) Int(in, field, value string, fallback, min, max int) int {
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || number > max {
+		v.Add(in, field, "", fmt.Sprintf("%s must be an integer between %d and %d", field, min, max))
+		return fallback
+	}
+	return number
+}
+
+// Parse non-negative 64-bit integer field, e.g. a size in bytes
+// @param in string where the field was sent
+// @param field string field name
+// @param value string raw value
+// @return *int64 value, nil if empty or invalid
+func (v *Validator) Size(in, field, value string) *int64 {
+	if value == "" {
+		return nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		v.Add(in, field, "", field+" must be a non-negative integer")
+		return nil
+	}
+	return &number
+}
+
+// Parse RFC 3339 timestamp field
+// @param in string where the field was sent
+// @param field string field name
+// @param value string raw value
+// @return time.Time value, zero if empty or invalid
+func (v *Validator) Time(in, field, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		v.Add(in, field, "", field+" must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+	return parsed
+}
+
+// Check that field is one of the allowed values
+// @param in string where the field was sent
+// @param field string field name
+// @param value string
+// @param allowed ...string allowed values
+// @return bool valid
+func (v *Validator) OneOf(in, field, value string, allowed ...string) bool {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return true
+		}
+	}
+	v.Add(in, field, "", field+" must be one of "+strings.Join(allowed, ", "))
+	return false
+}
+
+// Get violations recorded so far
+// @return error Errors, nil if there are none
+func (v *Validator) Err() error {
+	if len(v.violations) == 0 {
+		return nil
+	}
+	return v.violations
+}